@@ -0,0 +1,686 @@
+package gits
+
+import (
+	"errors"
+	"fmt"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// borrowed returns the alternate store holding the object, nil when none has it.
+func (f *filesObjects) borrowed(hash string) (*filesObjects, error) {
+	alternates, err := f.readAlternates()
+
+	if err != nil {
+		return nil, err
+	}
+
+	for _, alt := range alternates {
+		if ok, err := alt.Has(hash); err != nil || ok {
+			return ternary(ok, alt, nil), err
+		}
+	}
+
+	return nil, nil
+}
+
+// readAlternates returns the stores of info/alternates. The file is read on each call, the stores
+// and their packs are kept while it does not change.
+func (f *filesObjects) readAlternates() ([]*filesObjects, error) {
+	if f.depth >= maxAlternateDepth {
+		return nil, nil
+	}
+
+	file := f.dir + "/info/alternates"
+	data := ""
+
+	if f.repo.fs.Stat(file)[0] == 1 {
+		raw, err := f.repo.fs.ReadFile(file)
+
+		if err != nil {
+			return nil, err
+		}
+
+		data = string(raw)
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.alternates != nil && data == f.altData {
+		return f.alternates, nil
+	}
+
+	loaded := map[string]*filesObjects{}
+
+	for _, alt := range f.alternates {
+		loaded[alt.dir] = alt
+	}
+
+	alternates := []*filesObjects{}
+
+	for _, dir := range f.repo.alternateDirs(f.dir, data) {
+		if dir == f.dir {
+			continue
+		}
+
+		alt := loaded[dir]
+
+		if alt == nil {
+			alt = &filesObjects{repo: f.repo, dir: dir, depth: f.depth + 1}
+		}
+
+		alternates = append(alternates, alt)
+	}
+
+	f.alternates, f.altData = alternates, data
+
+	return alternates, nil
+}
+
+// alternateDirs returns the object directories listed in an alternates file of the objects directory.
+// Relative paths are relative to it, absolute ones under conf.Dir are made relative to the FS.
+func (repo *Repo) alternateDirs(objects, data string) []string {
+	root := strings.TrimSuffix(filepath.ToSlash(repo.conf.Dir), "/")
+
+	if abs, err := filepath.Abs(repo.conf.Dir); err == nil {
+		root = strings.TrimSuffix(filepath.ToSlash(abs), "/")
+	}
+
+	dirs := []string{}
+
+	for _, line := range strings.Split(data, "\n") {
+		line = strings.TrimSpace(line)
+
+		if line == "" || line[0] == '#' {
+			continue
+		}
+
+		if !path.IsAbs(line) {
+			line = path.Join(objects, line)
+		} else if root != "" && strings.HasPrefix(line, root+"/") {
+			line = strings.TrimPrefix(line, root)
+		}
+
+		dirs = append(dirs, path.Clean(line))
+	}
+
+	return dirs
+}
+
+// alternates returns the object directories repo borrows objects from.
+func (repo *Repo) alternates() ([]string, error) {
+	file := repo.absPath("objects/info/alternates")
+
+	if repo.fs.Stat(file)[0] != 1 {
+		return []string{}, nil
+	}
+
+	data, err := repo.fs.ReadFile(file)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return repo.alternateDirs(repo.absPath("objects"), string(data)), nil
+}
+
+// addAlternate adds an object directory to objects/info/alternates, as a path relative to objects/.
+func (repo *Repo) addAlternate(dir string) error {
+	unlock := repo.lock("alternates")
+	defer unlock()
+
+	dirs, err := repo.alternates()
+
+	if err != nil {
+		return err
+	}
+
+	for _, d := range dirs {
+		if d == dir {
+			return nil
+		}
+	}
+
+	file := repo.absPath("objects/info/alternates")
+	data := []byte{}
+
+	if repo.fs.Stat(file)[0] == 1 {
+		if data, err = repo.fs.ReadFile(file); err != nil {
+			return err
+		}
+	}
+
+	if len(data) > 0 && data[len(data)-1] != '\n' {
+		data = append(data, '\n')
+	}
+
+	data = append(data, relPath(repo.absPath("objects"), dir)+"\n"...)
+
+	return repo.fs.WriteFile(file, data)
+}
+
+// sibling opens another repo of the same directory, FS and stores.
+func (repo *Repo) sibling(name string) (*Repo, error) {
+	return OpenRepo(&Config{
+		Dir:         repo.conf.Dir,
+		Name:        name,
+		FS:          repo.conf.FS,
+		RefStore:    repo.conf.RefStore,
+		ObjectStore: repo.conf.ObjectStore,
+		HideRefs:    repo.conf.HideRefs,
+	})
+}
+
+// Fork creates the repo newName next to repo with its branches, tags and HEAD. No object is copied,
+// the fork borrows the objects of repo and of its alternates, which list it as gits.borrower in their
+// config. The fork of a pool member joins the pool.
+func (repo *Repo) Fork(newName string) (*Repo, error) {
+	src := repo.physical()
+	conf := *repo.conf
+	conf.Name, conf.Namespace = newName, ""
+
+	if conf.RefStore == nil {
+		_, reftable := src.refs.(*reftableRefs)
+		conf.RefStorage = ternary[uint8](reftable, REF_STORAGE_REFTABLE, REF_STORAGE_FILES)
+	}
+
+	head, err := repo.refs.Get("HEAD")
+
+	if err != nil {
+		return nil, err
+	}
+
+	conf.InitialBranch = ""
+
+	if head != nil && head.Target != "" {
+		conf.InitialBranch = head.Target
+	}
+
+	// Read before the fork exists, a fork of a fork borrows from the whole chain.
+	dirs, err := src.alternates()
+
+	if err != nil {
+		return nil, err
+	}
+
+	pool, err := repo.pool()
+
+	if err != nil {
+		return nil, err
+	}
+
+	refs, err := repo.listRefs()
+
+	if err != nil {
+		return nil, err
+	}
+
+	fork, err := InitRepo(&conf)
+
+	if err != nil {
+		return nil, err
+	}
+
+	for _, dir := range append(dirs, src.absPath("objects")) {
+		if err := fork.addAlternate(dir); err != nil {
+			return nil, err
+		}
+
+		// Recorded in the repo lending its objects, its GC keeps what the fork still reaches.
+		if path.Base(dir) != "objects" || path.Dir(dir) == "/" {
+			continue
+		}
+
+		lender, err := repo.sibling(strings.TrimPrefix(path.Dir(dir), "/"))
+
+		if err != nil {
+			return nil, err
+		}
+
+		if err := lender.addConfigValue("gits.borrower", newName); err != nil {
+			return nil, err
+		}
+	}
+
+	tx, err := fork.refs.Transaction()
+
+	if err != nil {
+		return nil, err
+	}
+
+	copied := 0
+
+	for name, hash := range refs {
+		if !strings.HasPrefix(name, "refs/heads/") && !strings.HasPrefix(name, "refs/tags/") {
+			continue
+		}
+
+		if err := tx.Update(name, ZERO_HASH, hash); err != nil {
+			tx.Abort()
+			return nil, err
+		}
+
+		copied++
+	}
+
+	if copied == 0 {
+		return fork, tx.Abort()
+	}
+
+	if err := tx.Commit(repo.identity(), "fork: from "+repo.conf.Name); err != nil {
+		return nil, err
+	}
+
+	if pool != nil {
+		if err := fork.JoinPool(pool); err != nil {
+			return nil, err
+		}
+	}
+
+	return fork, nil
+}
+
+// JoinPool makes repo a member of pool, a repo holding the objects of a fork network. The member
+// borrows the objects of the pool, DedupePool moves the objects of every member there.
+func (repo *Repo) JoinPool(pool *Repo) error {
+	if pool.conf.Dir != repo.conf.Dir || pool.conf.Name == repo.conf.Name {
+		return errors.New("a pool must be another repo of the same directory")
+	}
+
+	if err := repo.addAlternate(pool.absPath("objects")); err != nil {
+		return err
+	}
+
+	return pool.addConfigValue("pool.member", repo.conf.Name)
+}
+
+// addConfigValue adds a value to a multi-valued key of the config, unless it is there. Repos
+// without a config file are left alone.
+func (repo *Repo) addConfigValue(key, value string) error {
+	unlock := repo.lock("config")
+	defer unlock()
+
+	if repo.fs.Stat(repo.absPath("config"))[0] != 1 {
+		return nil
+	}
+
+	config, err := repo.Config()
+
+	if err != nil {
+		return err
+	}
+
+	for _, v := range config.GetAll(key) {
+		if v == value {
+			return nil
+		}
+	}
+
+	config.Add(key, value)
+
+	return repo.WriteConfig(config)
+}
+
+// pool returns the pool repo is a member of, nil when it is in none.
+func (repo *Repo) pool() (*Repo, error) {
+	dirs, err := repo.physical().alternates()
+
+	if err != nil {
+		return nil, err
+	}
+
+	for _, dir := range dirs {
+		if path.Base(dir) != "objects" || path.Dir(dir) == "/" {
+			continue
+		}
+
+		pool, err := repo.sibling(strings.TrimPrefix(path.Dir(dir), "/"))
+
+		if err != nil {
+			return nil, err
+		}
+
+		config, err := pool.Config()
+
+		if err != nil {
+			return nil, err
+		}
+
+		for _, member := range config.GetAll("pool.member") {
+			if member == repo.conf.Name {
+				return pool, nil
+			}
+		}
+	}
+
+	return nil, nil
+}
+
+// DedupePool moves the objects of the members of pool into it, run it periodically. Members keep
+// reading them through their alternates, an object pushed to several members is kept once. The refs
+// of each member are mirrored under refs/pool/<member>/ so that the pool reaches every object it
+// holds. The mirrors of deleted members are removed, GC of the pool then drops what only they reached.
+func (pool *Repo) DedupePool() error {
+	if _, ok := pool.objects.(*filesObjects); !ok {
+		return errors.New("a pool needs the built-in object store")
+	}
+
+	unlock := pool.lock("pool")
+	defer unlock()
+
+	config, err := pool.Config()
+
+	if err != nil {
+		return err
+	}
+
+	live := []string{}
+
+	for _, name := range config.GetAll("pool.member") {
+		member, err := pool.sibling(name)
+
+		if err != nil {
+			return err
+		}
+
+		if member.fs.Stat(member.absPath(""))[0] != 2 {
+			continue
+		}
+
+		live = append(live, name)
+
+		// Objects first, the mirrored refs must not point to objects the pool lacks.
+		if err := pool.moveObjects(member); err != nil {
+			return fmt.Errorf("%s: %w", name, err)
+		}
+
+		if err := pool.mirrorRefs(member); err != nil {
+			return fmt.Errorf("%s: %w", name, err)
+		}
+	}
+
+	return pool.pruneMirrors(live)
+}
+
+// moveObjects copies the packs and loose objects of member the pool lacks, then removes them from
+// member. A pack the pool has none of is copied whole under its name, the missing objects of one it
+// has some of go to a new pack.
+func (pool *Repo) moveObjects(member *Repo) error {
+	from, ok := member.objects.(*filesObjects)
+
+	if !ok {
+		return nil
+	}
+
+	if _, ok := member.fs.(RenameFS); !ok {
+		return fmt.Errorf("move objects: %w", ErrNoRename)
+	}
+
+	// Neither GC of them nor pushes to member meanwhile.
+	unlock := lockAllObjects([]*Repo{pool, member})
+	defer unlock()
+
+	to := pool.objects.(*filesObjects)
+	dirs, err := member.alternates()
+
+	if err != nil {
+		return err
+	}
+
+	// The member could not read back what is removed.
+	borrows := false
+
+	for _, dir := range dirs {
+		borrows = borrows || dir == to.dir
+	}
+
+	if !borrows {
+		return errors.New("not borrowing the objects of the pool")
+	}
+
+	packs, err := from.scanPacks()
+
+	if err != nil {
+		return err
+	}
+
+	for _, pack := range packs {
+		missing := []*gcObject{}
+
+		for i := 0; i < pack.count(); i++ {
+			hash := pack.hash(i)
+
+			if ok, err := to.Has(hash); err != nil || ok {
+				if err != nil {
+					return err
+				}
+
+				continue
+			}
+
+			typ, size, err := pack.stat(from, pack.offsets[i])
+
+			if err != nil {
+				return err
+			}
+
+			missing = append(missing, &gcObject{hash: hash, typ: typ, size: size})
+		}
+
+		if len(missing) == 0 {
+			continue
+		}
+
+		if len(missing) < pack.count() {
+			if _, err := pool.writeGCPack(from, missing, 10, 50); err != nil {
+				return err
+			}
+
+			continue
+		}
+
+		// The index last, a pack is only listed once both files exist.
+		target := to.dir + "/pack/" + path.Base(pack.path)
+
+		for _, ext := range []string{".pack", ".idx"} {
+			if err := copyFile(pool.fs, pack.path+ext, target+ext); err != nil {
+				return err
+			}
+		}
+	}
+
+	loose, err := from.looseObjects()
+
+	if err != nil {
+		return err
+	}
+
+	for _, hash := range loose {
+		if ok, err := to.Has(hash); err != nil || ok {
+			if err != nil {
+				return err
+			}
+
+			continue
+		}
+
+		if err := copyFile(pool.fs, from.loosePath(hash), to.loosePath(hash)); err != nil {
+			return err
+		}
+	}
+
+	for _, hash := range loose {
+		if err := removeFile(member.fs, from.loosePath(hash)); err != nil {
+			return err
+		}
+	}
+
+	for _, pack := range packs {
+		if err := from.removePack(pack); err != nil {
+			return err
+		}
+	}
+
+	// objects/info/packs lists the removed packs.
+	if len(packs) > 0 {
+		return member.UpdateServerInfo()
+	}
+
+	return nil
+}
+
+// mirrorRefs points refs/pool/<member>/ of the pool to the refs of member, every namespace included.
+func (pool *Repo) mirrorRefs(member *Repo) error {
+	prefix := "refs/pool/" + member.conf.Name + "/"
+	refs, err := member.physical().listRefs()
+
+	if err != nil {
+		return err
+	}
+
+	store := pool.physical().refs
+	mirrored := map[string]string{}
+
+	err = store.Iterate(prefix, func(ref *Ref) error {
+		mirrored[ref.Name] = ref.Hash
+		return nil
+	})
+
+	if err != nil {
+		return err
+	}
+
+	tx, err := store.Transaction()
+
+	if err != nil {
+		return err
+	}
+
+	changed := false
+
+	for name, hash := range refs {
+		target := prefix + strings.TrimPrefix(name, "refs/")
+
+		if mirrored[target] != hash {
+			if err := tx.Update(target, "", hash); err != nil {
+				tx.Abort()
+				return err
+			}
+
+			changed = true
+		}
+
+		delete(mirrored, target)
+	}
+
+	for name := range mirrored {
+		if err := tx.Update(name, "", ZERO_HASH); err != nil {
+			tx.Abort()
+			return err
+		}
+
+		changed = true
+	}
+
+	if !changed {
+		return tx.Abort()
+	}
+
+	return tx.Commit(pool.identity(), "pool: mirror "+member.conf.Name)
+}
+
+// pruneMirrors deletes the refs under refs/pool/ that mirror none of the live members.
+func (pool *Repo) pruneMirrors(live []string) error {
+	store := pool.physical().refs
+	stale := []string{}
+
+	err := store.Iterate("refs/pool/", func(ref *Ref) error {
+		for _, name := range live {
+			if strings.HasPrefix(ref.Name, "refs/pool/"+name+"/") {
+				return nil
+			}
+		}
+
+		stale = append(stale, ref.Name)
+
+		return nil
+	})
+
+	if err != nil || len(stale) == 0 {
+		return err
+	}
+
+	tx, err := store.Transaction()
+
+	if err != nil {
+		return err
+	}
+
+	for _, name := range stale {
+		if err := tx.Update(name, "", ZERO_HASH); err != nil {
+			tx.Abort()
+			return err
+		}
+	}
+
+	return tx.Commit(pool.identity(), "pool: prune deleted members")
+}
+
+// looseObjects lists the hashes of the loose objects of the store.
+func (f *filesObjects) looseObjects() ([]string, error) {
+	hashes := []string{}
+
+	if f.repo.fs.Stat(f.dir)[0] != 2 {
+		return hashes, nil
+	}
+
+	files, err := f.repo.fs.Scan(f.dir, FS_TYPE_FILE, 1)
+
+	if err != nil {
+		return nil, err
+	}
+
+	for file := range files {
+		if hash := path.Base(path.Dir(file)) + path.Base(file); isHash(hash) {
+			hashes = append(hashes, hash)
+		}
+	}
+
+	return hashes, nil
+}
+
+// copyFile streams the file on a CopyFS, other FS copy it through memory.
+func copyFile(fs FS, from, to string) error {
+	if copier, ok := fs.(CopyFS); ok {
+		return copier.Copy(from, to)
+	}
+
+	data, err := fs.ReadFile(from)
+
+	if err != nil {
+		return err
+	}
+
+	return fs.WriteFile(to, data)
+}
+
+// relPath returns the slash path to reach to from the directory from.
+func relPath(from, to string) string {
+	a := strings.Split(strings.Trim(from, "/"), "/")
+	b := strings.Split(strings.Trim(to, "/"), "/")
+	i := 0
+
+	for i < len(a) && i < len(b) && a[i] == b[i] {
+		i++
+	}
+
+	parts := []string{}
+
+	for range a[i:] {
+		parts = append(parts, "..")
+	}
+
+	return path.Join(append(parts, b[i:]...)...)
+}
@@ -0,0 +1,226 @@
+package gits
+
+import (
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestFork(t *testing.T) {
+	repo := newTestRepo(t, nil)
+
+	commit, err := repo.CommitFiles(&CommitFilesSpec{
+		Branch:  "main",
+		Author:  testSignature(),
+		Message: "first",
+		Ops:     []FileOp{{Action: FILE_ADD, Path: "a", Content: []byte("a\n")}},
+	})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	fork, err := repo.Fork("fork.git")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if hash, _ := fork.resolveRef("refs/heads/main"); hash != commit {
+		t.Fatalf("refs/heads/main = %s, want %s", hash, commit)
+	}
+
+	if content := readFile(t, fork, "main:a"); content != "a\n" {
+		t.Fatalf("a = %q", content)
+	}
+
+	loose, err := fork.objects.(*filesObjects).looseObjects()
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(loose) != 0 {
+		t.Fatalf("the fork has %d objects of its own", len(loose))
+	}
+
+	config, err := repo.Config()
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if borrowers := config.GetAll("gits.borrower"); len(borrowers) != 1 || borrowers[0] != "fork.git" {
+		t.Fatalf("gits.borrower = %v", borrowers)
+	}
+
+	// A fork of the fork borrows from both.
+	second, err := fork.Fork("second.git")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dirs, err := second.alternates()
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(dirs) != 2 {
+		t.Fatalf("alternates = %v", dirs)
+	}
+
+	runGit(t, repoPath(fork), "fsck", "--strict")
+
+	if out := runGit(t, repoPath(second), "cat-file", "-p", "main:a"); out != "a\n" {
+		t.Fatalf("git cat-file = %q", out)
+	}
+}
+
+func TestDedupePool(t *testing.T) {
+	a := newTestRepo(t, &Config{Name: "a.git"})
+	pool := newTestRepo(t, &Config{Dir: a.conf.Dir, Name: "pool.git"})
+
+	if err := a.JoinPool(pool); err != nil {
+		t.Fatal(err)
+	}
+
+	_, err := a.CommitFiles(&CommitFilesSpec{
+		Branch:  "main",
+		Author:  testSignature(),
+		Message: "first",
+		Ops:     []FileOp{{Action: FILE_ADD, Path: "a", Content: []byte("a\n")}},
+	})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	b, err := a.Fork("b.git")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The same blob pushed to both, loose and packed.
+	blobs := map[string]string{}
+
+	for _, repo := range []*Repo{a, b} {
+		name := repo.conf.Name
+		shared, err := repo.WriteBlob([]byte("shared\n"))
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		packed, err := repo.WriteBlob([]byte("packed\n"))
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		own, err := repo.WriteBlob([]byte(name + "\n"))
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		keepBlobs(t, repo, "packed", []string{packed, own})
+		runGit(t, repoPath(repo), "repack", "-q", "-a", "-d")
+		keepBlobs(t, repo, "loose", []string{shared})
+		blobs[name] = own
+	}
+
+	if err := pool.DedupePool(); err != nil {
+		t.Fatal(err)
+	}
+
+	store := pool.objects.(*filesObjects)
+	packs, err := store.scanPacks()
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	loose, err := store.looseObjects()
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	seen := map[string]bool{}
+
+	for _, hash := range loose {
+		seen[hash] = true
+	}
+
+	for _, pack := range packs {
+		for i := 0; i < pack.count(); i++ {
+			if hash := pack.hash(i); seen[hash] {
+				t.Errorf("%s is in the pool twice", hash)
+			} else {
+				seen[hash] = true
+			}
+		}
+	}
+
+	for _, repo := range []*Repo{a, b} {
+		name := repo.conf.Name
+		store := repo.objects.(*filesObjects)
+
+		if packs, _ := store.scanPacks(); len(packs) != 0 {
+			t.Errorf("%s kept %d packs", name, len(packs))
+		}
+
+		if loose, _ := store.looseObjects(); len(loose) != 0 {
+			t.Errorf("%s kept %d loose objects", name, len(loose))
+		}
+
+		if hash, _ := pool.resolveRef("refs/pool/" + name + "/keep/packed"); hash == "" {
+			t.Errorf("refs/keep/packed of %s is not mirrored", name)
+		}
+
+		if !seen[blobs[name]] {
+			t.Errorf("the blob of %s is not in the pool", name)
+		}
+
+		runGit(t, repoPath(repo), "fsck", "--strict")
+	}
+
+	runGit(t, repoPath(pool), "fsck", "--strict")
+
+	// The mirrors of a deleted member go, and GC of the pool drops what only they reached.
+	if err := os.RemoveAll(repoPath(b)); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := pool.DedupePool(); err != nil {
+		t.Fatal(err)
+	}
+
+	err = pool.refs.Iterate("refs/pool/", func(ref *Ref) error {
+		if !strings.HasPrefix(ref.Name, "refs/pool/a.git/") {
+			t.Errorf("%s was left behind", ref.Name)
+		}
+
+		return nil
+	})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := pool.GC(&GCOptions{PruneExpire: time.Now().Add(time.Hour)}); err != nil {
+		t.Fatal(err)
+	}
+
+	if ok, _ := pool.objects.Has(blobs["b.git"]); ok {
+		t.Fatal("the blob of the deleted member is still in the pool")
+	}
+
+	if ok, _ := pool.objects.Has(blobs["a.git"]); !ok {
+		t.Fatal("the blob of a.git is gone")
+	}
+}
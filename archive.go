@@ -0,0 +1,298 @@
+package gits
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"io/fs"
+	"strings"
+	"time"
+)
+
+// archiveWriter writes the entries of one archive format.
+type archiveWriter interface {
+	dir(path string) error
+	file(path string, mode uint32, data []byte) error
+	Close() error
+}
+
+type tarArchive struct {
+	tw    *tar.Writer
+	gz    *gzip.Writer
+	mtime time.Time
+}
+
+type zipArchive struct {
+	zw    *zip.Writer
+	mtime time.Time
+}
+
+// Archive writes the tree of treeish to w as a tar, tar.gz or zip stream, with every path under prefix.
+// When paths are given only those files and directories are included. Entries get the commit time
+// as mtime, or the Unix epoch for a bare tree, so the same input always gives the same bytes.
+func (repo *Repo) Archive(w io.Writer, treeish string, format uint8, prefix string, paths ...string) error {
+	tree, selected, err := repo.archiveTarget(treeish, paths)
+
+	if err != nil {
+		return err
+	}
+
+	commit, mtime := repo.archiveCommit(treeish)
+
+	var aw archiveWriter
+
+	switch format {
+	case ARCHIVE_TAR, ARCHIVE_TGZ:
+		ta := &tarArchive{mtime: mtime}
+
+		if format == ARCHIVE_TGZ {
+			ta.gz = gzip.NewWriter(w)
+			w = ta.gz
+		}
+
+		ta.tw = tar.NewWriter(w)
+
+		if commit != "" {
+			err = ta.tw.WriteHeader(&tar.Header{
+				Typeflag:   tar.TypeXGlobalHeader,
+				PAXRecords: map[string]string{"comment": commit},
+			})
+		}
+
+		aw = ta
+
+	case ARCHIVE_ZIP:
+		za := &zipArchive{zw: zip.NewWriter(w), mtime: mtime}
+
+		if commit != "" {
+			err = za.zw.SetComment(commit)
+		}
+
+		aw = za
+
+	default:
+		return fmt.Errorf("unknown archive format: %d", format)
+	}
+
+	if err != nil {
+		return err
+	}
+
+	if prefix != "" && strings.HasSuffix(prefix, "/") {
+		if err := aw.dir(prefix); err != nil {
+			return err
+		}
+	}
+
+	if err := repo.archiveTree(aw, tree, prefix, "", selected); err != nil {
+		return err
+	}
+
+	return aw.Close()
+}
+
+// archiveTarget resolves the tree of treeish and checks that every path exists in it.
+func (repo *Repo) archiveTarget(treeish string, paths []string) (string, []string, error) {
+	tree, err := repo.resolveTree(treeish)
+
+	if err != nil {
+		return "", nil, err
+	}
+
+	selected := make([]string, len(paths))
+
+	for i, path := range paths {
+		selected[i] = strings.Trim(path, "/")
+
+		hash, err := repo.treePathHash(tree, selected[i])
+
+		if err != nil {
+			return "", nil, err
+		}
+
+		if hash == "" || selected[i] == "" {
+			return "", nil, fmt.Errorf("pathspec '%s' did not match any files", path)
+		}
+	}
+
+	return tree, selected, nil
+}
+
+// archiveCommit returns the commit time of the commit a treeish comes from, also for "rev:path", and
+// the commit hash to record in the archive when the treeish is the commit itself.
+func (repo *Repo) archiveCommit(treeish string) (string, time.Time) {
+	rev, _, isPath := splitRevPath(treeish)
+	hash, err := repo.resolveCommit(rev)
+
+	if err != nil {
+		return "", time.Unix(0, 0).UTC()
+	}
+
+	object, err := repo.Object(hash)
+
+	if err != nil {
+		return "", time.Unix(0, 0).UTC()
+	}
+
+	commit, err := object.Commit()
+
+	if err != nil || commit.Committer == nil {
+		return "", time.Unix(0, 0).UTC()
+	}
+
+	return ternary(isPath, "", hash), commit.Committer.When
+}
+
+// archiveTree writes the entries of a tree in stored order, directories before their contents.
+func (repo *Repo) archiveTree(aw archiveWriter, tree, prefix, dir string, paths []string) error {
+	object, err := repo.Object(tree)
+
+	if err != nil {
+		return err
+	}
+
+	entries, err := object.Entries()
+
+	if err != nil {
+		return err
+	}
+
+	for _, entry := range entries {
+		path := dir + entry.Name
+		isDir := entry.Mode == MODE_TREE || entry.Mode == MODE_GITLINK
+
+		if !archiveSelected(path, isDir, paths) {
+			continue
+		}
+
+		switch entry.Mode {
+		case MODE_TREE:
+			if err := aw.dir(prefix + path + "/"); err != nil {
+				return err
+			}
+
+			if err := repo.archiveTree(aw, entry.Hash, prefix, path+"/", paths); err != nil {
+				return err
+			}
+
+		case MODE_GITLINK:
+			// Submodule contents are not in this repository, like git an empty directory stands in.
+			if err := aw.dir(prefix + path + "/"); err != nil {
+				return err
+			}
+
+		default:
+			data, err := repo.blobData(entry.Hash)
+
+			if err != nil {
+				return err
+			}
+
+			if err := aw.file(prefix+path, entry.Mode, data); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// archiveSelected reports whether path is one of paths, inside one of them, or a directory leading to one.
+func archiveSelected(path string, isDir bool, paths []string) bool {
+	if len(paths) == 0 {
+		return true
+	}
+
+	for _, p := range paths {
+		if path == p || strings.HasPrefix(path, p+"/") || (isDir && strings.HasPrefix(p, path+"/")) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (a *tarArchive) dir(path string) error {
+	return a.tw.WriteHeader(a.header(path, tar.TypeDir, 0775, 0))
+}
+
+func (a *tarArchive) file(path string, mode uint32, data []byte) error {
+	if mode == MODE_SYMLINK {
+		header := a.header(path, tar.TypeSymlink, 0777, 0)
+		header.Linkname = string(data)
+
+		return a.tw.WriteHeader(header)
+	}
+
+	if err := a.tw.WriteHeader(a.header(path, tar.TypeReg, ternary[int64](mode == MODE_EXEC, 0775, 0664), len(data))); err != nil {
+		return err
+	}
+
+	_, err := a.tw.Write(data)
+
+	return err
+}
+
+// header uses the permissions git archive writes with its default umask of 002.
+func (a *tarArchive) header(path string, typ byte, mode int64, size int) *tar.Header {
+	return &tar.Header{
+		Typeflag: typ,
+		Name:     path,
+		Mode:     mode,
+		Size:     int64(size),
+		ModTime:  a.mtime,
+		Uname:    "root",
+		Gname:    "root",
+	}
+}
+
+func (a *tarArchive) Close() error {
+	if err := a.tw.Close(); err != nil {
+		return err
+	}
+
+	if a.gz != nil {
+		return a.gz.Close()
+	}
+
+	return nil
+}
+
+// dir writes the entry as created on MS-DOS. Like git, only executables and symlinks get unix
+// modes, directories and other files are extracted with the default permissions.
+func (a *zipArchive) dir(path string) error {
+	header := &zip.FileHeader{Name: path, Method: zip.Store, Modified: a.mtime}
+	header.ExternalAttrs = 0x10 // MS-DOS directory.
+
+	_, err := a.zw.CreateHeader(header)
+
+	return err
+}
+
+func (a *zipArchive) file(path string, mode uint32, data []byte) error {
+	header := &zip.FileHeader{Name: path, Method: zip.Deflate, Modified: a.mtime}
+
+	switch mode {
+	case MODE_SYMLINK:
+		header.Method = zip.Store
+		header.SetMode(fs.ModeSymlink | 0777)
+	case MODE_EXEC:
+		header.SetMode(0755)
+	}
+
+	fw, err := a.zw.CreateHeader(header)
+
+	if err != nil {
+		return err
+	}
+
+	_, err = fw.Write(data)
+
+	return err
+}
+
+func (a *zipArchive) Close() error {
+	return a.zw.Close()
+}
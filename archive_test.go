@@ -0,0 +1,187 @@
+package gits
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"os/exec"
+	"testing"
+	"time"
+)
+
+func TestArchiveMatchesGit(t *testing.T) {
+	repo := newTestRepo(t, nil)
+	dir := repoPath(repo)
+
+	blob := func(content string) string {
+		hash, err := repo.WriteBlob([]byte(content))
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		return hash
+	}
+
+	sub, err := repo.WriteTree([]TreeEntry{
+		{Mode: MODE_FILE, Name: "nested.txt", Hash: blob("nested\n")},
+		{Mode: MODE_EXEC, Name: "run.sh", Hash: blob("#!/bin/sh\necho run\n")},
+	})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tree, err := repo.WriteTree([]TreeEntry{
+		{Mode: MODE_FILE, Name: "a.txt", Hash: blob("a\n")},
+		{Mode: MODE_TREE, Name: "dir", Hash: sub},
+		{Mode: MODE_SYMLINK, Name: "link", Hash: blob("dir/nested.txt")},
+		{Mode: MODE_GITLINK, Name: "module", Hash: "1111111111111111111111111111111111111111"},
+	})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sig := &Signature{Name: "t", Email: "t@t", When: time.Unix(1700000000, 0).In(time.FixedZone("", 2*3600))}
+	commit, err := repo.WriteCommit(&CommitSpec{Tree: tree, Author: sig, Message: "first\n"})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := repo.updateRef("refs/heads/main", "", commit, nil, "commit"); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name    string
+		format  string
+		treeish string
+		prefix  string
+		paths   []string
+	}{
+		{"tar", "tar", "main", "", nil},
+		{"tar with prefix", "tar", "main", "project/", nil},
+		{"tar of paths", "tar", "main", "project/", []string{"dir", "link"}},
+		{"tar of a commit hash", "tar", commit, "", nil},
+		{"tgz", "tar.gz", "main", "project/", nil},
+		{"zip", "zip", "main", "", nil},
+		{"zip with prefix", "zip", "main", "project/", nil},
+		{"zip of paths", "zip", "main", "project/", []string{"dir/run.sh"}},
+	}
+
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git not found")
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			args := append([]string{"archive", "--format=" + test.format, "--prefix=" + test.prefix, test.treeish, "--"}, test.paths...)
+			cmd := exec.Command("git", args...)
+			cmd.Dir = dir
+			want, err := cmd.Output()
+
+			if err != nil {
+				t.Fatalf("git archive: %v", err)
+			}
+
+			var got bytes.Buffer
+
+			if err := repo.Archive(&got, test.treeish, ARCHIVE_FORMATS[test.format], test.prefix, test.paths...); err != nil {
+				t.Fatal(err)
+			}
+
+			wantEntries := archiveEntries(t, test.format, want)
+			gotEntries := archiveEntries(t, test.format, got.Bytes())
+
+			if len(wantEntries) < 2 {
+				t.Fatalf("git archived %q", wantEntries)
+			}
+
+			if fmt.Sprint(gotEntries) != fmt.Sprint(wantEntries) {
+				t.Fatalf("entries:\n%q\nwant:\n%q", gotEntries, wantEntries)
+			}
+		})
+	}
+}
+
+// archiveEntries extracts an archive to one line per entry with its name, type, mode, mtime and
+// content or link target. The first line holds the commit git archive records.
+func archiveEntries(t *testing.T, format string, data []byte) []string {
+	t.Helper()
+
+	if format == "zip" {
+		zr, err := zip.NewReader(bytes.NewReader(data), int64(len(data)))
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		entries := []string{"comment " + zr.Comment}
+
+		for _, f := range zr.File {
+			r, err := f.Open()
+
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			content, err := io.ReadAll(r)
+			r.Close()
+
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			entries = append(entries, fmt.Sprintf("%s %s %d %s", f.Name, f.Mode(), f.Modified.Unix(), content))
+		}
+
+		return entries
+	}
+
+	var r io.Reader = bytes.NewReader(data)
+
+	if format == "tar.gz" {
+		gz, err := gzip.NewReader(r)
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		r = gz
+	}
+
+	tr := tar.NewReader(r)
+	entries := []string{}
+
+	for {
+		header, err := tr.Next()
+
+		if err == io.EOF {
+			return entries
+		}
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// The reader merges the global header into the entries after it.
+		if header.Typeflag == tar.TypeXGlobalHeader {
+			entries = append(entries, "comment "+header.PAXRecords["comment"])
+			continue
+		}
+
+		content, err := io.ReadAll(tr)
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		entries = append(entries, fmt.Sprintf("%s %c %o %s:%s %d %s%s", header.Name, header.Typeflag, header.Mode,
+			header.Uname, header.Gname, header.ModTime.Unix(), header.Linkname, content))
+	}
+}
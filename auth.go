@@ -0,0 +1,37 @@
+package gits
+
+import "errors"
+
+var (
+	ErrUnauthorized = errors.New("authentication required")
+	ErrForbidden    = errors.New("access denied")
+)
+
+// AuthorizerFunc adapts a function to the Authorizer interface.
+type AuthorizerFunc func(req *AuthRequest) error
+
+func (f AuthorizerFunc) Authorize(req *AuthRequest) error {
+	return f(req)
+}
+
+// With returns a copy of the repo bound to a client session. The transport entry points
+// (Advertise, UploadPack, ReceivePack, ...) ask the session's Authorizer before serving.
+func (repo *Repo) With(session *Session) *Repo {
+	clone := *repo
+	clone.session = session
+
+	return &clone
+}
+
+func (repo *Repo) authorize(op uint8, updates []*RefUpdate) error {
+	if repo.session == nil || repo.session.Authorizer == nil {
+		return nil
+	}
+
+	return repo.session.Authorizer.Authorize(&AuthRequest{
+		User:    repo.session.User,
+		Repo:    repo.conf.Name,
+		Op:      op,
+		Updates: updates,
+	})
+}
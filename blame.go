@@ -0,0 +1,314 @@
+package gits
+
+import (
+	"container/heap"
+	"fmt"
+)
+
+// blameEntry tracks one line of the blamed file while it is passed from commit to parent.
+type blameEntry struct {
+	final int // Index in the blamed file.
+	line  int // Index in the file of the current suspect.
+}
+
+type blamer struct {
+	*commitGraph
+	opts     *BlameOptions
+	ignore   map[string]bool
+	suspects map[string]map[string][]blameEntry // commit -> path -> lines
+	queue    *commitQueue
+	result   []*BlameLine
+}
+
+// Blame returns the commit that last changed each line of the file at path in rev, following renames.
+func (repo *Repo) Blame(rev, path string, opts *BlameOptions) ([]*BlameLine, error) {
+	if opts == nil {
+		opts = &BlameOptions{}
+	}
+
+	hash, err := repo.resolveCommit(rev)
+
+	if err != nil {
+		return nil, err
+	}
+
+	b := &blamer{
+		commitGraph: repo.newCommitGraph(),
+		opts:        opts,
+		ignore:      map[string]bool{},
+		suspects:    map[string]map[string][]blameEntry{},
+		queue: &commitQueue{less: func(a, b *Commit) bool {
+			return a.Committer.When.After(b.Committer.When)
+		}},
+	}
+
+	for _, ignored := range opts.IgnoreRevs {
+		if ignored, err = repo.resolveCommit(ignored); err != nil {
+			return nil, err
+		}
+
+		b.ignore[ignored] = true
+	}
+
+	lines, err := b.fileLines(hash, path)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if lines == nil {
+		return nil, fmt.Errorf("no such path %s in %s", path, rev)
+	}
+
+	start := max(opts.Start, 1)
+	end := ternary(opts.End == 0 || opts.End > len(lines), len(lines), opts.End)
+
+	if start > end && len(lines) > 0 {
+		return nil, fmt.Errorf("invalid line range %d,%d for a file with %d lines", opts.Start, opts.End, len(lines))
+	}
+
+	entries := []blameEntry{}
+
+	for i := start - 1; i < end; i++ {
+		entries = append(entries, blameEntry{final: i, line: i})
+	}
+
+	b.result = make([]*BlameLine, len(lines))
+
+	if err := b.pass(hash, path, entries); err != nil {
+		return nil, err
+	}
+
+	for b.queue.Len() > 0 {
+		commit := heap.Pop(b.queue).(*Commit)
+
+		for filePath, entries := range b.suspects[commit.Hash] {
+			if err := b.blame(commit, filePath, entries); err != nil {
+				return nil, err
+			}
+		}
+
+		delete(b.suspects, commit.Hash)
+	}
+
+	result := []*BlameLine{}
+
+	for i := start - 1; i < end; i++ {
+		b.result[i].Content = lines[i]
+		result = append(result, b.result[i])
+	}
+
+	return result, nil
+}
+
+// blame passes the lines that did not change in a parent on to that parent, and
+// attributes the rest to the commit itself.
+func (b *blamer) blame(commit *Commit, path string, entries []blameEntry) error {
+	blob, err := b.repo.treePathHash(commit.Tree, path)
+
+	if err != nil {
+		return err
+	}
+
+	parentPaths := make([]string, len(commit.Parents))
+
+	for i, parent := range commit.Parents {
+		if parentPaths[i], err = b.parentPath(commit, i, path); err != nil {
+			return err
+		}
+
+		if parentPaths[i] == "" {
+			continue
+		}
+
+		parentCommit, err := b.commit(parent)
+
+		if err != nil {
+			return err
+		}
+
+		parentBlob, err := b.repo.treePathHash(parentCommit.Tree, parentPaths[i])
+
+		if err != nil {
+			return err
+		}
+
+		// A parent with the same content takes the blame for every line.
+		if parentBlob == blob {
+			return b.pass(parent, parentPaths[i], entries)
+		}
+	}
+
+	lines, err := b.fileLines(commit.Hash, path)
+
+	if err != nil {
+		return err
+	}
+
+	for i, parent := range commit.Parents {
+		parentPath := parentPaths[i]
+
+		if len(entries) == 0 {
+			return nil
+		}
+
+		if parentPath == "" {
+			continue
+		}
+
+		parentLines, err := b.fileLines(parent, parentPath)
+
+		if err != nil {
+			return err
+		}
+
+		mapping, nearby := lineMapping(parentLines, lines, b.opts.Algorithm)
+		passed, remaining := []blameEntry{}, []blameEntry{}
+
+		for _, entry := range entries {
+			if mapping[entry.line] != -1 {
+				passed = append(passed, blameEntry{final: entry.final, line: mapping[entry.line]})
+			} else if b.ignore[commit.Hash] && i == 0 && nearby[entry.line] != -1 {
+				// Changes of ignored commits are blamed on the line they replaced.
+				passed = append(passed, blameEntry{final: entry.final, line: nearby[entry.line]})
+			} else {
+				remaining = append(remaining, entry)
+			}
+		}
+
+		if err := b.pass(parent, parentPath, passed); err != nil {
+			return err
+		}
+
+		entries = remaining
+	}
+
+	for _, entry := range entries {
+		b.result[entry.final] = &BlameLine{
+			Line:     entry.final + 1,
+			Commit:   commit.Hash,
+			Path:     path,
+			OrigLine: entry.line + 1,
+			Author:   commit.Author,
+		}
+	}
+
+	return nil
+}
+
+// pass queues lines to be blamed on a commit.
+func (b *blamer) pass(hash, path string, entries []blameEntry) error {
+	if len(entries) == 0 {
+		return nil
+	}
+
+	commit, err := b.commit(hash)
+
+	if err != nil {
+		return err
+	}
+
+	if b.suspects[hash] == nil {
+		b.suspects[hash] = map[string][]blameEntry{}
+		heap.Push(b.queue, commit)
+	}
+
+	b.suspects[hash][path] = append(b.suspects[hash][path], entries...)
+
+	return nil
+}
+
+// parentPath returns the path of the file in the n-th parent, following a rename, or an
+// empty string if the parent does not have the file.
+func (b *blamer) parentPath(commit *Commit, n int, path string) (string, error) {
+	parent, err := b.commit(commit.Parents[n])
+
+	if err != nil {
+		return "", err
+	}
+
+	hash, err := b.repo.treePathHash(parent.Tree, path)
+
+	if err != nil {
+		return "", err
+	}
+
+	if hash != "" {
+		return path, nil
+	}
+
+	changes, err := b.repo.DiffTrees(parent.Tree, commit.Tree, &DiffOptions{Renames: true})
+
+	if err != nil {
+		return "", err
+	}
+
+	for _, change := range changes {
+		if change.Type == DIFF_RENAME && change.NewPath == path {
+			return change.OldPath, nil
+		}
+	}
+
+	return "", nil
+}
+
+// fileLines returns the lines of the file at path in a commit, or nil if there is no such file.
+func (b *blamer) fileLines(hash, path string) ([]string, error) {
+	commit, err := b.commit(hash)
+
+	if err != nil {
+		return nil, err
+	}
+
+	blob, err := b.repo.treePathHash(commit.Tree, path)
+
+	if err != nil || blob == "" {
+		return nil, err
+	}
+
+	object, err := b.repo.Object(blob)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if object.Type != OBJ_BLOB {
+		return nil, nil
+	}
+
+	return splitLines(object.Data), nil
+}
+
+// lineMapping maps each line of b to the same line in a, or -1 if it was changed. For changed
+// lines, nearby holds the line of a that was replaced at the same offset, or -1 for pure additions.
+func lineMapping(a, b []string, algorithm uint8) ([]int, []int) {
+	mapping := make([]int, len(b))
+	nearby := make([]int, len(b))
+	ops := diffLines(a, b, algorithm)
+
+	for i := range mapping {
+		mapping[i], nearby[i] = -1, -1
+	}
+
+	for i, op := range ops {
+		switch op.kind {
+		case ' ':
+			for k := 0; k < op.n; k++ {
+				mapping[op.b+k] = op.a + k
+			}
+
+		case '+':
+			if i == 0 || ops[i-1].kind != '-' {
+				continue
+			}
+
+			deleted := ops[i-1]
+
+			for k := 0; k < op.n; k++ {
+				nearby[op.b+k] = deleted.a + min(k, deleted.n-1)
+			}
+		}
+	}
+
+	return mapping, nearby
+}
@@ -0,0 +1,146 @@
+package gits
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestBlameMatchesGit(t *testing.T) {
+	repo := newTestRepo(t, nil)
+	dir := repoPath(repo)
+	lines := []string{}
+
+	for i := 1; i <= 12; i++ {
+		lines = append(lines, fmt.Sprintf("line %d\n", i))
+	}
+
+	// Commits a minute apart, blame visits them by committer date.
+	minutes := 0
+	commit := func(branch, parent, message string, op FileOp) string {
+		if hash, _ := repo.resolveRef("refs/heads/" + branch); hash == "" && parent != "" {
+			if err := repo.updateRef("refs/heads/"+branch, "", parent, nil, "branch"); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		minutes++
+		op.Content = []byte(strings.Join(lines, ""))
+		sig := &Signature{Name: "t", Email: "t@t", When: time.Unix(1700000000+int64(minutes)*60, 0).UTC()}
+		hash, err := repo.CommitFiles(&CommitFilesSpec{Branch: branch, Parent: parent, Author: sig, Message: message, Ops: []FileOp{op}})
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		return hash
+	}
+
+	first := commit("main", "", "first", FileOp{Action: FILE_ADD, Path: "file.txt"})
+	lines[2], lines[3] = "line 3 changed\n", "line 4 changed\n"
+	second := commit("main", first, "second", FileOp{Action: FILE_MODIFY, Path: "file.txt"})
+
+	lines[8] = "line 9 on topic\n"
+	topic := commit("topic", second, "topic", FileOp{Action: FILE_MODIFY, Path: "file.txt"})
+
+	lines[8] = "line 9\n"
+	lines[0] = "line 1 on main\n"
+	third := commit("main", second, "third", FileOp{Action: FILE_MODIFY, Path: "file.txt"})
+
+	// The merge changes a line of its own.
+	lines[8], lines[5] = "line 9 on topic\n", "line 6 in the merge\n"
+	merged := commit("tmp", third, "tmp", FileOp{Action: FILE_MODIFY, Path: "file.txt"})
+	minutes++
+	sig := &Signature{Name: "t", Email: "t@t", When: time.Unix(1700000000+int64(minutes)*60, 0).UTC()}
+	merge, err := repo.WriteCommit(&CommitSpec{Tree: readTree(t, repo, merged), Parents: []string{third, topic}, Author: sig, Message: "merge\n"})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := repo.updateRef("refs/heads/main", third, merge, nil, "merge"); err != nil {
+		t.Fatal(err)
+	}
+
+	lines[10] = "line 11 renamed\n"
+	renamed := commit("main", merge, "rename", FileOp{Action: FILE_RENAME, OldPath: "file.txt", Path: "renamed.txt"})
+
+	lines[1] = "line  2\n"
+	reformat := commit("main", renamed, "reformat", FileOp{Action: FILE_MODIFY, Path: "renamed.txt"})
+
+	lines = append(lines[:7], append([]string{"inserted a\n", "inserted b\n"}, lines[7:11]...)...)
+	commit("main", reformat, "insert", FileOp{Action: FILE_MODIFY, Path: "renamed.txt"})
+
+	tests := []struct {
+		name string
+		rev  string
+		path string
+		opts *BlameOptions
+		args []string
+	}{
+		{"whole file", "main", "renamed.txt", nil, nil},
+		{"line range", "main", "renamed.txt", &BlameOptions{Start: 3, End: 8}, []string{"-L", "3,8"}},
+		{"histogram", "main", "renamed.txt", &BlameOptions{Algorithm: DIFF_HISTOGRAM}, []string{"--diff-algorithm=histogram"}},
+		{"ignored revision", "main", "renamed.txt", &BlameOptions{IgnoreRevs: []string{reformat}}, []string{"--ignore-rev", reformat}},
+		{"merge", merge, "file.txt", nil, nil},
+		{"topic", topic, "file.txt", nil, nil},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			args := append(append([]string{"blame", "--line-porcelain"}, test.args...), test.rev, "--", test.path)
+			want := parseBlamePorcelain(t, runGit(t, dir, args...))
+
+			if len(want) == 0 {
+				t.Fatal("git blamed no line")
+			}
+
+			blamed, err := repo.Blame(test.rev, test.path, test.opts)
+
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			got := []string{}
+
+			for _, line := range blamed {
+				got = append(got, fmt.Sprintf("%s %d %d %s\t%s", line.Commit, line.OrigLine, line.Line, line.Path, strings.TrimSuffix(line.Content, "\n")))
+			}
+
+			if strings.Join(got, "\n") != strings.Join(want, "\n") {
+				t.Fatalf("blame:\n%s\nwant:\n%s", strings.Join(got, "\n"), strings.Join(want, "\n"))
+			}
+		})
+	}
+}
+
+// parseBlamePorcelain returns "<commit> <orig line> <line> <path>\t<content>" for each line of
+// git blame --line-porcelain.
+func parseBlamePorcelain(t *testing.T, out string) []string {
+	t.Helper()
+
+	result := []string{}
+	header, path := []string{}, ""
+
+	for _, line := range strings.Split(strings.TrimSuffix(out, "\n"), "\n") {
+		switch {
+		case strings.HasPrefix(line, "\t"):
+			if len(header) < 3 {
+				t.Fatalf("content without a header: %q", line)
+			}
+
+			orig, _ := strconv.Atoi(header[1])
+			final, _ := strconv.Atoi(header[2])
+			result = append(result, fmt.Sprintf("%s %d %d %s%s", header[0], orig, final, path, line))
+			header = nil
+		case len(header) == 0:
+			header = strings.Fields(line)
+		case strings.HasPrefix(line, "filename "):
+			path = strings.TrimPrefix(line, "filename ")
+		}
+	}
+
+	return result
+}
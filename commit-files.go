@@ -0,0 +1,431 @@
+package gits
+
+import (
+	"fmt"
+	"strings"
+)
+
+// treeBuilder is an editable tree that only loads and rewrites the subtrees touched by edits.
+type treeBuilder struct {
+	repo     *Repo
+	hash     string
+	entries  map[string]TreeEntry
+	subtrees map[string]*treeBuilder
+	dirty    bool
+}
+
+// CommitFiles applies the file operations on top of the expected parent, writes
+// the commit and moves the branch to it if the branch still points to the parent.
+func (repo *Repo) CommitFiles(spec *CommitFilesSpec) (string, error) {
+	branch := spec.Branch
+
+	if !strings.HasPrefix(branch, "refs/") {
+		branch = "refs/heads/" + branch
+	}
+
+	if !validRefName(branch) {
+		return "", fmt.Errorf("invalid branch name: %s", spec.Branch)
+	}
+
+	for _, who := range []*Signature{spec.Author, spec.Committer} {
+		if who == nil {
+			continue
+		}
+
+		if err := validSignature(who); err != nil {
+			return "", err
+		}
+	}
+
+	// Until the branch points to the new objects, GC would see them as unreachable.
+	unlock := repo.lockObjects(false)
+	defer unlock()
+
+	current, err := repo.readRef(branch)
+
+	if err != nil {
+		return "", err
+	}
+
+	if current != spec.Parent {
+		return "", &RefConflictError{
+			Ref:      branch,
+			Expected: ternary(spec.Parent == "", ZERO_HASH, spec.Parent),
+			Actual:   ternary(current == "", ZERO_HASH, current),
+		}
+	}
+
+	rootHash := ""
+	parents := []string{}
+
+	if spec.Parent != "" {
+		parent, err := repo.Object(spec.Parent)
+
+		if err != nil {
+			return "", err
+		}
+
+		if parent.Type != OBJ_COMMIT {
+			return "", fmt.Errorf("parent %s is not a commit", spec.Parent)
+		}
+
+		rootHash = parent.TreeHash
+		parents = append(parents, spec.Parent)
+	}
+
+	root, err := repo.newTreeBuilder(rootHash)
+
+	if err != nil {
+		return "", err
+	}
+
+	for _, op := range spec.Ops {
+		if err := root.apply(op); err != nil {
+			return "", err
+		}
+	}
+
+	treeHash, err := root.write(true)
+
+	if err != nil {
+		return "", err
+	}
+
+	commit, err := repo.WriteCommit(&CommitSpec{
+		Tree:      treeHash,
+		Parents:   parents,
+		Author:    spec.Author,
+		Committer: spec.Committer,
+		Message:   spec.Message,
+	})
+
+	if err != nil {
+		return "", err
+	}
+
+	subject, _, _ := strings.Cut(strings.TrimSpace(spec.Message), "\n")
+	msg := ternary(spec.Parent == "", "commit (initial): ", "commit: ") + subject
+
+	if err := repo.updateRef(branch, spec.Parent, commit, ternary(spec.Committer != nil, spec.Committer, spec.Author), msg); err != nil {
+		return "", err
+	}
+
+	return commit, nil
+}
+
+func (repo *Repo) newTreeBuilder(hash string) (*treeBuilder, error) {
+	t := &treeBuilder{
+		repo:     repo,
+		hash:     hash,
+		entries:  map[string]TreeEntry{},
+		subtrees: map[string]*treeBuilder{},
+	}
+
+	if hash == "" {
+		t.dirty = true
+		return t, nil
+	}
+
+	object, err := repo.Object(hash)
+
+	if err != nil {
+		return nil, err
+	}
+
+	entries, err := object.Entries()
+
+	if err != nil {
+		return nil, err
+	}
+
+	for _, entry := range entries {
+		t.entries[entry.Name] = entry
+	}
+
+	return t, nil
+}
+
+func (t *treeBuilder) apply(op FileOp) error {
+	path, err := splitPath(op.Path)
+
+	if err != nil {
+		return err
+	}
+
+	existing, exists, err := t.get(path)
+
+	if err != nil {
+		return err
+	}
+
+	switch op.Action {
+	case FILE_ADD:
+		if exists {
+			return fmt.Errorf("%s already exists", op.Path)
+		}
+
+		return t.writeFile(path, op.Content, ternary(op.Mode == 0, uint32(MODE_FILE), op.Mode))
+
+	case FILE_MODIFY:
+		if !exists || existing.Mode == MODE_TREE {
+			return fmt.Errorf("%s is not a file", op.Path)
+		}
+
+		return t.writeFile(path, op.Content, ternary(op.Mode == 0, existing.Mode, op.Mode))
+
+	case FILE_DELETE:
+		if !exists {
+			return fmt.Errorf("%s does not exist", op.Path)
+		}
+
+		return t.remove(path)
+
+	case FILE_RENAME:
+		oldPath, err := splitPath(op.OldPath)
+
+		if err != nil {
+			return err
+		}
+
+		source, found, err := t.get(oldPath)
+
+		if err != nil {
+			return err
+		}
+
+		if !found {
+			return fmt.Errorf("%s does not exist", op.OldPath)
+		}
+
+		if exists {
+			return fmt.Errorf("%s already exists", op.Path)
+		}
+
+		if (op.Content != nil || op.Mode != 0) && source.Mode == MODE_TREE {
+			return fmt.Errorf("%s is not a file", op.OldPath)
+		}
+
+		if op.Content == nil && op.Mode != 0 && op.Mode != MODE_FILE && op.Mode != MODE_EXEC && op.Mode != MODE_SYMLINK {
+			return fmt.Errorf("invalid mode %o for %s", op.Mode, op.Path)
+		}
+
+		// A directory edited earlier in the commit moves with its edits, its hash is stale.
+		moved, err := t.subtree(oldPath)
+
+		if err != nil {
+			return err
+		}
+
+		if err := t.remove(oldPath); err != nil {
+			return err
+		}
+
+		if op.Content != nil {
+			return t.writeFile(path, op.Content, ternary(op.Mode == 0, source.Mode, op.Mode))
+		}
+
+		if op.Mode != 0 {
+			source.Mode = op.Mode
+		}
+
+		if err := t.set(path, source); err != nil {
+			return err
+		}
+
+		if moved != nil {
+			dir, err := t.dir(path[:len(path)-1], false)
+
+			if err != nil {
+				return err
+			}
+
+			dir.subtrees[path[len(path)-1]] = moved
+		}
+
+		return nil
+
+	case FILE_CHMOD:
+		if !exists || existing.Mode == MODE_TREE {
+			return fmt.Errorf("%s is not a file", op.Path)
+		}
+
+		if op.Mode != MODE_FILE && op.Mode != MODE_EXEC {
+			return fmt.Errorf("invalid mode %o for %s", op.Mode, op.Path)
+		}
+
+		existing.Mode = op.Mode
+
+		return t.set(path, existing)
+	}
+
+	return fmt.Errorf("unknown file action: %d", op.Action)
+}
+
+func (t *treeBuilder) writeFile(path []string, content []byte, mode uint32) error {
+	if mode != MODE_FILE && mode != MODE_EXEC && mode != MODE_SYMLINK {
+		return fmt.Errorf("invalid mode %o for %s", mode, strings.Join(path, "/"))
+	}
+
+	hash, err := t.repo.WriteBlob(content)
+
+	if err != nil {
+		return err
+	}
+
+	return t.set(path, TreeEntry{Mode: mode, Hash: hash})
+}
+
+func (t *treeBuilder) get(path []string) (TreeEntry, bool, error) {
+	dir, err := t.dir(path[:len(path)-1], false)
+
+	if err != nil || dir == nil {
+		return TreeEntry{}, false, err
+	}
+
+	entry, ok := dir.entries[path[len(path)-1]]
+
+	return entry, ok, nil
+}
+
+// subtree returns the loaded node of the directory at path, nil when it was not loaded.
+func (t *treeBuilder) subtree(path []string) (*treeBuilder, error) {
+	dir, err := t.dir(path[:len(path)-1], false)
+
+	if err != nil || dir == nil {
+		return nil, err
+	}
+
+	return dir.subtrees[path[len(path)-1]], nil
+}
+
+func (t *treeBuilder) set(path []string, entry TreeEntry) error {
+	dir, err := t.dir(path[:len(path)-1], true)
+
+	if err != nil {
+		return err
+	}
+
+	entry.Name = path[len(path)-1]
+	dir.entries[entry.Name] = entry
+	dir.dirty = true
+
+	// A moved directory replaces whatever subtree was loaded under the same name.
+	delete(dir.subtrees, entry.Name)
+
+	return nil
+}
+
+func (t *treeBuilder) remove(path []string) error {
+	dir, err := t.dir(path[:len(path)-1], false)
+
+	if err != nil {
+		return err
+	}
+
+	name := path[len(path)-1]
+
+	delete(dir.entries, name)
+	delete(dir.subtrees, name)
+	dir.dirty = true
+
+	return nil
+}
+
+// dir descends into the directory at path. Missing directories are created
+// when create is set, otherwise nil is returned for them.
+func (t *treeBuilder) dir(path []string, create bool) (*treeBuilder, error) {
+	node := t
+
+	for i, name := range path {
+		sub, ok := node.subtrees[name]
+
+		if !ok {
+			entry, exists := node.entries[name]
+
+			switch {
+			case exists && entry.Mode == MODE_TREE:
+				var err error
+
+				if sub, err = node.repo.newTreeBuilder(entry.Hash); err != nil {
+					return nil, err
+				}
+
+			case exists:
+				return nil, fmt.Errorf("%s is not a directory", strings.Join(path[:i+1], "/"))
+
+			case !create:
+				return nil, nil
+
+			default:
+				sub, _ = node.repo.newTreeBuilder("")
+				node.entries[name] = TreeEntry{Mode: MODE_TREE, Name: name}
+				node.dirty = true
+			}
+
+			node.subtrees[name] = sub
+		}
+
+		node = sub
+	}
+
+	return node, nil
+}
+
+// write stores every modified subtree bottom-up and returns the hash of the tree.
+// Empty subtrees are not stored unless keepEmpty is set.
+func (t *treeBuilder) write(keepEmpty bool) (string, error) {
+	for name, sub := range t.subtrees {
+		hash, err := sub.write(false)
+
+		if err != nil {
+			return "", err
+		}
+
+		// Git does not keep empty directories.
+		if len(sub.entries) == 0 {
+			delete(t.entries, name)
+			t.dirty = true
+			continue
+		}
+
+		if t.entries[name].Hash != hash {
+			t.entries[name] = TreeEntry{Mode: MODE_TREE, Name: name, Hash: hash}
+			t.dirty = true
+		}
+	}
+
+	if !t.dirty || (len(t.entries) == 0 && !keepEmpty) {
+		return t.hash, nil
+	}
+
+	entries := make([]TreeEntry, 0, len(t.entries))
+
+	for _, entry := range t.entries {
+		entries = append(entries, entry)
+	}
+
+	hash, err := t.repo.WriteTree(entries)
+
+	if err != nil {
+		return "", err
+	}
+
+	t.hash = hash
+	t.dirty = false
+
+	return hash, nil
+}
+
+// splitPath splits a path into its components, refusing the ones git's verify_path refuses.
+// Symlinks named like .gitmodules are left to WriteTree, which knows the mode.
+func splitPath(path string) ([]string, error) {
+	parts := strings.Split(strings.Trim(path, "/"), "/")
+
+	for _, part := range parts {
+		if !validPathComponent(part, MODE_TREE) {
+			return nil, fmt.Errorf("invalid path: %q", path)
+		}
+	}
+
+	return parts, nil
+}
@@ -0,0 +1,116 @@
+package gits
+
+import "testing"
+
+func TestCommitFilesRenameEditedDirectory(t *testing.T) {
+	repo := newTestRepo(t, nil)
+
+	first, err := repo.CommitFiles(&CommitFilesSpec{
+		Branch:  "main",
+		Author:  testSignature(),
+		Message: "add",
+		Ops:     []FileOp{{Action: FILE_ADD, Path: "dir/a.txt", Content: []byte("old\n")}},
+	})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = repo.CommitFiles(&CommitFilesSpec{
+		Branch:  "main",
+		Parent:  first,
+		Author:  testSignature(),
+		Message: "edit and move",
+		Ops: []FileOp{
+			{Action: FILE_MODIFY, Path: "dir/a.txt", Content: []byte("new\n")},
+			{Action: FILE_RENAME, OldPath: "dir", Path: "moved"},
+		},
+	})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if got := readFile(t, repo, "main:moved/a.txt"); got != "new\n" {
+		t.Fatalf("moved/a.txt = %q, want %q", got, "new\n")
+	}
+
+	if _, err := repo.ResolveRevision("main:dir"); err == nil {
+		t.Fatal("dir still exists")
+	}
+}
+
+func TestCommitFilesRenameMode(t *testing.T) {
+	repo := newTestRepo(t, nil)
+
+	first, err := repo.CommitFiles(&CommitFilesSpec{
+		Branch:  "main",
+		Author:  testSignature(),
+		Message: "add",
+		Ops:     []FileOp{{Action: FILE_ADD, Path: "a.sh", Content: []byte("echo\n")}},
+	})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, mode := range []uint32{MODE_TREE, MODE_GITLINK, 0123} {
+		_, err := repo.CommitFiles(&CommitFilesSpec{
+			Branch:  "main",
+			Parent:  first,
+			Author:  testSignature(),
+			Message: "move",
+			Ops:     []FileOp{{Action: FILE_RENAME, OldPath: "a.sh", Path: "b.sh", Mode: mode}},
+		})
+
+		if err == nil {
+			t.Fatalf("mode %o accepted", mode)
+		}
+	}
+
+	commit, err := repo.CommitFiles(&CommitFilesSpec{
+		Branch:  "main",
+		Parent:  first,
+		Author:  testSignature(),
+		Message: "move",
+		Ops:     []FileOp{{Action: FILE_RENAME, OldPath: "a.sh", Path: "bin/b.sh", Mode: MODE_EXEC}},
+	})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	runGit(t, repoPath(repo), "fsck", "--strict")
+
+	if out := runGit(t, repoPath(repo), "ls-tree", "-r", commit); out[:6] != "100755" {
+		t.Fatalf("ls-tree: %s", out)
+	}
+}
+
+func TestCommitFilesRejectsDotgit(t *testing.T) {
+	repo := newTestRepo(t, nil)
+
+	for _, path := range []string{".git/config", ".GIT/config", "dir/.Git/hooks/pre-commit", "git~1/config", ".git./config", ".g\u200cit/config", "a//b", "../a"} {
+		_, err := repo.CommitFiles(&CommitFilesSpec{
+			Branch:  "main",
+			Author:  testSignature(),
+			Message: "add",
+			Ops:     []FileOp{{Action: FILE_ADD, Path: path, Content: []byte("x\n")}},
+		})
+
+		if err == nil {
+			t.Errorf("%s accepted", path)
+		}
+	}
+
+	_, err := repo.CommitFiles(&CommitFilesSpec{
+		Branch:  "main",
+		Author:  testSignature(),
+		Message: "add",
+		Ops:     []FileOp{{Action: FILE_ADD, Path: ".gitmodules", Content: []byte("x\n"), Mode: MODE_SYMLINK}},
+	})
+
+	if err == nil {
+		t.Error(".gitmodules symlink accepted")
+	}
+}
@@ -1,5 +1,10 @@
 package gits
 
+import (
+	"io"
+	"time"
+)
+
 const (
 	OBJ_COMMIT    = 1
 	OBJ_TREE      = 2
@@ -9,6 +14,30 @@ const (
 	OBJ_REF_DELTA = 7
 )
 
+const (
+	SIDEBAND_DATA     = 1
+	SIDEBAND_PROGRESS = 2
+	SIDEBAND_ERROR    = 3
+	SIDEBAND_MAX_DATA = 65515 // Largest side-band-64k payload, 65520 minus length and band bytes.
+)
+
+const (
+	OP_READ  = 1 // Fetch, clone and archive.
+	OP_WRITE = 2 // Push.
+)
+
+const (
+	REF_STORAGE_FILES    = 1 // Loose ref files and packed-refs.
+	REF_STORAGE_REFTABLE = 2 // A stack of reftable files in reftable/.
+)
+
+const (
+	TRANSPORT_STATELESS = 1 // Smart HTTP, every negotiation round is a separate request.
+	TRANSPORT_STATEFUL  = 2 // SSH and git://, the whole conversation runs on one connection.
+)
+
+const ZERO_HASH = "0000000000000000000000000000000000000000"
+
 var OBJ_TYPES_NUM = map[string]uint8{
 	"commit":    OBJ_COMMIT,
 	"tree":      OBJ_TREE,
@@ -27,15 +56,89 @@ var OBJ_TYPES_STR = map[uint8]string{
 	OBJ_REF_DELTA: "ref-delta",
 }
 
-var ADVERTISE_CAPS = []string{
-	// "multi_ack",
-	// "multi_ack_detailed",
+// Capabilities of protocol v0 and v1 by service, upload-pack adds the ones its config turns on.
+var ADVERTISE_CAPS_UPLOAD_PACK = []string{
+	"multi_ack",
+	"multi_ack_detailed",
 	// "thin-pack",
 	// "side-band",
 	// "side-band-64k",
 	// "ofs-delta",
+	"agent=gits/dev",
+}
+
+var ADVERTISE_CAPS_RECEIVE_PACK = []string{
 	"report-status",
+	"delete-refs",
+	"atomic",
+	"agent=gits/dev",
+}
+
+// Bytes of parsed packs kept in memory across repos, see packCache.
+var PACK_CACHE_SIZE = 256 << 20
+
+// Refs hidden from clients unless Config.HideRefs is set.
+var DEFAULT_HIDE_REFS = []string{
+	"refs/internal",
+	"refs/keep-around",
+}
+
+// Capabilities of protocol v2, see https://git-scm.com/docs/protocol-v2.
+var ADVERTISE_CAPS_V2 = []string{
 	"agent=gits/dev",
+	"ls-refs=unborn",
+	"fetch",
+	"server-option",
+	"object-format=sha1",
+}
+
+const (
+	MODE_TREE    = 0040000
+	MODE_FILE    = 0100644
+	MODE_EXEC    = 0100755
+	MODE_SYMLINK = 0120000
+	MODE_GITLINK = 0160000
+)
+
+const (
+	FILE_ADD    = 1
+	FILE_MODIFY = 2
+	FILE_DELETE = 3
+	FILE_RENAME = 4
+	FILE_CHMOD  = 5
+)
+
+const (
+	LOG_ORDER_DEFAULT     = 0 // Newest commit date first, as git log walks.
+	LOG_ORDER_TOPO        = 1 // Children before parents, lines of history kept together.
+	LOG_ORDER_DATE        = 2 // Children before parents, then newest commit date first.
+	LOG_ORDER_AUTHOR_DATE = 3 // Children before parents, then newest author date first.
+)
+
+const (
+	DIFF_ADD    = 1
+	DIFF_MODIFY = 2
+	DIFF_DELETE = 3
+	DIFF_RENAME = 4
+	DIFF_COPY   = 5
+)
+
+const (
+	DIFF_MYERS     = 0
+	DIFF_HISTOGRAM = 1
+)
+
+const (
+	ARCHIVE_TAR = 1
+	ARCHIVE_TGZ = 2
+	ARCHIVE_ZIP = 3
+)
+
+var ARCHIVE_FORMATS = map[string]uint8{
+	"tar":    ARCHIVE_TAR,
+	"tgz":    ARCHIVE_TGZ,
+	"tar.gz": ARCHIVE_TGZ,
+	"zip":    ARCHIVE_ZIP,
 }
 
 const (
@@ -53,14 +156,68 @@ type Head struct {
 }
 
 type Config struct {
-	Dir  string
-	Name string
-	FS   func(root string) (FS, error)
+	Dir           string
+	Name          string
+	FS            func(root string) (FS, error)
+	RefStorage    uint8                                 // REF_STORAGE_FILES or REF_STORAGE_REFTABLE. Zero detects it, defaulting to files.
+	RefStore      func(repo *Repo) (RefStore, error)    // Custom ref storage, RefStorage is ignored when set.
+	ObjectStore   func(repo *Repo) (ObjectStore, error) // Custom object storage, defaults to loose objects and packs.
+	InitialBranch string                                // Branch HEAD points to in a repo made by InitRepo, e.g: main or refs/heads/main. Defaults to main.
+	Namespace     string                                // Serves the refs under refs/namespaces/<Namespace>/ as the refs of the repo, like GIT_NAMESPACE. Nested with a/b.
+	HideRefs      []string                              // Refs hidden from clients like transfer.hideRefs, before the patterns of the config file. Nil hides DEFAULT_HIDE_REFS.
 }
 
 type Repo struct {
-	conf *Config
-	fs   FS
+	conf    *Config
+	fs      FS
+	refs    RefStore
+	objects ObjectStore
+	session *Session
+}
+
+// Session is the state of one client connection, attached to a repo with Repo.With.
+type Session struct {
+	User       string     // Authenticated user, empty for anonymous access.
+	Authorizer Authorizer // Nil allows every operation.
+	Transport  uint8      // TRANSPORT_STATELESS (the default) or TRANSPORT_STATEFUL.
+}
+
+type Ref struct {
+	Name   string
+	Hash   string // Empty for symbolic refs.
+	Target string // Ref a symbolic ref points to, e.g: refs/heads/main
+}
+
+type RefUpdate struct {
+	Name string
+	Old  string // ZERO_HASH when the ref is created.
+	New  string // ZERO_HASH when the ref is deleted.
+}
+
+type ReflogEntry struct {
+	Old     string // ZERO_HASH when the ref was created.
+	New     string // ZERO_HASH when the ref was deleted.
+	Who     *Signature
+	Message string // E.g: push, or commit: <subject> for CommitFiles.
+}
+
+type ReflogExpireOptions struct {
+	Refs              []string  // Full ref names, e.g: refs/heads/main or HEAD. Defaults to every ref with a reflog.
+	Expire            time.Time // Entries older than this are dropped. Defaults to 90 days ago.
+	ExpireUnreachable time.Time // Entries older than this whose commit the ref no longer reaches are dropped. Defaults to 30 days ago.
+}
+
+type GCOptions struct {
+	PruneExpire time.Time // Unreachable objects written before this are removed. Defaults to 2 weeks ago, like gc.pruneExpire.
+	Window      int       // Objects compared to find the base of a delta, defaults to 10.
+	Depth       int       // Longest chain of deltas, defaults to 50.
+}
+
+type AuthRequest struct {
+	User    string
+	Repo    string       // Name of the repo, as in Config.Name.
+	Op      uint8        // OP_READ or OP_WRITE.
+	Updates []*RefUpdate // Ref updates of a push, empty when only the advertisement is requested.
 }
 
 type Object struct {
@@ -72,13 +229,136 @@ type Object struct {
 	Data         []byte
 }
 
+type Signature struct {
+	Name  string
+	Email string
+	When  time.Time
+}
+
+type TreeEntry struct {
+	Mode uint32 // One of MODE_*.
+	Name string // Single path component, no slashes.
+	Hash string
+}
+
+type Commit struct {
+	Hash      string
+	Tree      string
+	Parents   []string
+	Author    *Signature
+	Committer *Signature
+	Message   string
+}
+
+type CommitSpec struct {
+	Tree      string
+	Parents   []string
+	Author    *Signature
+	Committer *Signature // Defaults to Author when nil.
+	Message   string
+}
+
+type TagSpec struct {
+	Object  string
+	Type    uint8 // Type of Object, looked up when 0.
+	Name    string
+	Tagger  *Signature
+	Message string
+}
+
+type FileOp struct {
+	Action  uint8  // One of FILE_*.
+	Path    string // Slash separated path from the root of the tree.
+	OldPath string // Source path for FILE_RENAME.
+	Content []byte // New content for FILE_ADD and FILE_MODIFY, optional for FILE_RENAME.
+	Mode    uint32 // Defaults to MODE_FILE on add, keeps the existing mode otherwise.
+}
+
+type CommitFilesSpec struct {
+	Branch    string // E.g: main or refs/heads/main
+	Parent    string // Expected head of the branch, empty if the branch is new.
+	Author    *Signature
+	Committer *Signature
+	Message   string
+	Ops       []FileOp
+}
+
+type LogOptions struct {
+	Revisions   []string // E.g: main, ^v1.0, v1.0..main, main...feature. Defaults to HEAD.
+	Order       uint8    // One of LOG_ORDER_*.
+	FirstParent bool
+	Paths       []string // Only commits changing these paths, with history simplification.
+	Author      string   // Regexp matched against "Name <email>" of the author.
+	Committer   string   // Regexp matched against "Name <email>" of the committer.
+	Grep        string   // Regexp matched against the commit message.
+	Limit       int      // Commits per page, 0 for all.
+	Cursor      string   // LogPage.Next of the previous page.
+}
+
+type LogPage struct {
+	Commits []*Commit
+	Next    string // Cursor of the next page, empty on the last page.
+}
+
+type DiffOptions struct {
+	Renames          bool // Pair deleted and added files into renames.
+	Copies           bool // Detect copies from files modified in the same diff.
+	FindCopiesHarder bool // Also consider unmodified files as copy sources.
+	Similarity       int  // Minimum similarity percentage for renames and copies, defaults to 50.
+	Algorithm        uint8
+	Context          int // Lines of context in hunks, defaults to 3. Use a negative value for none.
+}
+
+type Change struct {
+	Type       uint8 // One of DIFF_*.
+	OldPath    string
+	NewPath    string
+	OldMode    uint32
+	NewMode    uint32
+	OldHash    string
+	NewHash    string
+	Similarity int // Percentage, for renames and copies.
+}
+
+type BlameOptions struct {
+	Start      int      // First line to blame, 1-based. Defaults to the first line.
+	End        int      // Last line to blame, inclusive. Defaults to the last line.
+	IgnoreRevs []string // Commits whose changes are passed on to their parents when possible.
+	Algorithm  uint8    // Line diff algorithm, DIFF_MYERS or DIFF_HISTOGRAM.
+}
+
+type BlameLine struct {
+	Line     int    // Line number in the blamed file, 1-based.
+	Commit   string // Commit that introduced the line.
+	Path     string // Path of the file in Commit, differs from the blamed path after renames.
+	OrigLine int    // Line number in the file of Commit, 1-based.
+	Author   *Signature
+	Content  string
+}
+
+type Patch struct {
+	Binary bool
+	Hunks  []*Hunk
+}
+
+type Hunk struct {
+	OldStart int
+	OldLines int
+	NewStart int
+	NewLines int
+	Section  string   // Closest line above the hunk that starts with a letter, '_' or '$', as git shows it.
+	Lines    []string // Each line is prefixed with ' ', '-' or '+' and keeps its newline.
+}
+
 type Negotiation struct {
-	Wants map[string]bool
-	Haves map[string]bool
-	Caps  map[string]bool
-	Agent string
-	Done  bool
-	EOF   bool
+	Wants  map[string]bool
+	Haves  map[string]bool
+	Caps   map[string]bool
+	Agent  string
+	Done   bool
+	EOF    bool
+	Acked  string // Last common have acknowledged during the negotiation.
+	Filter string // Filter-spec of a partial clone, e.g. blob:none, blob:limit=1m or tree:0.
 }
 
 type DeltaOp struct {
@@ -89,6 +369,125 @@ type DeltaOp struct {
 }
 
 // ///////// Interfaces ///////////
+
+// Authorizer decides whether a session may perform an operation. Return ErrUnauthorized when
+// credentials are missing or wrong, so clients ask for them, and ErrForbidden otherwise.
+type Authorizer interface {
+	Authorize(req *AuthRequest) error
+}
+
+// RefStore keeps the refs of a repo. The built-in stores use loose files with packed-refs, or reftable.
+type RefStore interface {
+	// Get returns a ref without following symbolic refs, nil when it does not exist.
+	Get(name string) (*Ref, error)
+
+	// Iterate calls fn for every ref under refs/ starting with prefix, by name. An error from fn
+	// stops the iteration and is returned.
+	Iterate(prefix string, fn func(ref *Ref) error) error
+
+	// Transaction starts a set of changes applied together.
+	Transaction() (RefTransaction, error)
+}
+
+// ReflogStore is implemented by ref stores that keep reflogs, Repo.Reflog and Repo.ExpireReflog use it.
+type ReflogStore interface {
+	// Reflog returns the entries of a ref, oldest first.
+	Reflog(name string) ([]*ReflogEntry, error)
+
+	// Reflogs returns the names of the refs that have a reflog.
+	Reflogs() ([]string, error)
+
+	// ExpireReflog drops the entries of a ref for which keep returns false.
+	ExpireReflog(name string, keep func(entry *ReflogEntry) bool) error
+}
+
+// RefTransaction queues ref changes until Commit applies all of them or none.
+type RefTransaction interface {
+	// Update points name to newHash if it is at oldHash. An empty oldHash skips the check, ZERO_HASH
+	// requires the ref to not exist. ZERO_HASH as newHash deletes the ref.
+	Update(name, oldHash, newHash string) error
+
+	// SetSymref points the symbolic ref name to target.
+	SetSymref(name, target string) error
+
+	// Commit applies the changes, or returns a *RefConflictError when a ref is not at its old hash.
+	// who and msg describe the change for the reflog of every updated ref.
+	Commit(who *Signature, msg string) error
+
+	// Abort drops the changes.
+	Abort() error
+}
+
+// ObjectStore keeps the objects of a repo. The built-in store reads loose objects and packs from
+// objects/ on the FS, and writes loose objects. Missing objects give errors wrapping ErrObjectNotFound.
+type ObjectStore interface {
+	// Has reports whether the object exists.
+	Has(hash string) (bool, error)
+
+	// Get returns the type and the data of an object.
+	Get(hash string) (uint8, []byte, error)
+
+	// Open returns the type and the size of an object, with a reader streaming its data.
+	Open(hash string) (uint8, int64, io.ReadCloser, error)
+
+	// Stat returns the type and the size of an object.
+	Stat(hash string) (uint8, int64, error)
+
+	// Put stores the data of an object of the given type and returns its hash.
+	Put(typ uint8, data []byte) (string, error)
+
+	// Iterate calls fn with the hash of every object, in no particular order. An error from fn stops
+	// the iteration and is returned.
+	Iterate(fn func(hash string) error) error
+}
+
+// PrefixObjectStore is implemented by object stores that find objects by an abbreviated hash without
+// iterating over all of them. Short hashes in revisions use it, other stores are iterated.
+type PrefixObjectStore interface {
+	// FindPrefix returns the hashes of the objects that start with prefix, lowercase hex of at least
+	// 2 digits, in no particular order.
+	FindPrefix(prefix string) ([]string, error)
+}
+
+// OpenFS is implemented by FS that can stream a file instead of reading it whole. The reader of a
+// file that also implements io.Seeker serves ranges to dumb HTTP clients, one that implements
+// io.ReaderAt has pack objects read at their offsets instead of keeping whole packs in memory.
+type OpenFS interface {
+	Open(path string) (io.ReadCloser, error)
+}
+
+// RenameFS is implemented by FS that can remove and rename files. Refs and the config are then
+// replaced through lock files, on other FS they are written in place and deleted loose refs are kept
+// holding ZERO_HASH. PackRefs, GC and moving objects to a pool fail with ErrNoRename without it.
+type RenameFS interface {
+	// Remove a file or an empty dir.
+	Remove(path string) error
+
+	// Rename a file, replacing the target if it exists.
+	Rename(oldPath, newPath string) error
+}
+
+// CreateFS is implemented by FS that can create a file only when it does not exist, like O_CREATE|O_EXCL.
+// Lock files are then taken like git's: a <file>.lock left by another process, or by git, makes the
+// change fail. On other FS only the changes made by one process exclude each other.
+type CreateFS interface {
+	// Create writes a new file, it fails with an error wrapping fs.ErrExist if the file exists.
+	Create(path string, data []byte) error
+}
+
+// CopyFS is implemented by FS that can copy a file without reading it whole. DedupePool then streams
+// the packs it moves to the pool, other FS copy them through memory.
+type CopyFS interface {
+	// Copy writes the content of from to to, replacing it if it exists.
+	Copy(from, to string) error
+}
+
+// ModTimeFS is implemented by FS that know when files were written. GC only prunes unreachable
+// objects on such a FS, the others are kept.
+type ModTimeFS interface {
+	ModTime(path string) (time.Time, error)
+}
+
 type FS interface {
 	// Read a single file from the FS
 	ReadFile(path string) ([]byte, error)
@@ -12,26 +12,37 @@ func (repo *Repo) applyDelta(base string, reader *bytes.Reader) (uint8, []byte,
 		return 0, nil, err
 	}
 
-	baseSize, err := readSize(reader)
+	data, err := patchDelta(object.Data, reader)
 
 	if err != nil {
 		return 0, nil, err
 	}
 
-	if baseSize != uint64(len(object.Data)) {
-		return 0, nil, fmt.Errorf("base size mismatch: %d != %d", baseSize, len(object.Data))
+	return object.Type, data, nil
+}
+
+// patchDelta rebuilds an object from the data of its base and a delta.
+func patchDelta(base []byte, reader *bytes.Reader) ([]byte, error) {
+	baseSize, err := readSize(reader)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if baseSize != uint64(len(base)) {
+		return nil, fmt.Errorf("base size mismatch: %d != %d", baseSize, len(base))
 	}
 
 	resultSize, err := readSize(reader)
 
 	if err != nil {
-		return 0, nil, err
+		return nil, err
 	}
 
 	ops, err := parseDeltaOps(reader)
 
 	if err != nil {
-		return 0, nil, err
+		return nil, err
 	}
 
 	var buffer bytes.Buffer
@@ -39,19 +50,153 @@ func (repo *Repo) applyDelta(base string, reader *bytes.Reader) (uint8, []byte,
 	for _, op := range ops {
 		// Copy.
 		if op.Copy {
-			buffer.Write(object.Data[op.Offset : op.Offset+op.Size])
+			if op.Offset+op.Size > uint64(len(base)) {
+				return nil, fmt.Errorf("delta copies past the end of its base")
+			}
+
+			buffer.Write(base[op.Offset : op.Offset+op.Size])
 		}
 
 		// Insert.
 		if !op.Copy {
-			// fmt.Println("Insert", string(op.Data))
 			buffer.Write(op.Data)
 		}
 	}
 
 	if buffer.Len() != int(resultSize) {
-		return 0, nil, fmt.Errorf("result size mismatch: %d != %d", buffer.Len(), resultSize)
+		return nil, fmt.Errorf("result size mismatch: %d != %d", buffer.Len(), resultSize)
+	}
+
+	return buffer.Bytes(), nil
+}
+
+// deltaIndex finds the blocks of a base that a delta against it can copy.
+type deltaIndex struct {
+	base   []byte
+	blocks map[uint32][]int // Offsets of the blocks of the base by hash.
+}
+
+const (
+	deltaBlock      = 16       // Shortest copy, bases are indexed every deltaBlock bytes.
+	deltaBucket     = 64       // Offsets kept per hash, repetitive bases would make the search quadratic.
+	deltaMaxCopy    = 0xffffff // Longest copy of one instruction.
+	deltaMaxLiteral = 0x7f
+)
+
+func newDeltaIndex(base []byte) *deltaIndex {
+	index := &deltaIndex{base: base, blocks: map[uint32][]int{}}
+
+	for i := 0; i+deltaBlock <= len(base); i += deltaBlock {
+		h := deltaHash(base[i : i+deltaBlock])
+
+		if len(index.blocks[h]) < deltaBucket {
+			index.blocks[h] = append(index.blocks[h], i)
+		}
+	}
+
+	return index
+}
+
+// delta returns the delta turning the base into target, nil when it would be longer than max.
+func (index *deltaIndex) delta(target []byte, max int) []byte {
+	base := index.base
+	out := appendSize(appendSize(nil, uint64(len(base))), uint64(len(target)))
+	literal := 0 // Start of the bytes not copied yet.
+
+	flush := func(end int) {
+		for literal < end {
+			n := min(end-literal, deltaMaxLiteral)
+			out = append(append(out, byte(n)), target[literal:literal+n]...)
+			literal += n
+		}
+	}
+
+	for i := 0; i+deltaBlock <= len(target) && len(out) <= max; {
+		offset, length := 0, 0
+
+		for _, at := range index.blocks[deltaHash(target[i:i+deltaBlock])] {
+			n := 0
+
+			for at+n < len(base) && i+n < len(target) && base[at+n] == target[i+n] {
+				n++
+			}
+
+			if n > length {
+				offset, length = at, n
+			}
+		}
+
+		if length < deltaBlock {
+			i++
+			continue
+		}
+
+		// The bytes before the block may match too.
+		for offset > 0 && i > literal && base[offset-1] == target[i-1] {
+			offset, i, length = offset-1, i-1, length+1
+		}
+
+		flush(i)
+
+		for length > 0 {
+			n := min(length, deltaMaxCopy)
+			out = appendCopy(out, offset, n)
+			offset, i, length = offset+n, i+n, length-n
+		}
+
+		literal = i
+	}
+
+	flush(len(target))
+
+	if len(out) > max {
+		return nil
+	}
+
+	return out
+}
+
+func deltaHash(block []byte) uint32 {
+	h := uint32(2166136261)
+
+	for _, b := range block {
+		h = (h ^ uint32(b)) * 16777619
+	}
+
+	return h
+}
+
+// appendSize appends a size of a delta header, 7 bits per byte, least significant first.
+func appendSize(out []byte, size uint64) []byte {
+	for size >= 0x80 {
+		out = append(out, byte(size)|0x80)
+		size >>= 7
+	}
+
+	return append(out, byte(size))
+}
+
+// appendCopy appends a copy instruction, only the non-zero bytes of offset and size are written.
+func appendCopy(out []byte, offset, size int) []byte {
+	at := len(out)
+	cmd := byte(0x80)
+	out = append(out, 0)
+
+	for i := 0; i < 4; i++ {
+		if b := byte(offset >> (8 * i)); b != 0 {
+			cmd |= 1 << i
+			out = append(out, b)
+		}
 	}
 
-	return object.Type, buffer.Bytes(), nil
+	for i := 0; i < 3; i++ {
+		if b := byte(size >> (8 * i)); b != 0 {
+			cmd |= 0x10 << i
+			out = append(out, b)
+		}
+	}
+
+	out[at] = cmd
+
+	return out
 }
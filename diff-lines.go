@@ -0,0 +1,603 @@
+package gits
+
+import (
+	"bytes"
+	"strconv"
+	"strings"
+)
+
+// Regions where every line occurs more often than this are handed to Myers, like git's histogram diff.
+const histogramMaxChain = 64
+
+// lineDiff marks the changed lines of a and b, which hold interned line ids.
+type lineDiff struct {
+	a       []int
+	b       []int
+	deleted []bool
+	added   []bool
+}
+
+// diffOp is a run of equal (' '), deleted ('-') or added ('+') lines.
+type diffOp struct {
+	kind byte
+	a    int // Start in a.
+	b    int // Start in b.
+	n    int
+}
+
+// DiffBlobs computes the line diff between two blobs. An empty hash stands for an empty blob.
+func (repo *Repo) DiffBlobs(oldHash, newHash string, opts *DiffOptions) (*Patch, error) {
+	if opts == nil {
+		opts = &DiffOptions{}
+	}
+
+	oldData, err := repo.blobData(oldHash)
+
+	if err != nil {
+		return nil, err
+	}
+
+	newData, err := repo.blobData(newHash)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if isBinary(oldData) || isBinary(newData) {
+		return &Patch{Binary: true, Hunks: []*Hunk{}}, nil
+	}
+
+	oldLines := splitLines(oldData)
+	newLines := splitLines(newData)
+	ops := diffLines(oldLines, newLines, opts.Algorithm)
+	context := ternary(opts.Context == 0, 3, max(opts.Context, 0))
+
+	return &Patch{Hunks: buildHunks(ops, oldLines, newLines, context)}, nil
+}
+
+// diffLines returns the edit script turning a into b.
+func diffLines(a, b []string, algorithm uint8) []diffOp {
+	ids := map[string]int{}
+	intern := func(lines []string) []int {
+		result := make([]int, len(lines))
+
+		for i, line := range lines {
+			id, ok := ids[line]
+
+			if !ok {
+				id = len(ids)
+				ids[line] = id
+			}
+
+			result[i] = id
+		}
+
+		return result
+	}
+
+	d := &lineDiff{
+		a:       intern(a),
+		b:       intern(b),
+		deleted: make([]bool, len(a)),
+		added:   make([]bool, len(b)),
+	}
+
+	if algorithm == DIFF_HISTOGRAM {
+		d.histogram(0, len(a), 0, len(b))
+	} else {
+		d.myers(0, len(a), 0, len(b))
+	}
+
+	compactChanges(d.deleted, d.a, d.added)
+	compactChanges(d.added, d.b, d.deleted)
+
+	return d.ops()
+}
+
+// compactChanges slides each group of changed lines of one side as far down as equal lines allow,
+// then back up to line up with a change of the other side, like git's xdl_change_compact without
+// the indent heuristic. Groups are the runs of changed lines between unchanged ones, possibly
+// empty: both sides have as many.
+func compactChanges(changed []bool, lines []int, other []bool) {
+	type group struct{ start, end int }
+
+	extend := func(changed []bool, g *group) {
+		for g.end < len(changed) && changed[g.end] {
+			g.end++
+		}
+	}
+
+	next := func(changed []bool, g *group) bool {
+		if g.end == len(changed) {
+			return false
+		}
+
+		g.start = g.end + 1
+		g.end = g.start
+		extend(changed, g)
+
+		return true
+	}
+
+	previous := func(changed []bool, g *group) bool {
+		if g.start == 0 {
+			return false
+		}
+
+		g.end = g.start - 1
+
+		for g.start = g.end; g.start > 0 && changed[g.start-1]; g.start-- {
+		}
+
+		return true
+	}
+
+	slideDown := func(g *group) bool {
+		if g.end == len(changed) || lines[g.start] != lines[g.end] {
+			return false
+		}
+
+		changed[g.start], changed[g.end] = false, true
+		g.start++
+		g.end++
+		extend(changed, g)
+
+		return true
+	}
+
+	slideUp := func(g *group) bool {
+		if g.start == 0 || lines[g.start-1] != lines[g.end-1] {
+			return false
+		}
+
+		g.start--
+		g.end--
+		changed[g.start], changed[g.end] = true, false
+
+		for g.start > 0 && changed[g.start-1] {
+			g.start--
+		}
+
+		return true
+	}
+
+	g, o := &group{}, &group{}
+	extend(changed, g)
+	extend(other, o)
+
+	for {
+		if g.end > g.start {
+			size := -1
+			earliestEnd, matchingEnd := 0, -1
+
+			// Sliding merges groups, until the size settles.
+			for size != g.end-g.start {
+				size = g.end - g.start
+				matchingEnd = -1
+
+				for slideUp(g) {
+					previous(other, o)
+				}
+
+				earliestEnd = g.end
+
+				if o.end > o.start {
+					matchingEnd = g.end
+				}
+
+				for slideDown(g) {
+					next(other, o)
+
+					if o.end > o.start {
+						matchingEnd = g.end
+					}
+				}
+			}
+
+			if g.end != earliestEnd && matchingEnd != -1 {
+				for o.end == o.start {
+					slideUp(g)
+					previous(other, o)
+				}
+			}
+		}
+
+		if !next(changed, g) {
+			return
+		}
+
+		next(other, o)
+	}
+}
+
+// myers diffs a[aLo:aHi] against b[bLo:bHi] using the linear space variant of Myers' algorithm.
+func (d *lineDiff) myers(aLo, aHi, bLo, bHi int) {
+	aLo, aHi, bLo, bHi = d.trim(aLo, aHi, bLo, bHi)
+
+	if aLo == aHi || bLo == bHi {
+		d.mark(aLo, aHi, bLo, bHi)
+		return
+	}
+
+	x, y, ok := d.middleSnake(aLo, aHi, bLo, bHi)
+
+	if !ok {
+		d.mark(aLo, aHi, bLo, bHi)
+		return
+	}
+
+	d.myers(aLo, x, bLo, y)
+	d.myers(x, aHi, y, bHi)
+}
+
+// middleSnake runs the forward and backward searches until they overlap and returns the split point.
+func (d *lineDiff) middleSnake(aLo, aHi, bLo, bHi int) (int, int, bool) {
+	n, m := aHi-aLo, bHi-bLo
+	maxD := (n + m + 1) / 2
+	offset := maxD
+	forward := make([]int, 2*maxD+2)
+	backward := make([]int, 2*maxD+2)
+
+	for i := range forward {
+		forward[i], backward[i] = -1, -1
+	}
+
+	forward[offset+1], backward[offset+1] = 0, 0
+	delta := n - m
+	odd := delta%2 != 0
+	k1start, k1end, k2start, k2end := 0, 0, 0, 0
+
+	for step := 0; step < maxD; step++ {
+		for k1 := -step + k1start; k1 <= step-k1end; k1 += 2 {
+			idx := offset + k1
+			var x1 int
+
+			if k1 == -step || (k1 != step && forward[idx-1] < forward[idx+1]) {
+				x1 = forward[idx+1]
+			} else {
+				x1 = forward[idx-1] + 1
+			}
+
+			y1 := x1 - k1
+
+			for x1 < n && y1 < m && d.a[aLo+x1] == d.b[bLo+y1] {
+				x1++
+				y1++
+			}
+
+			forward[idx] = x1
+
+			switch {
+			case x1 > n:
+				k1end += 2
+			case y1 > m:
+				k1start += 2
+			case odd:
+				idx2 := offset + delta - k1
+
+				if idx2 >= 0 && idx2 < len(backward) && backward[idx2] != -1 && x1 >= n-backward[idx2] {
+					return aLo + x1, bLo + y1, true
+				}
+			}
+		}
+
+		for k2 := -step + k2start; k2 <= step-k2end; k2 += 2 {
+			idx := offset + k2
+			var x2 int
+
+			if k2 == -step || (k2 != step && backward[idx-1] < backward[idx+1]) {
+				x2 = backward[idx+1]
+			} else {
+				x2 = backward[idx-1] + 1
+			}
+
+			y2 := x2 - k2
+
+			for x2 < n && y2 < m && d.a[aHi-x2-1] == d.b[bHi-y2-1] {
+				x2++
+				y2++
+			}
+
+			backward[idx] = x2
+
+			switch {
+			case x2 > n:
+				k2end += 2
+			case y2 > m:
+				k2start += 2
+			case !odd:
+				idx1 := offset + delta - k2
+
+				if idx1 >= 0 && idx1 < len(forward) && forward[idx1] != -1 {
+					x1 := forward[idx1]
+					y1 := offset + x1 - idx1
+
+					if x1 >= n-x2 {
+						return aLo + x1, bLo + y1, true
+					}
+				}
+			}
+		}
+	}
+
+	return 0, 0, false
+}
+
+// histogram diffs a[aLo:aHi] against b[bLo:bHi] by anchoring on the longest common
+// region built around the least frequent lines, then recursing on both sides.
+func (d *lineDiff) histogram(aLo, aHi, bLo, bHi int) {
+	aLo, aHi, bLo, bHi = d.trim(aLo, aHi, bLo, bHi)
+
+	if aLo == aHi || bLo == bHi {
+		d.mark(aLo, aHi, bLo, bHi)
+		return
+	}
+
+	counts := map[int]int{}
+	positions := map[int][]int{}
+
+	for i := aLo; i < aHi; i++ {
+		counts[d.a[i]]++
+		positions[d.a[i]] = append(positions[d.a[i]], i)
+	}
+
+	bestA, bestB, bestLen := 0, 0, 0
+	bestCount := histogramMaxChain + 1
+
+	for j := bLo; j < bHi; {
+		count := counts[d.b[j]]
+		next := j + 1
+
+		if count == 0 || count > bestCount {
+			j = next
+			continue
+		}
+
+		for _, i := range positions[d.b[j]] {
+			as, bs, ae, be := i, j, i+1, j+1
+
+			for as > aLo && bs > bLo && d.a[as-1] == d.b[bs-1] {
+				as--
+				bs--
+			}
+
+			for ae < aHi && be < bHi && d.a[ae] == d.b[be] {
+				ae++
+				be++
+			}
+
+			regionCount := count
+
+			for k := as; k < ae; k++ {
+				regionCount = min(regionCount, counts[d.a[k]])
+			}
+
+			if regionCount < bestCount || (regionCount == bestCount && ae-as > bestLen) {
+				bestA, bestB, bestLen, bestCount = as, bs, ae-as, regionCount
+			}
+
+			next = max(next, be)
+		}
+
+		j = next
+	}
+
+	if bestLen == 0 {
+		d.myers(aLo, aHi, bLo, bHi)
+		return
+	}
+
+	d.histogram(aLo, bestA, bLo, bestB)
+	d.histogram(bestA+bestLen, aHi, bestB+bestLen, bHi)
+}
+
+// trim skips the common prefix and suffix of both ranges.
+func (d *lineDiff) trim(aLo, aHi, bLo, bHi int) (int, int, int, int) {
+	for aLo < aHi && bLo < bHi && d.a[aLo] == d.b[bLo] {
+		aLo++
+		bLo++
+	}
+
+	for aLo < aHi && bLo < bHi && d.a[aHi-1] == d.b[bHi-1] {
+		aHi--
+		bHi--
+	}
+
+	return aLo, aHi, bLo, bHi
+}
+
+func (d *lineDiff) mark(aLo, aHi, bLo, bHi int) {
+	for i := aLo; i < aHi; i++ {
+		d.deleted[i] = true
+	}
+
+	for j := bLo; j < bHi; j++ {
+		d.added[j] = true
+	}
+}
+
+// ops converts the marked lines into runs, deletions before additions.
+func (d *lineDiff) ops() []diffOp {
+	ops := []diffOp{}
+	push := func(kind byte, a, b int) {
+		if last := len(ops) - 1; last >= 0 && ops[last].kind == kind {
+			ops[last].n++
+			return
+		}
+
+		ops = append(ops, diffOp{kind: kind, a: a, b: b, n: 1})
+	}
+
+	i, j := 0, 0
+
+	for i < len(d.a) || j < len(d.b) {
+		switch {
+		case i < len(d.a) && d.deleted[i]:
+			push('-', i, j)
+			i++
+		case j < len(d.b) && d.added[j]:
+			push('+', i, j)
+			j++
+		default:
+			push(' ', i, j)
+			i++
+			j++
+		}
+	}
+
+	return ops
+}
+
+// buildHunks groups changes that are at most 2*context lines apart into hunks.
+func buildHunks(ops []diffOp, a, b []string, context int) []*Hunk {
+	hunks := []*Hunk{}
+
+	for i := 0; i < len(ops); {
+		if ops[i].kind == ' ' {
+			i++
+			continue
+		}
+
+		// Extend over changes separated by short runs of equal lines.
+		end := i
+
+		for end+1 < len(ops) {
+			if ops[end+1].kind != ' ' {
+				end++
+				continue
+			}
+
+			if end+2 < len(ops) && ops[end+1].n <= 2*context {
+				end += 2
+				continue
+			}
+
+			break
+		}
+
+		lead := 0
+
+		if i > 0 {
+			lead = min(ops[i-1].n, context)
+		}
+
+		trail := 0
+
+		if end+1 < len(ops) {
+			trail = min(ops[end+1].n, context)
+		}
+
+		hunk := &Hunk{
+			OldStart: ops[i].a - lead,
+			NewStart: ops[i].b - lead,
+			Lines:    []string{},
+		}
+
+		for k := 0; k < lead; k++ {
+			hunk.Lines = append(hunk.Lines, " "+a[hunk.OldStart+k])
+		}
+
+		for _, op := range ops[i : end+1] {
+			for k := 0; k < op.n; k++ {
+				switch op.kind {
+				case ' ', '-':
+					hunk.Lines = append(hunk.Lines, string(op.kind)+a[op.a+k])
+				case '+':
+					hunk.Lines = append(hunk.Lines, "+"+b[op.b+k])
+				}
+			}
+		}
+
+		if trail > 0 {
+			next := ops[end+1]
+
+			for k := 0; k < trail; k++ {
+				hunk.Lines = append(hunk.Lines, " "+a[next.a+k])
+			}
+		}
+
+		for _, line := range hunk.Lines {
+			if line[0] != '+' {
+				hunk.OldLines++
+			}
+
+			if line[0] != '-' {
+				hunk.NewLines++
+			}
+		}
+
+		for k := ops[i].a - lead - 1; k >= 0; k-- {
+			if c := a[k][0]; c == '_' || c == '$' || (c|0x20 >= 'a' && c|0x20 <= 'z') {
+				hunk.Section = strings.TrimRight(a[k], " \t\r\n")
+				hunk.Section = hunk.Section[:min(len(hunk.Section), 80)]
+				break
+			}
+		}
+
+		// Line numbers are 1-based, an empty side points at the line before it.
+		hunk.OldStart += ternary(hunk.OldLines > 0, 1, 0)
+		hunk.NewStart += ternary(hunk.NewLines > 0, 1, 0)
+
+		hunks = append(hunks, hunk)
+		i = end + 1
+	}
+
+	return hunks
+}
+
+// String formats the patch body in unified format.
+func (p *Patch) String() string {
+	var buf strings.Builder
+
+	for _, hunk := range p.Hunks {
+		buf.WriteString("@@ -" + hunkRange(hunk.OldStart, hunk.OldLines) + " +" + hunkRange(hunk.NewStart, hunk.NewLines) + " @@")
+
+		if hunk.Section != "" {
+			buf.WriteString(" " + hunk.Section)
+		}
+
+		buf.WriteString("\n")
+
+		for _, line := range hunk.Lines {
+			buf.WriteString(line)
+
+			if !strings.HasSuffix(line, "\n") {
+				buf.WriteString("\n\\ No newline at end of file\n")
+			}
+		}
+	}
+
+	return buf.String()
+}
+
+func hunkRange(start, lines int) string {
+	if lines == 1 {
+		return strconv.Itoa(start)
+	}
+
+	return strconv.Itoa(start) + "," + strconv.Itoa(lines)
+}
+
+// splitLines splits data after every newline. The last line may lack one.
+func splitLines(data []byte) []string {
+	lines := []string{}
+
+	for len(data) > 0 {
+		idx := bytes.IndexByte(data, '\n')
+
+		if idx == -1 {
+			lines = append(lines, string(data))
+			break
+		}
+
+		lines = append(lines, string(data[:idx+1]))
+		data = data[idx+1:]
+	}
+
+	return lines
+}
+
+// Git treats a blob as binary if it has a NUL byte in the first 8000 bytes.
+func isBinary(data []byte) bool {
+	return bytes.IndexByte(data[:min(len(data), 8000)], 0) != -1
+}
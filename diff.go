@@ -0,0 +1,548 @@
+package gits
+
+import (
+	"bytes"
+	"fmt"
+	"hash/fnv"
+	"sort"
+	"strings"
+)
+
+// Git does not look for inexact renames when there are more candidates than this on either side.
+const renameLimit = 1000
+
+// DiffTrees compares two tree-ish revisions. An empty string stands for the empty tree,
+// so the root commit can be diffed with DiffTrees("", tree, opts).
+func (repo *Repo) DiffTrees(oldTree, newTree string, opts *DiffOptions) ([]*Change, error) {
+	if opts == nil {
+		opts = &DiffOptions{}
+	}
+
+	var err error
+
+	for _, rev := range []*string{&oldTree, &newTree} {
+		if *rev == "" {
+			continue
+		}
+
+		if *rev, err = repo.resolveTree(*rev); err != nil {
+			return nil, err
+		}
+	}
+
+	changes := []*Change{}
+
+	if err := repo.diffTree(oldTree, newTree, "", &changes); err != nil {
+		return nil, err
+	}
+
+	if opts.Renames || opts.Copies || opts.FindCopiesHarder {
+		if changes, err = repo.detectRenames(changes, oldTree, opts); err != nil {
+			return nil, err
+		}
+	}
+
+	sort.SliceStable(changes, func(i, j int) bool {
+		return changePath(changes[i]) < changePath(changes[j])
+	})
+
+	return changes, nil
+}
+
+// UnifiedDiff formats changes as a git style patch.
+func (repo *Repo) UnifiedDiff(changes []*Change, opts *DiffOptions) (string, error) {
+	var buf strings.Builder
+
+	for _, change := range changes {
+		oldPath := ternary(change.Type == DIFF_ADD, change.NewPath, change.OldPath)
+		newPath := ternary(change.Type == DIFF_DELETE, change.OldPath, change.NewPath)
+
+		fmt.Fprintf(&buf, "diff --git a/%s b/%s\n", oldPath, newPath)
+
+		switch change.Type {
+		case DIFF_ADD:
+			fmt.Fprintf(&buf, "new file mode %06o\n", change.NewMode)
+		case DIFF_DELETE:
+			fmt.Fprintf(&buf, "deleted file mode %06o\n", change.OldMode)
+		}
+
+		if change.Type != DIFF_ADD && change.Type != DIFF_DELETE && change.OldMode != change.NewMode {
+			fmt.Fprintf(&buf, "old mode %06o\nnew mode %06o\n", change.OldMode, change.NewMode)
+		}
+
+		if change.Type == DIFF_RENAME || change.Type == DIFF_COPY {
+			verb := ternary(change.Type == DIFF_RENAME, "rename", "copy")
+			fmt.Fprintf(&buf, "similarity index %d%%\n%s from %s\n%s to %s\n", change.Similarity, verb, change.OldPath, verb, change.NewPath)
+		}
+
+		if change.OldHash == change.NewHash {
+			continue
+		}
+
+		fmt.Fprintf(&buf, "index %s..%s", shortHash(change.OldHash), shortHash(change.NewHash))
+
+		if change.OldMode == change.NewMode {
+			fmt.Fprintf(&buf, " %06o", change.NewMode)
+		}
+
+		buf.WriteString("\n")
+
+		// Submodules are shown by commit only.
+		if change.OldMode == MODE_GITLINK || change.NewMode == MODE_GITLINK {
+			fmt.Fprintf(&buf, "-Subproject commit %s\n+Subproject commit %s\n", change.OldHash, change.NewHash)
+			continue
+		}
+
+		patch, err := repo.DiffBlobs(change.OldHash, change.NewHash, opts)
+
+		if err != nil {
+			return "", err
+		}
+
+		oldName := ternary(change.Type == DIFF_ADD, "/dev/null", "a/"+oldPath)
+		newName := ternary(change.Type == DIFF_DELETE, "/dev/null", "b/"+newPath)
+
+		if patch.Binary {
+			fmt.Fprintf(&buf, "Binary files %s and %s differ\n", oldName, newName)
+			continue
+		}
+
+		fmt.Fprintf(&buf, "--- %s\n+++ %s\n", oldName, newName)
+		buf.WriteString(patch.String())
+	}
+
+	return buf.String(), nil
+}
+
+// diffTree appends the changes between two trees under prefix, recursing into modified subtrees.
+func (repo *Repo) diffTree(oldTree, newTree, prefix string, changes *[]*Change) error {
+	if oldTree == newTree {
+		return nil
+	}
+
+	oldEntries, err := repo.treeEntries(oldTree)
+
+	if err != nil {
+		return err
+	}
+
+	newEntries, err := repo.treeEntries(newTree)
+
+	if err != nil {
+		return err
+	}
+
+	names := []string{}
+
+	for name := range oldEntries {
+		names = append(names, name)
+	}
+
+	for name := range newEntries {
+		if _, ok := oldEntries[name]; !ok {
+			names = append(names, name)
+		}
+	}
+
+	sort.Strings(names)
+
+	for _, name := range names {
+		oldEntry, inOld := oldEntries[name]
+		newEntry, inNew := newEntries[name]
+		path := prefix + name
+		oldIsTree := inOld && oldEntry.Mode == MODE_TREE
+		newIsTree := inNew && newEntry.Mode == MODE_TREE
+
+		if inOld && inNew && oldEntry.Hash == newEntry.Hash && oldEntry.Mode == newEntry.Mode {
+			continue
+		}
+
+		if oldIsTree || newIsTree {
+			// A file replaced by a directory, or the other way around, is a delete and an add.
+			if inOld && !oldIsTree {
+				*changes = append(*changes, &Change{Type: DIFF_DELETE, OldPath: path, OldMode: oldEntry.Mode, OldHash: oldEntry.Hash})
+			}
+
+			if inNew && !newIsTree {
+				*changes = append(*changes, &Change{Type: DIFF_ADD, NewPath: path, NewMode: newEntry.Mode, NewHash: newEntry.Hash})
+			}
+
+			err := repo.diffTree(ternary(oldIsTree, oldEntry.Hash, ""), ternary(newIsTree, newEntry.Hash, ""), path+"/", changes)
+
+			if err != nil {
+				return err
+			}
+
+			continue
+		}
+
+		change := &Change{
+			OldPath: ternary(inOld, path, ""),
+			NewPath: ternary(inNew, path, ""),
+			OldMode: oldEntry.Mode,
+			NewMode: newEntry.Mode,
+			OldHash: oldEntry.Hash,
+			NewHash: newEntry.Hash,
+		}
+
+		switch {
+		case !inOld:
+			change.Type = DIFF_ADD
+		case !inNew:
+			change.Type = DIFF_DELETE
+		default:
+			change.Type = DIFF_MODIFY
+		}
+
+		*changes = append(*changes, change)
+	}
+
+	return nil
+}
+
+// detectRenames pairs deleted files with added files, and finds the sources of copied files.
+func (repo *Repo) detectRenames(changes []*Change, oldTree string, opts *DiffOptions) ([]*Change, error) {
+	threshold := ternary(opts.Similarity == 0, 50, opts.Similarity)
+	deleted := []*Change{}
+	added := []*Change{}
+	result := []*Change{}
+
+	for _, change := range changes {
+		switch {
+		case change.Type == DIFF_DELETE && opts.Renames && change.OldMode != MODE_GITLINK:
+			deleted = append(deleted, change)
+		case change.Type == DIFF_ADD && change.NewMode != MODE_GITLINK:
+			added = append(added, change)
+		default:
+			result = append(result, change)
+		}
+	}
+
+	paired := map[*Change]*Change{} // added -> source
+	used := map[*Change]bool{}      // deleted files already renamed
+
+	// Exact renames first, preferring sources with the same file name.
+	byHash := map[string][]*Change{}
+
+	for _, del := range deleted {
+		byHash[del.OldHash] = append(byHash[del.OldHash], del)
+	}
+
+	for _, add := range added {
+		candidates := byHash[add.NewHash]
+		var best *Change
+
+		for _, del := range candidates {
+			if used[del] {
+				continue
+			}
+
+			if best == nil || baseName(del.OldPath) == baseName(add.NewPath) && baseName(best.OldPath) != baseName(add.NewPath) {
+				best = del
+			}
+		}
+
+		if best != nil {
+			used[best] = true
+			paired[add] = &Change{Type: DIFF_RENAME, Similarity: 100, OldPath: best.OldPath, OldMode: best.OldMode, OldHash: best.OldHash}
+		}
+	}
+
+	// Inexact renames, best scores first.
+	sources := []*Change{}
+
+	for _, del := range deleted {
+		if !used[del] {
+			sources = append(sources, del)
+		}
+	}
+
+	targets := []*Change{}
+
+	for _, add := range added {
+		if paired[add] == nil {
+			targets = append(targets, add)
+		}
+	}
+
+	if len(sources) > 0 && len(targets) > 0 && len(sources) <= renameLimit && len(targets) <= renameLimit {
+		type match struct {
+			del, add *Change
+			score    int
+		}
+
+		matches := []match{}
+		sigs := map[string]*blobSignature{}
+
+		for _, add := range targets {
+			for _, del := range sources {
+				score, err := repo.similarity(del.OldHash, add.NewHash, sigs)
+
+				if err != nil {
+					return nil, err
+				}
+
+				if score >= threshold {
+					matches = append(matches, match{del, add, score})
+				}
+			}
+		}
+
+		sort.SliceStable(matches, func(i, j int) bool {
+			return matches[i].score > matches[j].score
+		})
+
+		for _, m := range matches {
+			if used[m.del] || paired[m.add] != nil {
+				continue
+			}
+
+			used[m.del] = true
+			paired[m.add] = &Change{Type: DIFF_RENAME, Similarity: m.score, OldPath: m.del.OldPath, OldMode: m.del.OldMode, OldHash: m.del.OldHash}
+		}
+	}
+
+	// Copies come from modified files, or every file of the old tree when searching harder.
+	if opts.Copies || opts.FindCopiesHarder {
+		copySources := []*Change{}
+
+		for _, change := range changes {
+			if change.Type == DIFF_MODIFY || (change.Type == DIFF_DELETE && opts.Renames) {
+				copySources = append(copySources, &Change{OldPath: change.OldPath, OldMode: change.OldMode, OldHash: change.OldHash})
+			}
+		}
+
+		if opts.FindCopiesHarder && oldTree != "" {
+			all, err := repo.listFiles(oldTree, "")
+
+			if err != nil {
+				return nil, err
+			}
+
+			copySources = all
+		}
+
+		sigs := map[string]*blobSignature{}
+
+		for _, add := range added {
+			if paired[add] != nil || len(copySources) > renameLimit {
+				continue
+			}
+
+			var best *Change
+			bestScore := threshold - 1
+
+			for _, src := range copySources {
+				score, err := repo.similarity(src.OldHash, add.NewHash, sigs)
+
+				if err != nil {
+					return nil, err
+				}
+
+				if score > bestScore {
+					best, bestScore = src, score
+				}
+			}
+
+			if best != nil {
+				paired[add] = &Change{Type: DIFF_COPY, Similarity: bestScore, OldPath: best.OldPath, OldMode: best.OldMode, OldHash: best.OldHash}
+			}
+		}
+	}
+
+	for _, del := range deleted {
+		if !used[del] {
+			result = append(result, del)
+		}
+	}
+
+	for _, add := range added {
+		source := paired[add]
+
+		if source == nil {
+			result = append(result, add)
+			continue
+		}
+
+		source.NewPath, source.NewMode, source.NewHash = add.NewPath, add.NewMode, add.NewHash
+		result = append(result, source)
+	}
+
+	return result, nil
+}
+
+// blobSignature counts the bytes of each chunk of a blob, for similarity scoring.
+type blobSignature struct {
+	size   int
+	chunks map[uint32]int
+}
+
+// similarity estimates how much of the content of two blobs is shared, as a percentage of the larger one.
+// Like git, content is split into lines of at most 64 bytes which are compared by hash.
+func (repo *Repo) similarity(a, b string, cache map[string]*blobSignature) (int, error) {
+	if a == b {
+		return 100, nil
+	}
+
+	sigA, err := repo.blobSignature(a, cache)
+
+	if err != nil {
+		return 0, err
+	}
+
+	sigB, err := repo.blobSignature(b, cache)
+
+	if err != nil {
+		return 0, err
+	}
+
+	larger := max(sigA.size, sigB.size)
+
+	if larger == 0 {
+		return 100, nil
+	}
+
+	common := 0
+
+	for chunk, count := range sigA.chunks {
+		common += min(count, sigB.chunks[chunk])
+	}
+
+	return common * 100 / larger, nil
+}
+
+func (repo *Repo) blobSignature(hash string, cache map[string]*blobSignature) (*blobSignature, error) {
+	if sig, ok := cache[hash]; ok {
+		return sig, nil
+	}
+
+	data, err := repo.blobData(hash)
+
+	if err != nil {
+		return nil, err
+	}
+
+	sig := &blobSignature{size: len(data), chunks: map[uint32]int{}}
+
+	for len(data) > 0 {
+		end := bytes.IndexByte(data, '\n') + 1
+
+		if end == 0 || end > 64 {
+			end = min(len(data), 64)
+		}
+
+		h := fnv.New32a()
+		h.Write(data[:end])
+		sig.chunks[h.Sum32()] += end
+		data = data[end:]
+	}
+
+	cache[hash] = sig
+
+	return sig, nil
+}
+
+// listFiles returns every non-tree entry under a tree as a copy source.
+func (repo *Repo) listFiles(tree, prefix string) ([]*Change, error) {
+	entries, err := repo.treeEntries(tree)
+
+	if err != nil {
+		return nil, err
+	}
+
+	files := []*Change{}
+
+	for name, entry := range entries {
+		if entry.Mode == MODE_TREE {
+			sub, err := repo.listFiles(entry.Hash, prefix+name+"/")
+
+			if err != nil {
+				return nil, err
+			}
+
+			files = append(files, sub...)
+			continue
+		}
+
+		if entry.Mode != MODE_GITLINK {
+			files = append(files, &Change{OldPath: prefix + name, OldMode: entry.Mode, OldHash: entry.Hash})
+		}
+	}
+
+	return files, nil
+}
+
+// treeEntries returns the entries of a tree by name. An empty hash is the empty tree.
+func (repo *Repo) treeEntries(hash string) (map[string]TreeEntry, error) {
+	result := map[string]TreeEntry{}
+
+	if hash == "" {
+		return result, nil
+	}
+
+	object, err := repo.Object(hash)
+
+	if err != nil {
+		return nil, err
+	}
+
+	entries, err := object.Entries()
+
+	if err != nil {
+		return nil, err
+	}
+
+	for _, entry := range entries {
+		result[entry.Name] = entry
+	}
+
+	return result, nil
+}
+
+// blobData returns the content of a blob. An empty hash is the empty blob.
+func (repo *Repo) blobData(hash string) ([]byte, error) {
+	if hash == "" {
+		return []byte{}, nil
+	}
+
+	object, err := repo.Object(hash)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if object.Type != OBJ_BLOB {
+		return nil, fmt.Errorf("object %s is not a blob", hash)
+	}
+
+	return object.Data, nil
+}
+
+func changePath(change *Change) string {
+	return ternary(change.NewPath == "", change.OldPath, change.NewPath)
+}
+
+func baseName(path string) string {
+	return path[strings.LastIndexByte(path, '/')+1:]
+}
+
+func shortHash(hash string) string {
+	if hash == "" {
+		return strings.Repeat("0", 7)
+	}
+
+	return hash[:7]
+}
+
+func (c *Change) String() string {
+	status := map[uint8]string{DIFF_ADD: "A", DIFF_MODIFY: "M", DIFF_DELETE: "D", DIFF_RENAME: "R", DIFF_COPY: "C"}[c.Type]
+
+	switch c.Type {
+	case DIFF_RENAME, DIFF_COPY:
+		return status + fmt.Sprintf("%03d", c.Similarity) + "\t" + c.OldPath + "\t" + c.NewPath
+	case DIFF_DELETE:
+		return status + "\t" + c.OldPath
+	}
+
+	return status + "\t" + c.NewPath
+}
@@ -0,0 +1,99 @@
+package gits
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func TestUnifiedDiffMatchesGit(t *testing.T) {
+	repo := newTestRepo(t, nil)
+
+	lines := func(from, to int, format string) string {
+		var buf strings.Builder
+
+		for i := from; i <= to; i++ {
+			fmt.Fprintf(&buf, format+"\n", i)
+		}
+
+		return buf.String()
+	}
+
+	code := "package main\n\nimport \"fmt\"\n\nfunc main() {\n\tfmt.Println(1)\n\tfmt.Println(2)\n\tfmt.Println(3)\n}\n\nfunc other() {\n\treturn\n}\n"
+	moved := "{\n\ta()\n}\n\n{\n\tb()\n}\n\n{\n\tc()\n}\n"
+
+	tests := []struct {
+		name string
+		old  map[string]string
+		new  map[string]string
+		opts DiffOptions
+		args []string
+	}{
+		{"one line", map[string]string{"f": lines(1, 20, "line %d")}, map[string]string{"f": strings.Replace(lines(1, 20, "line %d"), "line 10\n", "ten\n", 1)}, DiffOptions{}, nil},
+		{"separate hunks", map[string]string{"f": lines(1, 40, "line %d")}, map[string]string{"f": strings.NewReplacer("line 5\n", "five\n", "line 30\n", "thirty\n").Replace(lines(1, 40, "line %d"))}, DiffOptions{}, nil},
+		{"merged hunks", map[string]string{"f": lines(1, 40, "line %d")}, map[string]string{"f": strings.NewReplacer("line 10\n", "ten\n", "line 16\n", "sixteen\n").Replace(lines(1, 40, "line %d"))}, DiffOptions{}, nil},
+		{"hunks 7 lines apart", map[string]string{"f": lines(1, 40, "line %d")}, map[string]string{"f": strings.NewReplacer("line 10\n", "ten\n", "line 18\n", "eighteen\n").Replace(lines(1, 40, "line %d"))}, DiffOptions{}, nil},
+		{"insert at the start", map[string]string{"f": lines(1, 10, "line %d")}, map[string]string{"f": "first\n" + lines(1, 10, "line %d")}, DiffOptions{}, nil},
+		{"append at the end", map[string]string{"f": lines(1, 10, "line %d")}, map[string]string{"f": lines(1, 10, "line %d") + "last\n"}, DiffOptions{}, nil},
+		{"no newline at the end", map[string]string{"f": lines(1, 5, "line %d")}, map[string]string{"f": strings.TrimSuffix(lines(1, 5, "line %d"), "\n")}, DiffOptions{}, nil},
+		{"emptied", map[string]string{"f": lines(1, 5, "line %d")}, map[string]string{"f": ""}, DiffOptions{}, nil},
+		{"added and deleted files", map[string]string{"gone": "a\nb\n"}, map[string]string{"new": "c\n"}, DiffOptions{}, nil},
+		{"section header", map[string]string{"main.go": code}, map[string]string{"main.go": strings.Replace(code, "\treturn\n", "\treturn // done\n", 1)}, DiffOptions{}, nil},
+		{"no context", map[string]string{"f": lines(1, 20, "line %d")}, map[string]string{"f": strings.NewReplacer("line 3\n", "three\n", "line 5\n", "").Replace(lines(1, 20, "line %d"))}, DiffOptions{Context: -1}, []string{"-U0"}},
+		{"one line of context", map[string]string{"f": lines(1, 20, "line %d")}, map[string]string{"f": strings.NewReplacer("line 3\n", "three\n", "line 6\n", "six\n").Replace(lines(1, 20, "line %d"))}, DiffOptions{Context: 1}, []string{"-U1"}},
+		{"myers moved block", map[string]string{"f": moved}, map[string]string{"f": "{\n\tc()\n}\n\n" + strings.TrimSuffix(moved, "\n{\n\tc()\n}\n")}, DiffOptions{}, nil},
+		{"histogram moved block", map[string]string{"f": moved}, map[string]string{"f": "{\n\tc()\n}\n\n" + strings.TrimSuffix(moved, "\n{\n\tc()\n}\n")}, DiffOptions{Algorithm: DIFF_HISTOGRAM}, []string{"--histogram"}},
+		{"histogram replaced lines", map[string]string{"f": lines(1, 30, "%d")}, map[string]string{"f": strings.NewReplacer("4\n", "x\n", "12\n", "4\n", "20\n", "").Replace(lines(1, 30, "%d"))}, DiffOptions{Algorithm: DIFF_HISTOGRAM}, []string{"--histogram"}},
+		{"binary", map[string]string{"bin": "a\x00b"}, map[string]string{"bin": "a\x00c"}, DiffOptions{}, nil},
+		{"rename", map[string]string{"old": lines(1, 20, "line %d")}, map[string]string{"new": strings.Replace(lines(1, 20, "line %d"), "line 7\n", "seven\n", 1)}, DiffOptions{Renames: true}, []string{"-M"}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			oldTree := writeFlatTree(t, repo, test.old)
+			newTree := writeFlatTree(t, repo, test.new)
+
+			changes, err := repo.DiffTrees(oldTree, newTree, &test.opts)
+
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			got, err := repo.UnifiedDiff(changes, &test.opts)
+
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			args := append([]string{"diff", "--no-color", "--no-indent-heuristic", "--no-ext-diff"}, test.args...)
+			want := runGit(t, repoPath(repo), append(args, oldTree, newTree)...)
+
+			if got != want {
+				t.Fatalf("diff:\n%s\nwant:\n%s", got, want)
+			}
+		})
+	}
+}
+
+// writeFlatTree stores the files as a tree without subdirectories.
+func writeFlatTree(t *testing.T, repo *Repo, files map[string]string) string {
+	entries := []TreeEntry{}
+
+	for name, content := range files {
+		blob, err := repo.WriteBlob([]byte(content))
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		entries = append(entries, TreeEntry{Mode: MODE_FILE, Name: name, Hash: blob})
+	}
+
+	tree, err := repo.WriteTree(entries)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return tree
+}
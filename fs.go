@@ -2,9 +2,11 @@ package gits
 
 import (
 	"errors"
+	"io"
 	"os"
 	"path/filepath"
 	"strings"
+	"time"
 )
 
 type DiskFS struct {
@@ -38,6 +40,66 @@ func (d *DiskFS) WriteFile(path string, data []byte) error {
 	return os.WriteFile(full, data, 0644)
 }
 
+func (d *DiskFS) Create(path string, data []byte) error {
+	full := d.abs(path)
+
+	if err := os.MkdirAll(filepath.Dir(full), 0755); err != nil {
+		return err
+	}
+
+	f, err := os.OpenFile(full, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+
+	if err != nil {
+		return err
+	}
+
+	if _, err = f.Write(data); err == nil {
+		err = f.Close()
+	} else {
+		f.Close()
+	}
+
+	if err != nil {
+		os.Remove(full)
+	}
+
+	return err
+}
+
+func (d *DiskFS) Copy(from, to string) error {
+	src, err := os.Open(d.abs(from))
+
+	if err != nil {
+		return err
+	}
+
+	defer src.Close()
+
+	full := d.abs(to)
+
+	if err := os.MkdirAll(filepath.Dir(full), 0755); err != nil {
+		return err
+	}
+
+	dst, err := os.Create(full)
+
+	if err != nil {
+		return err
+	}
+
+	if _, err = io.Copy(dst, src); err == nil {
+		err = dst.Close()
+	} else {
+		dst.Close()
+	}
+
+	if err != nil {
+		os.Remove(full)
+	}
+
+	return err
+}
+
 func (d *DiskFS) Scan(path string, include uint8, level int) (map[string][]int, error) {
 	result := make(map[string][]int)
 
@@ -116,10 +178,38 @@ func (d *DiskFS) Stat(path string) []int {
 	return []int{1, int(info.Size())}
 }
 
+func (d *DiskFS) Open(path string) (io.ReadCloser, error) {
+	return os.Open(d.abs(path))
+}
+
+func (d *DiskFS) ModTime(path string) (time.Time, error) {
+	info, err := os.Stat(d.abs(path))
+
+	if err != nil {
+		return time.Time{}, err
+	}
+
+	return info.ModTime(), nil
+}
+
 func (d *DiskFS) Mkdir(path string) error {
 	return os.MkdirAll(d.abs(path), 0755)
 }
 
+func (d *DiskFS) Remove(path string) error {
+	return os.Remove(d.abs(path))
+}
+
+func (d *DiskFS) Rename(oldPath, newPath string) error {
+	full := d.abs(newPath)
+
+	if err := os.MkdirAll(filepath.Dir(full), 0755); err != nil {
+		return err
+	}
+
+	return os.Rename(d.abs(oldPath), full)
+}
+
 func (d *DiskFS) Cd(path string) error {
 	if strings.HasPrefix(path, "/") {
 		d.dir = path
@@ -0,0 +1,617 @@
+package gits
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Object locks are shared by every Repo opened on the same directory in this process. Writers that
+// point refs to the objects they wrote hold it shared until then, GC holds it alone. Other processes,
+// git included, do not see them.
+var objectLocks sync.Map
+
+// gcObject is a reachable object.
+type gcObject struct {
+	hash string
+	typ  uint8
+	size int64
+	name string // Name of the tree entry it was reached through, objects of the same name make good deltas.
+}
+
+// gcEntry is an object written to the new pack.
+type gcEntry struct {
+	hash   string
+	typ    uint8
+	offset uint64
+	crc    uint32
+	depth  int         // Deltas between the object and its full base.
+	data   []byte      // Kept while the object can be a delta base.
+	index  *deltaIndex // Built the first time it is tried as a base.
+}
+
+// GC cleans up the objects of the repo like git gc. The objects reachable from refs and reflogs,
+// and from the ones of the pool members and forks borrowing objects from the repo, are repacked into
+// a single pack with deltas. Objects found in alternates are left out. Unreachable objects are
+// removed once written before opts.PruneExpire, the ones of a pack still in that grace period are
+// kept as loose objects. On an FS without ModTimeFS they are all kept.
+//
+// Pushes and CommitFiles of the same process wait for GC to finish, fetches go on: objects of the
+// removed packs are found in the new one. The lock is held in memory, a push served by another
+// process, or by git, races with GC as it does with git gc: only the grace period keeps the objects
+// it relies on. Keep opts.PruneExpire well in the past when other processes write to the repo.
+func (repo *Repo) GC(opts *GCOptions) error {
+	repo = repo.physical()
+	store, ok := repo.objects.(*filesObjects)
+
+	if !ok {
+		return errors.New("gc needs the built-in object store")
+	}
+
+	if _, ok := repo.fs.(RenameFS); !ok {
+		return fmt.Errorf("gc: %w", ErrNoRename)
+	}
+
+	if opts == nil {
+		opts = &GCOptions{}
+	}
+
+	expire := ternary(opts.PruneExpire.IsZero(), time.Now().AddDate(0, 0, -14), opts.PruneExpire)
+	window := ternary(opts.Window > 0, opts.Window, 10)
+	depth := ternary(opts.Depth > 0, opts.Depth, 50)
+	repos, err := repo.gcRepos()
+
+	if err != nil {
+		return err
+	}
+
+	unlock := lockAllObjects(repos)
+	defer unlock()
+
+	reachable := map[string]*gcObject{}
+
+	for _, r := range repos {
+		if err := r.walkReachable(reachable); err != nil {
+			return err
+		}
+	}
+
+	loose, err := store.looseObjects()
+
+	if err != nil {
+		return err
+	}
+
+	packs, err := store.scanPacks()
+
+	if err != nil {
+		return err
+	}
+
+	local := map[string]bool{}
+
+	for _, hash := range loose {
+		local[hash] = true
+	}
+
+	for _, pack := range packs {
+		for i := 0; i < pack.count(); i++ {
+			local[pack.hash(i)] = true
+		}
+	}
+
+	borrowed := map[string]bool{}
+	alternates, err := store.readAlternates()
+
+	if err != nil {
+		return err
+	}
+
+	for _, alt := range alternates {
+		err := alt.Iterate(func(hash string) error {
+			borrowed[hash] = true
+			return nil
+		})
+
+		if err != nil {
+			return err
+		}
+	}
+
+	objects := []*gcObject{}
+
+	for hash, object := range reachable {
+		if local[hash] && !borrowed[hash] {
+			objects = append(objects, object)
+		}
+	}
+
+	path, err := repo.writeGCPack(store, objects, window, depth)
+
+	if err != nil {
+		return err
+	}
+
+	isLoose := map[string]bool{}
+
+	for _, hash := range loose {
+		isLoose[hash] = true
+	}
+
+	// Unreachable objects of packs in their grace period live on as loose objects.
+	for _, pack := range packs {
+		if pack.path == path || repo.expired(pack.path+".pack", expire) {
+			continue
+		}
+
+		for i := 0; i < pack.count(); i++ {
+			hash := pack.hash(i)
+
+			if reachable[hash] != nil || borrowed[hash] || isLoose[hash] {
+				continue
+			}
+
+			typ, data, err := pack.object(store, pack.offsets[i])
+
+			if err != nil {
+				return err
+			}
+
+			if err := store.writeLoose(hash, typ, data); err != nil {
+				return err
+			}
+
+			isLoose[hash] = true
+		}
+	}
+
+	for _, pack := range packs {
+		if pack.path != path {
+			if err := store.removePack(pack); err != nil {
+				return err
+			}
+		}
+	}
+
+	dirs := map[string]bool{}
+
+	for _, hash := range loose {
+		file := store.loosePath(hash)
+
+		if reachable[hash] == nil && !borrowed[hash] && !repo.expired(file, expire) {
+			continue
+		}
+
+		if err := removeFile(repo.fs, file); err != nil {
+			return err
+		}
+
+		dirs[store.dir+"/"+hash[:2]] = true
+	}
+
+	// Like git prune, the fan-out directories left empty go too.
+	for dir := range dirs {
+		if files, err := repo.fs.Scan(dir, FS_TYPE_FILE|FS_TYPE_DIR, 0); err == nil && len(files) == 0 {
+			removeFile(repo.fs, dir)
+		}
+	}
+
+	if _, err := store.scanPacks(); err != nil {
+		return err
+	}
+
+	// objects/info/packs lists the new pack.
+	return repo.UpdateServerInfo()
+}
+
+// lockObjects takes the object lock of the repo, alone or shared, and returns its unlock. It only
+// excludes callers in this process.
+func (repo *Repo) lockObjects(exclusive bool) func() {
+	key := repo.conf.Dir + "\x00" + repo.conf.Name
+	mu, _ := objectLocks.LoadOrStore(key, &sync.RWMutex{})
+	lock := mu.(*sync.RWMutex)
+
+	if exclusive {
+		lock.Lock()
+		return lock.Unlock
+	}
+
+	lock.RLock()
+
+	return lock.RUnlock
+}
+
+// lockAllObjects takes the object locks of the repos alone and returns the unlock of all. They are
+// taken by name, callers locking some of the same repos cannot deadlock.
+func lockAllObjects(repos []*Repo) func() {
+	sorted := append([]*Repo{}, repos...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i].conf.Name < sorted[j].conf.Name })
+
+	unlocks := []func(){}
+
+	for _, repo := range sorted {
+		unlocks = append(unlocks, repo.lockObjects(true))
+	}
+
+	return func() {
+		for i := len(unlocks) - 1; i >= 0; i-- {
+			unlocks[i]()
+		}
+	}
+}
+
+// gcRepos returns repo, then the pool members and forks borrowing its objects. Deleted ones are skipped.
+func (repo *Repo) gcRepos() ([]*Repo, error) {
+	config, err := repo.Config()
+
+	if err != nil {
+		return nil, err
+	}
+
+	names := append(config.GetAll("pool.member"), config.GetAll("gits.borrower")...)
+	repos := []*Repo{repo}
+	seen := map[string]bool{repo.conf.Name: true}
+
+	for _, name := range names {
+		if seen[name] {
+			continue
+		}
+
+		seen[name] = true
+		other, err := repo.sibling(name)
+
+		if err != nil {
+			return nil, err
+		}
+
+		if other.fs.Stat(other.absPath(""))[0] == 2 {
+			repos = append(repos, other)
+		}
+	}
+
+	return repos, nil
+}
+
+// walkReachable adds the objects reachable from the refs and reflogs of every namespace to
+// reachable. Objects of reflog entries that are already gone are skipped.
+func (repo *Repo) walkReachable(reachable map[string]*gcObject) error {
+	physical := repo.physical()
+	refs, err := physical.listRefs()
+
+	if err != nil {
+		return err
+	}
+
+	stack := []*gcObject{}
+
+	for _, hash := range refs {
+		stack = append(stack, &gcObject{hash: hash})
+	}
+
+	// A detached HEAD.
+	head, err := physical.refs.Get("HEAD")
+
+	if err != nil {
+		return err
+	}
+
+	if head != nil && head.Target == "" && isHash(head.Hash) && head.Hash != ZERO_HASH {
+		stack = append(stack, &gcObject{hash: head.Hash})
+	}
+
+	if store, ok := physical.refs.(ReflogStore); ok {
+		names, err := store.Reflogs()
+
+		if err != nil {
+			return err
+		}
+
+		for _, name := range names {
+			entries, err := store.Reflog(name)
+
+			if err != nil {
+				return err
+			}
+
+			for _, entry := range entries {
+				for _, hash := range []string{entry.Old, entry.New} {
+					if hash != ZERO_HASH && reachable[hash] == nil && repo.hasObject(hash) {
+						stack = append(stack, &gcObject{hash: hash})
+					}
+				}
+			}
+		}
+	}
+
+	for len(stack) > 0 {
+		object := stack[len(stack)-1]
+		stack = stack[:len(stack)-1]
+
+		if reachable[object.hash] != nil {
+			continue
+		}
+
+		// Blobs are only checked, their content is not needed.
+		if object.typ == OBJ_BLOB {
+			if object.typ, object.size, err = repo.objects.Stat(object.hash); err != nil {
+				return err
+			}
+
+			reachable[object.hash] = object
+			continue
+		}
+
+		o, err := repo.Object(object.hash)
+
+		if err != nil {
+			return err
+		}
+
+		object.typ, object.size = o.Type, int64(o.Size)
+		reachable[object.hash] = object
+
+		switch o.Type {
+		case OBJ_COMMIT:
+			stack = append(stack, &gcObject{hash: o.TreeHash})
+
+			for _, parent := range o.ParentHashes {
+				stack = append(stack, &gcObject{hash: parent})
+			}
+
+		case OBJ_TREE:
+			entries, err := o.Entries()
+
+			if err != nil {
+				return err
+			}
+
+			for _, entry := range entries {
+				// Submodule commits are in another repo.
+				if entry.Mode == MODE_GITLINK {
+					continue
+				}
+
+				stack = append(stack, &gcObject{hash: entry.Hash, name: entry.Name, typ: ternary[uint8](entry.Mode == MODE_TREE, 0, OBJ_BLOB)})
+			}
+
+		case OBJ_TAG:
+			for _, target := range parseLinesKV(o.Data)["object"] {
+				stack = append(stack, &gcObject{hash: target})
+			}
+		}
+	}
+
+	return nil
+}
+
+// expired reports whether the file was written before expire. Without ModTimeFS nothing expires.
+func (repo *Repo) expired(path string, expire time.Time) bool {
+	fs, ok := repo.fs.(ModTimeFS)
+
+	if !ok {
+		return false
+	}
+
+	when, err := fs.ModTime(path)
+
+	return err == nil && when.Before(expire)
+}
+
+// writeGCPack writes the objects, read from store, to objects/pack/ of repo as a pack and its index,
+// and returns its path without extension. Like git, objects are sorted by type, name and size, each
+// is stored as a delta against one of the previous window objects when that is small enough.
+func (repo *Repo) writeGCPack(store *filesObjects, objects []*gcObject, window, depth int) (string, error) {
+	if len(objects) == 0 {
+		return "", nil
+	}
+
+	sort.Slice(objects, func(i, j int) bool {
+		a, b := objects[i], objects[j]
+
+		if a.typ != b.typ {
+			return a.typ < b.typ
+		}
+
+		if a.name != b.name {
+			return a.name < b.name
+		}
+
+		if a.size != b.size {
+			return a.size > b.size
+		}
+
+		return a.hash < b.hash
+	})
+
+	var buf bytes.Buffer
+
+	buf.WriteString("PACK")
+	binary.Write(&buf, binary.BigEndian, uint32(2))
+	binary.Write(&buf, binary.BigEndian, uint32(len(objects)))
+
+	entries := make([]*gcEntry, 0, len(objects))
+	recent := []*gcEntry{}
+
+	for _, object := range objects {
+		typ, data, err := store.Get(object.hash)
+
+		if err != nil {
+			return "", err
+		}
+
+		if len(recent) > 0 && recent[0].typ != typ {
+			for _, entry := range recent {
+				entry.data, entry.index = nil, nil
+			}
+
+			recent = []*gcEntry{}
+		}
+
+		entry := &gcEntry{hash: object.hash, typ: typ, offset: uint64(buf.Len()), data: data}
+
+		var base *gcEntry
+		var delta []byte
+
+		for _, candidate := range recent {
+			max := ternary(delta != nil, len(delta)-1, len(data)/2-20)
+
+			// The bytes missing from the base would be inserted.
+			if candidate.depth >= depth || max <= 0 || len(data)-len(candidate.data) > max {
+				continue
+			}
+
+			if candidate.index == nil {
+				candidate.index = newDeltaIndex(candidate.data)
+			}
+
+			if d := candidate.index.delta(data, max); d != nil {
+				base, delta = candidate, d
+			}
+		}
+
+		header := &Object{Type: typ, Size: len(data)}
+		content := data
+
+		if base != nil {
+			entry.depth = base.depth + 1
+			header = &Object{Type: OBJ_OFS_DELTA, Size: len(delta)}
+			content = delta
+		}
+
+		raw, err := header.Header()
+
+		if err != nil {
+			return "", err
+		}
+
+		if base != nil {
+			raw = appendOfsDistance(raw, entry.offset-base.offset)
+		}
+
+		compressed, err := Zlib.Compress(content)
+
+		if err != nil {
+			return "", err
+		}
+
+		buf.Write(raw)
+		buf.Write(compressed)
+
+		entry.crc = crc32.ChecksumIEEE(buf.Bytes()[entry.offset:])
+		entries = append(entries, entry)
+		recent = append(recent, entry)
+
+		if len(recent) > window {
+			recent[0].data, recent[0].index = nil, nil
+			recent = recent[1:]
+		}
+	}
+
+	checksum := sha1.Sum(buf.Bytes())
+	buf.Write(checksum[:])
+
+	dir := repo.objects.(*filesObjects).dir + "/pack/"
+	path := dir + "pack-" + hex.EncodeToString(checksum[:])
+
+	// Nothing changed since the last GC.
+	if repo.fs.Stat(path + ".pack")[0] == 1 && repo.fs.Stat(path + ".idx")[0] == 1 {
+		return path, nil
+	}
+
+	// The index last, a pack is only used once both files exist.
+	tmp := dir + "tmp_pack_" + hex.EncodeToString(checksum[:])
+
+	if err := repo.fs.WriteFile(tmp, buf.Bytes()); err != nil {
+		return "", err
+	}
+
+	rename := repo.fs.(RenameFS) // Checked by GC.
+
+	if err := rename.Rename(tmp, path+".pack"); err != nil {
+		return "", err
+	}
+
+	if err := repo.fs.WriteFile(tmp, packIndex(entries, checksum[:])); err != nil {
+		return "", err
+	}
+
+	if err := rename.Rename(tmp, path+".idx"); err != nil {
+		return "", err
+	}
+
+	return path, nil
+}
+
+// appendOfsDistance appends the distance of an ofs-delta to its base. Each continuation byte
+// stands for one more than its value, so that no distance has two encodings.
+func appendOfsDistance(out []byte, distance uint64) []byte {
+	encoded := []byte{byte(distance & 0x7f)}
+
+	for distance >>= 7; distance > 0; distance >>= 7 {
+		distance--
+		encoded = append([]byte{byte(0x80 | distance&0x7f)}, encoded...)
+	}
+
+	return append(out, encoded...)
+}
+
+// packIndex builds the version 2 index of a pack, see https://git-scm.com/docs/gitformat-pack.
+func packIndex(entries []*gcEntry, checksum []byte) []byte {
+	sorted := append([]*gcEntry{}, entries...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i].hash < sorted[j].hash })
+
+	var buf bytes.Buffer
+
+	buf.WriteString("\xfftOc")
+	binary.Write(&buf, binary.BigEndian, uint32(2))
+
+	var fanout [256]uint32
+
+	for _, entry := range sorted {
+		raw, _ := hex.DecodeString(entry.hash[:2])
+		fanout[raw[0]]++
+	}
+
+	for i := 1; i < 256; i++ {
+		fanout[i] += fanout[i-1]
+	}
+
+	binary.Write(&buf, binary.BigEndian, fanout)
+
+	for _, entry := range sorted {
+		raw, _ := hex.DecodeString(entry.hash)
+		buf.Write(raw)
+	}
+
+	for _, entry := range sorted {
+		binary.Write(&buf, binary.BigEndian, entry.crc)
+	}
+
+	// Offsets past 2 GiB go to a table of 64-bit offsets.
+	large := []uint64{}
+
+	for _, entry := range sorted {
+		if entry.offset < 0x80000000 {
+			binary.Write(&buf, binary.BigEndian, uint32(entry.offset))
+			continue
+		}
+
+		binary.Write(&buf, binary.BigEndian, uint32(0x80000000|len(large)))
+		large = append(large, entry.offset)
+	}
+
+	binary.Write(&buf, binary.BigEndian, large)
+	buf.Write(checksum)
+
+	sum := sha1.Sum(buf.Bytes())
+	buf.Write(sum[:])
+
+	return buf.Bytes()
+}
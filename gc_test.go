@@ -0,0 +1,149 @@
+package gits
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestGCMatchesGit(t *testing.T) {
+	tests := []struct {
+		name        string
+		repack      bool          // Git packs the first half of the history.
+		unreachable time.Duration // Age of an unreachable blob relative to PruneExpire, 0 for none.
+		opts        GCOptions
+	}{
+		{"loose objects", false, 0, GCOptions{}},
+		{"packs and loose objects", true, 0, GCOptions{}},
+		{"window of one", false, 0, GCOptions{Window: 1, Depth: 1}},
+		{"short chains", true, 0, GCOptions{Depth: 2}},
+		{"expired unreachable blob", false, -time.Hour, GCOptions{}},
+		{"recent unreachable blob", true, time.Hour, GCOptions{}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			repo := newTestRepo(t, nil)
+			dir := repoPath(repo)
+			content := strings.Repeat("a line long enough for deltas to be worth it\n", 50)
+			parent := ""
+
+			for i := 0; i < 12; i++ {
+				content += fmt.Sprintf("line %d\n", i)
+				ops := []FileOp{{Action: ternary[uint8](parent == "", FILE_ADD, FILE_MODIFY), Path: "file", Content: []byte(content)}}
+
+				hash, err := repo.CommitFiles(&CommitFilesSpec{Branch: "main", Parent: parent, Author: testSignature(), Message: fmt.Sprint(i), Ops: ops})
+
+				if err != nil {
+					t.Fatal(err)
+				}
+
+				parent = hash
+
+				if i == 5 && test.repack {
+					runGit(t, dir, "repack", "-q", "-d")
+				}
+			}
+
+			if _, err := repo.WriteTag(&TagSpec{Object: parent, Name: "v1", Tagger: testSignature(), Message: "v1\n"}); err != nil {
+				t.Fatal(err)
+			}
+
+			opts := test.opts
+			opts.PruneExpire = time.Now().Add(-24 * time.Hour)
+			unreachable := ""
+
+			if test.unreachable != 0 {
+				hash, err := repo.WriteBlob([]byte("unreachable\n"))
+
+				if err != nil {
+					t.Fatal(err)
+				}
+
+				unreachable = hash
+				when := opts.PruneExpire.Add(test.unreachable)
+
+				if err := os.Chtimes(filepath.Join(dir, "objects", hash[:2], hash[2:]), when, when); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			if err := repo.GC(&opts); err != nil {
+				t.Fatal(err)
+			}
+
+			runGit(t, dir, "fsck", "--strict", "--no-dangling", "--no-progress")
+
+			packs, err := filepath.Glob(filepath.Join(dir, "objects", "pack", "*.pack"))
+
+			if err != nil || len(packs) != 1 {
+				t.Fatalf("packs = %v: %v", packs, err)
+			}
+
+			packed, depth, deltas := verifyPack(t, dir, packs[0])
+			reachable := strings.Fields(runGit(t, dir, "rev-list", "--objects", "--all", "--reflog", "--no-object-names"))
+			sort.Strings(reachable)
+
+			if strings.Join(packed, " ") != strings.Join(reachable, " ") {
+				t.Fatalf("packed %d objects, want the %d reachable ones", len(packed), len(reachable))
+			}
+
+			limit := ternary(opts.Depth > 0, opts.Depth, 50)
+
+			if depth > limit {
+				t.Errorf("delta chain of %d, want at most %d", depth, limit)
+			}
+
+			if opts.Window != 1 && deltas == 0 {
+				t.Error("no deltas")
+			}
+
+			if unreachable != "" {
+				kept := exec.Command("git", "-C", dir, "cat-file", "-e", unreachable).Run() == nil
+
+				if want := test.unreachable > 0; kept != want {
+					t.Errorf("unreachable blob kept = %v, want %v", kept, want)
+				}
+			}
+		})
+	}
+}
+
+// verifyPack checks a pack with git verify-pack and returns its objects sorted, the longest
+// delta chain and the number of deltas.
+func verifyPack(t *testing.T, dir, pack string) ([]string, int, int) {
+	objects := []string{}
+	depth, deltas := 0, 0
+
+	for _, line := range strings.Split(runGit(t, dir, "verify-pack", "-v", pack), "\n") {
+		fields := strings.Fields(line)
+
+		if len(fields) < 5 || !isHash(fields[0]) {
+			continue
+		}
+
+		objects = append(objects, fields[0])
+
+		// A delta also has its depth and base.
+		if len(fields) == 7 {
+			n, err := strconv.Atoi(fields[5])
+
+			if err != nil {
+				t.Fatalf("verify-pack: %s", line)
+			}
+
+			depth = max(depth, n)
+			deltas++
+		}
+	}
+
+	sort.Strings(objects)
+
+	return objects, depth, deltas
+}
@@ -5,35 +5,58 @@ import (
 	"encoding/hex"
 	"fmt"
 	"io"
+	"sort"
 	"strings"
 )
 
 func (repo *Repo) Advertise(r io.Reader, w io.Writer, service string, cb func()) ([]byte, error) {
-	if service != "git-upload-pack" && service != "git-receive-pack" {
+	if service != "git-upload-pack" && service != "git-receive-pack" && service != "git-upload-archive" {
 		return nil, fmt.Errorf("unsupported service: %s", service)
 	}
 
-	var refs = map[string][]int{}
-	var err error
+	if err := repo.authorize(ternary[uint8](service == "git-receive-pack", OP_WRITE, OP_READ), nil); err != nil {
+		return nil, err
+	}
 
-	refsPath := repo.absPath("refs")
-	refsStat := repo.fs.Stat(refsPath)
+	// git-upload-archive starts with the client's request, there are no refs to advertise.
+	if service == "git-upload-archive" {
+		if cb != nil {
+			cb()
+		}
 
-	if refsStat[0] == 2 {
-		refs, err = repo.fs.Scan(refsPath, FS_TYPE_FILE, -1)
+		return []byte{}, nil
+	}
 
-		if err != nil {
-			return nil, err
+	refs, err := repo.listRefs()
+
+	if err != nil {
+		return nil, err
+	}
+
+	config, err := repo.Config()
+
+	if err != nil {
+		return nil, err
+	}
+
+	hidden := repo.hiddenRefs(config, ternary(service == "git-receive-pack", "receive", "uploadpack"))
+	names := make([]string, 0, len(refs))
+
+	for name := range refs {
+		if !repo.refHidden(name, hidden) {
+			names = append(names, name)
 		}
 	}
 
-	var buf bytes.Buffer
+	sort.Strings(names)
 
-	// Write service header.
-	buf.Write(pktLine(fmt.Sprintf("# service=%s\n", service)))
+	var buf bytes.Buffer
 
-	// Write flush.
-	buf.Write([]byte("0000"))
+	// Write service header, only smart HTTP has one.
+	if !repo.stateful() {
+		buf.Write(pktLine(fmt.Sprintf("# service=%s\n", service)))
+		buf.Write([]byte("0000"))
+	}
 
 	// Write head.
 	head, err := repo.getHead()
@@ -42,27 +65,41 @@ func (repo *Repo) Advertise(r io.Reader, w io.Writer, service string, cb func())
 		return nil, err
 	}
 
-	beforeNull := fmt.Sprintf("%s %s", head.Hash, ternary(head.NoHead, "", "HEAD"))
-	afterNull := strings.Join(ADVERTISE_CAPS, " ")
+	caps := ADVERTISE_CAPS_RECEIVE_PACK
+
+	if service == "git-upload-pack" {
+		if caps, err = uploadPackCaps(config); err != nil {
+			return nil, err
+		}
+	}
+
+	afterNull := strings.Join(caps, " ")
+	born := !head.NoHead && !head.Unborn
 
-	if !head.NoHead && !head.Detached && head.Ref != "" {
+	if born && !head.Detached && head.Ref != "" {
 		afterNull = fmt.Sprintf("%s symref=HEAD:%s", afterNull, head.Ref)
 	}
 
-	line := fmt.Sprintf("%s%c%s", beforeNull, 0, afterNull)
-	buf.Write(pktLine(line))
+	// Like git, an unborn HEAD is left out and the capabilities go on the first ref, or on a
+	// capabilities^{} line without refs.
+	lines := []string{}
 
-	// Write refs.
-	// refname = /<dir>/refs/<refname>
-	for refname := range refs {
-		hash, err := repo.fs.ReadFile(refname)
+	if born {
+		lines = append(lines, head.Hash+" HEAD")
+	}
 
-		if err != nil {
-			return nil, err
-		}
+	for _, name := range names {
+		lines = append(lines, refs[name]+" "+name)
+	}
 
-		advRef := fmt.Sprintf("refs%s", refname[len(refsPath):])
-		buf.Write(pktLine(fmt.Sprintf("%s %s\n", strings.Trim(string(hash), "\n"), advRef)))
+	if len(lines) == 0 {
+		lines = append(lines, ZERO_HASH+" capabilities^{}")
+	}
+
+	buf.Write(pktLine(fmt.Sprintf("%s%c%s", lines[0], 0, afterNull)))
+
+	for _, line := range lines[1:] {
+		buf.Write(pktLine(line + "\n"))
 	}
 
 	// Write flush.
@@ -81,51 +118,84 @@ func (repo *Repo) Advertise(r io.Reader, w io.Writer, service string, cb func())
 	return buf.Bytes(), nil
 }
 
-func (r *Repo) getHead() (*Head, error) {
-	headFile := r.absPath("HEAD")
-	headStat := r.fs.Stat(headFile)
+// uploadPackCaps adds the capabilities the config turns on to ADVERTISE_CAPS_UPLOAD_PACK: filter for
+// uploadpack.allowFilter, and the ones partial clones need to fetch missing objects for
+// uploadpack.allowTipSHA1InWant, allowReachableSHA1InWant and allowAnySHA1InWant, see checkWants.
+func uploadPackCaps(config *GitConfig) ([]string, error) {
+	caps := append([]string{}, ADVERTISE_CAPS_UPLOAD_PACK...)
+	allow, err := uploadPackAllow(config)
 
-	if headStat[0] != 1 {
-		head := &Head{
-			NoHead: true,
-			Hash:   hex.EncodeToString(make([]byte, 20)),
+	if err != nil {
+		return nil, err
+	}
+
+	if allow["allowFilter"] {
+		caps = append(caps, "filter")
+	}
+
+	if allow["allowTipSHA1InWant"] || allow["allowAnySHA1InWant"] {
+		caps = append(caps, "allow-tip-sha1-in-want")
+	}
+
+	if allow["allowReachableSHA1InWant"] || allow["allowAnySHA1InWant"] {
+		caps = append(caps, "allow-reachable-sha1-in-want")
+	}
+
+	return caps, nil
+}
+
+// uploadPackAllow reads the uploadpack.allow* settings, by key without the section.
+func uploadPackAllow(config *GitConfig) (map[string]bool, error) {
+	allow := map[string]bool{}
+
+	for _, key := range []string{"allowFilter", "allowTipSHA1InWant", "allowReachableSHA1InWant", "allowAnySHA1InWant"} {
+		value, err := config.Bool("uploadpack."+key, false)
+
+		if err != nil {
+			return nil, err
 		}
 
-		return head, nil
+		allow[key] = value
 	}
 
-	headBytes, err := r.fs.ReadFile(headFile)
+	return allow, nil
+}
+
+func (r *Repo) getHead() (*Head, error) {
+	ref, err := r.refs.Get("HEAD")
 
 	if err != nil {
 		return nil, err
 	}
 
+	if ref == nil {
+		head := &Head{
+			NoHead: true,
+			Hash:   hex.EncodeToString(make([]byte, 20)),
+		}
+
+		return head, nil
+	}
+
 	head := &Head{}
 	solved := false
-	headStr := strings.TrimSpace(string(headBytes))
 
 	// 1. First test if the head is a ref.
-	if strings.HasPrefix(headStr, "ref: ") {
-		head.Ref = strings.TrimPrefix(headStr, "ref: ")
+	if ref.Target != "" {
+		head.Ref = ref.Target
 
-		refFile := r.absPath(head.Ref)
-		stat := r.fs.Stat(refFile)
+		refHash, err := r.readRef(head.Ref)
 
-		// File not found, or size is 0.
-		if stat[0] == 0 || stat[1] == 0 {
-			head.Unborn = true
-			head.Hash = hex.EncodeToString(make([]byte, 20))
+		if err != nil {
+			return nil, err
 		}
 
-		// File found
-		if stat[0] == 1 {
-			refHash, err := r.fs.ReadFile(refFile)
-
-			if err != nil {
-				return nil, err
-			}
-
-			head.Hash = strings.TrimSpace(string(refHash))
+		// Neither a loose nor a packed ref.
+		if refHash == "" {
+			head.Unborn = true
+			head.Hash = hex.EncodeToString(make([]byte, 20))
+		} else {
+			head.Hash = refHash
 		}
 
 		solved = true
@@ -136,10 +206,11 @@ func (r *Repo) getHead() (*Head, error) {
 
 	// 3. Detached head.
 	if !solved {
-		_, err = hex.DecodeString(headStr)
+		_, err = hex.DecodeString(ref.Hash)
 
 		if err == nil {
 			head.Detached = true
+			head.Hash = ref.Hash
 		}
 
 		solved = true
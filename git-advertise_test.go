@@ -0,0 +1,60 @@
+package gits
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestAdvertiseCapsByService(t *testing.T) {
+	repo := newTestRepo(t, nil)
+
+	_, err := repo.CommitFiles(&CommitFilesSpec{
+		Branch:  "main",
+		Author:  testSignature(),
+		Message: "first",
+		Ops:     []FileOp{{Action: FILE_ADD, Path: "a", Content: []byte("a\n")}},
+	})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		service string
+		want    []string
+		other   []string
+	}{
+		{"git-upload-pack", []string{"multi_ack", "multi_ack_detailed"}, []string{"report-status", "delete-refs"}},
+		{"git-receive-pack", []string{"report-status", "delete-refs"}, []string{"multi_ack", "multi_ack_detailed"}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.service, func(t *testing.T) {
+			adv, err := repo.Advertise(nil, nil, test.service, nil)
+
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			_, after, _ := strings.Cut(string(adv), "\x00")
+			line, _, _ := strings.Cut(after, "\n")
+			caps := map[string]bool{}
+
+			for _, capability := range strings.Fields(line) {
+				caps[capability] = true
+			}
+
+			for _, capability := range test.want {
+				if !caps[capability] {
+					t.Errorf("%s is not advertised: %s", capability, line)
+				}
+			}
+
+			for _, capability := range test.other {
+				if caps[capability] {
+					t.Errorf("%s is advertised: %s", capability, line)
+				}
+			}
+		})
+	}
+}
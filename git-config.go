@@ -0,0 +1,736 @@
+package gits
+
+import (
+	"fmt"
+	"math"
+	"path"
+	"strconv"
+	"strings"
+)
+
+// Includes nested deeper are an error, like in git.
+const maxConfigIncludeDepth = 10
+
+// GitConfig is a git config file, see https://git-scm.com/docs/git-config#_configuration_file.
+// Keys are section.name or section.subsection.name, sections and names are case insensitive,
+// subsections are not. Changes keep the rest of the file as written, comments included.
+type GitConfig struct {
+	lines []*configLine
+}
+
+// configLine is a section header, a variable, or a blank or comment line.
+type configLine struct {
+	raw        string // As read, newline included.
+	section    string // Section the line is in.
+	subsection string
+	header     bool
+	v          *configVar   // The variable the line sets, nil for other lines.
+	included   []*configVar // Variables of the file an include.path line includes.
+}
+
+type configVar struct {
+	section    string
+	subsection string
+	name       string
+	value      string
+	implicit   bool // A name without "= value", a boolean true.
+}
+
+// Config reads the config file of the repo. Files of include.path are read through the FS, relative
+// paths from the directory of the including file. A repo without a config file has an empty one.
+func (repo *Repo) Config() (*GitConfig, error) {
+	return repo.readConfig(repo.absPath("config"), 0)
+}
+
+// WriteConfig replaces the config file of the repo, see Repo.Config.
+func (repo *Repo) WriteConfig(config *GitConfig) error {
+	return replaceFile(repo.fs, repo.absPath("config"), config.Bytes())
+}
+
+func (repo *Repo) readConfig(file string, depth int) (*GitConfig, error) {
+	if repo.fs.Stat(file)[0] != 1 {
+		return &GitConfig{}, nil
+	}
+
+	data, err := repo.fs.ReadFile(file)
+
+	if err != nil {
+		return nil, err
+	}
+
+	config, err := parseGitConfig(data, func(include string) ([]*configVar, error) {
+		if depth >= maxConfigIncludeDepth {
+			return nil, fmt.Errorf("exceeded maximum include depth (%d)", maxConfigIncludeDepth)
+		}
+
+		// There is no home directory to expand.
+		if strings.HasPrefix(include, "~") {
+			return nil, nil
+		}
+
+		if !path.IsAbs(include) {
+			include = path.Join(path.Dir(file), include)
+		}
+
+		included, err := repo.readConfig(include, depth+1)
+
+		if err != nil {
+			return nil, err
+		}
+
+		return included.vars(), nil
+	})
+
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path.Base(file), err)
+	}
+
+	return config, nil
+}
+
+// ParseGitConfig parses the content of a config file, include.path is not followed.
+func ParseGitConfig(data []byte) (*GitConfig, error) {
+	return parseGitConfig(data, nil)
+}
+
+// Get returns the last value of a key.
+func (c *GitConfig) Get(key string) (string, bool) {
+	v := c.last(key)
+
+	if v == nil {
+		return "", false
+	}
+
+	return v.value, true
+}
+
+// GetAll returns every value of a multi-valued key in file order.
+func (c *GitConfig) GetAll(key string) []string {
+	values := []string{}
+	section, subsection, name, err := splitConfigKey(key)
+
+	if err != nil {
+		return values
+	}
+
+	for _, v := range c.vars() {
+		if v.is(section, subsection, name) {
+			values = append(values, v.value)
+		}
+	}
+
+	return values
+}
+
+// Bool returns the last value of a key as a boolean: true, yes, on or a name without a value, and
+// false, no, off or an empty value. Numbers are true unless 0. Def is returned for a missing key.
+func (c *GitConfig) Bool(key string, def bool) (bool, error) {
+	v := c.last(key)
+
+	if v == nil {
+		return def, nil
+	}
+
+	if v.implicit {
+		return true, nil
+	}
+
+	switch strings.ToLower(v.value) {
+	case "true", "yes", "on":
+		return true, nil
+	case "false", "no", "off", "":
+		return false, nil
+	}
+
+	n, err := parseConfigInt(v.value)
+
+	if err != nil {
+		return false, fmt.Errorf("bad boolean config value '%s' for '%s'", v.value, key)
+	}
+
+	return n != 0, nil
+}
+
+// Int returns the last value of a key as a number, a k, m or g suffix multiplies it by 1024,
+// 1024^2 or 1024^3. Def is returned for a missing key.
+func (c *GitConfig) Int(key string, def int64) (int64, error) {
+	v := c.last(key)
+
+	if v == nil {
+		return def, nil
+	}
+
+	n, err := parseConfigInt(v.value)
+
+	if err != nil {
+		return 0, fmt.Errorf("bad numeric config value '%s' for '%s': %w", v.value, key, err)
+	}
+
+	return n, nil
+}
+
+// Subsections returns the subsections of a section in file order, e.g. the names of the remotes
+// for "remote".
+func (c *GitConfig) Subsections(section string) []string {
+	seen := map[string]bool{}
+	names := []string{}
+
+	for _, v := range c.vars() {
+		if strings.EqualFold(v.section, section) && v.subsection != "" && !seen[v.subsection] {
+			seen[v.subsection] = true
+			names = append(names, v.subsection)
+		}
+	}
+
+	return names
+}
+
+// Set replaces every value of a key with one. The value takes the place of the last one, a new
+// key is added to the end of its section, the section to the end of the file.
+func (c *GitConfig) Set(key, value string) error {
+	v, err := newConfigVar(key, value)
+
+	if err != nil {
+		return err
+	}
+
+	last := -1
+
+	for i, line := range c.lines {
+		if line.v != nil && line.v.is(v.section, v.subsection, v.name) {
+			last = i
+		}
+	}
+
+	if last == -1 {
+		c.insert(v)
+		return nil
+	}
+
+	lines := []*configLine{}
+
+	for i, line := range c.lines {
+		switch {
+		case i == last:
+			lines = append(lines, &configLine{raw: formatConfigVar(v), section: line.section, subsection: line.subsection, v: v})
+		case line.v == nil || !line.v.is(v.section, v.subsection, v.name):
+			lines = append(lines, line)
+		}
+	}
+
+	c.lines = lines
+
+	return nil
+}
+
+// Add adds a value to a key, other values are kept.
+func (c *GitConfig) Add(key, value string) error {
+	v, err := newConfigVar(key, value)
+
+	if err != nil {
+		return err
+	}
+
+	c.insert(v)
+
+	return nil
+}
+
+// Unset removes every value of a key. Values from included files stay.
+func (c *GitConfig) Unset(key string) error {
+	section, subsection, name, err := splitConfigKey(key)
+
+	if err != nil {
+		return err
+	}
+
+	lines := []*configLine{}
+
+	for _, line := range c.lines {
+		if line.v == nil || !line.v.is(section, subsection, name) {
+			lines = append(lines, line)
+		}
+	}
+
+	c.lines = lines
+
+	return nil
+}
+
+// Bytes returns the content of the config file.
+func (c *GitConfig) Bytes() []byte {
+	var buf strings.Builder
+
+	for _, line := range c.lines {
+		buf.WriteString(line.raw)
+	}
+
+	return []byte(buf.String())
+}
+
+// vars returns the variables in the order they take effect, included files where they are included.
+func (c *GitConfig) vars() []*configVar {
+	vars := []*configVar{}
+
+	for _, line := range c.lines {
+		if line.v != nil {
+			vars = append(vars, line.v)
+		}
+
+		vars = append(vars, line.included...)
+	}
+
+	return vars
+}
+
+func (c *GitConfig) last(key string) *configVar {
+	section, subsection, name, err := splitConfigKey(key)
+
+	if err != nil {
+		return nil
+	}
+
+	var last *configVar
+
+	for _, v := range c.vars() {
+		if v.is(section, subsection, name) {
+			last = v
+		}
+	}
+
+	return last
+}
+
+// insert adds a line after the last one of the section of v, or the section at the end.
+func (c *GitConfig) insert(v *configVar) {
+	line := &configLine{raw: formatConfigVar(v), section: v.section, subsection: v.subsection, v: v}
+	at := -1
+
+	for i, other := range c.lines {
+		if (other.header || other.v != nil) && strings.EqualFold(other.section, v.section) && other.subsection == v.subsection {
+			at = i
+		}
+	}
+
+	if at == -1 {
+		if n := len(c.lines); n > 0 && !strings.HasSuffix(c.lines[n-1].raw, "\n") {
+			c.lines[n-1].raw += "\n"
+		}
+
+		header := &configLine{raw: formatConfigHeader(v.section, v.subsection), section: v.section, subsection: v.subsection, header: true}
+		c.lines = append(c.lines, header, line)
+
+		return
+	}
+
+	if !strings.HasSuffix(c.lines[at].raw, "\n") {
+		c.lines[at].raw += "\n"
+	}
+
+	c.lines = append(c.lines[:at+1], append([]*configLine{line}, c.lines[at+1:]...)...)
+}
+
+func (v *configVar) is(section, subsection, name string) bool {
+	return strings.EqualFold(v.section, section) && v.subsection == subsection && strings.EqualFold(v.name, name)
+}
+
+func newConfigVar(key, value string) (*configVar, error) {
+	section, subsection, name, err := splitConfigKey(key)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return &configVar{section: section, subsection: subsection, name: name, value: value}, nil
+}
+
+// splitConfigKey splits section.subsection.name, the subsection may have dots.
+func splitConfigKey(key string) (string, string, string, error) {
+	first, last := strings.Index(key, "."), strings.LastIndex(key, ".")
+
+	if first <= 0 || last == len(key)-1 {
+		return "", "", "", fmt.Errorf("key does not contain a section: %s", key)
+	}
+
+	section, name := key[:first], key[last+1:]
+	subsection := ""
+
+	if first != last {
+		subsection = key[first+1 : last]
+	}
+
+	for _, c := range []byte(section) {
+		if !isConfigKeyChar(c) {
+			return "", "", "", fmt.Errorf("invalid key: %s", key)
+		}
+	}
+
+	if !isAlpha(name[0]) || strings.ContainsAny(subsection, "\n\x00") {
+		return "", "", "", fmt.Errorf("invalid key: %s", key)
+	}
+
+	for _, c := range []byte(name) {
+		if !isConfigKeyChar(c) {
+			return "", "", "", fmt.Errorf("invalid key: %s", key)
+		}
+	}
+
+	return section, subsection, name, nil
+}
+
+func formatConfigHeader(section, subsection string) string {
+	if subsection == "" {
+		return "[" + section + "]\n"
+	}
+
+	escaped := strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(subsection)
+
+	return "[" + section + ` "` + escaped + `"]` + "\n"
+}
+
+// formatConfigVar quotes values that would lose spaces at their ends or be cut by a comment.
+func formatConfigVar(v *configVar) string {
+	value := strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`, "\t", `\t`, "\b", `\b`).Replace(v.value)
+
+	if v.value != strings.TrimSpace(v.value) || strings.ContainsAny(v.value, "#;") {
+		value = `"` + value + `"`
+	}
+
+	return "\t" + v.name + " = " + value + "\n"
+}
+
+func parseConfigInt(value string) (int64, error) {
+	value = strings.TrimSpace(value)
+	factor := int64(1)
+
+	if value != "" {
+		switch value[len(value)-1] {
+		case 'k', 'K':
+			factor = 1 << 10
+		case 'm', 'M':
+			factor = 1 << 20
+		case 'g', 'G':
+			factor = 1 << 30
+		}
+	}
+
+	if factor > 1 {
+		value = value[:len(value)-1]
+	}
+
+	n, err := strconv.ParseInt(value, 10, 64)
+
+	if err != nil {
+		return 0, err
+	}
+
+	if n > math.MaxInt64/factor || n < math.MinInt64/factor {
+		return 0, fmt.Errorf("out of range")
+	}
+
+	return n * factor, nil
+}
+
+func isAlpha(c byte) bool {
+	return c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z'
+}
+
+func isConfigKeyChar(c byte) bool {
+	return isAlpha(c) || c >= '0' && c <= '9' || c == '-'
+}
+
+// configParser reads a config file the way git does, see config.c.
+type configParser struct {
+	data    []byte
+	pos     int
+	line    int
+	include func(path string) ([]*configVar, error)
+}
+
+// parseGitConfig parses a config file, include is called with the value of every include.path.
+func parseGitConfig(data []byte, include func(path string) ([]*configVar, error)) (*GitConfig, error) {
+	p := &configParser{data: data, line: 1, include: include}
+	config := &GitConfig{}
+	section, subsection := "", ""
+
+	// A UTF-8 byte order mark stays with the first line.
+	start := 0
+
+	if strings.HasPrefix(string(data), "\xef\xbb\xbf") {
+		p.pos = 3
+	}
+
+	for p.pos < len(p.data) {
+		line := &configLine{}
+		p.skipSpace()
+
+		switch c := p.peek(); {
+		case c == '[':
+			var err error
+
+			if section, subsection, err = p.header(); err != nil {
+				return nil, err
+			}
+
+			line.header = true
+
+		case isAlpha(c):
+			if section == "" {
+				return nil, p.error()
+			}
+
+			v, err := p.variable()
+
+			if err != nil {
+				return nil, err
+			}
+
+			v.section, v.subsection = section, subsection
+			line.v = v
+
+			if include != nil && v.is("include", "", "path") && !v.implicit && v.value != "" {
+				if line.included, err = include(v.value); err != nil {
+					return nil, err
+				}
+			}
+
+		case c == '\n' || c == '#' || c == ';':
+			p.skipLine()
+
+		default:
+			return nil, p.error()
+		}
+
+		line.section, line.subsection = section, subsection
+		line.raw = string(p.data[start:p.pos])
+		config.lines = append(config.lines, line)
+		start = p.pos
+	}
+
+	return config, nil
+}
+
+func (p *configParser) error() error {
+	return fmt.Errorf("bad config line %d", p.line)
+}
+
+// next returns the next character, a carriage return before a newline is dropped and the end of
+// the data reads as a newline.
+func (p *configParser) next() byte {
+	if p.pos >= len(p.data) {
+		return '\n'
+	}
+
+	c := p.data[p.pos]
+	p.pos++
+
+	if c == '\r' && p.pos < len(p.data) && p.data[p.pos] == '\n' {
+		c = '\n'
+		p.pos++
+	}
+
+	if c == '\n' {
+		p.line++
+	}
+
+	return c
+}
+
+// peek returns the next character without reading it, a newline at the end of the data.
+func (p *configParser) peek() byte {
+	if p.pos >= len(p.data) {
+		return '\n'
+	}
+
+	return p.data[p.pos]
+}
+
+func (p *configParser) skipSpace() {
+	for p.pos < len(p.data) && (p.data[p.pos] == ' ' || p.data[p.pos] == '\t' || p.data[p.pos] == '\r') {
+		p.pos++
+	}
+}
+
+func (p *configParser) skipLine() {
+	for p.pos < len(p.data) && p.next() != '\n' {
+	}
+}
+
+// header reads [section], [section "subsection"] or the deprecated [section.subsection]. A variable
+// may follow on the same line.
+func (p *configParser) header() (string, string, error) {
+	p.next()
+	name := []byte{}
+
+	for {
+		c := p.next()
+
+		if c == ']' {
+			break
+		}
+
+		if c == ' ' || c == '\t' {
+			sub, err := p.subsection()
+
+			if err != nil {
+				return "", "", err
+			}
+
+			return p.endHeader(string(name), sub)
+		}
+
+		if !isConfigKeyChar(c) && c != '.' {
+			return "", "", p.error()
+		}
+
+		name = append(name, c)
+	}
+
+	section, sub, _ := strings.Cut(strings.ToLower(string(name)), ".")
+
+	if section == "" {
+		return "", "", p.error()
+	}
+
+	return p.endHeader(section, sub)
+}
+
+func (p *configParser) subsection() (string, error) {
+	p.skipSpace()
+
+	if p.next() != '"' {
+		return "", p.error()
+	}
+
+	sub := []byte{}
+
+	for {
+		c := p.next()
+
+		switch c {
+		case '\n':
+			return "", p.error()
+		case '"':
+			if p.next() != ']' {
+				return "", p.error()
+			}
+
+			return string(sub), nil
+		case '\\':
+			if c = p.next(); c == '\n' {
+				return "", p.error()
+			}
+		}
+
+		sub = append(sub, c)
+	}
+}
+
+func (p *configParser) endHeader(section, subsection string) (string, string, error) {
+	if section == "" {
+		return "", "", p.error()
+	}
+
+	rest := p.pos
+	p.skipSpace()
+
+	if p.pos < len(p.data) && p.data[p.pos] != '\n' && p.data[p.pos] != '#' && p.data[p.pos] != ';' {
+		p.pos = rest
+		return section, subsection, nil
+	}
+
+	p.skipLine()
+
+	return section, subsection, nil
+}
+
+// variable reads "name = value" or a name alone, up to the end of the line.
+func (p *configParser) variable() (*configVar, error) {
+	start := p.pos
+
+	for p.pos < len(p.data) && isConfigKeyChar(p.data[p.pos]) {
+		p.pos++
+	}
+
+	v := &configVar{name: string(p.data[start:p.pos])}
+	p.skipSpace()
+
+	switch c := p.next(); c {
+	case '\n':
+		v.implicit = true
+		return v, nil
+	case '#', ';':
+		v.implicit = true
+		p.skipLine()
+		return v, nil
+	case '=':
+		value, err := p.value()
+		v.value = value
+		return v, err
+	}
+
+	return nil, p.error()
+}
+
+// value reads a value: quotes and escapes removed, spaces outside quotes trimmed at the ends, lines
+// continued by a backslash joined.
+func (p *configParser) value() (string, error) {
+	value := []byte{}
+	quote, comment, spaces := false, false, 0
+
+	for {
+		c := p.next()
+
+		if c == '\n' {
+			if quote {
+				return "", p.error()
+			}
+
+			return string(value), nil
+		}
+
+		if comment {
+			continue
+		}
+
+		if !quote && (c == ' ' || c == '\t') {
+			if len(value) > 0 {
+				spaces++
+			}
+
+			continue
+		}
+
+		if !quote && (c == ';' || c == '#') {
+			comment = true
+			continue
+		}
+
+		for ; spaces > 0; spaces-- {
+			value = append(value, ' ')
+		}
+
+		switch c {
+		case '\\':
+			switch c = p.next(); c {
+			case '\n':
+				continue
+			case 't':
+				c = '\t'
+			case 'b':
+				c = '\b'
+			case 'n':
+				c = '\n'
+			case '\\', '"':
+			default:
+				return "", p.error()
+			}
+
+		case '"':
+			quote = !quote
+			continue
+		}
+
+		value = append(value, c)
+	}
+}
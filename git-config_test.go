@@ -0,0 +1,201 @@
+package gits
+
+import (
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestConfigMatchesGit(t *testing.T) {
+	tests := []struct {
+		name    string
+		config  string
+		include string // Content of the file included as "extra".
+		invalid bool
+	}{
+		{"sections", "[core]\n\tbare = true\n[remote \"origin\"]\n\turl = /a\n\tfetch = +refs/heads/*:refs/remotes/origin/*\n", "", false},
+		{"case", "[Core]\n\tBare = true\n[Remote \"Origin\"]\n\tURL = /a\n", "", false},
+		{"deprecated subsection", "[branch.Main]\n\tremote = origin\n", "", false},
+		{"implicit and empty", "[a]\n\tflag\n\tempty =\n\tspaced = \n", "", false},
+		{"multiple values", "[a]\n\tv = 1\n\tv = 2\n[b]\n\tv = 3\n[a]\n\tv = 4\n", "", false},
+		{"comments", "# top\n; top\n[a] # after header\n\tv = 1 # comment\n\tw = 2 ; comment\n\tx = \"#not\" # comment\n", "", false},
+		{"quotes and escapes", "[a]\n\tv = \"  padded  \"\n\tw = a\\tb\\\\c\\\"d\n\tx = one \"two  three\" four\n\ty = a\\nb\n", "", false},
+		{"inner spaces", "[a]\n\tv = a  \t b   \n", "", false},
+		{"continued lines", "[a]\n\tv = one \\\n two\n\tw = \"x\\\ny\"\n", "", false},
+		{"crlf", "[a]\r\n\tv = 1\r\n\tw = 2\r\n", "", false},
+		{"subsection escapes", "[a \"x\\\"y\\\\z\"]\n\tv = 1\n", "", false},
+		{"variable after header", "[a] v = 1\n", "", false},
+		{"no trailing newline", "[a]\n\tv = 1", "", false},
+		{"include", "[a]\n\tv = 1\n[include]\n\tpath = extra\n[a]\n\tw = 3\n", "[a]\n\tv = 2\n", false},
+		{"unterminated quote", "[a]\n\tv = \"x\n", "", true},
+		{"bad section", "[a b]\n\tv = 1\n", "", true},
+		{"bad name", "[a]\n\t1v = 1\n", "", true},
+		{"bad escape", "[a]\n\tv = \\q\n", "", true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			repo := newTestRepo(t, nil)
+			dir := repoPath(repo)
+
+			if err := os.WriteFile(filepath.Join(dir, "config"), []byte(test.config), 0644); err != nil {
+				t.Fatal(err)
+			}
+
+			if err := os.WriteFile(filepath.Join(dir, "extra"), []byte(test.include), 0644); err != nil {
+				t.Fatal(err)
+			}
+
+			config, err := repo.Config()
+
+			if test.invalid {
+				if err == nil {
+					t.Fatalf("parsed %q", test.config)
+				}
+
+				if _, ok := gitConfigList(t, dir, "config"); ok {
+					t.Fatalf("git parsed %q", test.config)
+				}
+
+				return
+			}
+
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			want, _ := gitConfigList(t, dir, "config")
+
+			if got := configList(config); got != want {
+				t.Fatalf("vars:\n%s\nwant:\n%s", got, want)
+			}
+
+			if string(config.Bytes()) != test.config {
+				t.Fatalf("Bytes = %q, want %q", config.Bytes(), test.config)
+			}
+		})
+	}
+}
+
+func TestConfigWriteMatchesGit(t *testing.T) {
+	original := "# settings\n[core]\n\tbare = true ; comment\n[remote \"origin\"]\n\turl = /a\n\tfetch = +refs/heads/*:refs/remotes/origin/*\n[a]\n\tv = 1\n\tv = 2\n"
+
+	type op struct {
+		action string // set, add or unset, like git config, git config --add and git config --unset-all.
+		key    string
+		value  string
+	}
+
+	tests := []struct {
+		name string
+		ops  []op
+	}{
+		{"replace", []op{{"set", "core.bare", "false"}}},
+		{"replace every value", []op{{"set", "a.v", "3"}}},
+		{"new key in a section", []op{{"set", "remote.origin.pushurl", "/b"}}},
+		{"new section", []op{{"set", "b.c.d", "e"}}},
+		{"new subsection with quotes", []op{{"set", "b.x\"y\\z.d", "e"}}},
+		{"add", []op{{"add", "a.v", "3"}, {"add", "remote.origin.fetch", "+refs/tags/*:refs/tags/*"}}},
+		{"unset", []op{{"unset", "a.v", ""}, {"unset", "core.bare", ""}}},
+		{"case insensitive names", []op{{"set", "CORE.Bare", "false"}, {"unset", "A.V", ""}}},
+		{"values needing quotes", []op{{"set", "b.padded", " x "}, {"set", "b.comment", "a # b ; c"}, {"set", "b.escapes", "a\tb\\c\"d\ne"}}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			repo := newTestRepo(t, nil)
+			dir := repoPath(repo)
+
+			for _, name := range []string{"config", "expected"} {
+				if err := os.WriteFile(filepath.Join(dir, name), []byte(original), 0644); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			config, err := repo.Config()
+
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			for _, op := range test.ops {
+				args := []string{"config", "--file", "expected"}
+
+				switch op.action {
+				case "set":
+					err = config.Set(op.key, op.value)
+					args = append(args, "--replace-all", op.key, op.value)
+				case "add":
+					err = config.Add(op.key, op.value)
+					args = append(args, "--add", op.key, op.value)
+				case "unset":
+					err = config.Unset(op.key)
+					args = append(args, "--unset-all", op.key)
+				}
+
+				if err != nil {
+					t.Fatal(err)
+				}
+
+				runGit(t, dir, args...)
+			}
+
+			if err := repo.WriteConfig(config); err != nil {
+				t.Fatal(err)
+			}
+
+			got, ok := gitConfigList(t, dir, "config")
+
+			if !ok {
+				t.Fatalf("git cannot read the written config:\n%s", config.Bytes())
+			}
+
+			if want, _ := gitConfigList(t, dir, "expected"); got != want {
+				t.Fatalf("vars:\n%s\nwant:\n%s", got, want)
+			}
+
+			// The comments stay.
+			if data := string(config.Bytes()); !strings.Contains(data, "# settings\n") {
+				t.Fatalf("comment lost:\n%s", data)
+			}
+		})
+	}
+}
+
+// gitConfigList lists the variables of a config file with git config --list, ok is false when git
+// cannot parse it.
+func gitConfigList(t *testing.T, dir, file string) (string, bool) {
+	runGit(t, dir, "--version")
+
+	cmd := exec.Command("git", "config", "--file", file, "--includes", "--list", "-z")
+	cmd.Dir = dir
+	out, err := cmd.Output()
+
+	return string(out), err == nil
+}
+
+// configList formats the variables like git config --list -z: key, then a newline and the value
+// unless the key has none, each followed by a NUL.
+func configList(config *GitConfig) string {
+	var buf strings.Builder
+
+	for _, v := range config.vars() {
+		buf.WriteString(strings.ToLower(v.section) + ".")
+
+		if v.subsection != "" {
+			buf.WriteString(v.subsection + ".")
+		}
+
+		buf.WriteString(strings.ToLower(v.name))
+
+		if !v.implicit {
+			buf.WriteString("\n" + v.value)
+		}
+
+		buf.WriteString("\x00")
+	}
+
+	return buf.String()
+}
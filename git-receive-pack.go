@@ -13,6 +13,7 @@ func (repo *Repo) ReceivePack(r io.Reader, w io.Writer, cb func()) error {
 	// Refs to be upated.
 	// Ref name, Old hash, New hash
 	refs := [][]string{}
+	caps := map[string]bool{}
 
 	for {
 		line, flush, err := readPktLine(br)
@@ -25,36 +26,249 @@ func (repo *Repo) ReceivePack(r io.Reader, w io.Writer, cb func()) error {
 			break
 		}
 
-		parts := strings.Split(line, " ")
+		parts := strings.SplitN(line, " ", 3)
 
 		if len(parts) < 3 {
 			return errors.New("invalid ref update line: " + line)
 		}
 
+		// The first line carries the capabilities after a NUL.
+		name, list, _ := strings.Cut(parts[2], "\x00")
+
+		for _, capability := range strings.Fields(list) {
+			caps[capability] = true
+		}
+
 		refs = append(refs, []string{
-			parts[2], // Ref name, e.g. refs/heads/main
+			name,     // Ref name, e.g. refs/heads/main
 			parts[0], // Old hash
 			parts[1], // New hash
 		})
 	}
 
-	if err := repo.Unpack(br); err != nil {
+	// Nothing to push, the client only wanted the advertisement.
+	if len(refs) == 0 {
+		return nil
+	}
+
+	updates := make([]*RefUpdate, len(refs))
+
+	for i, ref := range refs {
+		updates[i] = &RefUpdate{Name: ref[0], Old: ref[1], New: ref[2]}
+	}
+
+	if err := repo.authorize(OP_WRITE, updates); err != nil {
 		return err
 	}
 
+	// A push that only deletes refs comes without a pack.
+	deletesOnly := true
+
 	for _, ref := range refs {
-		repo.fs.WriteFile(repo.absPath(ref[0]), []byte(ref[2]))
+		deletesOnly = deletesOnly && ref[2] == ZERO_HASH
+	}
+
+	// Until the refs point to the new objects, GC would see them as unreachable.
+	unlock := repo.lockObjects(false)
+	defer unlock()
+
+	if !deletesOnly {
+		if err := repo.Unpack(br); err != nil {
+			return err
+		}
+	}
+
+	rejected, err := repo.refuseUpdates(updates)
+
+	if err != nil {
+		return err
+	}
+
+	accepted := []*RefUpdate{}
+
+	for _, update := range updates {
+		if rejected[update.Name] == "" {
+			accepted = append(accepted, update)
+		}
+	}
+
+	// With the atomic capability a refused ref, or one that moved since the advertisement, fails all
+	// the updates. Otherwise each ref is updated on its own.
+	batches := [][]*RefUpdate{accepted}
+
+	if caps["atomic"] && len(rejected) > 0 {
+		for _, update := range accepted {
+			rejected[update.Name] = "atomic transaction failed"
+		}
+
+		batches = nil
+	} else if !caps["atomic"] {
+		batches = nil
+
+		for _, update := range accepted {
+			batches = append(batches, []*RefUpdate{update})
+		}
 	}
 
-	res := prepSuccessRes(refs)
+	updated := false
+
+	for _, batch := range batches {
+		conflict, err := repo.applyUpdates(batch)
+
+		if err != nil {
+			return err
+		}
+
+		if conflict == nil {
+			updated = updated || len(batch) > 0
+			continue
+		}
+
+		for _, update := range batch {
+			rejected[update.Name] = ternary(update.Name == conflict.Ref, "failed to update ref", "atomic transaction failed")
+		}
+	}
 
 	if cb != nil {
 		cb()
 	}
 
-	if _, err := w.Write(res); err != nil {
+	if _, err := w.Write(prepReportRes(refs, rejected)); err != nil {
 		return err
 	}
 
-	return nil
+	if !updated {
+		return nil
+	}
+
+	// Keeps dumb HTTP clients up to date, the push itself already succeeded.
+	return repo.UpdateServerInfo()
+}
+
+// applyUpdates moves the refs in one transaction. A ref that is not at its old hash is returned
+// instead of an error, none of the refs moved.
+func (repo *Repo) applyUpdates(updates []*RefUpdate) (*RefConflictError, error) {
+	if len(updates) == 0 {
+		return nil, nil
+	}
+
+	tx, err := repo.refs.Transaction()
+
+	if err != nil {
+		return nil, err
+	}
+
+	for _, update := range updates {
+		if err := tx.Update(update.Name, update.Old, update.New); err != nil {
+			tx.Abort()
+			return nil, err
+		}
+	}
+
+	var conflict *RefConflictError
+
+	if err := tx.Commit(repo.identity(), "push"); errors.As(err, &conflict) {
+		return conflict, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	return nil, nil
+}
+
+// refuseUpdates returns the reason git gives for each update it refuses: invalid ref names, hidden
+// refs (transfer.hideRefs, receive.hideRefs), the checked out branch of a repo that is not core.bare
+// (receive.denyCurrentBranch), deleted branches (receive.denyDeletes) and branches that do not
+// fast-forward (receive.denyNonFastForwards), which includes an old or new commit that is missing here.
+func (repo *Repo) refuseUpdates(updates []*RefUpdate) (map[string]string, error) {
+	config, err := repo.Config()
+
+	if err != nil {
+		return nil, err
+	}
+
+	bare, err := config.Bool("core.bare", true)
+
+	if err != nil {
+		return nil, err
+	}
+
+	denyDeletes, err := config.Bool("receive.denyDeletes", false)
+
+	if err != nil {
+		return nil, err
+	}
+
+	denyNonFastForwards, err := config.Bool("receive.denyNonFastForwards", false)
+
+	if err != nil {
+		return nil, err
+	}
+
+	// There is no work tree to update, updateInstead refuses too.
+	denyCurrentBranch := true
+
+	switch value, _ := config.Get("receive.denyCurrentBranch"); strings.ToLower(value) {
+	case "refuse", "updateinstead":
+	case "ignore", "warn":
+		denyCurrentBranch = false
+	default:
+		if denyCurrentBranch, err = config.Bool("receive.denyCurrentBranch", true); err != nil {
+			return nil, err
+		}
+	}
+
+	current := ""
+
+	if !bare {
+		head, err := repo.refs.Get("HEAD")
+
+		if err != nil {
+			return nil, err
+		}
+
+		if head != nil {
+			current = head.Target
+		}
+	}
+
+	hidden := repo.hiddenRefs(config, "receive")
+	rejected := map[string]string{}
+
+	for _, update := range updates {
+		branch := strings.HasPrefix(update.Name, "refs/heads/")
+
+		switch {
+		case !validRefName(update.Name):
+			rejected[update.Name] = "funny refname"
+
+		case repo.refHidden(update.Name, hidden):
+			rejected[update.Name] = "deny updating a hidden ref"
+
+		case denyCurrentBranch && update.Name == current:
+			rejected[update.Name] = "branch is currently checked out"
+
+		case denyDeletes && branch && update.Old != ZERO_HASH && update.New == ZERO_HASH:
+			rejected[update.Name] = "deletion prohibited"
+
+		case denyNonFastForwards && branch && update.Old != ZERO_HASH && update.New != ZERO_HASH:
+			// The old hash comes from the client, it may be missing here.
+			if !repo.hasObject(update.Old) || !repo.hasObject(update.New) {
+				rejected[update.Name] = "missing necessary objects"
+				continue
+			}
+
+			ok, err := repo.IsAncestor(update.Old, update.New)
+
+			if err != nil {
+				return nil, err
+			}
+
+			if !ok {
+				rejected[update.Name] = "non-fast-forward"
+			}
+		}
+	}
+
+	return rejected, nil
 }
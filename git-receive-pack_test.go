@@ -0,0 +1,205 @@
+package gits
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"strings"
+	"testing"
+)
+
+func TestReceivePackFunnyRefname(t *testing.T) {
+	repo := newTestRepo(t, nil)
+
+	commit, err := repo.CommitFiles(&CommitFilesSpec{
+		Branch:  "main",
+		Author:  testSignature(),
+		Message: "first",
+		Ops:     []FileOp{{Action: FILE_ADD, Path: "a", Content: []byte("a\n")}},
+	})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := repo.updateRef("refs/heads/old", "", commit, nil, "test"); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name   string
+		report string
+	}{
+		{"refs/heads/a..b", "ng refs/heads/a..b funny refname"},
+		{"refs/heads/x.lock", "ng refs/heads/x.lock funny refname"},
+		{"HEAD", "ng HEAD funny refname"},
+		{"refs/heads/old", "ok refs/heads/old"},
+	}
+
+	var in bytes.Buffer
+
+	for i, test := range tests {
+		line := commit + " " + ZERO_HASH + " " + test.name
+
+		if i == 0 {
+			line += "\x00report-status"
+		}
+
+		in.Write(pktLine(line + "\n"))
+	}
+
+	in.WriteString("0000")
+
+	var out bytes.Buffer
+
+	if err := repo.ReceivePack(&in, &out, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if !strings.Contains(out.String(), test.report+"\n") {
+				t.Fatalf("report %q does not contain %q", out.String(), test.report)
+			}
+		})
+	}
+
+	if hash, _ := repo.resolveRef("refs/heads/old"); hash != "" {
+		t.Fatalf("refs/heads/old still points to %s", hash)
+	}
+}
+
+func TestRefuseUpdatesNonFastForward(t *testing.T) {
+	repo := newTestRepo(t, nil)
+
+	first, err := repo.CommitFiles(&CommitFilesSpec{
+		Branch:  "main",
+		Author:  testSignature(),
+		Message: "first",
+		Ops:     []FileOp{{Action: FILE_ADD, Path: "a", Content: []byte("a\n")}},
+	})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	second, err := repo.CommitFiles(&CommitFilesSpec{
+		Branch:  "main",
+		Parent:  first,
+		Author:  testSignature(),
+		Message: "second",
+		Ops:     []FileOp{{Action: FILE_MODIFY, Path: "a", Content: []byte("b\n")}},
+	})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	config, err := repo.Config()
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	config.Set("receive.denyNonFastForwards", "true")
+
+	if err := repo.WriteConfig(config); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name     string
+		old, new string
+		reason   string
+		fails    bool
+	}{
+		{"fast-forward", first, second, "", false},
+		{"rewind", second, first, "non-fast-forward", false},
+		{"missing new commit", first, strings.Repeat("1", 40), "missing necessary objects", false},
+		{"missing old commit", strings.Repeat("2", 40), second, "missing necessary objects", false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			rejected, err := repo.refuseUpdates([]*RefUpdate{{Name: "refs/heads/main", Old: test.old, New: test.new}})
+
+			if (err != nil) != test.fails {
+				t.Fatalf("err = %v, want failure %v", err, test.fails)
+			}
+
+			if rejected["refs/heads/main"] != test.reason {
+				t.Fatalf("reason = %q, want %q", rejected["refs/heads/main"], test.reason)
+			}
+		})
+	}
+}
+
+func TestReceivePackAtomic(t *testing.T) {
+	tests := []struct {
+		name    string
+		caps    string
+		funny   bool
+		reports []string
+	}{
+		{"separate", "report-status", false, []string{"ng refs/heads/main failed to update ref", "ok refs/heads/new"}},
+		{"atomic", "report-status atomic", false, []string{"ng refs/heads/main failed to update ref", "ng refs/heads/new atomic transaction failed"}},
+		{"separate refused", "report-status", true, []string{"ok refs/heads/new", "ng refs/heads/a..b funny refname"}},
+		{"atomic refused", "report-status atomic", true, []string{"ng refs/heads/new atomic transaction failed", "ng refs/heads/a..b funny refname"}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			repo := newTestRepo(t, nil)
+
+			first, err := repo.CommitFiles(&CommitFilesSpec{
+				Branch:  "main",
+				Author:  testSignature(),
+				Message: "first",
+				Ops:     []FileOp{{Action: FILE_ADD, Path: "a", Content: []byte("a\n")}},
+			})
+
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			// main moved since the client read the advertisement, unless the push is refused first.
+			old := ternary(test.funny, first, strings.Repeat("1", 40))
+			lines := []string{
+				old + " " + first + " refs/heads/main\x00" + test.caps,
+				ZERO_HASH + " " + first + " refs/heads/new",
+			}
+
+			if test.funny {
+				lines = append(lines, ZERO_HASH+" "+first+" refs/heads/a..b")
+			}
+
+			var in, out bytes.Buffer
+
+			for _, line := range lines {
+				in.Write(pktLine(line + "\n"))
+			}
+
+			in.WriteString("0000")
+
+			// An empty pack, the objects are already there.
+			pack := []byte("PACK\x00\x00\x00\x02\x00\x00\x00\x00")
+			sum := sha1.Sum(pack)
+			in.Write(append(pack, sum[:]...))
+
+			if err := repo.ReceivePack(&in, &out, nil); err != nil {
+				t.Fatal(err)
+			}
+
+			for _, report := range test.reports {
+				if !strings.Contains(out.String(), report+"\n") {
+					t.Errorf("report %q does not contain %q", out.String(), report)
+				}
+			}
+
+			created, _ := repo.resolveRef("refs/heads/new")
+
+			if want := strings.Contains(strings.Join(test.reports, "\n"), "ok refs/heads/new"); (created != "") != want {
+				t.Fatalf("refs/heads/new created = %v, want %v", created != "", want)
+			}
+		})
+	}
+}
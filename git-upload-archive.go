@@ -0,0 +1,146 @@
+package gits
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// Same limit git puts on the number of arguments of a remote archive request.
+const uploadArchiveMaxArgs = 64
+
+// UploadArchive serves `git archive --remote`. The request is validated before it is acknowledged,
+// problems are reported with NACK. The archive is then streamed on side-band 1.
+// Cb is called before the acknowledgement is sent.
+func (repo *Repo) UploadArchive(r io.Reader, w io.Writer, cb func()) error {
+	if err := repo.authorize(OP_READ, nil); err != nil {
+		return err
+	}
+
+	args, err := readArchiveArgs(bufio.NewReader(r))
+
+	if err != nil {
+		return err
+	}
+
+	format, prefix, treeish, paths, err := repo.parseArchiveArgs(args)
+
+	if err == nil {
+		_, _, err = repo.archiveTarget(treeish, paths)
+	}
+
+	if cb != nil {
+		cb()
+	}
+
+	if err != nil {
+		if _, werr := w.Write(pktLine(fmt.Sprintf("NACK %s\n", err))); werr != nil {
+			return werr
+		}
+
+		return err
+	}
+
+	if _, err := w.Write(append(pktLine("ACK\n"), "0000"...)); err != nil {
+		return err
+	}
+
+	if err := repo.Archive(&sidebandWriter{w: w, band: SIDEBAND_DATA}, treeish, format, prefix, paths...); err != nil {
+		msg := &sidebandWriter{w: w, band: SIDEBAND_ERROR}
+
+		if _, werr := fmt.Fprintf(msg, "fatal: %s\n", err); werr != nil {
+			return werr
+		}
+
+		return err
+	}
+
+	_, err = io.WriteString(w, "0000")
+
+	return err
+}
+
+// readArchiveArgs reads the "argument <arg>" pkt-lines up to the flush.
+func readArchiveArgs(br *bufio.Reader) ([]string, error) {
+	args := []string{}
+
+	for {
+		line, flush, err := readPktLine(br)
+
+		if err != nil {
+			return nil, err
+		}
+
+		if flush {
+			return args, nil
+		}
+
+		if !strings.HasPrefix(line, "argument ") {
+			return nil, fmt.Errorf("expected argument, got: %s", line)
+		}
+
+		if len(args) == uploadArchiveMaxArgs {
+			return nil, fmt.Errorf("too many options (>%d)", uploadArchiveMaxArgs)
+		}
+
+		args = append(args, strings.TrimPrefix(line, "argument "))
+	}
+}
+
+// parseArchiveArgs parses the arguments git archive sends to the remote side.
+// Like git without uploadArchive.allowUnreachable, the tree-ish must be a ref name, optionally followed by :<path>.
+// Reflog and ancestry suffixes such as main@{1} or main~1 are refused, they can reach commits no ref points to.
+func (repo *Repo) parseArchiveArgs(args []string) (uint8, string, string, []string, error) {
+	format := uint8(ARCHIVE_TAR)
+	prefix := ""
+	rest := []string{}
+
+	for i := 0; i < len(args); i++ {
+		arg := args[i]
+
+		switch {
+		case arg == "--":
+			rest = append(rest, args[i+1:]...)
+			i = len(args)
+
+		case strings.HasPrefix(arg, "--format="):
+			if format = ARCHIVE_FORMATS[strings.TrimPrefix(arg, "--format=")]; format == 0 {
+				return 0, "", "", nil, fmt.Errorf("unknown archive format '%s'", strings.TrimPrefix(arg, "--format="))
+			}
+
+		case strings.HasPrefix(arg, "--prefix="):
+			prefix = strings.TrimPrefix(arg, "--prefix=")
+
+		// Compression levels and attributes are accepted, the output does not depend on them.
+		case len(arg) == 2 && arg[0] == '-' && arg[1] >= '0' && arg[1] <= '9', arg == "--worktree-attributes":
+
+		case strings.HasPrefix(arg, "-"):
+			return 0, "", "", nil, fmt.Errorf("unsupported option '%s'", arg)
+
+		default:
+			rest = append(rest, arg)
+		}
+	}
+
+	if len(rest) == 0 {
+		return 0, "", "", nil, fmt.Errorf("no tree-ish given")
+	}
+
+	treeish := rest[0]
+	name, _, _ := strings.Cut(treeish, ":")
+
+	for _, rule := range revRefRules {
+		hash, err := repo.resolveRef(fmt.Sprintf(rule, name))
+
+		if err != nil {
+			return 0, "", "", nil, err
+		}
+
+		if hash != "" {
+			return format, prefix, treeish, rest[1:], nil
+		}
+	}
+
+	return 0, "", "", nil, fmt.Errorf("no such ref: %s", name)
+}
@@ -0,0 +1,77 @@
+package gits
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestUploadArchiveRefusesUnreachable(t *testing.T) {
+	repo := newTestRepo(t, nil)
+
+	base, err := repo.CommitFiles(&CommitFilesSpec{
+		Branch:  "main",
+		Author:  testSignature(),
+		Message: "base",
+		Ops:     []FileOp{{Action: FILE_ADD, Path: "dir/a", Content: []byte("a\n")}},
+	})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	secret, err := repo.CommitFiles(&CommitFilesSpec{
+		Branch:  "main",
+		Parent:  base,
+		Author:  testSignature(),
+		Message: "secret",
+		Ops:     []FileOp{{Action: FILE_ADD, Path: "secret", Content: []byte("secret\n")}},
+	})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The secret commit is now only in the reflog of main.
+	if err := repo.updateRef("refs/heads/main", secret, base, nil, "force push"); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		treeish string
+		refused bool
+	}{
+		{"main", false},
+		{"main:dir", false},
+		{"refs/heads/main", false},
+		{"HEAD", false},
+		{"main@{1}", true},
+		{"main@{1}:secret", true},
+		{"main^", true},
+		{"main~1", true},
+		{"@{1}", true},
+		{":dir", true},
+		{secret, true},
+		{secret + ":secret", true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.treeish, func(t *testing.T) {
+			var in, out bytes.Buffer
+
+			in.Write(pktLine("argument --format=tar\n"))
+			in.Write(pktLine("argument " + test.treeish + "\n"))
+			in.WriteString("0000")
+
+			err := repo.UploadArchive(&in, &out, nil)
+
+			if refused := err != nil; refused != test.refused {
+				t.Fatalf("refused = %v, want %v: %v", refused, test.refused, err)
+			}
+
+			if test.refused && !strings.Contains(out.String(), "NACK no such ref") {
+				t.Fatalf("answer = %q", out.String())
+			}
+		})
+	}
+}
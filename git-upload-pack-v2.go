@@ -0,0 +1,381 @@
+package gits
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+)
+
+// commandV2 is one protocol v2 request: the command, its capabilities and its arguments.
+type commandV2 struct {
+	name string
+	caps []string
+	args []string
+}
+
+// AdvertiseV2 writes the protocol v2 capability advertisement of git-upload-pack.
+// Cb is called before sending advertisement.
+func (repo *Repo) AdvertiseV2(w io.Writer, cb func()) ([]byte, error) {
+	if err := repo.authorize(OP_READ, nil); err != nil {
+		return nil, err
+	}
+
+	config, err := repo.Config()
+
+	if err != nil {
+		return nil, err
+	}
+
+	allowFilter, err := config.Bool("uploadpack.allowFilter", false)
+
+	if err != nil {
+		return nil, err
+	}
+
+	var buf bytes.Buffer
+
+	buf.Write(pktLine("version 2\n"))
+
+	for _, capability := range ADVERTISE_CAPS_V2 {
+		if capability == "fetch" && allowFilter {
+			capability = "fetch=filter"
+		}
+
+		buf.Write(pktLine(capability + "\n"))
+	}
+
+	buf.WriteString("0000")
+
+	if cb != nil {
+		cb()
+	}
+
+	if w != nil {
+		if _, err := w.Write(buf.Bytes()); err != nil {
+			return nil, err
+		}
+	}
+
+	return buf.Bytes(), nil
+}
+
+// UploadPackV2 answers protocol v2 commands (ls-refs and fetch) until the client is done.
+// Cb is called once, before the first response is written.
+func (repo *Repo) UploadPackV2(r io.Reader, w io.Writer, cb func()) error {
+	if err := repo.authorize(OP_READ, nil); err != nil {
+		return err
+	}
+
+	br := bufio.NewReader(r)
+
+	for {
+		cmd, err := readCommandV2(br)
+
+		if err == io.EOF || (err == nil && cmd == nil) {
+			return nil
+		}
+
+		if err != nil {
+			return err
+		}
+
+		if cb != nil {
+			cb()
+			cb = nil
+		}
+
+		switch cmd.name {
+		case "ls-refs":
+			err = repo.lsRefs(cmd, w)
+		case "fetch":
+			err = repo.fetchV2(cmd, w)
+		default:
+			err = fmt.Errorf("unknown command '%s'", cmd.name)
+			w.Write(pktLine("ERR " + err.Error() + "\n"))
+		}
+
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// readCommandV2 reads one command request. A flush in place of a command ends the session, then
+// the command is nil.
+func readCommandV2(br *bufio.Reader) (*commandV2, error) {
+	cmd := &commandV2{}
+	inArgs := false
+
+	for {
+		line, special, err := readPktLineV2(br)
+
+		if err != nil {
+			return nil, err
+		}
+
+		switch special {
+		case "0000":
+			if cmd.name == "" {
+				return nil, nil
+			}
+
+			return cmd, nil
+
+		case "0001":
+			inArgs = true
+
+		case "":
+			switch {
+			case inArgs:
+				cmd.args = append(cmd.args, line)
+			case strings.HasPrefix(line, "command="):
+				cmd.name = strings.TrimPrefix(line, "command=")
+			default:
+				cmd.caps = append(cmd.caps, line)
+			}
+
+		default:
+			return nil, fmt.Errorf("unexpected packet %s", special)
+		}
+	}
+}
+
+// lsRefs lists HEAD and the refs, honoring the symrefs, peel, unborn and ref-prefix arguments.
+func (repo *Repo) lsRefs(cmd *commandV2, w io.Writer) error {
+	opts := map[string]bool{}
+	prefixes := []string{}
+
+	for _, arg := range cmd.args {
+		if strings.HasPrefix(arg, "ref-prefix ") {
+			prefixes = append(prefixes, strings.TrimPrefix(arg, "ref-prefix "))
+		} else {
+			opts[arg] = true
+		}
+	}
+
+	matches := func(name string) bool {
+		for _, prefix := range prefixes {
+			if strings.HasPrefix(name, prefix) {
+				return true
+			}
+		}
+
+		return len(prefixes) == 0
+	}
+
+	refs, err := repo.listRefs()
+
+	if err != nil {
+		return err
+	}
+
+	config, err := repo.Config()
+
+	if err != nil {
+		return err
+	}
+
+	hidden := repo.hiddenRefs(config, "uploadpack")
+
+	head, err := repo.getHead()
+
+	if err != nil {
+		return err
+	}
+
+	var buf bytes.Buffer
+
+	line := func(hash, name, target string) error {
+		text := hash + " " + name
+
+		if opts["symrefs"] && target != "" {
+			text += " symref-target:" + target
+		}
+
+		if opts["peel"] && hash != "unborn" {
+			peeled, err := repo.peelRevision(name, hash, "")
+
+			if err != nil {
+				return err
+			}
+
+			if peeled != hash {
+				text += " peeled:" + peeled
+			}
+		}
+
+		buf.Write(pktLine(text + "\n"))
+
+		return nil
+	}
+
+	if !head.NoHead && matches("HEAD") {
+		switch {
+		case head.Unborn && opts["unborn"]:
+			err = line("unborn", "HEAD", head.Ref)
+		case !head.Unborn:
+			err = line(head.Hash, "HEAD", ternary(head.Detached, "", head.Ref))
+		}
+
+		if err != nil {
+			return err
+		}
+	}
+
+	names := []string{}
+
+	for name := range refs {
+		if matches(name) && !repo.refHidden(name, hidden) {
+			names = append(names, name)
+		}
+	}
+
+	sort.Strings(names)
+
+	for _, name := range names {
+		if err := line(refs[name], name, ""); err != nil {
+			return err
+		}
+	}
+
+	buf.WriteString("0000")
+
+	_, err = w.Write(buf.Bytes())
+
+	return err
+}
+
+// fetchV2 sends the acknowledgments, unless the client is done, and the pack on side-band 1 once
+// every want reaches a common commit.
+func (repo *Repo) fetchV2(cmd *commandV2, w io.Writer) error {
+	n := &Negotiation{
+		Wants: map[string]bool{},
+		Haves: map[string]bool{},
+		Caps:  map[string]bool{},
+	}
+
+	for _, arg := range cmd.args {
+		switch {
+		case strings.HasPrefix(arg, "want "):
+			n.Wants[strings.TrimPrefix(arg, "want ")] = true
+		case strings.HasPrefix(arg, "have "):
+			n.Haves[strings.TrimPrefix(arg, "have ")] = true
+		case strings.HasPrefix(arg, "filter "):
+			n.Filter = strings.TrimPrefix(arg, "filter ")
+		case arg == "done":
+			n.Done = true
+		default:
+			n.Caps[arg] = true
+		}
+	}
+
+	if err := repo.checkFilter(n); err != nil {
+		w.Write(pktLine("ERR " + err.Error() + "\n"))
+		return err
+	}
+
+	if err := repo.checkWants(n.Wants); err != nil {
+		w.Write(pktLine("ERR " + err.Error() + "\n"))
+		return err
+	}
+
+	var buf bytes.Buffer
+
+	if !n.Done {
+		buf.Write(pktLine("acknowledgments\n"))
+		common := []string{}
+
+		for have := range n.Haves {
+			if repo.hasObject(have) {
+				common = append(common, have)
+			}
+		}
+
+		sort.Strings(common)
+
+		for _, hash := range common {
+			buf.Write(pktLine("ACK " + hash + "\n"))
+		}
+
+		if len(common) == 0 {
+			buf.Write(pktLine("NAK\n"))
+		}
+
+		// Without ready the client sends more haves in another request.
+		ready, err := repo.readyToGiveUp(n, map[string]bool{})
+
+		if err != nil {
+			return err
+		}
+
+		if !ready {
+			buf.WriteString("0000")
+			_, err := w.Write(buf.Bytes())
+
+			return err
+		}
+
+		buf.Write(pktLine("ready\n"))
+		buf.WriteString("0001")
+	}
+
+	buf.Write(pktLine("packfile\n"))
+
+	if _, err := w.Write(buf.Bytes()); err != nil {
+		return err
+	}
+
+	objects, err := repo.Traverse(n)
+
+	if err != nil {
+		return err
+	}
+
+	if n.Caps["include-tag"] {
+		if err := repo.includeTags(objects); err != nil {
+			return err
+		}
+	}
+
+	if err := repo.writePack(objects, &sidebandWriter{w: w, band: SIDEBAND_DATA}); err != nil {
+		return err
+	}
+
+	_, err = io.WriteString(w, "0000")
+
+	return err
+}
+
+// includeTags adds the annotated tags that point to objects being sent.
+func (repo *Repo) includeTags(objects map[string]bool) error {
+	refs, err := repo.listRefs()
+
+	if err != nil {
+		return err
+	}
+
+	for name, hash := range refs {
+		if !strings.HasPrefix(name, "refs/tags/") || objects[hash] {
+			continue
+		}
+
+		object, err := repo.Object(hash)
+
+		if err != nil {
+			return err
+		}
+
+		if object.Type != OBJ_TAG {
+			continue
+		}
+
+		if target := parseLinesKV(object.Data)["object"]; len(target) > 0 && objects[target[0]] {
+			objects[hash] = true
+		}
+	}
+
+	return nil
+}
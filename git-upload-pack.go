@@ -1,14 +1,56 @@
 package gits
 
 import (
+	"bytes"
+	"errors"
+	"fmt"
 	"io"
 )
 
 // UploadPack handles the request phase and returns bytes to send back.
+// With TRANSPORT_STATELESS a request without done only gets the acknowledgments, the pack follows
+// the request that ends with done. With TRANSPORT_STATEFUL every round is answered on w.
 func (repo *Repo) UploadPack(r io.Reader, w io.Writer, cb func()) error {
-	n, err := repo.Negotiate(r, w)
+	if err := repo.authorize(OP_READ, nil); err != nil {
+		return err
+	}
+
+	// Stateless answers are held back until cb has run, it may need to go first (HTTP headers).
+	var buf bytes.Buffer
+	out := ternary[io.Writer](repo.stateful(), w, &buf)
+
+	n, err := repo.Negotiate(r, out)
 
 	if err != nil {
+		// Send what was answered so far, e.g. the ERR of a refused want.
+		if !repo.stateful() && buf.Len() > 0 {
+			if cb != nil {
+				cb()
+			}
+
+			w.Write(buf.Bytes())
+		}
+
+		return err
+	}
+
+	if err := repo.checkFilter(n); err != nil {
+		return err
+	}
+
+	// The client only wanted the advertisement, or hung up.
+	if len(n.Wants) == 0 || (!n.Done && repo.stateful()) {
+		return nil
+	}
+
+	// Another negotiation round follows, the request only gets the acknowledgments.
+	if !n.Done {
+		if cb != nil {
+			cb()
+		}
+
+		_, err = w.Write(buf.Bytes())
+
 		return err
 	}
 
@@ -22,5 +64,203 @@ func (repo *Repo) UploadPack(r io.Reader, w io.Writer, cb func()) error {
 		cb()
 	}
 
-	return repo.Pack(objects, w)
+	if _, err := w.Write(buf.Bytes()); err != nil {
+		return err
+	}
+
+	// The answer to done. Without multi_ack the common commit was already acknowledged.
+	final := ""
+
+	switch {
+	case n.Acked == "":
+		final = "NAK\n"
+	case n.Caps["multi_ack"] || n.Caps["multi_ack_detailed"]:
+		final = "ACK " + n.Acked + "\n"
+	}
+
+	if final != "" {
+		if _, err := w.Write(pktLine(final)); err != nil {
+			return err
+		}
+	}
+
+	return repo.writePack(objects, w)
+}
+
+// checkFilter refuses a filter-spec unless uploadpack.allowFilter offered filtering.
+func (repo *Repo) checkFilter(n *Negotiation) error {
+	if n.Filter == "" {
+		return nil
+	}
+
+	config, err := repo.Config()
+
+	if err != nil {
+		return err
+	}
+
+	allowFilter, err := config.Bool("uploadpack.allowFilter", false)
+
+	if err != nil {
+		return err
+	}
+
+	if !allowFilter {
+		return errors.New("upload-pack: filtering capability not negotiated")
+	}
+
+	_, err = parseObjectFilter(n.Filter)
+
+	return err
+}
+
+// checkWants refuses wants that are not the tip of an advertised ref, like git. With
+// uploadpack.allowTipSHA1InWant or allowAnySHA1InWant the tips of hidden refs are allowed too, with
+// allowReachableSHA1InWant or allowAnySHA1InWant the objects reachable from an advertised ref. The
+// refs of other namespaces never make an object visible.
+func (repo *Repo) checkWants(wants map[string]bool) error {
+	if len(wants) == 0 {
+		return nil
+	}
+
+	config, err := repo.Config()
+
+	if err != nil {
+		return err
+	}
+
+	allow, err := uploadPackAllow(config)
+
+	if err != nil {
+		return err
+	}
+
+	refs, err := repo.listRefs()
+
+	if err != nil {
+		return err
+	}
+
+	hidden := repo.hiddenRefs(config, "uploadpack")
+	tips, hiddenTips := []string{}, []string{}
+
+	for name, hash := range refs {
+		if repo.refHidden(name, hidden) {
+			hiddenTips = append(hiddenTips, hash)
+		} else {
+			tips = append(tips, hash)
+		}
+	}
+
+	head, err := repo.getHead()
+
+	if err != nil {
+		return err
+	}
+
+	if !head.NoHead && !head.Unborn {
+		tips = append(tips, head.Hash)
+	}
+
+	pending := map[string]bool{}
+
+	for want := range wants {
+		pending[want] = true
+	}
+
+	for _, tip := range tips {
+		delete(pending, tip)
+	}
+
+	if allow["allowTipSHA1InWant"] || allow["allowAnySHA1InWant"] {
+		for _, tip := range hiddenTips {
+			delete(pending, tip)
+		}
+	}
+
+	if len(pending) > 0 && (allow["allowReachableSHA1InWant"] || allow["allowAnySHA1InWant"]) {
+		if err := repo.findReachable(tips, pending); err != nil {
+			return err
+		}
+	}
+
+	for want := range pending {
+		return fmt.Errorf("upload-pack: not our ref %s", want)
+	}
+
+	return nil
+}
+
+// findReachable walks the objects reachable from tips and removes them from pending, until it is empty.
+// Trees are only walked while a pending object is not a commit.
+func (repo *Repo) findReachable(tips []string, pending map[string]bool) error {
+	commitsOnly := true
+
+	for hash := range pending {
+		object, err := repo.Object(hash)
+
+		if err != nil {
+			return nil // Missing, the want stays refused.
+		}
+
+		commitsOnly = commitsOnly && object.Type == OBJ_COMMIT
+	}
+
+	visited := map[string]bool{}
+	stack := append([]string{}, tips...)
+
+	for len(stack) > 0 && len(pending) > 0 {
+		hash := stack[len(stack)-1]
+		stack = stack[:len(stack)-1]
+
+		if visited[hash] {
+			continue
+		}
+
+		visited[hash] = true
+		delete(pending, hash)
+		object, err := repo.Object(hash)
+
+		if err != nil {
+			return err
+		}
+
+		switch object.Type {
+		case OBJ_COMMIT:
+			stack = append(stack, object.ParentHashes...)
+
+			if !commitsOnly {
+				stack = append(stack, object.TreeHash)
+			}
+
+		case OBJ_TREE:
+			entries, err := object.Entries()
+
+			if err != nil {
+				return err
+			}
+
+			for _, entry := range entries {
+				switch entry.Mode {
+				case MODE_GITLINK: // Submodule commits are in another repo.
+				case MODE_TREE:
+					stack = append(stack, entry.Hash)
+				default:
+					visited[entry.Hash] = true
+					delete(pending, entry.Hash)
+				}
+			}
+
+		case OBJ_TAG:
+			kv := parseLinesKV(object.Data)
+
+			if len(kv["object"]) == 0 {
+				return fmt.Errorf("invalid tag object: %s", hash)
+			}
+
+			stack = append(stack, kv["object"][0])
+		}
+	}
+
+	return nil
 }
@@ -0,0 +1,110 @@
+package gits
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestCheckWants(t *testing.T) {
+	repo := newTestRepo(t, nil)
+
+	open := func(namespace string) *Repo {
+		r, err := OpenRepo(&Config{Dir: repo.conf.Dir, Name: repo.conf.Name, Namespace: namespace})
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		return r
+	}
+
+	commit := func(r *Repo, branch, parent, path string) string {
+		hash, err := r.CommitFiles(&CommitFilesSpec{
+			Branch:  branch,
+			Parent:  parent,
+			Author:  testSignature(),
+			Message: path,
+			Ops:     []FileOp{{Action: FILE_ADD, Path: path, Content: []byte(path + "\n")}},
+		})
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		return hash
+	}
+
+	ours, theirs := open("ours"), open("theirs")
+	base := commit(ours, "main", "", "base")
+	tip := commit(ours, "main", base, "tip")
+	blob, _ := ours.ResolveRevision(base + ":base")
+
+	if err := ours.updateRef("refs/internal/keep", "", base, nil, "test"); err != nil {
+		t.Fatal(err)
+	}
+
+	hidden := commit(ours, "refs/internal/keep", base, "hidden")
+	other := commit(theirs, "main", "", "other")
+
+	tests := []struct {
+		name    string
+		allow   string
+		want    string
+		refused bool
+	}{
+		{"tip", "", tip, false},
+		{"ancestor", "", base, true},
+		{"hidden tip", "", hidden, true},
+		{"other namespace", "", other, true},
+		{"unknown", "", strings.Repeat("1", 40), true},
+		{"allowed hidden tip", "allowTipSHA1InWant", hidden, false},
+		{"tip ancestor", "allowTipSHA1InWant", base, true},
+		{"tip from another namespace", "allowTipSHA1InWant", other, true},
+		{"reachable ancestor", "allowReachableSHA1InWant", base, false},
+		{"reachable blob", "allowReachableSHA1InWant", blob, false},
+		{"reachable from a hidden ref", "allowReachableSHA1InWant", hidden, true},
+		{"reachable from another namespace", "allowReachableSHA1InWant", other, true},
+		{"any ancestor", "allowAnySHA1InWant", base, false},
+		{"any hidden tip", "allowAnySHA1InWant", hidden, false},
+		{"any from another namespace", "allowAnySHA1InWant", other, true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			config, err := ours.Config()
+
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			for _, key := range []string{"allowTipSHA1InWant", "allowReachableSHA1InWant", "allowAnySHA1InWant"} {
+				config.Unset("uploadpack." + key)
+			}
+
+			if test.allow != "" {
+				config.Set("uploadpack."+test.allow, "true")
+			}
+
+			if err := ours.WriteConfig(config); err != nil {
+				t.Fatal(err)
+			}
+
+			var in, out bytes.Buffer
+
+			in.Write(pktLine("want " + test.want + "\n"))
+			in.WriteString("0000")
+			in.Write(pktLine("done\n"))
+
+			_, err = ours.Negotiate(&in, &out)
+
+			if refused := err != nil; refused != test.refused {
+				t.Fatalf("refused = %v, want %v: %v", refused, test.refused, err)
+			}
+
+			if test.refused && !strings.Contains(out.String(), "ERR upload-pack: not our ref "+test.want) {
+				t.Fatalf("answer = %q", out.String())
+			}
+		})
+	}
+}
@@ -0,0 +1,256 @@
+// Package gitdaemon serves gits repositories read-only over the native git:// protocol.
+package gitdaemon
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"gits"
+)
+
+// ErrNotFound is returned by a Resolver when no repository has the requested name.
+var ErrNotFound = errors.New("repository not found")
+
+// Request is the first packet a git:// client sends,
+// e.g. "git-upload-pack /team/app.git\0host=example.com\0\0version=2\0".
+type Request struct {
+	Service    string   // "git-upload-pack" or "git-upload-archive".
+	Path       string   // Path as sent by the client, e.g. "/team/app.git".
+	Host       string   // Value of the host parameter, may include the port.
+	Params     []string // Extra parameters, e.g. "version=2".
+	RemoteAddr net.Addr
+}
+
+// Resolver maps the repository path of a request, e.g. "team/app.git", to a repo.
+type Resolver func(req *Request, name string) (*gits.Repo, error)
+
+// Server is read-only, pushing over git:// is not supported. Clients are anonymous.
+type Server struct {
+	Resolve     Resolver
+	Authorizer  gits.Authorizer // Nil allows every operation.
+	InitTimeout time.Duration   // Time allowed to send the request, defaults to 10 seconds.
+	Timeout     time.Duration   // Idle time allowed once the request is read, like git daemon --timeout. Defaults to 5 minutes.
+	ErrorLog    *log.Logger     // Nil uses the log package.
+}
+
+var services = map[string]bool{
+	"git-upload-pack":    true,
+	"git-upload-archive": true,
+}
+
+func (s *Server) ListenAndServe(addr string) error {
+	l, err := net.Listen("tcp", addr)
+
+	if err != nil {
+		return err
+	}
+
+	return s.Serve(l)
+}
+
+// Serve accepts connections on l until it fails.
+func (s *Server) Serve(l net.Listener) error {
+	for {
+		conn, err := l.Accept()
+
+		if err != nil {
+			return err
+		}
+
+		go s.ServeConn(conn)
+	}
+}
+
+// ServeConn runs one request on conn and closes it.
+func (s *Server) ServeConn(conn net.Conn) {
+	defer conn.Close()
+
+	timeout := s.InitTimeout
+
+	if timeout == 0 {
+		timeout = 10 * time.Second
+	}
+
+	conn.SetReadDeadline(time.Now().Add(timeout))
+
+	idle := &idleConn{Conn: conn}
+	br := bufio.NewReader(idle)
+	req, err := readRequest(br)
+
+	if err != nil {
+		s.logf("request from %s: %v", conn.RemoteAddr(), err)
+		writeErr(conn, err.Error())
+		return
+	}
+
+	idle.timeout = s.Timeout
+
+	if idle.timeout == 0 {
+		idle.timeout = 5 * time.Minute
+	}
+
+	req.RemoteAddr = conn.RemoteAddr()
+
+	if err := s.serve(req, br, idle); err != nil {
+		s.logf("%s %s: %v", req.Service, req.Path, err)
+	}
+}
+
+func (s *Server) serve(req *Request, r io.Reader, w io.Writer) error {
+	name, err := repoName(req.Path)
+
+	if err != nil {
+		writeErr(w, err.Error())
+		return err
+	}
+
+	repo, err := s.Resolve(req, name)
+
+	// Like git daemon, a missing repository looks the same as one that is not exported.
+	if errors.Is(err, ErrNotFound) || (err == nil && repo == nil) {
+		writeErr(w, "access denied or repository not exported: "+req.Path)
+		return nil
+	}
+
+	if err != nil {
+		writeErr(w, "internal server error")
+		return err
+	}
+
+	repo = repo.With(&gits.Session{Authorizer: s.Authorizer})
+	err = repo.Serve(r, w, req.Service, req.version())
+
+	if errors.Is(err, gits.ErrUnauthorized) || errors.Is(err, gits.ErrForbidden) {
+		writeErr(w, err.Error())
+		return nil
+	}
+
+	if errors.Is(err, io.EOF) {
+		return nil
+	}
+
+	return err
+}
+
+// idleConn pushes the deadline of the connection back on every read and write once timeout is set,
+// a client idle for longer is dropped.
+type idleConn struct {
+	net.Conn
+	timeout time.Duration
+}
+
+func (c *idleConn) Read(p []byte) (int, error) {
+	if c.timeout > 0 {
+		c.Conn.SetDeadline(time.Now().Add(c.timeout))
+	}
+
+	return c.Conn.Read(p)
+}
+
+func (c *idleConn) Write(p []byte) (int, error) {
+	if c.timeout > 0 {
+		c.Conn.SetDeadline(time.Now().Add(c.timeout))
+	}
+
+	return c.Conn.Write(p)
+}
+
+// version returns the highest protocol version asked for with "version=N".
+func (req *Request) version() int {
+	version := 0
+
+	for _, param := range req.Params {
+		if v, ok := strings.CutPrefix(param, "version="); ok {
+			if n, err := strconv.Atoi(v); err == nil && n > version {
+				version = n
+			}
+		}
+	}
+
+	return version
+}
+
+func (s *Server) logf(format string, args ...any) {
+	if s.ErrorLog != nil {
+		s.ErrorLog.Printf(format, args...)
+	} else {
+		log.Printf(format, args...)
+	}
+}
+
+// readRequest reads and parses the request packet. The host parameter follows the path after
+// a NUL, extra parameters follow after a second NUL, each one NUL-terminated.
+func readRequest(br *bufio.Reader) (*Request, error) {
+	head := make([]byte, 4)
+
+	if _, err := io.ReadFull(br, head); err != nil {
+		return nil, err
+	}
+
+	size, err := strconv.ParseUint(string(head), 16, 16)
+
+	if err != nil || size <= 4 {
+		return nil, fmt.Errorf("bad request packet")
+	}
+
+	data := make([]byte, size-4)
+
+	if _, err := io.ReadFull(br, data); err != nil {
+		return nil, err
+	}
+
+	fields := strings.Split(string(data), "\x00")
+	command := strings.TrimSuffix(fields[0], "\n")
+	service, path, _ := strings.Cut(command, " ")
+
+	if !services[service] {
+		return nil, fmt.Errorf("service not enabled: %s", service)
+	}
+
+	req := &Request{Service: service, Path: path}
+	extra := false
+
+	for _, field := range fields[1:] {
+		switch {
+		case field == "":
+			extra = true
+		case extra:
+			req.Params = append(req.Params, field)
+		case strings.HasPrefix(field, "host="):
+			req.Host = strings.TrimPrefix(field, "host=")
+		}
+	}
+
+	return req, nil
+}
+
+// repoName turns "/team/app.git" into "team/app.git". Names with empty, "." or ".." segments and
+// "~user" paths are rejected.
+func repoName(path string) (string, error) {
+	name := strings.Trim(path, "/")
+
+	if name == "" || strings.HasPrefix(name, "~") {
+		return "", fmt.Errorf("invalid repository path: %s", path)
+	}
+
+	for _, part := range strings.Split(name, "/") {
+		if part == "" || part == "." || part == ".." {
+			return "", fmt.Errorf("invalid repository path: %s", path)
+		}
+	}
+
+	return name, nil
+}
+
+// writeErr sends an ERR packet, git shows it as "remote error".
+func writeErr(w io.Writer, msg string) {
+	msg = "ERR " + msg + "\n"
+	fmt.Fprintf(w, "%04x%s", len(msg)+4, msg)
+}
@@ -0,0 +1,238 @@
+package gitdaemon
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"gits"
+)
+
+func TestServeGit(t *testing.T) {
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git not found")
+	}
+
+	repo, addr := startServer(t, &Server{})
+
+	head, err := repo.CommitFiles(&gits.CommitFilesSpec{
+		Branch:  "main",
+		Author:  &gits.Signature{Name: "t", Email: "t@t", When: time.Unix(1700000000, 0)},
+		Message: "first",
+		Ops:     []gits.FileOp{{Action: gits.FILE_ADD, Path: "a", Content: []byte("a\n")}},
+	})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name  string
+		path  string
+		args  []string
+		error string // Part of the output of a failing clone.
+	}{
+		{"v0", "/test.git", []string{"-c", "protocol.version=0"}, ""},
+		{"v2", "/test.git", []string{"-c", "protocol.version=2"}, ""},
+		{"missing", "/missing.git", nil, "access denied or repository not exported: /missing.git"},
+		{"outside", "/../test.git", nil, "invalid repository path"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			dir := filepath.Join(t.TempDir(), "clone")
+			args := append(test.args, "clone", "-q", "git://"+addr+test.path, dir)
+			out, err := exec.Command("git", args...).CombinedOutput()
+
+			if test.error != "" {
+				if err == nil || !strings.Contains(string(out), test.error) {
+					t.Fatalf("git clone: %v\n%s", err, out)
+				}
+
+				return
+			}
+
+			if err != nil {
+				t.Fatalf("git clone: %v\n%s", err, out)
+			}
+
+			cmd := exec.Command("git", "rev-parse", "HEAD")
+			cmd.Dir = dir
+
+			if out, err := cmd.Output(); err != nil || strings.TrimSpace(string(out)) != head {
+				t.Fatalf("HEAD = %s: %v", out, err)
+			}
+		})
+	}
+
+	// Pushing is not a service of the daemon.
+	cmd := exec.Command("git", "push", "-q", "git://"+addr+"/test.git", "main")
+	cmd.Dir = t.TempDir()
+
+	if out, err := cmd.CombinedOutput(); err == nil {
+		t.Fatalf("git push succeeded\n%s", out)
+	}
+}
+
+func TestTimeouts(t *testing.T) {
+	repo, addr := startServer(t, &Server{InitTimeout: 100 * time.Millisecond, Timeout: 200 * time.Millisecond})
+
+	_, err := repo.CommitFiles(&gits.CommitFilesSpec{
+		Branch:  "main",
+		Author:  &gits.Signature{Name: "t", Email: "t@t", When: time.Unix(1700000000, 0)},
+		Message: "first",
+		Ops:     []gits.FileOp{{Action: gits.FILE_ADD, Path: "a", Content: []byte("a\n")}},
+	})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Run("no request", func(t *testing.T) {
+		conn := dial(t, addr)
+		start := time.Now()
+		data, err := io.ReadAll(conn)
+
+		if err != nil || !strings.Contains(string(data), "ERR") {
+			t.Fatalf("answer = %q: %v", data, err)
+		}
+
+		if elapsed := time.Since(start); elapsed > 2*time.Second {
+			t.Fatalf("closed after %v", elapsed)
+		}
+	})
+
+	t.Run("idle", func(t *testing.T) {
+		conn := dial(t, addr)
+		br := bufio.NewReader(conn)
+		fmt.Fprint(conn, pktLine("git-upload-pack /test.git\x00host=localhost\x00\x00version=2\x00"))
+
+		// Each command pushes the deadline back, the session outlives the timeout.
+		for i := 0; i < 3; i++ {
+			if i > 0 {
+				fmt.Fprint(conn, pktLine("command=ls-refs\n")+"0001"+pktLine("peel\n")+"0000")
+			}
+
+			lines, err := readUntilFlush(br)
+
+			if err != nil {
+				t.Fatalf("read %d: %v", i, err)
+			}
+
+			if i > 0 && (len(lines) != 2 || !strings.HasSuffix(lines[1], " refs/heads/main\n")) {
+				t.Fatalf("ls-refs = %q", lines)
+			}
+
+			time.Sleep(120 * time.Millisecond)
+		}
+
+		start := time.Now()
+
+		if _, err := br.ReadByte(); err != io.EOF {
+			t.Fatalf("read after the timeout: %v, want EOF", err)
+		}
+
+		if elapsed := time.Since(start); elapsed > 2*time.Second {
+			t.Fatalf("closed after %v", elapsed)
+		}
+	})
+}
+
+// startServer serves test.git of a new directory on a local port.
+func startServer(t *testing.T, server *Server) (*gits.Repo, string) {
+	t.Helper()
+
+	dir := t.TempDir()
+	repo, err := gits.InitRepo(&gits.Config{Dir: dir, Name: "test.git"})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	server.Resolve = func(req *Request, name string) (*gits.Repo, error) {
+		if _, err := os.Stat(filepath.Join(dir, name)); err != nil {
+			return nil, ErrNotFound
+		}
+
+		return gits.OpenRepo(&gits.Config{Dir: dir, Name: name})
+	}
+
+	server.ErrorLog = log.New(io.Discard, "", 0)
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Cleanup(func() { l.Close() })
+
+	go server.Serve(l)
+
+	return repo, l.Addr().String()
+}
+
+func dial(t *testing.T, addr string) net.Conn {
+	t.Helper()
+
+	conn, err := net.Dial("tcp", addr)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Cleanup(func() { conn.Close() })
+
+	// The test fails instead of hanging when the server never closes.
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+	return conn
+}
+
+func pktLine(s string) string {
+	return fmt.Sprintf("%04x%s", len(s)+4, s)
+}
+
+// readUntilFlush returns the packets read before a flush packet.
+func readUntilFlush(br *bufio.Reader) ([]string, error) {
+	lines := []string{}
+
+	for {
+		head := make([]byte, 4)
+
+		if _, err := io.ReadFull(br, head); err != nil {
+			return nil, err
+		}
+
+		size, err := strconv.ParseUint(string(head), 16, 16)
+
+		if err != nil {
+			return nil, err
+		}
+
+		if size == 0 {
+			return lines, nil
+		}
+
+		if size < 4 {
+			return nil, errors.New("unexpected special packet")
+		}
+
+		data := make([]byte, size-4)
+
+		if _, err := io.ReadFull(br, data); err != nil {
+			return nil, err
+		}
+
+		lines = append(lines, string(data))
+	}
+}
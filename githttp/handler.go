@@ -0,0 +1,383 @@
+// Package githttp serves gits repositories over the smart HTTP protocol, and the dumb one for older clients.
+package githttp
+
+import (
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"net/http"
+	"regexp"
+	"strings"
+	"time"
+
+	"gits"
+)
+
+// ErrNotFound is returned by a Resolver when no repository has the requested name.
+var ErrNotFound = errors.New("repository not found")
+
+// Resolver maps the repository name from the URL, e.g. "team/app.git", to a repo.
+type Resolver func(r *http.Request, name string) (*gits.Repo, error)
+
+// Authenticator checks the credentials of a request and returns the user name. Creds is nil
+// when the request has none, return an empty user to allow anonymous access, or gits.ErrUnauthorized.
+// Gits.ErrForbidden answers 403, other errors are logged and answer 500.
+type Authenticator func(r *http.Request, creds *Credentials) (string, error)
+
+// Credentials from the Authorization header, either Basic (Username and Password) or Bearer (Token).
+type Credentials struct {
+	Username string
+	Password string
+	Token    string
+}
+
+type Handler struct {
+	Resolve      Resolver
+	Authenticate Authenticator   // Nil treats every request as anonymous.
+	Authorizer   gits.Authorizer // Nil allows every operation.
+	Realm        string          // Realm of the WWW-Authenticate challenge, defaults to "Git".
+	ErrorLog     *log.Logger     // Errors that happen after the response started. Nil uses the log package.
+}
+
+// flushWriter flushes after every write, so responses are streamed in chunks instead of buffered.
+type flushWriter struct {
+	w http.ResponseWriter
+}
+
+var routes = []string{"/info/refs", "/git-upload-pack", "/git-receive-pack"}
+
+// Files of the dumb protocol after the repository name, info/refs is one of the routes.
+var dumbRoute = regexp.MustCompile(`^(.+)(/(?:HEAD|objects/info/(?:packs|alternates|http-alternates)|objects/[0-9a-f]{2}/[0-9a-f]{38}|objects/pack/pack-[0-9a-f]{40}\.(?:pack|idx)))$`)
+
+// Content types used by git http-backend.
+var dumbTypes = map[string]string{
+	".pack": "application/x-git-packed-objects",
+	".idx":  "application/x-git-packed-objects-toc",
+}
+
+func New(resolve Resolver) *Handler {
+	return &Handler{Resolve: resolve}
+}
+
+func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	name, route := splitPath(r.URL.Path)
+
+	if route == "" {
+		http.NotFound(w, r)
+		return
+	}
+
+	user := ""
+
+	if h.Authenticate != nil {
+		var err error
+
+		user, err = h.Authenticate(r, credentials(r))
+
+		if errors.Is(err, gits.ErrUnauthorized) || errors.Is(err, gits.ErrForbidden) {
+			h.deny(w, err)
+			return
+		}
+
+		if err != nil {
+			h.logf("authenticating %s: %v", name, err)
+			http.Error(w, "internal server error", http.StatusInternalServerError)
+			return
+		}
+	}
+
+	repo, err := h.Resolve(r, name)
+
+	if errors.Is(err, ErrNotFound) || (err == nil && repo == nil) {
+		http.NotFound(w, r)
+		return
+	}
+
+	if err != nil {
+		h.logf("resolving %s: %v", name, err)
+		http.Error(w, "internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	repo = repo.With(&gits.Session{User: user, Authorizer: h.Authorizer})
+
+	switch route {
+	case "/info/refs":
+		h.infoRefs(w, r, repo)
+	case "/git-upload-pack", "/git-receive-pack":
+		h.serviceRPC(w, r, repo, route[1:])
+	default:
+		h.dumbFile(w, r, repo, route[1:])
+	}
+}
+
+func (h *Handler) infoRefs(w http.ResponseWriter, r *http.Request, repo *gits.Repo) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	service := r.URL.Query().Get("service")
+
+	// Dumb clients read the static file UpdateServerInfo writes.
+	if service == "" {
+		h.dumbFile(w, r, repo, "info/refs")
+		return
+	}
+
+	if service != "git-upload-pack" && service != "git-receive-pack" {
+		http.Error(w, "unsupported service", http.StatusForbidden)
+		return
+	}
+
+	cb := func() {
+		setNoCache(w)
+		w.Header().Set("Content-Type", "application/x-"+service+"-advertisement")
+		w.WriteHeader(http.StatusOK)
+	}
+
+	var err error
+
+	// Protocol v2 only exists for upload-pack, receive-pack keeps using v0.
+	if service == "git-upload-pack" && wantsV2(r) {
+		_, err = repo.AdvertiseV2(w, cb)
+	} else {
+		_, err = repo.Advertise(r.Body, w, service, cb)
+	}
+
+	if err != nil {
+		h.fail(w, service, err, false)
+	}
+}
+
+func (h *Handler) serviceRPC(w http.ResponseWriter, r *http.Request, repo *gits.Repo, service string) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	if r.Header.Get("Content-Type") != "application/x-"+service+"-request" {
+		http.Error(w, "unsupported media type", http.StatusUnsupportedMediaType)
+		return
+	}
+
+	body := io.Reader(r.Body)
+
+	// Git compresses large negotiations.
+	if encoding := r.Header.Get("Content-Encoding"); encoding == "gzip" || encoding == "x-gzip" {
+		gz, err := gzip.NewReader(r.Body)
+
+		if err != nil {
+			http.Error(w, "invalid gzip body", http.StatusBadRequest)
+			return
+		}
+
+		defer gz.Close()
+		body = gz
+	}
+
+	started := false
+	out := &flushWriter{w: w}
+
+	cb := func() {
+		started = true
+		setNoCache(w)
+		w.Header().Set("Content-Type", "application/x-"+service+"-result")
+		w.WriteHeader(http.StatusOK)
+	}
+
+	var err error
+
+	switch {
+	case service == "git-receive-pack":
+		err = repo.ReceivePack(body, out, cb)
+	case wantsV2(r):
+		err = repo.UploadPackV2(body, out, cb)
+	default:
+		err = repo.UploadPack(body, out, cb)
+	}
+
+	if err != nil {
+		h.fail(w, service, err, started)
+	}
+}
+
+// dumbFile serves a file of the dumb protocol. Objects and packs never change, so they may be cached.
+func (h *Handler) dumbFile(w http.ResponseWriter, r *http.Request, repo *gits.Repo, name string) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	file, err := repo.DumbFile(name)
+
+	if errors.Is(err, fs.ErrNotExist) {
+		http.NotFound(w, r)
+		return
+	}
+
+	if err != nil {
+		h.fail(w, name, err, false)
+		return
+	}
+
+	contentType := "text/plain"
+
+	switch {
+	case name == "objects/info/packs":
+		contentType = "text/plain; charset=utf-8"
+		setNoCache(w)
+	case strings.HasPrefix(name, "objects/pack/"):
+		contentType = dumbTypes[name[strings.LastIndex(name, "."):]]
+		setCacheForever(w)
+	case strings.HasPrefix(name, "objects/") && !strings.HasPrefix(name, "objects/info/"):
+		contentType = "application/x-git-loose-object"
+		setCacheForever(w)
+	default:
+		setNoCache(w)
+	}
+
+	w.Header().Set("Content-Type", contentType)
+
+	defer file.Close()
+
+	// Handles HEAD requests and the ranges clients use to resume pack downloads.
+	if seeker, ok := file.(io.ReadSeeker); ok {
+		http.ServeContent(w, r, "", time.Time{}, seeker)
+		return
+	}
+
+	if r.Method == http.MethodHead {
+		return
+	}
+
+	if _, err := io.Copy(w, file); err != nil {
+		h.fail(w, name, err, true)
+	}
+}
+
+// fail reports an error as a 500, or only logs it once the response has started.
+func (h *Handler) fail(w http.ResponseWriter, service string, err error, started bool) {
+	if !started && (errors.Is(err, gits.ErrUnauthorized) || errors.Is(err, gits.ErrForbidden)) {
+		h.deny(w, err)
+		return
+	}
+
+	h.logf("%s: %v", service, err)
+
+	if !started {
+		http.Error(w, "internal server error", http.StatusInternalServerError)
+	}
+}
+
+// deny answers 403 for gits.ErrForbidden, and 401 with a Basic challenge otherwise, so git asks for credentials.
+func (h *Handler) deny(w http.ResponseWriter, err error) {
+	if errors.Is(err, gits.ErrForbidden) {
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
+
+	realm := h.Realm
+
+	if realm == "" {
+		realm = "Git"
+	}
+
+	w.Header().Set("WWW-Authenticate", fmt.Sprintf("Basic realm=%q", realm))
+	http.Error(w, gits.ErrUnauthorized.Error(), http.StatusUnauthorized)
+}
+
+func (h *Handler) logf(format string, args ...any) {
+	if h.ErrorLog != nil {
+		h.ErrorLog.Printf(format, args...)
+	} else {
+		log.Printf(format, args...)
+	}
+}
+
+func (f *flushWriter) Write(p []byte) (int, error) {
+	n, err := f.w.Write(p)
+
+	if flusher, ok := f.w.(http.Flusher); ok {
+		flusher.Flush()
+	}
+
+	return n, err
+}
+
+// splitPath splits "/team/app.git/info/refs" into the repository name and the route, files of the
+// dumb protocol like "/objects/info/packs" are routes too. Names with empty, "." or ".." segments are rejected.
+func splitPath(path string) (string, string) {
+	name, route := "", ""
+
+	for _, r := range routes {
+		if strings.HasSuffix(path, r) {
+			name, route = strings.TrimSuffix(path, r), r
+			break
+		}
+	}
+
+	if route == "" {
+		if m := dumbRoute.FindStringSubmatch(path); m != nil {
+			name, route = m[1], m[2]
+		}
+	}
+
+	name = strings.Trim(name, "/")
+
+	if name == "" {
+		return "", ""
+	}
+
+	for _, part := range strings.Split(name, "/") {
+		if part == "" || part == "." || part == ".." {
+			return "", ""
+		}
+	}
+
+	return name, route
+}
+
+// credentials returns the Basic or Bearer credentials of a request, or nil.
+func credentials(r *http.Request) *Credentials {
+	if username, password, ok := r.BasicAuth(); ok {
+		return &Credentials{Username: username, Password: password}
+	}
+
+	scheme, token, ok := strings.Cut(r.Header.Get("Authorization"), " ")
+
+	if ok && strings.EqualFold(scheme, "Bearer") && token != "" {
+		return &Credentials{Token: strings.TrimSpace(token)}
+	}
+
+	return nil
+}
+
+// wantsV2 reports whether the client asked for protocol v2 in the Git-Protocol header.
+func wantsV2(r *http.Request) bool {
+	for _, param := range strings.Split(r.Header.Get("Git-Protocol"), ":") {
+		if param == "version=2" {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Same headers as git-http-backend.
+func setNoCache(w http.ResponseWriter) {
+	w.Header().Set("Expires", "Fri, 01 Jan 1980 00:00:00 GMT")
+	w.Header().Set("Pragma", "no-cache")
+	w.Header().Set("Cache-Control", "no-cache, max-age=0, must-revalidate")
+}
+
+func setCacheForever(w http.ResponseWriter) {
+	now := time.Now()
+
+	w.Header().Set("Date", now.UTC().Format(http.TimeFormat))
+	w.Header().Set("Expires", now.Add(365*24*time.Hour).UTC().Format(http.TimeFormat))
+	w.Header().Set("Cache-Control", "public, max-age=31536000")
+}
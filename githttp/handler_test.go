@@ -0,0 +1,117 @@
+package githttp
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"gits"
+)
+
+func TestAuthenticateErrors(t *testing.T) {
+	repo, err := gits.InitRepo(&gits.Config{Dir: t.TempDir(), Name: "test.git"})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name   string
+		err    error
+		status int
+	}{
+		{"anonymous", nil, http.StatusOK},
+		{"unauthorized", gits.ErrUnauthorized, http.StatusUnauthorized},
+		{"forbidden", fmt.Errorf("token revoked: %w", gits.ErrForbidden), http.StatusForbidden},
+		{"backend down", errors.New("connection refused"), http.StatusInternalServerError},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			h := New(func(r *http.Request, name string) (*gits.Repo, error) { return repo, nil })
+			h.ErrorLog = log.New(io.Discard, "", 0)
+			h.Authenticate = func(r *http.Request, creds *Credentials) (string, error) { return "", test.err }
+
+			w := httptest.NewRecorder()
+			h.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/test.git/info/refs?service=git-upload-pack", nil))
+
+			if w.Code != test.status {
+				t.Fatalf("status = %d, want %d: %s", w.Code, test.status, w.Body)
+			}
+		})
+	}
+}
+
+func TestCloneWithSubmodule(t *testing.T) {
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git not found")
+	}
+
+	repo, err := gits.InitRepo(&gits.Config{Dir: t.TempDir(), Name: "test.git"})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	server := httptest.NewServer(New(func(r *http.Request, name string) (*gits.Repo, error) { return repo, nil }))
+	defer server.Close()
+
+	work := t.TempDir()
+	url := server.URL + "/test.git"
+
+	git := func(dir string, args ...string) string {
+		t.Helper()
+
+		cmd := exec.Command("git", args...)
+		cmd.Dir = dir
+		cmd.Env = append(os.Environ(),
+			"GIT_AUTHOR_NAME=t", "GIT_AUTHOR_EMAIL=t@t", "GIT_COMMITTER_NAME=t", "GIT_COMMITTER_EMAIL=t@t",
+			"GIT_CONFIG_NOSYSTEM=1", "HOME="+work,
+		)
+
+		out, err := cmd.CombinedOutput()
+
+		if err != nil {
+			t.Fatalf("git %s: %v\n%s", strings.Join(args, " "), err, out)
+		}
+
+		return strings.TrimSpace(string(out))
+	}
+
+	// The submodule commit only exists in another repo.
+	src := filepath.Join(work, "src")
+	git(work, "init", "-q", "-b", "main", src)
+	os.WriteFile(filepath.Join(src, "a"), []byte("a\n"), 0644)
+	git(src, "add", "a")
+	git(src, "update-index", "--add", "--cacheinfo", "160000,"+strings.Repeat("1", 40)+",sub")
+	git(src, "commit", "-q", "-m", "base")
+	git(src, "push", "-q", url, "main")
+
+	for _, version := range []string{"0", "2"} {
+		t.Run("v"+version, func(t *testing.T) {
+			dst := filepath.Join(work, "v"+version)
+			git(work, "-c", "protocol.version="+version, "clone", "-q", url, dst)
+			git(dst, "fsck", "--strict")
+
+			// An incremental fetch walks the trees of the common commit as well.
+			os.WriteFile(filepath.Join(src, version), []byte(version+"\n"), 0644)
+			git(src, "add", version)
+			git(src, "commit", "-q", "-m", "v"+version)
+			git(src, "push", "-q", url, "main")
+			git(dst, "-c", "protocol.version="+version, "pull", "-q", "--ff-only")
+			git(dst, "fsck", "--strict")
+
+			if got, want := git(dst, "rev-parse", "HEAD"), git(src, "rev-parse", "HEAD"); got != want {
+				t.Fatalf("HEAD = %s, want %s", got, want)
+			}
+		})
+	}
+}
@@ -5,6 +5,12 @@ import (
 	"strings"
 )
 
+// Config of a new repo, reftable needs repository format version 1 and the refStorage extension.
+const (
+	initConfig         = "[core]\n\trepositoryformatversion = 0\n\tfilemode = true\n\tbare = true\n"
+	initConfigReftable = "[core]\n\trepositoryformatversion = 1\n\tfilemode = true\n\tbare = true\n[extensions]\n\trefStorage = reftable\n"
+)
+
 func OpenRepo(conf *Config) (*Repo, error) {
 	r := &Repo{
 		conf: conf,
@@ -18,9 +24,24 @@ func OpenRepo(conf *Config) (*Repo, error) {
 		r.fs, err = conf.FS(conf.Dir)
 	}
 
-	return r, err
+	if err != nil {
+		return nil, err
+	}
+
+	if r.refs, err = r.newRefStore(); err != nil {
+		return nil, err
+	}
+
+	if r.objects, err = r.newObjectStore(); err != nil {
+		return nil, err
+	}
+
+	return r, nil
 }
 
+// InitRepo creates a bare repo: HEAD pointing to the initial branch, config, objects/ and refs/.
+// With conf.Namespace the HEAD of the namespace is set too, other namespaces of an existing repo
+// are started with OpenRepo and SetHead.
 func InitRepo(conf *Config) (*Repo, error) {
 	r := &Repo{
 		conf: conf,
@@ -38,14 +59,65 @@ func InitRepo(conf *Config) (*Repo, error) {
 		return nil, err
 	}
 
-	dir := r.absPath(conf.Name)
-	stat := r.fs.Stat(dir)
+	branch := conf.InitialBranch
 
-	if stat[0] != 0 {
+	if branch == "" {
+		branch = "main"
+	}
+
+	if !strings.HasPrefix(branch, "refs/heads/") {
+		branch = "refs/heads/" + branch
+	}
+
+	if !validRefName(branch) {
+		return nil, fmt.Errorf("invalid initial branch: %s", conf.InitialBranch)
+	}
+
+	if r.fs.Stat(r.absPath(""))[0] != 0 {
 		return nil, fmt.Errorf("repo '%s' already exists", conf.Name)
 	}
 
-	return r, r.fs.Mkdir(dir)
+	for _, dir := range []string{"objects/info", "objects/pack", "refs/heads", "refs/tags"} {
+		if err := r.fs.Mkdir(r.absPath(dir)); err != nil {
+			return nil, err
+		}
+	}
+
+	reftable := conf.RefStore == nil && conf.RefStorage == REF_STORAGE_REFTABLE
+	config := ternary(reftable, initConfigReftable, initConfig)
+
+	if err := r.fs.WriteFile(r.absPath("config"), []byte(config)); err != nil {
+		return nil, err
+	}
+
+	if r.refs, err = r.newRefStore(); err != nil {
+		return nil, err
+	}
+
+	if r.objects, err = r.newObjectStore(); err != nil {
+		return nil, err
+	}
+
+	physical := r.physical()
+
+	if store, ok := physical.refs.(refStore); ok {
+		if err := store.init(); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := physical.SetHead(branch); err != nil {
+		return nil, err
+	}
+
+	// The namespace gets its own HEAD, the repo still needs one.
+	if r.conf.Namespace != "" {
+		if err := r.SetHead(branch); err != nil {
+			return nil, err
+		}
+	}
+
+	return r, nil
 }
 
 // Helpers.
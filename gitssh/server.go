@@ -0,0 +1,322 @@
+// Package gitssh serves gits repositories over SSH.
+package gitssh
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"strconv"
+	"strings"
+
+	"gits"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// ErrNotFound is returned by a Resolver when no repository has the requested name.
+var ErrNotFound = errors.New("repository not found")
+
+// Resolver maps the repository path of a command, e.g. "team/app.git", to a repo.
+type Resolver func(conn ssh.ConnMetadata, name string) (*gits.Repo, error)
+
+// PublicKeyAuth returns the user a key belongs to, or an error to reject the key.
+type PublicKeyAuth func(conn ssh.ConnMetadata, key ssh.PublicKey) (string, error)
+
+type Server struct {
+	Resolve    Resolver
+	PublicKey  PublicKeyAuth   // Nil rejects every client unless Anonymous is set.
+	Authorizer gits.Authorizer // Nil allows every operation.
+	HostKeys   []ssh.Signer
+	ErrorLog   *log.Logger // Nil uses the log package.
+
+	// Anonymous lets clients in as an anonymous user, with an empty user name for the Authorizer.
+	// Without PublicKey no key is asked for, otherwise the keys PublicKey rejects get in too.
+	Anonymous bool
+}
+
+// ErrNoClientAuth is returned by Serve when neither PublicKey nor Anonymous lets a client in.
+var ErrNoClientAuth = errors.New("gitssh: no PublicKey and anonymous access is off")
+
+// Extension of ssh.Permissions holding the user returned by PublicKey.
+const userExtension = "gits-user"
+
+var services = map[string]bool{
+	"git-upload-pack":    true,
+	"git-receive-pack":   true,
+	"git-upload-archive": true,
+}
+
+func (s *Server) ListenAndServe(addr string) error {
+	l, err := net.Listen("tcp", addr)
+
+	if err != nil {
+		return err
+	}
+
+	return s.Serve(l)
+}
+
+// Serve accepts connections on l until it fails.
+func (s *Server) Serve(l net.Listener) error {
+	if s.PublicKey == nil && !s.Anonymous {
+		return ErrNoClientAuth
+	}
+
+	config := s.config()
+
+	for {
+		conn, err := l.Accept()
+
+		if err != nil {
+			return err
+		}
+
+		go s.serveConn(conn, config)
+	}
+}
+
+// ServeConn runs the SSH protocol on a single connection.
+func (s *Server) ServeConn(conn net.Conn) {
+	s.serveConn(conn, s.config())
+}
+
+func (s *Server) config() *ssh.ServerConfig {
+	config := &ssh.ServerConfig{}
+
+	// Without any callback, the handshake fails: no client gets in.
+	if s.PublicKey == nil {
+		config.NoClientAuth = s.Anonymous
+	} else {
+		config.PublicKeyCallback = func(conn ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
+			user, err := s.PublicKey(conn, key)
+
+			if err != nil && s.Anonymous {
+				return &ssh.Permissions{}, nil
+			}
+
+			if err != nil {
+				return nil, err
+			}
+
+			return &ssh.Permissions{Extensions: map[string]string{userExtension: user}}, nil
+		}
+	}
+
+	for _, key := range s.HostKeys {
+		config.AddHostKey(key)
+	}
+
+	return config
+}
+
+func (s *Server) serveConn(conn net.Conn, config *ssh.ServerConfig) {
+	defer conn.Close()
+
+	sshConn, chans, reqs, err := ssh.NewServerConn(conn, config)
+
+	if err != nil {
+		s.logf("ssh handshake with %s: %v", conn.RemoteAddr(), err)
+		return
+	}
+
+	defer sshConn.Close()
+
+	go ssh.DiscardRequests(reqs)
+
+	for newChan := range chans {
+		if newChan.ChannelType() != "session" {
+			newChan.Reject(ssh.UnknownChannelType, "only session channels are supported")
+			continue
+		}
+
+		ch, chReqs, err := newChan.Accept()
+
+		if err != nil {
+			s.logf("accepting channel: %v", err)
+			continue
+		}
+
+		go s.session(sshConn, ch, chReqs)
+	}
+}
+
+// session waits for the exec request of a channel, remembering GIT_PROTOCOL from env requests.
+func (s *Server) session(conn *ssh.ServerConn, ch ssh.Channel, reqs <-chan *ssh.Request) {
+	defer ch.Close()
+
+	gitProtocol := ""
+
+	for req := range reqs {
+		switch req.Type {
+		case "env":
+			var env struct{ Name, Value string }
+
+			if ssh.Unmarshal(req.Payload, &env) == nil && env.Name == "GIT_PROTOCOL" {
+				gitProtocol = env.Value
+			}
+
+			req.Reply(true, nil)
+
+		case "exec":
+			var exec struct{ Command string }
+
+			if err := ssh.Unmarshal(req.Payload, &exec); err != nil {
+				req.Reply(false, nil)
+				continue
+			}
+
+			req.Reply(true, nil)
+
+			status := s.exec(conn, ch, exec.Command, gitProtocol)
+			ch.SendRequest("exit-status", false, ssh.Marshal(struct{ Status uint32 }{status}))
+
+			return
+
+		default:
+			req.Reply(false, nil)
+		}
+	}
+}
+
+// exec runs a git command on the channel and returns its exit status.
+func (s *Server) exec(conn *ssh.ServerConn, ch ssh.Channel, command, gitProtocol string) uint32 {
+	service, name, err := parseCommand(command)
+
+	if err != nil {
+		fmt.Fprintf(ch.Stderr(), "fatal: %v\n", err)
+		return 128
+	}
+
+	repo, err := s.Resolve(conn, name)
+
+	if errors.Is(err, ErrNotFound) || (err == nil && repo == nil) {
+		fmt.Fprintf(ch.Stderr(), "fatal: '%s' does not appear to be a git repository\n", name)
+		return 128
+	}
+
+	if err != nil {
+		s.logf("resolving %s: %v", name, err)
+		fmt.Fprintln(ch.Stderr(), "fatal: internal server error")
+		return 128
+	}
+
+	user := ""
+
+	if conn.Permissions != nil {
+		user = conn.Permissions.Extensions[userExtension]
+	}
+
+	repo = repo.With(&gits.Session{User: user, Authorizer: s.Authorizer})
+	err = repo.Serve(ch, ch, service, protocolVersion(gitProtocol))
+
+	if err == nil || errors.Is(err, io.EOF) {
+		return 0
+	}
+
+	// Git shows ERR packets as "remote error", the advertisement has not been sent yet.
+	if errors.Is(err, gits.ErrUnauthorized) || errors.Is(err, gits.ErrForbidden) {
+		msg := "ERR " + err.Error() + "\n"
+		fmt.Fprintf(ch, "%04x%s", len(msg)+4, msg)
+
+		return 1
+	}
+
+	s.logf("%s %s: %v", service, name, err)
+	fmt.Fprintf(ch.Stderr(), "fatal: %v\n", err)
+
+	return 1
+}
+
+func (s *Server) logf(format string, args ...any) {
+	if s.ErrorLog != nil {
+		s.ErrorLog.Printf(format, args...)
+	} else {
+		log.Printf(format, args...)
+	}
+}
+
+// parseCommand splits "git-upload-pack '/team/app.git'" into the service and the repository name.
+// The "git upload-pack" spelling is accepted too.
+func parseCommand(command string) (string, string, error) {
+	command = strings.TrimSpace(command)
+
+	if strings.HasPrefix(command, "git ") {
+		command = "git-" + strings.TrimLeft(command[4:], " ")
+	}
+
+	service, arg, _ := strings.Cut(command, " ")
+
+	if !services[service] {
+		return "", "", fmt.Errorf("unsupported command: %s", command)
+	}
+
+	path, err := unquote(strings.TrimSpace(arg))
+
+	if err != nil {
+		return "", "", err
+	}
+
+	name := strings.Trim(path, "/")
+
+	if name == "" {
+		return "", "", fmt.Errorf("missing repository path")
+	}
+
+	for _, part := range strings.Split(name, "/") {
+		if part == "" || part == "." || part == ".." {
+			return "", "", fmt.Errorf("invalid repository path: %s", path)
+		}
+	}
+
+	return service, name, nil
+}
+
+// unquote undoes the shell quoting git applies to the path, including quotes escaped with a backslash.
+func unquote(s string) (string, error) {
+	var out strings.Builder
+
+	for len(s) > 0 {
+		switch s[0] {
+		case '\'':
+			end := strings.IndexByte(s[1:], '\'')
+
+			if end == -1 {
+				return "", fmt.Errorf("unterminated quote")
+			}
+
+			out.WriteString(s[1 : end+1])
+			s = s[end+2:]
+
+		case '\\':
+			if len(s) < 2 {
+				return "", fmt.Errorf("trailing backslash")
+			}
+
+			out.WriteByte(s[1])
+			s = s[2:]
+
+		default:
+			out.WriteByte(s[0])
+			s = s[1:]
+		}
+	}
+
+	return out.String(), nil
+}
+
+// protocolVersion returns the highest version GIT_PROTOCOL asks for, e.g. 2 for "version=2".
+func protocolVersion(gitProtocol string) int {
+	version := 0
+
+	for _, param := range strings.Split(gitProtocol, ":") {
+		if v, ok := strings.CutPrefix(param, "version="); ok {
+			if n, err := strconv.Atoi(v); err == nil && n > version {
+				version = n
+			}
+		}
+	}
+
+	return version
+}
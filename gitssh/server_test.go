@@ -0,0 +1,226 @@
+package gitssh
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"gits"
+
+	"golang.org/x/crypto/ssh"
+)
+
+func TestServeGit(t *testing.T) {
+	for _, tool := range []string{"git", "ssh"} {
+		if _, err := exec.LookPath(tool); err != nil {
+			t.Skipf("%s not found", tool)
+		}
+	}
+
+	dir := t.TempDir()
+	hostKey := newSigner(t)
+	client := writeKey(t, dir, "client")
+	writeKey(t, dir, "stranger")
+
+	known := func(conn ssh.ConnMetadata, key ssh.PublicKey) (string, error) {
+		if bytes.Equal(key.Marshal(), client.PublicKey().Marshal()) {
+			return "alice", nil
+		}
+
+		return "", errors.New("unknown key")
+	}
+
+	// Anonymous users may only read.
+	readOnly := gits.AuthorizerFunc(func(req *gits.AuthRequest) error {
+		if req.Op == gits.OP_WRITE && req.User == "" {
+			return gits.ErrForbidden
+		}
+
+		return nil
+	})
+
+	tests := []struct {
+		name      string
+		publicKey PublicKeyAuth
+		anonymous bool
+		key       string
+		clone     bool
+		push      bool
+	}{
+		{"known key", known, false, "client", true, true},
+		{"unknown key", known, false, "stranger", false, false},
+		{"no key", known, false, "", false, false},
+		{"anonymous", nil, true, "", true, false},
+		{"anonymous with an unknown key", known, true, "stranger", true, false},
+		{"anonymous with a known key", known, true, "client", true, true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			repo, err := gits.InitRepo(&gits.Config{Dir: t.TempDir(), Name: "test.git"})
+
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			head, err := repo.CommitFiles(&gits.CommitFilesSpec{
+				Branch:  "main",
+				Author:  &gits.Signature{Name: "t", Email: "t@t", When: time.Unix(1700000000, 0)},
+				Message: "first",
+				Ops:     []gits.FileOp{{Action: gits.FILE_ADD, Path: "a", Content: []byte("a\n")}},
+			})
+
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			server := &Server{
+				Resolve:    func(conn ssh.ConnMetadata, name string) (*gits.Repo, error) { return repo, nil },
+				PublicKey:  test.publicKey,
+				Anonymous:  test.anonymous,
+				Authorizer: readOnly,
+				HostKeys:   []ssh.Signer{hostKey},
+				ErrorLog:   log.New(io.Discard, "", 0),
+			}
+
+			l, err := net.Listen("tcp", "127.0.0.1:0")
+
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			defer l.Close()
+			go server.Serve(l)
+
+			url := "ssh://git@" + l.Addr().String() + "/test.git"
+			sshCommand := "ssh -o BatchMode=yes -o StrictHostKeyChecking=no -o UserKnownHostsFile=/dev/null -o LogLevel=ERROR -F /dev/null"
+
+			if test.key != "" {
+				sshCommand += " -o IdentitiesOnly=yes -i " + filepath.Join(dir, test.key)
+			} else {
+				sshCommand += " -o PubkeyAuthentication=no"
+			}
+
+			work := t.TempDir()
+			git := func(args ...string) error {
+				cmd := exec.Command("git", args...)
+				cmd.Dir = work
+				cmd.Env = append(os.Environ(),
+					"GIT_SSH_COMMAND="+sshCommand, "HOME="+work, "GIT_CONFIG_NOSYSTEM=1",
+					"GIT_AUTHOR_NAME=t", "GIT_AUTHOR_EMAIL=t@t", "GIT_COMMITTER_NAME=t", "GIT_COMMITTER_EMAIL=t@t",
+				)
+
+				if out, err := cmd.CombinedOutput(); err != nil {
+					return fmt.Errorf("git %s: %v\n%s", strings.Join(args, " "), err, out)
+				}
+
+				return nil
+			}
+
+			err = git("clone", "-q", url, "clone")
+
+			if cloned := err == nil; cloned != test.clone {
+				t.Fatalf("cloned = %v, want %v: %v", cloned, test.clone, err)
+			}
+
+			if !test.clone {
+				if err := git("init", "-q", "-b", "main", "clone"); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			work = filepath.Join(work, "clone")
+
+			if err := git("commit", "-q", "--allow-empty", "-m", "second"); err != nil {
+				t.Fatal(err)
+			}
+
+			err = git("push", "-q", url, "HEAD:refs/heads/pushed")
+
+			if pushed := err == nil; pushed != test.push {
+				t.Fatalf("pushed = %v, want %v: %v", pushed, test.push, err)
+			}
+
+			pushed, err := repo.ResolveRevision("refs/heads/pushed")
+
+			if test.push && (err != nil || pushed == head) {
+				t.Fatalf("refs/heads/pushed = %s: %v", pushed, err)
+			}
+
+			if !test.push && err == nil {
+				t.Fatalf("refs/heads/pushed = %s after a refused push", pushed)
+			}
+		})
+	}
+}
+
+func TestServeWithoutClientAuth(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer l.Close()
+
+	server := &Server{HostKeys: []ssh.Signer{newSigner(t)}}
+
+	if err := server.Serve(l); !errors.Is(err, ErrNoClientAuth) {
+		t.Fatalf("Serve = %v, want ErrNoClientAuth", err)
+	}
+}
+
+func newSigner(t *testing.T) ssh.Signer {
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	signer, err := ssh.NewSignerFromKey(key)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return signer
+}
+
+// writeKey writes a new private key in the OpenSSH format to dir/name for ssh -i.
+func writeKey(t *testing.T, dir, name string) ssh.Signer {
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	block, err := ssh.MarshalPrivateKey(key, name)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := os.WriteFile(filepath.Join(dir, name), pem.EncodeToMemory(block), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	signer, err := ssh.NewSignerFromKey(key)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return signer
+}
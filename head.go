@@ -0,0 +1,48 @@
+package gits
+
+import "fmt"
+
+// SetHead points HEAD to a branch, which becomes the default branch clients check out. The branch
+// does not have to exist yet, e.g: refs/heads/main
+func (repo *Repo) SetHead(ref string) error {
+	if !validRefName(ref) {
+		return fmt.Errorf("invalid ref name: %s", ref)
+	}
+
+	tx, err := repo.refs.Transaction()
+
+	if err != nil {
+		return err
+	}
+
+	if err := tx.SetSymref("HEAD", ref); err != nil {
+		tx.Abort()
+		return err
+	}
+
+	return tx.Commit(repo.identity(), "")
+}
+
+// SymbolicRefs returns the target of every symbolic ref by name, HEAD included.
+func (repo *Repo) SymbolicRefs() (map[string]string, error) {
+	symrefs := map[string]string{}
+	head, err := repo.refs.Get("HEAD")
+
+	if err != nil {
+		return nil, err
+	}
+
+	if head != nil && head.Target != "" {
+		symrefs["HEAD"] = head.Target
+	}
+
+	err = repo.refs.Iterate("", func(ref *Ref) error {
+		if ref.Target != "" {
+			symrefs[ref.Name] = ref.Target
+		}
+
+		return nil
+	})
+
+	return symrefs, err
+}
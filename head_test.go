@@ -0,0 +1,124 @@
+package gits
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestSetHead(t *testing.T) {
+	repo := newTestRepo(t, &Config{RefStorage: REF_STORAGE_FILES})
+	dir := repoPath(repo)
+
+	headFile := func() string {
+		data, err := os.ReadFile(filepath.Join(dir, "HEAD"))
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		return string(data)
+	}
+
+	symrefs := func() string {
+		refs, err := repo.SymbolicRefs()
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		return fmt.Sprint(refs)
+	}
+
+	advertised := func() string {
+		adv, err := repo.Advertise(nil, nil, "git-upload-pack", nil)
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		return strings.Join(advertisedRefs(t, adv), " ")
+	}
+
+	// A new repo has a dangling HEAD, reported but not advertised.
+	if got := symrefs(); got != "map[HEAD:refs/heads/main]" {
+		t.Fatalf("symbolic refs = %s", got)
+	}
+
+	if got := advertised(); got != "" {
+		t.Fatalf("advertised %s", got)
+	}
+
+	commit, err := repo.CommitFiles(&CommitFilesSpec{
+		Branch:  "other",
+		Author:  testSignature(),
+		Message: "first",
+		Ops:     []FileOp{{Action: FILE_ADD, Path: "a", Content: []byte("a\n")}},
+	})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if got := advertised(); got != "refs/heads/other" {
+		t.Fatalf("advertised %s with a dangling HEAD", got)
+	}
+
+	if got := dumbFile(t, repo, "HEAD"); got != "ref: refs/heads/main\n" {
+		t.Fatalf("HEAD = %q", got)
+	}
+
+	if err := repo.SetHead("refs/heads/other"); err != nil {
+		t.Fatal(err)
+	}
+
+	if got := headFile(); got != "ref: refs/heads/other\n" {
+		t.Fatalf("HEAD = %q", got)
+	}
+
+	if hash, _ := repo.resolveRef("HEAD"); hash != commit {
+		t.Fatalf("HEAD resolves to %s, want %s", hash, commit)
+	}
+
+	if got := advertised(); got != "HEAD refs/heads/other" {
+		t.Fatalf("advertised %s", got)
+	}
+
+	if got := strings.TrimSpace(runGit(t, dir, "symbolic-ref", "HEAD")); got != "refs/heads/other" {
+		t.Fatalf("git symbolic-ref HEAD = %s", got)
+	}
+
+	runGit(t, dir, "fsck", "--strict")
+
+	// Symbolic refs other than HEAD, e.g. written by git.
+	runGit(t, dir, "symbolic-ref", "refs/remotes/origin/HEAD", "refs/remotes/origin/main")
+
+	if got := symrefs(); got != "map[HEAD:refs/heads/other refs/remotes/origin/HEAD:refs/remotes/origin/main]" {
+		t.Fatalf("symbolic refs = %s", got)
+	}
+
+	for _, target := range []string{"other", "HEAD", "refs/heads/", "refs/heads/a..b", "refs/heads/a.lock", "refs/heads/a b", "refs/heads/a@{1}"} {
+		if err := repo.SetHead(target); err == nil {
+			t.Errorf("SetHead(%q) succeeded", target)
+		}
+
+		if got := headFile(); got != "ref: refs/heads/other\n" {
+			t.Fatalf("HEAD = %q after SetHead(%q)", got, target)
+		}
+	}
+
+	// HEAD may point to a branch that does not exist yet.
+	if err := repo.SetHead("refs/heads/later"); err != nil {
+		t.Fatal(err)
+	}
+
+	if hash, _ := repo.resolveRef("HEAD"); hash != "" {
+		t.Fatalf("HEAD resolves to %s, want nothing", hash)
+	}
+
+	if got := advertised(); got != "refs/heads/other" {
+		t.Fatalf("advertised %s with a dangling HEAD", got)
+	}
+}
@@ -0,0 +1,115 @@
+package gits
+
+import (
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// newTestRepo creates a bare repo named test.git in a temporary directory.
+func newTestRepo(t *testing.T, conf *Config) *Repo {
+	t.Helper()
+
+	if conf == nil {
+		conf = &Config{}
+	}
+
+	if conf.Dir == "" {
+		conf.Dir = t.TempDir()
+	}
+
+	if conf.Name == "" {
+		conf.Name = "test.git"
+	}
+
+	repo, err := InitRepo(conf)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return repo
+}
+
+// runGit runs git in dir and returns its output, the test is skipped without git.
+func runGit(t *testing.T, dir string, args ...string) string {
+	t.Helper()
+
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git not found")
+	}
+
+	cmd := exec.Command("git", args...)
+	cmd.Dir = dir
+	cmd.Env = append(os.Environ(),
+		"GIT_AUTHOR_NAME=t", "GIT_AUTHOR_EMAIL=t@t", "GIT_COMMITTER_NAME=t", "GIT_COMMITTER_EMAIL=t@t",
+		"GIT_CONFIG_NOSYSTEM=1", "HOME="+t.TempDir(),
+	)
+
+	out, err := cmd.CombinedOutput()
+
+	if err != nil {
+		t.Fatalf("git %s: %v\n%s", strings.Join(args, " "), err, out)
+	}
+
+	return string(out)
+}
+
+// repoPath is the directory of the repo on disk.
+func repoPath(repo *Repo) string {
+	return filepath.Join(repo.conf.Dir, repo.conf.Name)
+}
+
+func testSignature() *Signature {
+	return &Signature{Name: "t", Email: "t@t", When: time.Unix(1700000000, 0).UTC()}
+}
+
+// readFile returns the content of a file at a revision.
+func readFile(t *testing.T, repo *Repo, rev string) string {
+	t.Helper()
+
+	hash, err := repo.ResolveRevision(rev)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	object, err := repo.Object(hash)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return string(object.Data)
+}
+
+// keepBlobs points refs/keep/<name> to a tree of the blobs, git repack only packs reachable objects.
+func keepBlobs(t *testing.T, repo *Repo, name string, blobs []string) {
+	t.Helper()
+
+	entries := []TreeEntry{}
+
+	for _, hash := range blobs {
+		entries = append(entries, TreeEntry{Mode: MODE_FILE, Name: hash, Hash: hash})
+	}
+
+	tree, err := repo.WriteTree(entries)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := repo.updateRef("refs/keep/"+name, "", tree, nil, "test"); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// plainFS returns a DiskFS with only the methods of FS: it cannot open, rename or remove files.
+func plainFS(root string) (FS, error) {
+	disk, err := NewDiskFS(root)
+
+	return struct{ FS }{disk}, err
+}
@@ -0,0 +1,221 @@
+package gits
+
+import (
+	"errors"
+	"fmt"
+	iofs "io/fs"
+)
+
+// ErrNoRename is returned when a change needs to remove or rename files on an FS without RenameFS.
+var ErrNoRename = errors.New("the FS cannot remove or rename files")
+
+// lockTx changes files through <file>.lock files renamed into place, like git's lockfiles. Every
+// file is written to its lock first, commit then renames the locks in the order they were staged.
+// When a step fails, the files already changed get their previous content back.
+//
+// On a CreateFS a lock that already exists fails the change, whoever took it. Without RenameFS the
+// files are written in place on commit and cannot be removed.
+type lockTx struct {
+	fs     FS
+	rename RenameFS // Nil when the FS has no locks.
+	steps  []*lockStep
+	paths  map[string]*lockStep
+}
+
+type lockStep struct {
+	path   string
+	data   []byte // Nil removes the file.
+	old    []byte // Content before the transaction.
+	exists bool
+}
+
+func newLockTx(fs FS) *lockTx {
+	rename, _ := fs.(RenameFS)
+
+	return &lockTx{fs: fs, rename: rename, paths: map[string]*lockStep{}}
+}
+
+// read returns the content of a file as staged so far.
+func (tx *lockTx) read(path string) ([]byte, bool, error) {
+	if step, ok := tx.paths[path]; ok {
+		return step.data, step.data != nil, nil
+	}
+
+	if tx.fs.Stat(path)[0] != 1 {
+		return nil, false, nil
+	}
+
+	data, err := tx.fs.ReadFile(path)
+
+	return data, err == nil, err
+}
+
+// write stages the new content of a file in its lock.
+func (tx *lockTx) write(path string, data []byte) error {
+	if data == nil {
+		data = []byte{}
+	}
+
+	if tx.rename != nil {
+		var err error
+
+		if _, locked := tx.paths[path]; locked {
+			err = tx.fs.WriteFile(path+".lock", data)
+		} else {
+			err = createLock(tx.fs, path, data)
+		}
+
+		if err != nil {
+			return err
+		}
+	}
+
+	return tx.stage(path, data)
+}
+
+// remove stages the removal of a file, nothing happens if there is none. The file is locked until commit.
+func (tx *lockTx) remove(path string) error {
+	_, locked := tx.paths[path]
+
+	if !locked && tx.fs.Stat(path)[0] != 1 {
+		return nil
+	}
+
+	if tx.rename == nil {
+		return fmt.Errorf("remove %s: %w", path, ErrNoRename)
+	}
+
+	if !locked {
+		if err := createLock(tx.fs, path, []byte{}); err != nil {
+			return err
+		}
+	}
+
+	return tx.stage(path, nil)
+}
+
+func (tx *lockTx) stage(path string, data []byte) error {
+	if step, ok := tx.paths[path]; ok {
+		step.data = data
+
+		return nil
+	}
+
+	old, exists, err := tx.read(path)
+
+	if err != nil {
+		return err
+	}
+
+	step := &lockStep{path: path, data: data, old: old, exists: exists}
+	tx.steps = append(tx.steps, step)
+	tx.paths[path] = step
+
+	return nil
+}
+
+// commit renames the locks over their files and removes the files staged for removal.
+func (tx *lockTx) commit() error {
+	for i, step := range tx.steps {
+		var err error
+
+		switch {
+		case step.data != nil && tx.rename == nil:
+			err = tx.fs.WriteFile(step.path, step.data)
+		case step.data != nil:
+			err = tx.rename.Rename(step.path+".lock", step.path)
+		case tx.fs.Stat(step.path)[0] == 1:
+			if err = tx.rename.Remove(step.path); err == nil {
+				err = tx.rename.Remove(step.path + ".lock")
+			}
+		default:
+			err = tx.rename.Remove(step.path + ".lock")
+		}
+
+		if err != nil {
+			tx.rollback(i)
+			return err
+		}
+	}
+
+	return nil
+}
+
+// rollback restores the files of the first done steps and removes the locks of the others.
+func (tx *lockTx) rollback(done int) {
+	for i := done - 1; i >= 0; i-- {
+		step := tx.steps[i]
+
+		if step.exists {
+			tx.fs.WriteFile(step.path, step.old)
+		} else if tx.rename != nil && tx.fs.Stat(step.path)[0] == 1 {
+			tx.rename.Remove(step.path)
+		}
+	}
+
+	if tx.rename == nil {
+		return
+	}
+
+	for _, step := range tx.steps[done:] {
+		tx.rename.Remove(step.path + ".lock")
+	}
+}
+
+// abort removes the locks, no file was changed.
+func (tx *lockTx) abort() {
+	tx.rollback(0)
+}
+
+// replaceFile writes a file through <file>.lock renamed over it, readers see the old or the new
+// content. An FS without RenameFS gets the file written in place.
+func replaceFile(fs FS, path string, data []byte) error {
+	rename, ok := fs.(RenameFS)
+
+	if !ok {
+		return fs.WriteFile(path, data)
+	}
+
+	if err := createLock(fs, path, data); err != nil {
+		return err
+	}
+
+	if err := rename.Rename(path+".lock", path); err != nil {
+		rename.Remove(path + ".lock")
+
+		return err
+	}
+
+	return nil
+}
+
+// createLock writes <path>.lock. On a CreateFS it fails if the lock exists, another process may be
+// changing the file.
+func createLock(fs FS, path string, data []byte) error {
+	create, ok := fs.(CreateFS)
+
+	if !ok {
+		return fs.WriteFile(path+".lock", data)
+	}
+
+	if err := create.Create(path+".lock", data); err != nil {
+		if errors.Is(err, iofs.ErrExist) {
+			return fmt.Errorf("unable to create %s.lock, another process may be changing it: %w", path, err)
+		}
+
+		return err
+	}
+
+	return nil
+}
+
+// removeFile removes a file, it fails with ErrNoRename on an FS without RenameFS.
+func removeFile(fs FS, path string) error {
+	rename, ok := fs.(RenameFS)
+
+	if !ok {
+		return fmt.Errorf("remove %s: %w", path, ErrNoRename)
+	}
+
+	return rename.Remove(path)
+}
@@ -0,0 +1,518 @@
+package gits
+
+import (
+	"container/heap"
+	"encoding/base64"
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+type logWalker struct {
+	*commitGraph
+	opts *LogOptions
+}
+
+// commitQueue is a heap of commits ordered by less, ties keep insertion order.
+type commitQueue struct {
+	items []*Commit
+	seq   []int
+	next  int
+	less  func(a, b *Commit) bool
+}
+
+// Log lists the commits selected by opts, one page at a time. The walk stops at the first commit of
+// the next page, the cursor holds the commits left to walk and the excluded tips.
+func (repo *Repo) Log(opts *LogOptions) (*LogPage, error) {
+	if opts == nil {
+		opts = &LogOptions{}
+	}
+
+	var revs []string
+	var err error
+
+	if opts.Cursor != "" {
+		revs, err = decodeLogCursor(opts.Cursor)
+	} else {
+		revs, err = repo.pinRevisions(ternary(len(opts.Revisions) == 0, []string{"HEAD"}, opts.Revisions))
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	matchers := map[string]*regexp.Regexp{}
+
+	for name, expr := range map[string]string{"author": opts.Author, "committer": opts.Committer, "grep": opts.Grep} {
+		if expr == "" {
+			continue
+		}
+
+		if matchers[name], err = regexp.Compile(expr); err != nil {
+			return nil, fmt.Errorf("invalid %s pattern: %w", name, err)
+		}
+	}
+
+	w := &logWalker{
+		commitGraph: repo.newCommitGraph(),
+		opts:        opts,
+	}
+
+	include, exclude, err := w.parseRevisions(revs)
+
+	if err != nil {
+		return nil, err
+	}
+
+	uninteresting := map[string]bool{}
+
+	if len(exclude) > 0 {
+		if _, uninteresting, err = w.limit(include, exclude); err != nil {
+			return nil, err
+		}
+	}
+
+	page := &LogPage{Commits: []*Commit{}}
+
+	emit := func(commit *Commit) bool {
+		if matchers["author"] != nil && !matchers["author"].MatchString(commit.Author.Name+" <"+commit.Author.Email+">") {
+			return true
+		}
+
+		if matchers["committer"] != nil && !matchers["committer"].MatchString(commit.Committer.Name+" <"+commit.Committer.Email+">") {
+			return true
+		}
+
+		if matchers["grep"] != nil && !matchers["grep"].MatchString(commit.Message) {
+			return true
+		}
+
+		if opts.Limit > 0 && len(page.Commits) == opts.Limit {
+			return false
+		}
+
+		page.Commits = append(page.Commits, commit)
+
+		return true
+	}
+
+	frontier, err := w.walk(include, uninteresting, opts.Cursor != "", emit)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if len(frontier) > 0 {
+		for _, hash := range exclude {
+			frontier = append(frontier, "^"+hash)
+		}
+
+		page.Next = encodeLogCursor(frontier)
+	}
+
+	return page, nil
+}
+
+// pinRevisions resolves every revision to commit hashes, so the cursor of
+// later pages is not affected by refs moving between requests.
+func (repo *Repo) pinRevisions(revs []string) ([]string, error) {
+	pinned := []string{}
+
+	for _, rev := range revs {
+		prefix, sep, sides := splitRange(rev)
+
+		for i, side := range sides {
+			hash, err := repo.resolveCommit(ternary(side == "", "HEAD", side))
+
+			if err != nil {
+				return nil, err
+			}
+
+			sides[i] = hash
+		}
+
+		pinned = append(pinned, prefix+strings.Join(sides, sep))
+	}
+
+	return pinned, nil
+}
+
+// parseRevisions splits pinned revisions into tips to include and tips whose history is excluded.
+func (w *logWalker) parseRevisions(revs []string) ([]string, []string, error) {
+	include := []string{}
+	exclude := []string{}
+
+	for _, rev := range revs {
+		prefix, sep, sides := splitRange(rev)
+
+		switch {
+		case prefix == "^":
+			exclude = append(exclude, sides[0])
+
+		case sep == "..":
+			exclude = append(exclude, sides[0])
+			include = append(include, sides[1])
+
+		case sep == "...":
+			include = append(include, sides...)
+
+			// Commits reachable from both sides are excluded.
+			bases, err := w.mergeBases(sides[0], sides[1:])
+
+			if err != nil {
+				return nil, nil, err
+			}
+
+			exclude = append(exclude, bases...)
+
+		default:
+			include = append(include, sides[0])
+		}
+	}
+
+	return include, exclude, nil
+}
+
+// walk visits the history of include that is not uninteresting and passes the commits to show to
+// emit in order. Once emit refuses a commit, it returns that commit and the ones still queued, in the
+// order to queue them again: walking from them with resume set passes the rest of the commits.
+func (w *logWalker) walk(include []string, uninteresting map[string]bool, resume bool, emit func(commit *Commit) bool) ([]string, error) {
+	byDate := func(a, b *Commit) bool {
+		return a.Committer.When.After(b.Committer.When)
+	}
+
+	queue := &commitQueue{less: byDate}
+	visited := map[string]bool{}
+	shown := map[string]bool{}
+	children := map[string]int{}
+	edges := map[string][]string{}
+	order := []*Commit{}
+
+	for _, hash := range include {
+		if uninteresting[hash] || visited[hash] {
+			continue
+		}
+
+		commit, err := w.commit(hash)
+
+		if err != nil {
+			return nil, err
+		}
+
+		visited[hash] = true
+		heap.Push(queue, commit)
+	}
+
+	for queue.Len() > 0 {
+		commit := heap.Pop(queue).(*Commit)
+		order = append(order, commit)
+
+		parents, show, err := w.simplify(commit)
+
+		if err != nil {
+			return nil, err
+		}
+
+		shown[commit.Hash] = show
+
+		// Without topological ordering, commits are shown as they are walked.
+		if w.opts.Order == LOG_ORDER_DEFAULT && show && !emit(commit) {
+			frontier := []string{commit.Hash}
+
+			for queue.Len() > 0 {
+				frontier = append(frontier, heap.Pop(queue).(*Commit).Hash)
+			}
+
+			return frontier, nil
+		}
+
+		for _, parent := range parents {
+			if uninteresting[parent] {
+				continue
+			}
+
+			edges[commit.Hash] = append(edges[commit.Hash], parent)
+			children[parent]++
+
+			if visited[parent] {
+				continue
+			}
+
+			next, err := w.commit(parent)
+
+			if err != nil {
+				return nil, err
+			}
+
+			visited[parent] = true
+			heap.Push(queue, next)
+		}
+	}
+
+	if w.opts.Order == LOG_ORDER_DEFAULT {
+		return nil, nil
+	}
+
+	// A resumed sort starts from the commits that were ready, in the order they were queued.
+	tips := []*Commit{}
+
+	if resume {
+		for _, hash := range include {
+			if visited[hash] && !uninteresting[hash] {
+				tips = append(tips, w.commits[hash])
+			}
+		}
+	} else {
+		// Tips are pushed in reverse for the stack, so the newest tip comes out first.
+		for i := len(order) - 1; i >= 0; i-- {
+			if children[order[i].Hash] == 0 {
+				tips = append(tips, order[i])
+			}
+		}
+	}
+
+	return w.sortTopo(tips, edges, children, shown, emit), nil
+}
+
+// sortTopo passes commits to emit so that no parent comes before all of its children, starting from
+// the tips. Once emit refuses a commit, it returns the commits that were ready, see walk.
+func (w *logWalker) sortTopo(tips []*Commit, edges map[string][]string, children map[string]int, shown map[string]bool, emit func(commit *Commit) bool) []string {
+	var ready *commitQueue
+	var stack []*Commit
+
+	switch w.opts.Order {
+	case LOG_ORDER_DATE:
+		ready = &commitQueue{less: func(a, b *Commit) bool { return a.Committer.When.After(b.Committer.When) }}
+	case LOG_ORDER_AUTHOR_DATE:
+		ready = &commitQueue{less: func(a, b *Commit) bool { return a.Author.When.After(b.Author.When) }}
+	}
+
+	push := func(commit *Commit) {
+		if ready != nil {
+			heap.Push(ready, commit)
+		} else {
+			stack = append(stack, commit)
+		}
+	}
+
+	for _, tip := range tips {
+		push(tip)
+	}
+
+	for (ready != nil && ready.Len() > 0) || len(stack) > 0 {
+		var commit *Commit
+
+		if ready != nil {
+			commit = heap.Pop(ready).(*Commit)
+		} else {
+			commit, stack = stack[len(stack)-1], stack[:len(stack)-1]
+		}
+
+		// The refused commit is pushed first, it comes out first again: it wins ties in the
+		// queue and is pushed last on the stack.
+		if shown[commit.Hash] && !emit(commit) {
+			frontier := []string{commit.Hash}
+
+			for ready != nil && ready.Len() > 0 {
+				frontier = append(frontier, heap.Pop(ready).(*Commit).Hash)
+			}
+
+			if ready == nil {
+				frontier = []string{}
+
+				for _, pending := range append(stack, commit) {
+					frontier = append(frontier, pending.Hash)
+				}
+			}
+
+			return frontier
+		}
+
+		parents := edges[commit.Hash]
+
+		// Like git, the side branches of a merge come out of the stack before its first parent.
+		for _, parent := range parents {
+			children[parent]--
+
+			if children[parent] == 0 {
+				push(w.commits[parent])
+			}
+		}
+	}
+
+	return nil
+}
+
+// simplify returns the parents to follow from commit and whether the commit is shown.
+// With path limiting a commit that is TREESAME to a parent is hidden and only that parent is followed.
+func (w *logWalker) simplify(commit *Commit) ([]string, bool, error) {
+	parents := commit.Parents
+
+	if w.opts.FirstParent && len(parents) > 1 {
+		parents = parents[:1]
+	}
+
+	if len(w.opts.Paths) == 0 {
+		return parents, true, nil
+	}
+
+	if len(parents) == 0 {
+		same, err := w.treesame(commit.Tree, "")
+		return parents, !same, err
+	}
+
+	for _, parent := range parents {
+		parentCommit, err := w.commit(parent)
+
+		if err != nil {
+			return nil, false, err
+		}
+
+		same, err := w.treesame(commit.Tree, parentCommit.Tree)
+
+		if err != nil {
+			return nil, false, err
+		}
+
+		if same {
+			return []string{parent}, false, nil
+		}
+	}
+
+	return parents, true, nil
+}
+
+// treesame reports whether both trees have the same content at every limited path.
+func (w *logWalker) treesame(a, b string) (bool, error) {
+	for _, path := range w.opts.Paths {
+		hashA, err := w.repo.treePathHash(a, path)
+
+		if err != nil {
+			return false, err
+		}
+
+		hashB, err := w.repo.treePathHash(b, path)
+
+		if err != nil {
+			return false, err
+		}
+
+		if hashA != hashB {
+			return false, nil
+		}
+	}
+
+	return true, nil
+}
+
+// treePathHash returns the hash of the entry at path in a tree, or an empty string if it does not exist.
+func (repo *Repo) treePathHash(tree, path string) (string, error) {
+	hash := tree
+
+	for _, name := range strings.Split(strings.Trim(path, "/"), "/") {
+		if hash == "" || name == "" {
+			break
+		}
+
+		object, err := repo.Object(hash)
+
+		if err != nil {
+			return "", err
+		}
+
+		if object.Type != OBJ_TREE {
+			return "", nil
+		}
+
+		entries, err := object.Entries()
+
+		if err != nil {
+			return "", err
+		}
+
+		next := ""
+
+		for _, entry := range entries {
+			if entry.Name == name {
+				next = entry.Hash
+				break
+			}
+		}
+
+		hash = next
+	}
+
+	return hash, nil
+}
+
+// splitRange splits "^a", "a..b" and "a...b" into their prefix, separator and sides.
+func splitRange(rev string) (string, string, []string) {
+	if strings.HasPrefix(rev, "^") && !strings.HasPrefix(rev, "^{") {
+		return "^", "", []string{rev[1:]}
+	}
+
+	for _, sep := range []string{"...", ".."} {
+		if idx := strings.Index(rev, sep); idx != -1 {
+			return "", sep, []string{rev[:idx], rev[idx+len(sep):]}
+		}
+	}
+
+	return "", "", []string{rev}
+}
+
+// encodeLogCursor encodes the commits left to walk and the excluded tips, prefixed with "^".
+func encodeLogCursor(revs []string) string {
+	return base64.RawURLEncoding.EncodeToString([]byte(strings.Join(revs, " ")))
+}
+
+func decodeLogCursor(cursor string) ([]string, error) {
+	raw, err := base64.RawURLEncoding.DecodeString(cursor)
+
+	if err != nil {
+		return nil, fmt.Errorf("invalid cursor")
+	}
+
+	revs := strings.Fields(string(raw))
+
+	if len(revs) == 0 {
+		return nil, fmt.Errorf("invalid cursor")
+	}
+
+	for _, rev := range revs {
+		if !isHash(strings.TrimPrefix(rev, "^")) {
+			return nil, fmt.Errorf("invalid cursor")
+		}
+	}
+
+	return revs, nil
+}
+
+// heap.Interface
+func (q *commitQueue) Len() int { return len(q.items) }
+
+func (q *commitQueue) Less(i, j int) bool {
+	if q.less(q.items[i], q.items[j]) {
+		return true
+	}
+
+	return !q.less(q.items[j], q.items[i]) && q.seq[i] < q.seq[j]
+}
+
+func (q *commitQueue) Swap(i, j int) {
+	q.items[i], q.items[j] = q.items[j], q.items[i]
+	q.seq[i], q.seq[j] = q.seq[j], q.seq[i]
+}
+
+func (q *commitQueue) Push(x any) {
+	q.items = append(q.items, x.(*Commit))
+	q.seq = append(q.seq, q.next)
+	q.next++
+}
+
+func (q *commitQueue) Pop() any {
+	item := q.items[len(q.items)-1]
+	q.items = q.items[:len(q.items)-1]
+	q.seq = q.seq[:len(q.seq)-1]
+
+	return item
+}
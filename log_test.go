@@ -0,0 +1,150 @@
+package gits
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestLogPages(t *testing.T) {
+	repo := newTestRepo(t, nil)
+	branches := 0
+
+	at := func(offset int) *Signature {
+		who := testSignature()
+		who.When = who.When.Add(time.Duration(offset) * time.Second)
+
+		return who
+	}
+
+	// commit changes path on top of parent, authored at author and committed at committer.
+	commit := func(parent, path string, author, committer int) string {
+		_, err := repo.ResolveRevision(parent + ":" + path)
+		branches++
+
+		if parent != "" {
+			if err := repo.updateRef(fmt.Sprintf("refs/heads/b%d", branches), "", parent, nil, "test"); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		hash, err := repo.CommitFiles(&CommitFilesSpec{
+			Branch:    fmt.Sprintf("b%d", branches),
+			Parent:    parent,
+			Author:    at(author),
+			Committer: at(committer),
+			Message:   fmt.Sprintf("change %s %d", path, branches),
+			Ops:       []FileOp{{Action: ternary[uint8](err == nil, FILE_MODIFY, FILE_ADD), Path: path, Content: []byte(fmt.Sprint(branches))}},
+		})
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		return hash
+	}
+
+	merge := func(parents []string, when int) string {
+		hash, err := repo.WriteCommit(&CommitSpec{Tree: readTree(t, repo, parents[0]), Parents: parents, Author: at(when), Message: "merge\n"})
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		return hash
+	}
+
+	base := commit("", "a", 0, 0)
+	a1 := commit(base, "a", 10, 10)
+	a2 := commit(a1, "a", 20, 20)
+	b1 := commit(base, "b", 15, 15)
+	b2 := commit(b1, "b", 100, 30)
+	m1 := merge([]string{a2, b2}, 40)
+	c1 := commit(m1, "a", 50, 50)
+	c2 := commit(c1, "b", 55, 55)
+	d1 := commit(base, "b", 25, 25)
+	d2 := commit(d1, "a", 35, 35)
+
+	orders := map[uint8]string{
+		LOG_ORDER_DEFAULT:     "",
+		LOG_ORDER_TOPO:        "--topo-order",
+		LOG_ORDER_DATE:        "--date-order",
+		LOG_ORDER_AUTHOR_DATE: "--author-date-order",
+	}
+
+	tests := []struct {
+		name string
+		opts LogOptions
+		args []string
+	}{
+		{"tip", LogOptions{Revisions: []string{c2}}, []string{c2}},
+		{"two tips", LogOptions{Revisions: []string{c2, d2}}, []string{c2, d2}},
+		{"range", LogOptions{Revisions: []string{d2 + ".." + c2}}, []string{d2 + ".." + c2}},
+		{"symmetric range", LogOptions{Revisions: []string{c2 + "..." + d2}}, []string{c2 + "..." + d2}},
+		{"excluded ancestor", LogOptions{Revisions: []string{"^" + b1, c2}}, []string{"^" + b1, c2}},
+		{"first parent", LogOptions{Revisions: []string{c2}, FirstParent: true}, []string{"--first-parent", c2}},
+		{"path", LogOptions{Revisions: []string{c2, d2}, Paths: []string{"a"}}, []string{c2, d2, "--", "a"}},
+		{"grep", LogOptions{Revisions: []string{c2, d2}, Grep: "change b"}, []string{"-E", "--grep=change b", c2, d2}},
+	}
+
+	for _, test := range tests {
+		for order, flag := range orders {
+			t.Run(fmt.Sprintf("%s/%d", test.name, order), func(t *testing.T) {
+				opts := test.opts
+				opts.Order = order
+				args := append([]string{"log", "--format=%H"}, test.args...)
+
+				if flag != "" {
+					args = append([]string{args[0], flag}, args[1:]...)
+				}
+
+				want := strings.Fields(runGit(t, repoPath(repo), args...))
+				all, err := repo.Log(&opts)
+
+				if err != nil {
+					t.Fatal(err)
+				}
+
+				if got := logHashes(all.Commits); strings.Join(got, " ") != strings.Join(want, " ") {
+					t.Fatalf("commits = %v, want %v", got, want)
+				}
+
+				for limit := 1; limit <= len(want); limit++ {
+					opts.Limit = limit
+					opts.Cursor = ""
+					got := []string{}
+
+					for pages := 0; pages == 0 || opts.Cursor != ""; pages++ {
+						page, err := repo.Log(&opts)
+
+						if err != nil {
+							t.Fatal(err)
+						}
+
+						if len(page.Commits) > limit || (page.Next != "" && len(page.Commits) != limit) {
+							t.Fatalf("limit %d: page of %d commits, next %q", limit, len(page.Commits), page.Next)
+						}
+
+						got = append(got, logHashes(page.Commits)...)
+						opts.Cursor = page.Next
+					}
+
+					if strings.Join(got, " ") != strings.Join(want, " ") {
+						t.Fatalf("limit %d: commits = %v, want %v", limit, got, want)
+					}
+				}
+			})
+		}
+	}
+}
+
+func logHashes(commits []*Commit) []string {
+	hashes := []string{}
+
+	for _, commit := range commits {
+		hashes = append(hashes, commit.Hash)
+	}
+
+	return hashes
+}
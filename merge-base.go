@@ -0,0 +1,479 @@
+package gits
+
+import (
+	"container/heap"
+	"fmt"
+	"sort"
+	"time"
+)
+
+// commitGraph caches parsed commits while walking history.
+type commitGraph struct {
+	repo    *Repo
+	commits map[string]*Commit
+}
+
+// MergeBase returns the best common ancestor of two commits, or an empty string if they share no history.
+func (repo *Repo) MergeBase(a, b string) (string, error) {
+	bases, err := repo.MergeBaseAll(a, b)
+
+	if err != nil || len(bases) == 0 {
+		return "", err
+	}
+
+	return bases[0], nil
+}
+
+// MergeBaseAll returns all best common ancestors of a and a hypothetical merge of others, newest first.
+func (repo *Repo) MergeBaseAll(a string, others ...string) ([]string, error) {
+	if len(others) == 0 {
+		return nil, fmt.Errorf("at least two commits are required")
+	}
+
+	tips, err := repo.resolveCommits(append([]string{a}, others...))
+
+	if err != nil {
+		return nil, err
+	}
+
+	return repo.newCommitGraph().mergeBases(tips[0], tips[1:])
+}
+
+// MergeBaseOctopus returns the best common ancestors of all commits, for use in an n-way merge.
+func (repo *Repo) MergeBaseOctopus(revs ...string) ([]string, error) {
+	if len(revs) < 2 {
+		return nil, fmt.Errorf("at least two commits are required")
+	}
+
+	g := repo.newCommitGraph()
+	tips, err := repo.resolveCommits(revs)
+
+	if err != nil {
+		return nil, err
+	}
+
+	// Like git, the bases so far are merged with each next commit.
+	bases := tips[:1]
+
+	for _, tip := range tips[1:] {
+		next := []string{}
+
+		for _, base := range bases {
+			found, err := g.mergeBases(tip, []string{base})
+
+			if err != nil {
+				return nil, err
+			}
+
+			next = append(next, found...)
+		}
+
+		if bases, err = g.reduce(next); err != nil {
+			return nil, err
+		}
+	}
+
+	return bases, nil
+}
+
+// IsAncestor reports whether a is reachable from b. A commit is its own ancestor.
+func (repo *Repo) IsAncestor(a, b string) (bool, error) {
+	tips, err := repo.resolveCommits([]string{a, b})
+
+	if err != nil {
+		return false, err
+	}
+
+	g := repo.newCommitGraph()
+	visited := map[string]bool{}
+	stack := []string{tips[1]}
+
+	for len(stack) > 0 {
+		hash := stack[len(stack)-1]
+		stack = stack[:len(stack)-1]
+
+		if hash == tips[0] {
+			return true, nil
+		}
+
+		if visited[hash] {
+			continue
+		}
+
+		visited[hash] = true
+		commit, err := g.commit(hash)
+
+		if err != nil {
+			return false, err
+		}
+
+		stack = append(stack, commit.Parents...)
+	}
+
+	return false, nil
+}
+
+// AheadBehind counts the commits reachable from a but not b (ahead) and from b but not a (behind).
+func (repo *Repo) AheadBehind(a, b string) (int, int, error) {
+	tips, err := repo.resolveCommits([]string{a, b})
+
+	if err != nil {
+		return 0, 0, err
+	}
+
+	g := repo.newCommitGraph()
+	ahead, _, err := g.limit(tips[:1], tips[1:])
+
+	if err != nil {
+		return 0, 0, err
+	}
+
+	behind, _, err := g.limit(tips[1:], tips[:1])
+
+	if err != nil {
+		return 0, 0, err
+	}
+
+	return len(ahead), len(behind), nil
+}
+
+func (repo *Repo) newCommitGraph() *commitGraph {
+	return &commitGraph{
+		repo:    repo,
+		commits: map[string]*Commit{},
+	}
+}
+
+func (g *commitGraph) commit(hash string) (*Commit, error) {
+	if commit, ok := g.commits[hash]; ok {
+		return commit, nil
+	}
+
+	object, err := g.repo.Object(hash)
+
+	if err != nil {
+		return nil, err
+	}
+
+	commit, err := object.Commit()
+
+	if err != nil {
+		return nil, err
+	}
+
+	if commit.Author == nil || commit.Committer == nil {
+		return nil, fmt.Errorf("invalid commit object: %s", hash)
+	}
+
+	g.commits[hash] = commit
+
+	return commit, nil
+}
+
+// limit walks the history of include newest first and returns the commits that are not reachable
+// from exclude, like git's limit_list. The walk stops once only uninteresting commits are queued,
+// the second result holds the uninteresting commits it reached.
+func (g *commitGraph) limit(include, exclude []string) ([]*Commit, map[string]bool, error) {
+	queue := &commitQueue{less: func(a, b *Commit) bool { return a.Committer.When.After(b.Committer.When) }}
+	seen := map[string]bool{}
+	done := map[string]bool{}
+	uninteresting := map[string]bool{}
+	interesting := 0 // Queued commits that are not uninteresting.
+
+	push := func(hash string) error {
+		if seen[hash] {
+			return nil
+		}
+
+		commit, err := g.commit(hash)
+
+		if err != nil {
+			return err
+		}
+
+		seen[hash] = true
+		interesting += ternary(uninteresting[hash], 0, 1)
+		heap.Push(queue, commit)
+
+		return nil
+	}
+
+	// mark also marks the ancestors that were already walked, they were queued as interesting.
+	var mark func(hash string)
+
+	mark = func(hash string) {
+		if uninteresting[hash] {
+			return
+		}
+
+		uninteresting[hash] = true
+
+		if seen[hash] && !done[hash] {
+			interesting--
+		}
+
+		if done[hash] {
+			for _, parent := range g.commits[hash].Parents {
+				mark(parent)
+			}
+		}
+	}
+
+	for _, hash := range exclude {
+		mark(hash)
+
+		if err := push(hash); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	for _, hash := range include {
+		if err := push(hash); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	order := []*Commit{}
+	slop := 5
+	var last time.Time
+
+	for queue.Len() > 0 {
+		// Once only uninteresting commits are queued, walk past the commits as new as the last one
+		// and a few more, in case of equal or skewed dates.
+		if interesting > 0 || !queue.items[0].Committer.When.Before(last) {
+			slop = 5
+		} else if slop--; slop == 0 {
+			break
+		}
+
+		commit := heap.Pop(queue).(*Commit)
+		done[commit.Hash] = true
+		last = commit.Committer.When
+
+		if uninteresting[commit.Hash] {
+			for _, parent := range commit.Parents {
+				mark(parent)
+			}
+		} else {
+			interesting--
+			order = append(order, commit)
+		}
+
+		for _, parent := range commit.Parents {
+			if err := push(parent); err != nil {
+				return nil, nil, err
+			}
+		}
+	}
+
+	// A commit walked before its uninteresting descendant (clock skew) was marked since.
+	result := []*Commit{}
+
+	for _, commit := range order {
+		if !uninteresting[commit.Hash] {
+			result = append(result, commit)
+		}
+	}
+
+	return result, uninteresting, nil
+}
+
+// Flags of the commits painted by paintDown.
+const (
+	paintOne = 1 << iota
+	paintTwo
+	paintStale
+	paintResult
+)
+
+// paintDown walks the history of one and others newest first and returns the commits reached from
+// both, like git's paint_down_to_common. Their ancestors are painted stale, the walk stops once only
+// stale commits are queued. The second result holds the flags of every commit reached.
+func (g *commitGraph) paintDown(one string, others []string) ([]string, map[string]uint8, error) {
+	queue := &commitQueue{less: func(a, b *Commit) bool { return a.Committer.When.After(b.Committer.When) }}
+	flags := map[string]uint8{}
+	queued := map[string]bool{}
+	live := 0 // Queued commits that are not stale.
+
+	// paint adds flags to a commit, and queues it again when they are new.
+	paint := func(hash string, paint uint8) error {
+		old := flags[hash]
+
+		if old&paint == paint {
+			return nil
+		}
+
+		flags[hash] = old | paint
+
+		if queued[hash] {
+			live -= ternary(old&paintStale == 0 && paint&paintStale != 0, 1, 0)
+			return nil
+		}
+
+		commit, err := g.commit(hash)
+
+		if err != nil {
+			return err
+		}
+
+		queued[hash] = true
+		live += ternary(flags[hash]&paintStale == 0, 1, 0)
+		heap.Push(queue, commit)
+
+		return nil
+	}
+
+	if err := paint(one, paintOne); err != nil {
+		return nil, nil, err
+	}
+
+	for _, hash := range others {
+		if err := paint(hash, paintTwo); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	found := []string{}
+
+	for live > 0 {
+		commit := heap.Pop(queue).(*Commit)
+		queued[commit.Hash] = false
+		paints := flags[commit.Hash] & (paintOne | paintTwo | paintStale)
+		live -= ternary(paints&paintStale == 0, 1, 0)
+
+		if paints == paintOne|paintTwo {
+			if flags[commit.Hash]&paintResult == 0 {
+				flags[commit.Hash] |= paintResult
+				found = append(found, commit.Hash)
+			}
+
+			paints |= paintStale
+		}
+
+		for _, parent := range commit.Parents {
+			if err := paint(parent, paints); err != nil {
+				return nil, nil, err
+			}
+		}
+	}
+
+	return found, flags, nil
+}
+
+// mergeBases returns the best common ancestors of one and a hypothetical merge of others, newest first.
+func (g *commitGraph) mergeBases(one string, others []string) ([]string, error) {
+	found, flags, err := g.paintDown(one, others)
+
+	if err != nil {
+		return nil, err
+	}
+
+	// A commit found before its descendant (clock skew) was painted stale since.
+	bases := []string{}
+
+	for _, hash := range found {
+		if flags[hash]&paintStale == 0 {
+			bases = append(bases, hash)
+		}
+	}
+
+	return g.reduce(bases)
+}
+
+// reduce drops the commits reachable from another one of the list, like git's remove_redundant,
+// and sorts the others newest first.
+func (g *commitGraph) reduce(hashes []string) ([]string, error) {
+	seen := map[string]bool{}
+	unique := []string{}
+
+	for _, hash := range hashes {
+		if !seen[hash] {
+			seen[hash] = true
+			unique = append(unique, hash)
+		}
+	}
+
+	redundant := map[string]bool{}
+
+	for i, hash := range unique {
+		others := []string{}
+
+		for j, other := range unique {
+			if j != i && !redundant[other] {
+				others = append(others, other)
+			}
+		}
+
+		if redundant[hash] || len(others) == 0 {
+			continue
+		}
+
+		_, flags, err := g.paintDown(hash, others)
+
+		if err != nil {
+			return nil, err
+		}
+
+		redundant[hash] = flags[hash]&paintTwo != 0
+
+		for _, other := range others {
+			redundant[other] = redundant[other] || flags[other]&paintOne != 0
+		}
+	}
+
+	bases := []string{}
+
+	for _, hash := range unique {
+		if !redundant[hash] {
+			bases = append(bases, hash)
+		}
+	}
+
+	sort.Slice(bases, func(i, j int) bool {
+		a, b := g.commits[bases[i]].Committer.When, g.commits[bases[j]].Committer.When
+
+		if a.Equal(b) {
+			return bases[i] < bases[j]
+		}
+
+		return a.After(b)
+	})
+
+	return bases, nil
+}
+
+func (repo *Repo) resolveCommit(rev string) (string, error) {
+	hash, err := repo.ResolveRevision(rev)
+
+	if err != nil {
+		return "", err
+	}
+
+	return repo.peelRevision(rev, hash, "commit")
+}
+
+func (repo *Repo) resolveTree(rev string) (string, error) {
+	hash, err := repo.ResolveRevision(rev)
+
+	if err != nil {
+		return "", err
+	}
+
+	return repo.peelRevision(rev, hash, "tree")
+}
+
+func (repo *Repo) resolveCommits(revs []string) ([]string, error) {
+	hashes := make([]string, len(revs))
+
+	for i, rev := range revs {
+		hash, err := repo.resolveCommit(rev)
+
+		if err != nil {
+			return nil, err
+		}
+
+		hashes[i] = hash
+	}
+
+	return hashes, nil
+}
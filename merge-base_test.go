@@ -0,0 +1,146 @@
+package gits
+
+import (
+	"fmt"
+	"os/exec"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMergeBase(t *testing.T) {
+	repo := newTestRepo(t, nil)
+	commits := 0
+
+	// commit writes a commit with a file of its own on top of the tree of the first parent.
+	commit := func(when int, parents ...string) string {
+		commits++
+		who := testSignature()
+		who.When = who.When.Add(time.Duration(when) * time.Second)
+		entries := []TreeEntry{}
+
+		if len(parents) > 0 {
+			object, err := repo.Object(readTree(t, repo, parents[0]))
+
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if entries, err = object.Entries(); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		blob, err := repo.WriteBlob([]byte(fmt.Sprint(commits)))
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		tree, err := repo.WriteTree(append(entries, TreeEntry{Mode: MODE_FILE, Name: fmt.Sprintf("f%d", commits), Hash: blob}))
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		hash, err := repo.WriteCommit(&CommitSpec{Tree: tree, Parents: parents, Author: who, Message: fmt.Sprintf("c%d\n", commits)})
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		return hash
+	}
+
+	base := commit(0)
+	x1 := commit(10, base)
+	y1 := commit(20, base)
+	x2 := commit(30, x1, y1)
+	y2 := commit(40, y1, x1)
+	x3 := commit(50, x2)
+	long := base
+
+	for i := 0; i < 20; i++ {
+		long = commit(100+i, long)
+	}
+
+	skewed := commit(5, y2)
+	after := commit(200, skewed)
+	root := commit(60)
+
+	tests := []struct {
+		name string
+		revs []string
+	}{
+		{"linear", []string{x1, x3}},
+		{"same", []string{x3, x3}},
+		{"criss-cross", []string{x2, y2}},
+		{"criss-cross descendants", []string{x3, y2}},
+		{"long side", []string{long, x3}},
+		{"skewed date", []string{after, x3}},
+		{"unrelated", []string{root, x3}},
+		{"three", []string{x3, y2, long}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			dir := repoPath(repo)
+			bases, err := repo.MergeBaseAll(test.revs[0], test.revs[1:]...)
+
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if got, want := sortedHashes(bases), sortedHashes(strings.Fields(gitMergeBase(t, dir, append([]string{"--all"}, test.revs...)...))); got != want {
+				t.Errorf("MergeBaseAll = %s, want %s", got, want)
+			}
+
+			octopus, err := repo.MergeBaseOctopus(test.revs...)
+
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if got, want := sortedHashes(octopus), sortedHashes(strings.Fields(gitMergeBase(t, dir, append([]string{"--octopus", "--all"}, test.revs...)...))); got != want {
+				t.Errorf("MergeBaseOctopus = %s, want %s", got, want)
+			}
+
+			ahead, behind, err := repo.AheadBehind(test.revs[0], test.revs[1])
+
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			want := runGit(t, dir, "rev-list", "--left-right", "--count", test.revs[0]+"..."+test.revs[1])
+
+			if got := fmt.Sprintf("%d\t%d\n", ahead, behind); got != want {
+				t.Errorf("AheadBehind = %q, want %q", got, want)
+			}
+		})
+	}
+}
+
+// gitMergeBase runs git merge-base, which exits with 1 when there is no base.
+func gitMergeBase(t *testing.T, dir string, args ...string) string {
+	cmd := exec.Command("git", append([]string{"merge-base"}, args...)...)
+	cmd.Dir = dir
+	out, err := cmd.Output()
+
+	if exit, ok := err.(*exec.ExitError); ok && exit.ExitCode() == 1 {
+		return ""
+	}
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return string(out)
+}
+
+func sortedHashes(hashes []string) string {
+	sorted := append([]string{}, hashes...)
+	sort.Strings(sorted)
+
+	return strings.Join(sorted, " ")
+}
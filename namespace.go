@@ -0,0 +1,165 @@
+package gits
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// namespacedRefs shows the refs under refs/namespaces/<ns>/ as the refs of the repo, HEAD included,
+// like GIT_NAMESPACE. Objects stay shared by every namespace.
+type namespacedRefs struct {
+	store  RefStore
+	prefix string // refs/namespaces/<ns>/, once per level of a nested namespace.
+}
+
+type namespacedTransaction struct {
+	tx     RefTransaction
+	prefix string
+}
+
+// namespacePrefix turns a/b into refs/namespaces/a/refs/namespaces/b/.
+func namespacePrefix(namespace string) (string, error) {
+	prefix := ""
+
+	for _, part := range strings.Split(strings.Trim(namespace, "/"), "/") {
+		prefix += "refs/namespaces/" + part + "/"
+	}
+
+	if !validRefName(prefix + "HEAD") {
+		return "", fmt.Errorf("invalid namespace: %s", namespace)
+	}
+
+	return prefix, nil
+}
+
+// physical returns the repo without its namespace, e.g. for the files every namespace shares.
+func (repo *Repo) physical() *Repo {
+	ns, ok := repo.refs.(*namespacedRefs)
+
+	if !ok {
+		return repo
+	}
+
+	physical := *repo
+	physical.refs = ns.store
+
+	return &physical
+}
+
+// namespace returns the prefix of the refs of the namespace, empty without one.
+func (repo *Repo) namespace() string {
+	if ns, ok := repo.refs.(*namespacedRefs); ok {
+		return ns.prefix
+	}
+
+	return ""
+}
+
+func (n *namespacedRefs) Get(name string) (*Ref, error) {
+	ref, err := n.store.Get(n.prefix + name)
+
+	if err != nil || ref == nil {
+		return nil, err
+	}
+
+	return n.strip(ref), nil
+}
+
+func (n *namespacedRefs) Iterate(prefix string, fn func(ref *Ref) error) error {
+	return n.store.Iterate(n.prefix+prefix, func(ref *Ref) error {
+		// The HEAD of the namespace.
+		if ref = n.strip(ref); !strings.HasPrefix(ref.Name, "refs/") {
+			return nil
+		}
+
+		return fn(ref)
+	})
+}
+
+func (n *namespacedRefs) Transaction() (RefTransaction, error) {
+	tx, err := n.store.Transaction()
+
+	if err != nil {
+		return nil, err
+	}
+
+	return &namespacedTransaction{tx: tx, prefix: n.prefix}, nil
+}
+
+func (n *namespacedRefs) Reflog(name string) ([]*ReflogEntry, error) {
+	store, ok := n.store.(ReflogStore)
+
+	if !ok {
+		return []*ReflogEntry{}, nil
+	}
+
+	return store.Reflog(n.prefix + name)
+}
+
+func (n *namespacedRefs) Reflogs() ([]string, error) {
+	store, ok := n.store.(ReflogStore)
+
+	if !ok {
+		return []string{}, nil
+	}
+
+	all, err := store.Reflogs()
+
+	if err != nil {
+		return nil, err
+	}
+
+	names := []string{}
+
+	for _, name := range all {
+		if strings.HasPrefix(name, n.prefix) {
+			names = append(names, strings.TrimPrefix(name, n.prefix))
+		}
+	}
+
+	return names, nil
+}
+
+func (n *namespacedRefs) ExpireReflog(name string, keep func(entry *ReflogEntry) bool) error {
+	store, ok := n.store.(ReflogStore)
+
+	if !ok {
+		return nil
+	}
+
+	return store.ExpireReflog(n.prefix+name, keep)
+}
+
+// strip removes the prefix from the name and from a target in the namespace.
+func (n *namespacedRefs) strip(ref *Ref) *Ref {
+	return &Ref{
+		Name:   strings.TrimPrefix(ref.Name, n.prefix),
+		Hash:   ref.Hash,
+		Target: strings.TrimPrefix(ref.Target, n.prefix),
+	}
+}
+
+func (t *namespacedTransaction) Update(name, oldHash, newHash string) error {
+	return t.tx.Update(t.prefix+name, oldHash, newHash)
+}
+
+func (t *namespacedTransaction) SetSymref(name, target string) error {
+	return t.tx.SetSymref(t.prefix+name, t.prefix+target)
+}
+
+func (t *namespacedTransaction) Commit(who *Signature, msg string) error {
+	err := t.tx.Commit(who, msg)
+
+	var conflict *RefConflictError
+
+	if errors.As(err, &conflict) {
+		return &RefConflictError{Ref: strings.TrimPrefix(conflict.Ref, t.prefix), Expected: conflict.Expected, Actual: conflict.Actual}
+	}
+
+	return err
+}
+
+func (t *namespacedTransaction) Abort() error {
+	return t.tx.Abort()
+}
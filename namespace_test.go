@@ -0,0 +1,228 @@
+package gits
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"sort"
+	"strings"
+	"testing"
+)
+
+func TestNamespaces(t *testing.T) {
+	repo := newTestRepo(t, nil)
+	namespaces := map[string]*Repo{}
+	heads := map[string]string{}
+
+	for _, ns := range []string{"alice", "bob"} {
+		view, err := OpenRepo(&Config{Dir: repo.conf.Dir, Name: repo.conf.Name, Namespace: ns})
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if err := view.SetHead("refs/heads/" + ns); err != nil {
+			t.Fatal(err)
+		}
+
+		head, err := view.CommitFiles(&CommitFilesSpec{
+			Branch:  ns,
+			Author:  testSignature(),
+			Message: ns,
+			Ops:     []FileOp{{Action: FILE_ADD, Path: "owner", Content: []byte(ns + "\n")}},
+		})
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if err := view.updateRef("refs/internal/secret", "", head, nil, "internal"); err != nil {
+			t.Fatal(err)
+		}
+
+		namespaces[ns], heads[ns] = view, head
+	}
+
+	if err := repo.updateRef("refs/internal/root", "", heads["alice"], nil, "internal"); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := repo.UpdateServerInfo(); err != nil {
+		t.Fatal(err)
+	}
+
+	t.Run("isolation", func(t *testing.T) {
+		for ns, view := range namespaces {
+			branch := "refs/heads/" + ns
+			refs, err := view.listRefs()
+
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			want := map[string]string{branch: heads[ns], "refs/internal/secret": heads[ns]}
+
+			if formatRefs(refs) != formatRefs(want) {
+				t.Errorf("%s refs:\n%s\nwant:\n%s", ns, formatRefs(refs), formatRefs(want))
+			}
+
+			if content := readFile(t, view, "HEAD:owner"); content != ns+"\n" {
+				t.Errorf("%s HEAD:owner = %q", ns, content)
+			}
+
+			// git upload-pack serves the same refs through GIT_NAMESPACE.
+			out := runGit(t, repoPath(repo), "--namespace="+ns, "ls-remote", ".")
+			want = map[string]string{"HEAD": heads[ns], branch: heads[ns], "refs/internal/secret": heads[ns]}
+
+			if got := parseLsRemote(out); formatRefs(got) != formatRefs(want) {
+				t.Errorf("git ls-remote in %s:\n%s", ns, out)
+			}
+		}
+
+		// The repo itself has none of their refs as its own.
+		if hash, _ := repo.resolveRef("refs/heads/alice"); hash != "" {
+			t.Errorf("refs/heads/alice = %s outside the namespace", hash)
+		}
+
+		if hash, _ := repo.resolveRef("refs/namespaces/alice/refs/heads/alice"); hash != heads["alice"] {
+			t.Errorf("refs/namespaces/alice/refs/heads/alice = %s, want %s", hash, heads["alice"])
+		}
+
+		runGit(t, repoPath(repo), "fsck", "--strict")
+	})
+
+	t.Run("hidden refs", func(t *testing.T) {
+		for _, service := range []string{"git-upload-pack", "git-receive-pack"} {
+			for ns, view := range namespaces {
+				adv, err := view.Advertise(nil, nil, service, nil)
+
+				if err != nil {
+					t.Fatal(err)
+				}
+
+				branch := "refs/heads/" + ns
+
+				if got := advertisedRefs(t, adv); strings.Join(got, " ") != "HEAD "+branch {
+					t.Errorf("%s in %s advertises %v, want HEAD and %s", service, ns, got, branch)
+				}
+			}
+		}
+
+		shown, err := OpenRepo(&Config{Dir: repo.conf.Dir, Name: repo.conf.Name, Namespace: "alice", HideRefs: []string{}})
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		adv, err := shown.Advertise(nil, nil, "git-upload-pack", nil)
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if got := advertisedRefs(t, adv); strings.Join(got, " ") != "HEAD refs/heads/alice refs/internal/secret" {
+			t.Errorf("without hideRefs refs/internal is not advertised: %v", got)
+		}
+	})
+
+	t.Run("dumb files", func(t *testing.T) {
+		for ns, view := range namespaces {
+			branch := "refs/heads/" + ns
+
+			if got := dumbFile(t, view, "info/refs"); got != heads[ns]+"\t"+branch+"\n" {
+				t.Errorf("info/refs of %s = %q", ns, got)
+			}
+
+			if got := dumbFile(t, view, "HEAD"); got != "ref: "+branch+"\n" {
+				t.Errorf("HEAD of %s = %q", ns, got)
+			}
+		}
+
+		// Outside a namespace the files on disk are served, they list every namespace. hideRefs
+		// patterns match the full names there, like for git.
+		info := dumbFile(t, repo, "info/refs")
+
+		for ns, head := range heads {
+			prefix, _ := namespacePrefix(ns)
+
+			if !strings.Contains(info, head+"\t"+prefix+"refs/heads/") {
+				t.Errorf("info/refs does not list %s:\n%s", ns, info)
+			}
+		}
+
+		if strings.Contains(info, "\trefs/internal/") {
+			t.Errorf("info/refs lists hidden refs:\n%s", info)
+		}
+
+		if got := dumbFile(t, repo, "HEAD"); got != "ref: refs/heads/main\n" {
+			t.Errorf("HEAD = %q", got)
+		}
+	})
+}
+
+// advertisedRefs returns the names of the refs of a protocol v0 advertisement.
+func advertisedRefs(t *testing.T, adv []byte) []string {
+	t.Helper()
+
+	br := bufio.NewReader(bytes.NewReader(adv))
+	names := []string{}
+
+	for {
+		line, flush, err := readPktLine(br)
+
+		if err == io.EOF {
+			break
+		}
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if flush || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		line, _, _ = strings.Cut(strings.TrimSuffix(line, "\n"), "\x00")
+
+		if _, name, ok := strings.Cut(line, " "); ok && name != "capabilities^{}" {
+			names = append(names, name)
+		}
+	}
+
+	sort.Strings(names)
+
+	return names
+}
+
+// parseLsRemote returns the refs of the output of git ls-remote by name, peeled tags left out.
+func parseLsRemote(out string) map[string]string {
+	refs := map[string]string{}
+
+	for _, line := range strings.Split(strings.TrimSpace(out), "\n") {
+		if hash, name, ok := strings.Cut(line, "\t"); ok && !strings.HasSuffix(name, "^{}") {
+			refs[name] = hash
+		}
+	}
+
+	return refs
+}
+
+func dumbFile(t *testing.T, repo *Repo, name string) string {
+	t.Helper()
+
+	file, err := repo.DumbFile(name)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer file.Close()
+
+	data, err := io.ReadAll(file)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return string(data)
+}
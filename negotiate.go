@@ -5,6 +5,7 @@ import (
 	"fmt"
 	"io"
 	"strings"
+	"time"
 )
 
 func (repo *Repo) Negotiate(r io.Reader, w io.Writer) (*Negotiation, error) {
@@ -45,6 +46,11 @@ func (repo *Repo) Negotiate(r io.Reader, w io.Writer) (*Negotiation, error) {
 			break
 		}
 
+		if strings.HasPrefix(line, "filter ") {
+			n.Filter = strings.TrimPrefix(line, "filter ")
+			continue
+		}
+
 		if strings.HasPrefix(line, "want ") {
 			parts := strings.Split(line, " ")
 
@@ -67,11 +73,20 @@ func (repo *Repo) Negotiate(r io.Reader, w io.Writer) (*Negotiation, error) {
 		}
 	}
 
+	if err := repo.checkWants(n.Wants); err != nil {
+		w.Write(pktLine("ERR " + err.Error() + "\n"))
+		return nil, err
+	}
+
 	// Return if done.
 	if n.Done {
 		return n, nil
 	}
 
+	multiAck := n.Caps["multi_ack"] || n.Caps["multi_ack_detailed"]
+	ready := false
+	reached := map[string]bool{} // Wants known to reach a common commit.
+
 	// Read haves.
 	for {
 		line, flush, err := readPktLine(br)
@@ -86,7 +101,33 @@ func (repo *Repo) Negotiate(r io.Reader, w io.Writer) (*Negotiation, error) {
 		}
 
 		if flush {
-			// Batch of haves.
+			// End of a batch of haves, the client waits for an answer. Once every want reaches a
+			// common commit more haves would not make the pack smaller, so the client may stop.
+			if n.Caps["multi_ack_detailed"] && n.Acked != "" && !ready {
+				ready, err = repo.readyToGiveUp(n, reached)
+
+				if err != nil {
+					return nil, err
+				}
+
+				if ready {
+					if _, err := w.Write(pktLine("ACK " + n.Acked + " ready\n")); err != nil {
+						return nil, err
+					}
+				}
+			}
+
+			if multiAck || n.Acked == "" {
+				if _, err := w.Write(pktLine("NAK\n")); err != nil {
+					return nil, err
+				}
+			}
+
+			// A stateless request ends here, the next round comes as a new request.
+			if !repo.stateful() {
+				break
+			}
+
 			continue
 		}
 
@@ -106,9 +147,123 @@ func (repo *Repo) Negotiate(r io.Reader, w io.Writer) (*Negotiation, error) {
 				return nil, fmt.Errorf("invalid have line: %s", line)
 			}
 
+			if n.Haves[parts[1]] || !repo.hasObject(parts[1]) {
+				n.Haves[parts[1]] = true
+				continue
+			}
+
 			n.Haves[parts[1]] = true
+			ack := ""
+
+			// Without multi_ack only the first common commit is acknowledged, the client then sends done.
+			switch {
+			case n.Caps["multi_ack_detailed"]:
+				ack = "ACK " + parts[1] + " common\n"
+			case multiAck:
+				ack = "ACK " + parts[1] + " continue\n"
+			case n.Acked == "":
+				ack = "ACK " + parts[1] + "\n"
+			}
+
+			n.Acked = parts[1]
+
+			if ack != "" {
+				if _, err := w.Write(pktLine(ack)); err != nil {
+					return nil, err
+				}
+			}
 		}
 	}
 
 	return n, nil
 }
+
+// readyToGiveUp reports whether every wanted commit reaches a common have, like git's
+// ok_to_give_up. Commits older than the oldest common commit are not walked. Wants found to
+// reach one are added to reached.
+func (repo *Repo) readyToGiveUp(n *Negotiation, reached map[string]bool) (bool, error) {
+	g := repo.newCommitGraph()
+	common := map[string]bool{}
+	var oldest time.Time
+
+	for have := range n.Haves {
+		if !repo.hasObject(have) {
+			continue
+		}
+
+		hash, err := repo.peelRevision(have, have, "")
+
+		if err != nil {
+			return false, err
+		}
+
+		if object, err := repo.Object(hash); err != nil || object.Type != OBJ_COMMIT {
+			continue
+		}
+
+		commit, err := g.commit(hash)
+
+		if err != nil {
+			return false, err
+		}
+
+		common[hash] = true
+
+		if oldest.IsZero() || commit.Committer.When.Before(oldest) {
+			oldest = commit.Committer.When
+		}
+	}
+
+	if len(common) == 0 {
+		return false, nil
+	}
+
+	for want := range n.Wants {
+		if reached[want] {
+			continue
+		}
+
+		hash, err := repo.peelRevision(want, want, "")
+
+		if err != nil {
+			return false, err
+		}
+
+		// Trees and blobs wanted by hash have no history to negotiate.
+		if object, err := repo.Object(hash); err != nil || object.Type != OBJ_COMMIT {
+			reached[want] = err == nil
+			continue
+		}
+
+		stack := []string{hash}
+		visited := map[string]bool{}
+
+		for len(stack) > 0 && !reached[want] {
+			hash := stack[len(stack)-1]
+			stack = stack[:len(stack)-1]
+
+			if visited[hash] {
+				continue
+			}
+
+			visited[hash] = true
+			commit, err := g.commit(hash)
+
+			if err != nil {
+				return false, err
+			}
+
+			if common[hash] {
+				reached[want] = true
+			} else if !commit.Committer.When.Before(oldest) {
+				stack = append(stack, commit.Parents...)
+			}
+		}
+
+		if !reached[want] {
+			return false, nil
+		}
+	}
+
+	return true, nil
+}
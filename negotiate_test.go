@@ -0,0 +1,84 @@
+package gits
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestNegotiateReady(t *testing.T) {
+	repo := newTestRepo(t, nil)
+
+	base, err := repo.CommitFiles(&CommitFilesSpec{
+		Branch:  "main",
+		Author:  testSignature(),
+		Message: "base",
+		Ops:     []FileOp{{Action: FILE_ADD, Path: "a", Content: []byte("a\n")}},
+	})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := repo.updateRef("refs/heads/other", "", base, nil, "test"); err != nil {
+		t.Fatal(err)
+	}
+
+	tip, err := repo.CommitFiles(&CommitFilesSpec{
+		Branch:  "main",
+		Parent:  base,
+		Author:  testSignature(),
+		Message: "tip",
+		Ops:     []FileOp{{Action: FILE_MODIFY, Path: "a", Content: []byte("b\n")}},
+	})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// An unrelated root commit is common, but the want does not reach it.
+	root, err := repo.CommitFiles(&CommitFilesSpec{
+		Branch:  "root",
+		Author:  testSignature(),
+		Message: "root",
+		Ops:     []FileOp{{Action: FILE_ADD, Path: "r", Content: []byte("r\n")}},
+	})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name  string
+		haves []string
+		ready bool
+	}{
+		{"no common commit", []string{strings.Repeat("1", 40)}, false},
+		{"unrelated common commit", []string{root}, false},
+		{"ancestor", []string{base}, true},
+		{"ancestor among others", []string{root, base}, true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var in, out bytes.Buffer
+
+			in.Write(pktLine("want " + tip + " multi_ack_detailed\n"))
+			in.WriteString("0000")
+
+			for _, have := range test.haves {
+				in.Write(pktLine("have " + have + "\n"))
+			}
+
+			in.WriteString("0000")
+
+			if _, err := repo.Negotiate(&in, &out); err != nil {
+				t.Fatal(err)
+			}
+
+			if ready := strings.Contains(out.String(), " ready\n"); ready != test.ready {
+				t.Fatalf("ready = %v, want %v: %q", ready, test.ready, out.String())
+			}
+		})
+	}
+}
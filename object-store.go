@@ -0,0 +1,515 @@
+package gits
+
+import (
+	"bufio"
+	"bytes"
+	"compress/zlib"
+	"errors"
+	"fmt"
+	"io"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+var ErrObjectNotFound = errors.New("object not found")
+
+// filesObjects keeps objects as loose files in objects/xx/ and reads packs from objects/pack/.
+// Objects missing there are borrowed from the object directories of objects/info/alternates.
+type filesObjects struct {
+	repo       *Repo
+	dir        string // The objects directory.
+	depth      int    // Levels of alternates above this store.
+	mu         sync.Mutex
+	packs      []*packFile // Rescanned when an object is not found, new packs show up.
+	alternates []*filesObjects
+	altData    string // Content of the alternates file the alternates were read from.
+}
+
+// Alternates nested deeper are ignored, like in git.
+const maxAlternateDepth = 5
+
+// newObjectStore returns the store of conf.ObjectStore, or the built-in one.
+func (repo *Repo) newObjectStore() (ObjectStore, error) {
+	if repo.conf.ObjectStore != nil {
+		return repo.conf.ObjectStore(repo)
+	}
+
+	return &filesObjects{repo: repo, dir: repo.absPath("objects")}, nil
+}
+
+func (f *filesObjects) Has(hash string) (bool, error) {
+	if !isHash(hash) {
+		return false, nil
+	}
+
+	if f.repo.fs.Stat(f.loosePath(hash))[0] == 1 {
+		return true, nil
+	}
+
+	pack, _, err := f.find(hash)
+
+	if err != nil || pack != nil {
+		return pack != nil, err
+	}
+
+	alt, err := f.borrowed(hash)
+
+	return alt != nil, err
+}
+
+func (f *filesObjects) Get(hash string) (uint8, []byte, error) {
+	typ, size, r, err := f.openLoose(hash)
+
+	if err != nil {
+		return 0, nil, err
+	}
+
+	if r == nil {
+		pack, offset, err := f.find(hash)
+
+		if err != nil {
+			return 0, nil, err
+		}
+
+		if pack == nil {
+			alt, err := f.borrowed(hash)
+
+			if err != nil || alt == nil {
+				return 0, nil, ternary(err != nil, err, notFound(hash))
+			}
+
+			return alt.Get(hash)
+		}
+
+		typ, data, err := pack.object(f, offset)
+
+		if err != nil && f.dropped(pack) {
+			return f.Get(hash)
+		}
+
+		return typ, data, err
+	}
+
+	defer r.Close()
+
+	data := make([]byte, size)
+
+	if _, err := io.ReadFull(r, data); err != nil {
+		return 0, nil, fmt.Errorf("object %s: %w", hash, err)
+	}
+
+	// Nothing may follow the data.
+	if n, _ := r.Read(make([]byte, 1)); n > 0 {
+		return 0, nil, fmt.Errorf("object %s: size mismatch: header says %d", hash, size)
+	}
+
+	return typ, data, nil
+}
+
+// Packed objects are inflated whole, deltas need their base.
+func (f *filesObjects) Open(hash string) (uint8, int64, io.ReadCloser, error) {
+	typ, size, r, err := f.openLoose(hash)
+
+	if err != nil || r != nil {
+		return typ, size, r, err
+	}
+
+	pack, offset, err := f.find(hash)
+
+	if err != nil {
+		return 0, 0, nil, err
+	}
+
+	if pack == nil {
+		alt, err := f.borrowed(hash)
+
+		if err != nil || alt == nil {
+			return 0, 0, nil, ternary(err != nil, err, notFound(hash))
+		}
+
+		return alt.Open(hash)
+	}
+
+	typ, data, err := pack.object(f, offset)
+
+	if err != nil && f.dropped(pack) {
+		return f.Open(hash)
+	}
+
+	if err != nil {
+		return 0, 0, nil, err
+	}
+
+	return typ, int64(len(data)), io.NopCloser(bytes.NewReader(data)), nil
+}
+
+func (f *filesObjects) Stat(hash string) (uint8, int64, error) {
+	typ, size, r, err := f.openLoose(hash)
+
+	if err != nil {
+		return 0, 0, err
+	}
+
+	if r != nil {
+		return typ, size, r.Close()
+	}
+
+	pack, offset, err := f.find(hash)
+
+	if err != nil {
+		return 0, 0, err
+	}
+
+	if pack == nil {
+		alt, err := f.borrowed(hash)
+
+		if err != nil || alt == nil {
+			return 0, 0, ternary(err != nil, err, notFound(hash))
+		}
+
+		return alt.Stat(hash)
+	}
+
+	typ, size, err = pack.stat(f, offset)
+
+	if err != nil && f.dropped(pack) {
+		return f.Stat(hash)
+	}
+
+	return typ, size, err
+}
+
+// Objects that already exist, packed or borrowed included, are not written again.
+func (f *filesObjects) Put(typ uint8, data []byte) (string, error) {
+	hash := objectHash(typ, data)
+
+	if ok, err := f.Has(hash); err != nil || ok {
+		return hash, err
+	}
+
+	return hash, f.writeLoose(hash, typ, data)
+}
+
+func (f *filesObjects) writeLoose(hash string, typ uint8, data []byte) error {
+	compressed, err := Zlib.Compress(append([]byte(fmt.Sprintf("%s %d\x00", OBJ_TYPES_STR[typ], len(data))), data...))
+
+	if err != nil {
+		return err
+	}
+
+	return f.repo.fs.WriteFile(f.loosePath(hash), compressed)
+}
+
+// Loose objects come first, then packs and borrowed objects. Objects in several places are passed once.
+func (f *filesObjects) Iterate(fn func(hash string) error) error {
+	seen := map[string]bool{}
+
+	if err := f.iterateLocal(seen, fn); err != nil {
+		return err
+	}
+
+	alternates, err := f.readAlternates()
+
+	if err != nil {
+		return err
+	}
+
+	for _, alt := range alternates {
+		if err := alt.iterateLocal(seen, fn); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// iterateLocal passes the objects of the store itself, the ones in seen are skipped.
+func (f *filesObjects) iterateLocal(seen map[string]bool, fn func(hash string) error) error {
+	loose, err := f.looseObjects()
+
+	if err != nil {
+		return err
+	}
+
+	for _, hash := range loose {
+		if seen[hash] {
+			continue
+		}
+
+		seen[hash] = true
+
+		if err := fn(hash); err != nil {
+			return err
+		}
+	}
+
+	packs, err := f.scanPacks()
+
+	if err != nil {
+		return err
+	}
+
+	for _, pack := range packs {
+		for i := 0; i < pack.count(); i++ {
+			hash := pack.hash(i)
+
+			if seen[hash] {
+				continue
+			}
+
+			seen[hash] = true
+
+			if err := fn(hash); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// Loose objects are listed from the directory of the first two digits, packed ones are searched in
+// each index. Borrowed objects are included.
+func (f *filesObjects) FindPrefix(prefix string) ([]string, error) {
+	found := map[string]bool{}
+
+	if err := f.findPrefixLocal(prefix, found); err != nil {
+		return nil, err
+	}
+
+	alternates, err := f.readAlternates()
+
+	if err != nil {
+		return nil, err
+	}
+
+	for _, alt := range alternates {
+		if err := alt.findPrefixLocal(prefix, found); err != nil {
+			return nil, err
+		}
+	}
+
+	hashes := make([]string, 0, len(found))
+
+	for hash := range found {
+		hashes = append(hashes, hash)
+	}
+
+	return hashes, nil
+}
+
+// findPrefixLocal adds the objects of the store itself that start with prefix to found.
+func (f *filesObjects) findPrefixLocal(prefix string, found map[string]bool) error {
+	dir := f.dir + "/" + prefix[:2]
+
+	if f.repo.fs.Stat(dir)[0] == 2 {
+		files, err := f.repo.fs.Scan(dir, FS_TYPE_FILE, 0)
+
+		if err != nil {
+			return err
+		}
+
+		for file := range files {
+			if hash := prefix[:2] + path.Base(file); isHash(hash) && strings.HasPrefix(hash, prefix) {
+				found[hash] = true
+			}
+		}
+	}
+
+	packs, err := f.scanPacks()
+
+	if err != nil {
+		return err
+	}
+
+	for _, pack := range packs {
+		for _, hash := range pack.findPrefix(prefix) {
+			found[hash] = true
+		}
+	}
+
+	return nil
+}
+
+func (f *filesObjects) loosePath(hash string) string {
+	return fmt.Sprintf("%s/%s/%s", f.dir, hash[:2], hash[2:])
+}
+
+// openLoose returns a reader on the data of a loose object, positioned after its header.
+// The reader is nil when there is no loose object.
+func (f *filesObjects) openLoose(hash string) (uint8, int64, io.ReadCloser, error) {
+	if !isHash(hash) {
+		return 0, 0, nil, notFound(hash)
+	}
+
+	path := f.loosePath(hash)
+
+	if f.repo.fs.Stat(path)[0] != 1 {
+		return 0, 0, nil, nil
+	}
+
+	content, err := f.repo.fs.ReadFile(path)
+
+	// Packed or moved to a pool meanwhile.
+	if err != nil && f.repo.fs.Stat(path)[0] != 1 {
+		return 0, 0, nil, nil
+	}
+
+	if err != nil {
+		return 0, 0, nil, err
+	}
+
+	zr, err := zlib.NewReader(bytes.NewReader(content))
+
+	if err != nil {
+		return 0, 0, nil, fmt.Errorf("object %s: %w", hash, err)
+	}
+
+	br := bufio.NewReader(zr)
+	header, err := br.ReadString(0)
+
+	if err != nil {
+		zr.Close()
+		return 0, 0, nil, fmt.Errorf("invalid object %s: no null terminator found", hash)
+	}
+
+	name, sizeStr, ok := strings.Cut(strings.TrimSuffix(header, "\x00"), " ")
+	size, err := strconv.ParseInt(sizeStr, 10, 64)
+
+	if !ok || err != nil || size < 0 {
+		zr.Close()
+		return 0, 0, nil, fmt.Errorf("invalid object %s: bad header %q", hash, header)
+	}
+
+	if OBJ_TYPES_NUM[name] < OBJ_COMMIT || OBJ_TYPES_NUM[name] > OBJ_TAG {
+		zr.Close()
+		return 0, 0, nil, fmt.Errorf("unknown object type: %s", name)
+	}
+
+	return OBJ_TYPES_NUM[name], size, &looseReader{Reader: br, zr: zr}, nil
+}
+
+// find returns the pack holding the object and its offset there, a nil pack when no pack has it.
+func (f *filesObjects) find(hash string) (*packFile, uint64, error) {
+	f.mu.Lock()
+	packs, scanned := f.packs, false
+	f.mu.Unlock()
+
+	for {
+		for _, pack := range packs {
+			if offset, ok := pack.find(hash); ok {
+				return pack, offset, nil
+			}
+		}
+
+		if scanned {
+			return nil, 0, nil
+		}
+
+		var err error
+
+		if packs, err = f.scanPacks(); err != nil {
+			return nil, 0, err
+		}
+
+		scanned = true
+	}
+}
+
+// scanPacks lists the packs that have an index, packs already loaded are reused.
+func (f *filesObjects) scanPacks() ([]*packFile, error) {
+	dir := f.dir + "/pack"
+	packs := []*packFile{}
+
+	if f.repo.fs.Stat(dir)[0] == 2 {
+		files, err := f.repo.fs.Scan(dir, FS_TYPE_FILE, 0)
+
+		if err != nil {
+			return nil, err
+		}
+
+		for file := range files {
+			name := path.Base(file)
+
+			if !strings.HasPrefix(name, "pack-") || !strings.HasSuffix(name, ".idx") {
+				continue
+			}
+
+			if f.repo.fs.Stat(dir + "/" + strings.TrimSuffix(name, ".idx") + ".pack")[0] != 1 {
+				continue
+			}
+
+			pack, err := f.repo.openPack(dir + "/" + strings.TrimSuffix(name, ".idx"))
+
+			if err != nil {
+				return nil, err
+			}
+
+			packs = append(packs, pack)
+		}
+	}
+
+	f.mu.Lock()
+	f.packs = packs
+	f.mu.Unlock()
+
+	return packs, nil
+}
+
+// dropped forgets a pack removed since it was scanned, by GC or DedupePool. Its objects are
+// looked up again, they moved to another pack or to an alternate.
+func (f *filesObjects) dropped(pack *packFile) bool {
+	if f.repo.fs.Stat(pack.path + ".pack")[0] == 1 {
+		return false
+	}
+
+	packCache.remove(f.repo.packKey(pack.path))
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	packs := []*packFile{}
+
+	for _, p := range f.packs {
+		if p != pack {
+			packs = append(packs, p)
+		}
+	}
+
+	f.packs = packs
+
+	return true
+}
+
+// removePack removes the files of a pack, the index first so that it is no longer listed.
+func (f *filesObjects) removePack(pack *packFile) error {
+	for _, ext := range []string{".idx", ".pack", ".rev", ".bitmap", ".keep"} {
+		if f.repo.fs.Stat(pack.path + ext)[0] != 1 {
+			continue
+		}
+
+		if err := removeFile(f.repo.fs, pack.path+ext); err != nil {
+			return err
+		}
+	}
+
+	packCache.remove(f.repo.packKey(pack.path))
+
+	return nil
+}
+
+// looseReader closes the zlib stream under the buffered reader.
+type looseReader struct {
+	*bufio.Reader
+	zr io.ReadCloser
+}
+
+func (r *looseReader) Close() error {
+	return r.zr.Close()
+}
+
+func notFound(hash string) error {
+	return fmt.Errorf("%w: %s", ErrObjectNotFound, hash)
+}
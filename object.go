@@ -6,61 +6,21 @@ import (
 	"fmt"
 	"strconv"
 	"strings"
+	"time"
 )
 
 func (r *Repo) Object(hash string) (*Object, error) {
-	path := r.absPath(fmt.Sprintf("objects/%s/%s", hash[:2], hash[2:]))
-
-	content, err := r.fs.ReadFile(path)
-
-	if err != nil {
-		return nil, err
-	}
-
-	content, err = Zlib.Decompress(content)
+	typ, data, err := r.objects.Get(hash)
 
 	if err != nil {
 		return nil, err
 	}
 
-	spaceIdx := bytes.IndexByte(content, ' ')
-
-	if spaceIdx == -1 {
-		return nil, fmt.Errorf("invalid object: no space found")
-	}
-
-	objectType := string(content[:spaceIdx])
-	nullIdx := bytes.IndexByte(content[spaceIdx+1:], 0)
-
-	if nullIdx == -1 {
-		return nil, fmt.Errorf("invalid object: no null terminator found")
-	}
-
-	nullIdx += spaceIdx + 1
-
-	sizeStr := string(content[spaceIdx+1 : nullIdx])
-	size, err := strconv.Atoi(sizeStr)
-
-	if err != nil {
-		return nil, fmt.Errorf("invalid size: %w", err)
-	}
-
-	dataIndex := nullIdx + 1
-	data := content[dataIndex:]
-
-	if len(data) != size {
-		return nil, fmt.Errorf("size mismatch: header says %d, got %d", size, len(data))
-	}
-
 	object := &Object{
 		Hash: hash,
-		Size: size,
+		Size: len(data),
 		Data: data,
-		Type: OBJ_TYPES_NUM[objectType],
-	}
-
-	if object.Type == 0 {
-		return nil, fmt.Errorf("unknown object type: %s", objectType)
+		Type: typ,
 	}
 
 	if object.Type == OBJ_COMMIT {
@@ -76,8 +36,15 @@ func (r *Repo) Object(hash string) (*Object, error) {
 	return object, nil
 }
 
+// hasObject reports whether an object is stored in the repo.
+func (r *Repo) hasObject(hash string) bool {
+	has, err := r.objects.Has(hash)
+
+	return err == nil && has
+}
+
 func (o *Object) Header() ([]byte, error) {
-	if o.Type < 1 || o.Type > 4 {
+	if OBJ_TYPES_STR[o.Type] == "" {
 		return nil, fmt.Errorf("invalid object type")
 	}
 
@@ -165,3 +132,127 @@ func (o *Object) Tree() (map[string]uint8, error) {
 
 	return result, nil
 }
+
+// Entries parses a tree object, keeping names and modes in stored order.
+func (o *Object) Entries() ([]TreeEntry, error) {
+	if o.Type != OBJ_TREE {
+		return nil, fmt.Errorf("object is not a tree")
+	}
+
+	entries := []TreeEntry{}
+	i := 0
+
+	for i < len(o.Data) {
+		spaceIdx := bytes.IndexByte(o.Data[i:], ' ')
+
+		if spaceIdx == -1 {
+			return nil, fmt.Errorf("invalid format: mode not terminated")
+		}
+
+		spaceIdx += i
+		nullIdx := bytes.IndexByte(o.Data[spaceIdx:], 0)
+
+		if nullIdx == -1 {
+			return nil, fmt.Errorf("invalid format: filename not terminated")
+		}
+
+		nullIdx += spaceIdx
+		hashEnd := nullIdx + 21
+
+		if hashEnd > len(o.Data) {
+			return nil, fmt.Errorf("invalid format: hash truncated")
+		}
+
+		mode, err := strconv.ParseUint(string(o.Data[i:spaceIdx]), 8, 32)
+
+		if err != nil {
+			return nil, fmt.Errorf("invalid mode: %w", err)
+		}
+
+		entries = append(entries, TreeEntry{
+			Mode: uint32(mode),
+			Name: string(o.Data[spaceIdx+1 : nullIdx]),
+			Hash: hex.EncodeToString(o.Data[nullIdx+1 : hashEnd]),
+		})
+
+		i = hashEnd
+	}
+
+	return entries, nil
+}
+
+// Commit parses a commit object.
+func (o *Object) Commit() (*Commit, error) {
+	if o.Type != OBJ_COMMIT {
+		return nil, fmt.Errorf("object is not a commit")
+	}
+
+	kv := parseLinesKV(o.Data)
+
+	commit := &Commit{
+		Hash:    o.Hash,
+		Parents: kv["parent"],
+	}
+
+	if len(kv["tree"]) > 0 {
+		commit.Tree = kv["tree"][0]
+	}
+
+	if len(kv["author"]) > 0 {
+		commit.Author = ParseSignature(kv["author"][0])
+	}
+
+	if len(kv["committer"]) > 0 {
+		commit.Committer = ParseSignature(kv["committer"][0])
+	}
+
+	if idx := bytes.Index(o.Data, []byte("\n\n")); idx != -1 {
+		commit.Message = string(o.Data[idx+2:])
+	}
+
+	return commit, nil
+}
+
+// ParseSignature parses "Name <email> 1700000000 +0100". Missing parts are left empty.
+func ParseSignature(s string) *Signature {
+	sig := &Signature{When: time.Unix(0, 0).UTC()}
+	open := strings.IndexByte(s, '<')
+	close := strings.LastIndexByte(s, '>')
+
+	if open == -1 || close < open {
+		sig.Name = strings.TrimSpace(s)
+		return sig
+	}
+
+	sig.Name = strings.TrimSpace(s[:open])
+	sig.Email = s[open+1 : close]
+	fields := strings.Fields(s[close+1:])
+
+	if len(fields) == 0 {
+		return sig
+	}
+
+	unix, err := strconv.ParseInt(fields[0], 10, 64)
+
+	if err != nil {
+		return sig
+	}
+
+	loc := time.UTC
+
+	if len(fields) > 1 && len(fields[1]) == 5 {
+		hours, _ := strconv.Atoi(fields[1][1:3])
+		minutes, _ := strconv.Atoi(fields[1][3:5])
+		offset := hours*3600 + minutes*60
+
+		if fields[1][0] == '-' {
+			offset = -offset
+		}
+
+		loc = time.FixedZone("", offset)
+	}
+
+	sig.When = time.Unix(unix, 0).In(loc)
+
+	return sig
+}
@@ -0,0 +1,517 @@
+package gits
+
+import (
+	"bufio"
+	"bytes"
+	"container/list"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Parsed packs by path, a pack and its index never change once written. Indexes, pack data and
+// cached delta bases count toward PACK_CACHE_SIZE, the least recently used packs are dropped first.
+// Stores that still hold a dropped pack keep using it.
+var packCache = &packLRU{entries: map[string]*list.Element{}, order: list.New()}
+
+// packLRU keeps packs by key until their bytes reach PACK_CACHE_SIZE.
+type packLRU struct {
+	mu      sync.Mutex
+	size    int
+	order   *list.List // Of *packFile, the most recently used first.
+	entries map[string]*list.Element
+}
+
+// packFile is a pack of objects/pack with its index. On an OpenFS whose files implement io.ReaderAt,
+// as DiskFS, objects are read at their offsets and the pack is not kept in memory. Other FS only read
+// whole files, the pack is then read on the first object looked up in it.
+type packFile struct {
+	key     string // Of packCache.
+	size    int    // Bytes counted by packCache.
+	path    string // Without the .pack or .idx extension.
+	fanout  [256]uint32
+	hashes  []byte // Raw hashes of the index, sorted.
+	offsets []uint64
+	once    sync.Once
+	data    []byte
+	err     error
+	mu      sync.Mutex
+	bases   map[uint64]*packBase // Inflated delta bases, dropped together once packBaseCache is reached.
+	cached  int
+}
+
+// packBase is an object of the pack other objects are deltas against.
+type packBase struct {
+	typ  uint8
+	data []byte
+}
+
+// Bytes of delta bases kept per pack.
+const packBaseCache = 32 << 20
+
+// openPack reads the index of path.idx, see https://git-scm.com/docs/gitformat-pack.
+func (repo *Repo) openPack(path string) (*packFile, error) {
+	key := repo.packKey(path)
+
+	if cached := packCache.get(key); cached != nil {
+		return cached, nil
+	}
+
+	data, err := repo.fs.ReadFile(path + ".idx")
+
+	if err != nil {
+		return nil, err
+	}
+
+	pack := &packFile{key: key, path: path}
+
+	if err := pack.parseIndex(data); err != nil {
+		return nil, fmt.Errorf("%s.idx: %w", path, err)
+	}
+
+	return packCache.add(pack), nil
+}
+
+func (repo *Repo) packKey(path string) string {
+	return repo.conf.Dir + "\x00" + path
+}
+
+// get returns the pack of key and marks it as used.
+func (c *packLRU) get(key string) *packFile {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	elem, ok := c.entries[key]
+
+	if !ok {
+		return nil
+	}
+
+	c.order.MoveToFront(elem)
+
+	return elem.Value.(*packFile)
+}
+
+// add caches a pack, or returns the one cached meanwhile.
+func (c *packLRU) add(pack *packFile) *packFile {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if elem, ok := c.entries[pack.key]; ok {
+		c.order.MoveToFront(elem)
+		return elem.Value.(*packFile)
+	}
+
+	c.entries[pack.key] = c.order.PushFront(pack)
+	c.resizeLocked(pack)
+
+	return pack
+}
+
+// resize counts the bytes of a pack again after it grew, and drops the oldest packs beyond the limit.
+func (c *packLRU) resize(pack *packFile) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if elem, ok := c.entries[pack.key]; ok && elem.Value == pack {
+		c.resizeLocked(pack)
+	}
+}
+
+func (c *packLRU) resizeLocked(pack *packFile) {
+	size := pack.bytes()
+	c.size += size - pack.size
+	pack.size = size
+
+	for c.size > PACK_CACHE_SIZE && c.order.Len() > 1 {
+		c.removeLocked(c.order.Back().Value.(*packFile))
+	}
+}
+
+// remove drops the pack of key, e.g. once its files are removed.
+func (c *packLRU) remove(key string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if elem, ok := c.entries[key]; ok {
+		c.removeLocked(elem.Value.(*packFile))
+	}
+}
+
+func (c *packLRU) removeLocked(pack *packFile) {
+	c.order.Remove(c.entries[pack.key])
+	delete(c.entries, pack.key)
+	c.size -= pack.size
+}
+
+// parseIndex reads version 2 indexes, and version 1 ones that start with the fanout table.
+func (p *packFile) parseIndex(data []byte) error {
+	version := 1
+	table := data
+
+	if bytes.HasPrefix(data, []byte("\xfftOc")) {
+		if len(data) < 8 || binary.BigEndian.Uint32(data[4:8]) != 2 {
+			return fmt.Errorf("unsupported index version")
+		}
+
+		version = 2
+		table = data[8:]
+	}
+
+	if len(table) < 1024 {
+		return fmt.Errorf("index truncated")
+	}
+
+	for i := range p.fanout {
+		p.fanout[i] = binary.BigEndian.Uint32(table[i*4:])
+	}
+
+	count := int(p.fanout[255])
+	table = table[1024:]
+
+	if version == 1 {
+		if len(table) < count*24 {
+			return fmt.Errorf("index truncated")
+		}
+
+		p.hashes = make([]byte, 0, count*20)
+		p.offsets = make([]uint64, count)
+
+		for i := 0; i < count; i++ {
+			entry := table[i*24:]
+			p.offsets[i] = uint64(binary.BigEndian.Uint32(entry))
+			p.hashes = append(p.hashes, entry[4:24]...)
+		}
+
+		return nil
+	}
+
+	// Hashes, CRC32s, then 31-bit offsets. An offset with the high bit set indexes the 64-bit ones.
+	if len(table) < count*28 {
+		return fmt.Errorf("index truncated")
+	}
+
+	p.hashes = table[:count*20]
+	small := table[count*24 : count*28]
+	large := table[count*28:]
+	p.offsets = make([]uint64, count)
+
+	for i := 0; i < count; i++ {
+		offset := binary.BigEndian.Uint32(small[i*4:])
+
+		if offset&0x80000000 == 0 {
+			p.offsets[i] = uint64(offset)
+			continue
+		}
+
+		at := int(offset&0x7fffffff) * 8
+
+		if at+8 > len(large) {
+			return fmt.Errorf("index truncated")
+		}
+
+		p.offsets[i] = binary.BigEndian.Uint64(large[at:])
+	}
+
+	return nil
+}
+
+func (p *packFile) count() int {
+	return len(p.offsets)
+}
+
+func (p *packFile) hash(i int) string {
+	return hex.EncodeToString(p.hashes[i*20 : i*20+20])
+}
+
+// find returns the offset of an object in the pack.
+func (p *packFile) find(hash string) (uint64, bool) {
+	raw, err := hex.DecodeString(hash)
+
+	if err != nil || len(raw) != 20 {
+		return 0, false
+	}
+
+	lo := 0
+
+	if raw[0] > 0 {
+		lo = int(p.fanout[raw[0]-1])
+	}
+
+	hi := int(p.fanout[raw[0]])
+	at := lo + sort.Search(hi-lo, func(i int) bool { return bytes.Compare(p.hashes[(lo+i)*20:(lo+i)*20+20], raw) >= 0 })
+
+	if at < hi && bytes.Equal(p.hashes[at*20:at*20+20], raw) {
+		return p.offsets[at], true
+	}
+
+	return 0, false
+}
+
+// findPrefix returns the hashes of the pack that start with prefix, hex of at least 2 digits.
+func (p *packFile) findPrefix(prefix string) []string {
+	first, err := strconv.ParseUint(prefix[:2], 16, 8)
+
+	if err != nil {
+		return nil
+	}
+
+	lo := 0
+
+	if first > 0 {
+		lo = int(p.fanout[first-1])
+	}
+
+	hi := int(p.fanout[first])
+	hashes := []string{}
+
+	for at := lo + sort.Search(hi-lo, func(i int) bool { return p.hash(lo+i) >= prefix }); at < hi; at++ {
+		hash := p.hash(at)
+
+		if !strings.HasPrefix(hash, prefix) {
+			break
+		}
+
+		hashes = append(hashes, hash)
+	}
+
+	return hashes
+}
+
+func (p *packFile) load(repo *Repo) ([]byte, error) {
+	p.once.Do(func() {
+		data, err := repo.fs.ReadFile(p.path + ".pack")
+
+		if err == nil && (len(data) < 32 || string(data[:4]) != "PACK") {
+			err = fmt.Errorf("%s.pack: invalid pack", p.path)
+		}
+
+		p.mu.Lock()
+		p.data, p.err = data, err
+		p.mu.Unlock()
+
+		packCache.resize(p)
+	})
+
+	return p.data, p.err
+}
+
+// open returns the pack data up to its trailer and the closer of the file. A pack read whole stays in
+// memory, its closer does nothing.
+func (p *packFile) open(repo *Repo) (io.ReaderAt, int64, io.Closer, error) {
+	if opener, ok := repo.fs.(OpenFS); ok {
+		file, err := opener.Open(p.path + ".pack")
+
+		if err != nil {
+			return nil, 0, nil, err
+		}
+
+		if at, ok := file.(io.ReaderAt); ok {
+			size := int64(repo.fs.Stat(p.path + ".pack")[1])
+
+			if size < 32 {
+				file.Close()
+				return nil, 0, nil, fmt.Errorf("%s.pack: invalid pack", p.path)
+			}
+
+			return at, size - 20, file, nil
+		}
+
+		file.Close()
+	}
+
+	data, err := p.load(repo)
+
+	if err != nil {
+		return nil, 0, nil, err
+	}
+
+	return bytes.NewReader(data), int64(len(data) - 20), io.NopCloser(nil), nil
+}
+
+// bytes is the memory held by the pack: its index, its data once loaded and the cached delta bases.
+func (p *packFile) bytes() int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	return len(p.hashes) + 8*len(p.offsets) + len(p.data) + p.cached
+}
+
+// entry reads the header of the object at offset. Deltas also return their base: the offset of
+// an ofs-delta base, or the hash of a ref-delta base. The caller closes the pack once the object
+// is read.
+func (p *packFile) entry(store *filesObjects, offset uint64) (uint8, uint64, uint64, string, *bufio.Reader, io.Closer, error) {
+	data, end, closer, err := p.open(store.repo)
+
+	if err != nil {
+		return 0, 0, 0, "", nil, nil, err
+	}
+
+	typ, size, baseOffset, baseHash, br, err := p.header(data, end, offset)
+
+	if err != nil {
+		closer.Close()
+		return 0, 0, 0, "", nil, nil, err
+	}
+
+	return typ, size, baseOffset, baseHash, br, closer, nil
+}
+
+func (p *packFile) header(data io.ReaderAt, end int64, offset uint64) (uint8, uint64, uint64, string, *bufio.Reader, error) {
+	if offset < 12 || offset >= uint64(end) {
+		return 0, 0, 0, "", nil, fmt.Errorf("%s.pack: offset %d out of range", p.path, offset)
+	}
+
+	br := bufio.NewReader(io.NewSectionReader(data, int64(offset), end-int64(offset)))
+	typ, size, err := getPackObjectHeader(br)
+
+	if err != nil {
+		return 0, 0, 0, "", nil, err
+	}
+
+	switch typ {
+	case OBJ_OFS_DELTA:
+		b, err := br.ReadByte()
+		distance := uint64(b & 0x7f)
+
+		for err == nil && b&0x80 != 0 {
+			b, err = br.ReadByte()
+			distance = (distance+1)<<7 | uint64(b&0x7f)
+		}
+
+		if err != nil {
+			return 0, 0, 0, "", nil, err
+		}
+
+		if distance == 0 || distance > offset {
+			return 0, 0, 0, "", nil, fmt.Errorf("%s.pack: invalid delta base at %d", p.path, offset)
+		}
+
+		return typ, size, offset - distance, "", br, nil
+
+	case OBJ_REF_DELTA:
+		base := make([]byte, 20)
+
+		if _, err := io.ReadFull(br, base); err != nil {
+			return 0, 0, 0, "", nil, err
+		}
+
+		return typ, size, 0, hex.EncodeToString(base), br, nil
+	}
+
+	return typ, size, 0, "", br, nil
+}
+
+// object inflates the object at offset, applying its chain of deltas.
+func (p *packFile) object(store *filesObjects, offset uint64) (uint8, []byte, error) {
+	typ, size, baseOffset, baseHash, br, closer, err := p.entry(store, offset)
+
+	if err != nil {
+		return 0, nil, err
+	}
+
+	data, err := Zlib.Inflate(br, size)
+	closer.Close()
+
+	if err != nil {
+		return 0, nil, err
+	}
+
+	var base []byte
+
+	switch typ {
+	case OBJ_OFS_DELTA:
+		typ, base, err = p.base(store, baseOffset)
+	case OBJ_REF_DELTA:
+		typ, base, err = store.Get(baseHash)
+	default:
+		return typ, data, nil
+	}
+
+	if err != nil {
+		return 0, nil, err
+	}
+
+	data, err = patchDelta(base, bytes.NewReader(data))
+
+	return typ, data, err
+}
+
+// base returns the object at offset through the cache, walking a chain of deltas inflates each
+// base once. The data is shared and must not be changed.
+func (p *packFile) base(store *filesObjects, offset uint64) (uint8, []byte, error) {
+	p.mu.Lock()
+	cached := p.bases[offset]
+	p.mu.Unlock()
+
+	if cached != nil {
+		return cached.typ, cached.data, nil
+	}
+
+	typ, data, err := p.object(store, offset)
+
+	if err != nil {
+		return 0, nil, err
+	}
+
+	p.mu.Lock()
+
+	if p.bases == nil || p.cached+len(data) > packBaseCache {
+		p.bases = map[uint64]*packBase{}
+		p.cached = 0
+	}
+
+	p.bases[offset] = &packBase{typ: typ, data: data}
+	p.cached += len(data)
+	p.mu.Unlock()
+
+	packCache.resize(p)
+
+	return typ, data, nil
+}
+
+// stat follows the chain of deltas for the type, the size of a delta result is in its header.
+func (p *packFile) stat(store *filesObjects, offset uint64) (uint8, int64, error) {
+	typ, size, baseOffset, baseHash, br, closer, err := p.entry(store, offset)
+
+	if err != nil {
+		return 0, 0, err
+	}
+
+	if typ != OBJ_OFS_DELTA && typ != OBJ_REF_DELTA {
+		closer.Close()
+		return typ, int64(size), nil
+	}
+
+	delta, err := Zlib.Inflate(br, size)
+	closer.Close()
+
+	if err != nil {
+		return 0, 0, err
+	}
+
+	reader := bytes.NewReader(delta)
+
+	if _, err := readSize(reader); err != nil {
+		return 0, 0, err
+	}
+
+	resultSize, err := readSize(reader)
+
+	if err != nil {
+		return 0, 0, err
+	}
+
+	if typ == OBJ_OFS_DELTA {
+		typ, _, err = p.stat(store, baseOffset)
+	} else {
+		typ, _, err = store.Stat(baseHash)
+	}
+
+	return typ, int64(resultSize), err
+}
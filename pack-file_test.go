@@ -0,0 +1,142 @@
+package gits
+
+import (
+	"container/list"
+	"crypto/sha1"
+	"fmt"
+	"math/rand"
+	"strings"
+	"testing"
+)
+
+func TestPackCacheLimit(t *testing.T) {
+	repo := newTestRepo(t, nil)
+	hashes := []string{}
+
+	random := rand.New(rand.NewSource(1))
+
+	// Three packs of 200KB that do not compress.
+	for pack := 0; pack < 3; pack++ {
+		for i := 0; i < 10; i++ {
+			data := make([]byte, 20<<10)
+			random.Read(data)
+
+			hash, err := repo.WriteBlob(data)
+
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			hashes = append(hashes, hash)
+		}
+
+		keepBlobs(t, repo, fmt.Sprint(pack), hashes)
+		runGit(t, repoPath(repo), "repack", "-dq")
+	}
+
+	defer func(size int) { PACK_CACHE_SIZE = size }(PACK_CACHE_SIZE)
+	PACK_CACHE_SIZE = 300 << 10
+
+	tests := []struct {
+		name  string
+		reads int
+	}{
+		{"first read", 1},
+		{"reads again", 3},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			for round := 0; round < test.reads; round++ {
+				// A new repo per round, like a server opening a repo per request.
+				reopened, err := OpenRepo(repo.conf)
+
+				if err != nil {
+					t.Fatal(err)
+				}
+
+				for _, hash := range hashes {
+					if _, err := reopened.Object(hash); err != nil {
+						t.Fatal(err)
+					}
+
+					packCache.mu.Lock()
+					size, count := packCache.size, packCache.order.Len()
+					packCache.mu.Unlock()
+
+					if size > PACK_CACHE_SIZE && count > 1 {
+						t.Fatalf("cache holds %d bytes in %d packs, limit %d", size, count, PACK_CACHE_SIZE)
+					}
+				}
+			}
+		})
+	}
+}
+
+func TestPackReadAtOffsets(t *testing.T) {
+	repo := newTestRepo(t, nil)
+	blobs := []string{}
+
+	// Similar blobs, git stores most of them as deltas.
+	for i := 0; i < 20; i++ {
+		hash, err := repo.WriteBlob([]byte(strings.Repeat(fmt.Sprintf("line %d\n", i%3), 200) + fmt.Sprint(i)))
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		blobs = append(blobs, hash)
+	}
+
+	keepBlobs(t, repo, "blobs", blobs)
+	runGit(t, repoPath(repo), "repack", "-adfq")
+
+	tests := []struct {
+		name  string
+		fs    func(root string) (FS, error)
+		whole bool
+	}{
+		{"open", nil, false},
+		{"whole file", plainFS, true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			packCache.mu.Lock()
+			packCache.entries, packCache.order, packCache.size = map[string]*list.Element{}, list.New(), 0
+			packCache.mu.Unlock()
+
+			reopened, err := OpenRepo(&Config{Dir: repo.conf.Dir, Name: repo.conf.Name, FS: test.fs})
+
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			for _, hash := range blobs {
+				object, err := reopened.Object(hash)
+
+				if err != nil {
+					t.Fatal(err)
+				}
+
+				if sum := fmt.Sprintf("%x", sha1.Sum(fmt.Appendf(nil, "blob %d\x00%s", len(object.Data), object.Data))); sum != hash {
+					t.Fatalf("%s reads as %s", hash, sum)
+				}
+			}
+
+			packs, err := reopened.objects.(*filesObjects).scanPacks()
+
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if len(packs) != 1 {
+				t.Fatalf("%d packs", len(packs))
+			}
+
+			if held := packs[0].data != nil; held != test.whole {
+				t.Fatalf("pack data in memory = %v, want %v", held, test.whole)
+			}
+		})
+	}
+}
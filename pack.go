@@ -1,6 +1,7 @@
 package gits
 
 import (
+	"compress/zlib"
 	"crypto/sha1"
 	"encoding/binary"
 	"io"
@@ -12,6 +13,11 @@ func (r *Repo) Pack(hashes map[string]bool, w io.Writer) error {
 		return err
 	}
 
+	return r.writePack(hashes, w)
+}
+
+// writePack writes the pack data alone, without any negotiation lines.
+func (r *Repo) writePack(hashes map[string]bool, w io.Writer) error {
 	// We'll hash as we write so we don't need to keep pack content in memory.
 	h := sha1.New()
 	mw := io.MultiWriter(w, h) // writes to w and updates hash
@@ -37,37 +43,44 @@ func (r *Repo) Pack(hashes map[string]bool, w io.Writer) error {
 			continue
 		}
 
-		object, err := r.Object(hash)
-
-		if err != nil {
+		if err := r.writePackObject(mw, hash); err != nil {
 			return err
 		}
+	}
 
-		header, err := object.Header()
+	// Append the SHA-1 trailer (computed from h)
+	if _, err := w.Write(h.Sum(nil)); err != nil {
+		return err
+	}
 
-		if err != nil {
-			return err
-		}
+	return nil
+}
 
-		if _, err := mw.Write(header); err != nil {
-			return err
-		}
+// writePackObject streams one object from the store into the pack.
+func (r *Repo) writePackObject(w io.Writer, hash string) error {
+	typ, size, data, err := r.objects.Open(hash)
 
-		zContent, err := Zlib.Compress(object.Data)
+	if err != nil {
+		return err
+	}
 
-		if err != nil {
-			return err
-		}
+	defer data.Close()
 
-		if _, err := mw.Write(zContent); err != nil {
-			return err
-		}
+	header, err := (&Object{Type: typ, Size: int(size)}).Header()
+
+	if err != nil {
+		return err
 	}
 
-	// Append the SHA-1 trailer (computed from h)
-	if _, err := w.Write(h.Sum(nil)); err != nil {
+	if _, err := w.Write(header); err != nil {
 		return err
 	}
 
-	return nil
+	zw := zlib.NewWriter(w)
+
+	if _, err := io.Copy(zw, data); err != nil {
+		return err
+	}
+
+	return zw.Close()
 }
@@ -0,0 +1,181 @@
+package gits
+
+import (
+	"bytes"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// Header git writes, every ref pointing to an annotated tag is followed by its peeled line.
+const packedRefsHeader = "# pack-refs with: peeled fully-peeled sorted \n"
+
+// readPackedRefs returns the refs in packed-refs by name, and the objects annotated tags peel to
+// from the "^" lines. Both are empty when the file does not exist.
+func (f *filesRefs) readPackedRefs() (map[string]string, map[string]string, error) {
+	refs := map[string]string{}
+	peeled := map[string]string{}
+	path := f.repo.absPath("packed-refs")
+
+	if f.repo.fs.Stat(path)[0] != 1 {
+		return refs, peeled, nil
+	}
+
+	data, err := f.repo.fs.ReadFile(path)
+
+	if err != nil {
+		return nil, nil, err
+	}
+
+	last := ""
+
+	for _, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSpace(line)
+
+		switch {
+		case line == "" || strings.HasPrefix(line, "#"):
+			continue
+
+		case strings.HasPrefix(line, "^"):
+			if last == "" || !isHash(line[1:]) {
+				return nil, nil, fmt.Errorf("invalid packed-refs line: %s", line)
+			}
+
+			peeled[last] = line[1:]
+
+		default:
+			hash, name, ok := strings.Cut(line, " ")
+
+			if !ok || !isHash(hash) {
+				return nil, nil, fmt.Errorf("invalid packed-refs line: %s", line)
+			}
+
+			refs[name] = hash
+			last = name
+		}
+	}
+
+	return refs, peeled, nil
+}
+
+// writePackedRefs replaces packed-refs through packed-refs.lock, readers see either the old or the new file.
+func (f *filesRefs) writePackedRefs(refs, peeled map[string]string) error {
+	return replaceFile(f.repo.fs, f.repo.absPath("packed-refs"), formatPackedRefs(refs, peeled))
+}
+
+// formatPackedRefs returns the content of packed-refs, refs sorted by name.
+func formatPackedRefs(refs, peeled map[string]string) []byte {
+	names := make([]string, 0, len(refs))
+
+	for name := range refs {
+		names = append(names, name)
+	}
+
+	sort.Strings(names)
+
+	var buf bytes.Buffer
+
+	buf.WriteString(packedRefsHeader)
+
+	for _, name := range names {
+		fmt.Fprintf(&buf, "%s %s\n", refs[name], name)
+
+		if peeled[name] != "" {
+			fmt.Fprintf(&buf, "^%s\n", peeled[name])
+		}
+	}
+
+	return buf.Bytes()
+}
+
+// PackRefs compacts the ref storage. Loose refs are moved into packed-refs, like git pack-refs --all,
+// refs pointing to annotated tags get their peeled line. A reftable stack is merged into one table.
+// Custom ref stores are left alone. Every namespace is packed.
+func (repo *Repo) PackRefs() error {
+	store, ok := repo.physical().refs.(refStore)
+
+	if !ok {
+		return nil
+	}
+
+	unlock := repo.lockRefs()
+	defer unlock()
+
+	return store.pack()
+}
+
+func (f *filesRefs) pack() error {
+	// The packed loose refs are removed.
+	if _, ok := f.repo.fs.(RenameFS); !ok {
+		return fmt.Errorf("pack refs: %w", ErrNoRename)
+	}
+
+	all, err := f.refs()
+
+	if err != nil {
+		return err
+	}
+
+	refs := map[string]string{}
+	peeled := map[string]string{}
+
+	for name, ref := range all {
+		if ref.Target != "" {
+			continue
+		}
+
+		hash := ref.Hash
+		refs[name] = hash
+
+		object, err := f.repo.Object(hash)
+
+		if err != nil {
+			return err
+		}
+
+		if object.Type != OBJ_TAG {
+			continue
+		}
+
+		if peeled[name], err = f.repo.peelRevision(name, hash, ""); err != nil {
+			return err
+		}
+	}
+
+	if err := f.writePackedRefs(refs, peeled); err != nil {
+		return err
+	}
+
+	refsPath := f.repo.absPath("refs")
+
+	if f.repo.fs.Stat(refsPath)[0] != 2 {
+		return nil
+	}
+
+	files, err := f.repo.fs.Scan(refsPath, FS_TYPE_FILE, -1)
+
+	if err != nil {
+		return err
+	}
+
+	// Symbolic refs and invalid names stay loose, deleted refs are already left out of packed-refs.
+	for file := range files {
+		data, err := f.repo.fs.ReadFile(file)
+
+		if err != nil {
+			return err
+		}
+
+		hash := strings.TrimSpace(string(data))
+
+		if refs["refs"+file[len(refsPath):]] != hash && hash != "" && hash != ZERO_HASH {
+			continue
+		}
+
+		if err := removeFile(f.repo.fs, file); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
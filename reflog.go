@@ -0,0 +1,317 @@
+package gits
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// Reflog returns the entries of a ref newest first, entry n is what <ref>@{n} resolves to.
+// Name is a full ref name or HEAD. Stores without reflogs return no entries.
+func (repo *Repo) Reflog(name string) ([]*ReflogEntry, error) {
+	store, ok := repo.refs.(ReflogStore)
+
+	if !ok {
+		return []*ReflogEntry{}, nil
+	}
+
+	entries, err := store.Reflog(name)
+
+	if err != nil {
+		return nil, err
+	}
+
+	for i, j := 0, len(entries)-1; i < j; i, j = i+1, j-1 {
+		entries[i], entries[j] = entries[j], entries[i]
+	}
+
+	return entries, nil
+}
+
+// ExpireReflog drops old reflog entries like git reflog expire: every entry older than opts.Expire,
+// and the ones older than opts.ExpireUnreachable that the ref no longer reaches, e.g. after a force push.
+func (repo *Repo) ExpireReflog(opts *ReflogExpireOptions) error {
+	store, ok := repo.refs.(ReflogStore)
+
+	if !ok {
+		return nil
+	}
+
+	if opts == nil {
+		opts = &ReflogExpireOptions{}
+	}
+
+	now := time.Now()
+	expire := ternary(opts.Expire.IsZero(), now.AddDate(0, 0, -90), opts.Expire)
+	unreachable := ternary(opts.ExpireUnreachable.IsZero(), now.AddDate(0, 0, -30), opts.ExpireUnreachable)
+	names := opts.Refs
+
+	if len(names) == 0 {
+		var err error
+
+		if names, err = store.Reflogs(); err != nil {
+			return err
+		}
+	}
+
+	if _, ok := repo.physical().refs.(refStore); ok {
+		unlock := repo.lockRefs()
+		defer unlock()
+	}
+
+	for _, name := range names {
+		tip, err := repo.resolveRef(name)
+
+		if err != nil {
+			return err
+		}
+
+		var reachable map[string]bool
+
+		err = store.ExpireReflog(name, func(entry *ReflogEntry) bool {
+			when := entry.Who.When
+
+			if when.Before(expire) {
+				return false
+			}
+
+			if !when.Before(unreachable) {
+				return true
+			}
+
+			// Walked once per ref, only when an entry is old enough to need it.
+			if reachable == nil {
+				reachable = repo.reachableCommits(tip)
+			}
+
+			return reachable[entry.New]
+		})
+
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// reachableCommits returns the commits reachable from tip, tags peeled. It is empty when tip is not
+// a commit-ish.
+func (repo *Repo) reachableCommits(tip string) map[string]bool {
+	reachable := map[string]bool{}
+
+	if tip == "" {
+		return reachable
+	}
+
+	hash, err := repo.peelRevision(tip, tip, "commit")
+
+	if err != nil {
+		return reachable
+	}
+
+	g := repo.newCommitGraph()
+	stack := []string{hash}
+
+	for len(stack) > 0 {
+		hash := stack[len(stack)-1]
+		stack = stack[:len(stack)-1]
+
+		if reachable[hash] {
+			continue
+		}
+
+		commit, err := g.commit(hash)
+
+		if err != nil {
+			continue
+		}
+
+		reachable[hash] = true
+		stack = append(stack, commit.Parents...)
+	}
+
+	return reachable
+}
+
+func (f *filesRefs) Reflog(name string) ([]*ReflogEntry, error) {
+	logPath := f.repo.absPath("logs/" + name)
+
+	if f.repo.fs.Stat(logPath)[0] != 1 {
+		return []*ReflogEntry{}, nil
+	}
+
+	data, err := f.repo.fs.ReadFile(logPath)
+
+	if err != nil {
+		return nil, err
+	}
+
+	entries := []*ReflogEntry{}
+
+	for _, line := range strings.Split(string(data), "\n") {
+		if entry := parseReflogLine(line); entry != nil {
+			entries = append(entries, entry)
+		}
+	}
+
+	return entries, nil
+}
+
+func (f *filesRefs) Reflogs() ([]string, error) {
+	names := []string{}
+
+	if f.repo.fs.Stat(f.repo.absPath("logs/HEAD"))[0] == 1 {
+		names = append(names, "HEAD")
+	}
+
+	dir := f.repo.absPath("logs/refs")
+
+	if f.repo.fs.Stat(dir)[0] != 2 {
+		return names, nil
+	}
+
+	files, err := f.repo.fs.Scan(dir, FS_TYPE_FILE, -1)
+
+	if err != nil {
+		return nil, err
+	}
+
+	// Skips the locks of an update in progress.
+	for file := range files {
+		if name := "refs" + file[len(dir):]; validRefName(name) {
+			names = append(names, name)
+		}
+	}
+
+	return names, nil
+}
+
+func (f *filesRefs) ExpireReflog(name string, keep func(entry *ReflogEntry) bool) error {
+	entries, err := f.Reflog(name)
+
+	if err != nil || len(entries) == 0 {
+		return err
+	}
+
+	var buf bytes.Buffer
+
+	for _, entry := range entries {
+		if keep(entry) {
+			buf.WriteString(formatReflogLine(entry))
+		}
+	}
+
+	return replaceFile(f.repo.fs, f.repo.absPath("logs/"+name), buf.Bytes())
+}
+
+// appendReflog stages logs/<ref> with a line added. The FS cannot append, the file is rewritten.
+func (f *filesRefs) appendReflog(tx *lockTx, update *RefUpdate, who *Signature, msg string) error {
+	logPath := f.repo.absPath("logs/" + update.Name)
+	data, _, err := tx.read(logPath)
+
+	if err != nil {
+		return err
+	}
+
+	entry := &ReflogEntry{Old: update.Old, New: update.New, Who: who, Message: msg}
+
+	return tx.write(logPath, append(data, formatReflogLine(entry)...))
+}
+
+func (t *reftableRefs) Reflog(name string) ([]*ReflogEntry, error) {
+	logs, err := t.logs()
+
+	if err != nil {
+		return nil, err
+	}
+
+	entries := []*ReflogEntry{}
+
+	for i := len(logs) - 1; i >= 0; i-- {
+		if log := logs[i]; log.ref == name {
+			entries = append(entries, &ReflogEntry{Old: log.old, New: log.new, Who: log.who, Message: log.message})
+		}
+	}
+
+	return entries, nil
+}
+
+func (t *reftableRefs) Reflogs() ([]string, error) {
+	logs, err := t.logs()
+
+	if err != nil {
+		return nil, err
+	}
+
+	names := []string{}
+
+	for i, log := range logs {
+		if i == 0 || logs[i-1].ref != log.ref {
+			names = append(names, log.ref)
+		}
+	}
+
+	return names, nil
+}
+
+// The stack is merged into one table without the dropped records.
+func (t *reftableRefs) ExpireReflog(name string, keep func(entry *ReflogEntry) bool) error {
+	names, tables, err := t.load()
+
+	if err != nil || len(tables) == 0 {
+		return err
+	}
+
+	return t.compact(names, tables, 0, len(tables), func(log *reftableLog) bool {
+		return log.ref != name || keep(&ReflogEntry{Old: log.old, New: log.new, Who: log.who, Message: log.message})
+	})
+}
+
+// logs returns the log records of the stack by ref then newest first, deleted records left out.
+func (t *reftableRefs) logs() ([]*reftableLog, error) {
+	_, tables, err := t.load()
+
+	if err != nil {
+		return nil, err
+	}
+
+	// Newer tables win over older records of the same ref and update index.
+	seen := map[string]bool{}
+	logs := []*reftableLog{}
+
+	for i := len(tables) - 1; i >= 0; i-- {
+		for _, log := range tables[i].logs {
+			key := fmt.Sprintf("%s\x00%d", log.ref, log.updateIndex)
+
+			if !seen[key] && !log.deleted {
+				logs = append(logs, log)
+			}
+
+			seen[key] = true
+		}
+	}
+
+	sortReftableLogs(logs)
+
+	return logs, nil
+}
+
+// formatReflogLine formats an entry as a line of logs/<ref>: old new identity timestamp, a tab and the message.
+func formatReflogLine(entry *ReflogEntry) string {
+	msg := strings.ReplaceAll(strings.TrimSpace(entry.Message), "\n", " ")
+
+	return fmt.Sprintf("%s %s %s\t%s\n", entry.Old, entry.New, entry.Who, msg)
+}
+
+func parseReflogLine(line string) *ReflogEntry {
+	head, msg, _ := strings.Cut(line, "\t")
+	fields := strings.SplitN(head, " ", 3)
+
+	if len(fields) != 3 || !isHash(fields[0]) || !isHash(fields[1]) {
+		return nil
+	}
+
+	return &ReflogEntry{Old: fields[0], New: fields[1], Who: ParseSignature(fields[2]), Message: msg}
+}
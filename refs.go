@@ -0,0 +1,554 @@
+package gits
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+type RefConflictError struct {
+	Ref      string
+	Expected string
+	Actual   string
+}
+
+func (e *RefConflictError) Error() string {
+	return fmt.Sprintf("ref %s is at %s, expected %s", e.Ref, e.Actual, e.Expected)
+}
+
+// Repo locks are shared by every Repo opened on the same directory.
+var repoLocks sync.Map
+
+// refStore is the part of the built-in stores that transactions, InitRepo and PackRefs use.
+type refStore interface {
+	RefStore
+
+	// apply writes the checked changes of a transaction, New set to ZERO_HASH deletes the ref.
+	// Every entry of logs gets a reflog entry.
+	apply(updates []*RefUpdate, symrefs map[string]string, logs []*RefUpdate, who *Signature, msg string) error
+
+	// pack compacts the storage, see Repo.PackRefs.
+	pack() error
+
+	// init creates the empty storage of a new repo.
+	init() error
+}
+
+// refTransaction checks and applies the changes of a built-in store under the ref lock.
+type refTransaction struct {
+	repo    *Repo
+	store   refStore
+	updates []*RefUpdate
+	symrefs map[string]string
+}
+
+// filesRefs keeps every ref in its own file, refs missing there are looked up in packed-refs.
+type filesRefs struct {
+	repo *Repo
+}
+
+// newRefStore picks the store of conf.RefStore or conf.RefStorage. Without either, a repo that has
+// a reftable/tables.list uses reftable. With conf.Namespace the store is seen through the namespace.
+func (repo *Repo) newRefStore() (RefStore, error) {
+	var store RefStore
+
+	storage := repo.conf.RefStorage
+
+	if storage == 0 && repo.fs.Stat(repo.absPath("reftable/tables.list"))[0] == 1 {
+		storage = REF_STORAGE_REFTABLE
+	}
+
+	switch {
+	case repo.conf.RefStore != nil:
+		var err error
+
+		if store, err = repo.conf.RefStore(repo); err != nil {
+			return nil, err
+		}
+
+	case storage == REF_STORAGE_REFTABLE:
+		store = &reftableRefs{repo: repo}
+
+	default:
+		store = &filesRefs{repo: repo}
+	}
+
+	if repo.conf.Namespace == "" {
+		return store, nil
+	}
+
+	prefix, err := namespacePrefix(repo.conf.Namespace)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return &namespacedRefs{store: store, prefix: prefix}, nil
+}
+
+// readRef returns the hash stored in a ref, "ref: <target>" for a symbolic ref, or an empty string
+// if the ref does not exist.
+func (repo *Repo) readRef(name string) (string, error) {
+	ref, err := repo.refs.Get(name)
+
+	if err != nil || ref == nil {
+		return "", err
+	}
+
+	if ref.Target != "" {
+		return "ref: " + ref.Target, nil
+	}
+
+	return ternary(ref.Hash == ZERO_HASH, "", ref.Hash), nil
+}
+
+// listRefs returns the hash of every ref by name, symbolic refs are left out.
+func (repo *Repo) listRefs() (map[string]string, error) {
+	refs := map[string]string{}
+
+	err := repo.refs.Iterate("", func(ref *Ref) error {
+		if ref.Target == "" {
+			refs[ref.Name] = ref.Hash
+		}
+
+		return nil
+	})
+
+	return refs, err
+}
+
+// updateRef points the ref to newHash if it currently points to oldHash.
+// An empty oldHash means the ref must not exist. A nil who is the session identity.
+func (repo *Repo) updateRef(name, oldHash, newHash string, who *Signature, msg string) error {
+	if !validRefName(name) {
+		return fmt.Errorf("invalid ref name: %s", name)
+	}
+
+	tx, err := repo.refs.Transaction()
+
+	if err != nil {
+		return err
+	}
+
+	if err := tx.Update(name, ternary(oldHash == "", ZERO_HASH, oldHash), newHash); err != nil {
+		tx.Abort()
+		return err
+	}
+
+	return tx.Commit(ternary(who != nil, who, repo.identity()), msg)
+}
+
+// identity is the session user, or gits for changes made through the API.
+func (repo *Repo) identity() *Signature {
+	who := &Signature{Name: "gits", When: time.Now()}
+
+	if repo.session != nil && repo.session.User != "" {
+		// The user comes from the transport, so drop what would break the reflog line.
+		who.Name = strings.Map(func(r rune) rune {
+			return ternary(strings.ContainsRune(identityDelimiters, r), -1, r)
+		}, repo.session.User)
+	}
+
+	return who
+}
+
+func (repo *Repo) lockRefs() func() {
+	return repo.lock("refs")
+}
+
+// lock takes the lock of the repo named what, e.g. refs or objects, and returns its unlock.
+func (repo *Repo) lock(what string) func() {
+	key := repo.conf.Dir + "\x00" + repo.conf.Name + "\x00" + what
+	mu, _ := repoLocks.LoadOrStore(key, &sync.Mutex{})
+
+	mu.(*sync.Mutex).Lock()
+
+	return mu.(*sync.Mutex).Unlock
+}
+
+// hiddenRefs returns the hideRefs patterns of a service, section being uploadpack or receive:
+// conf.HideRefs, then transfer.hideRefs and <section>.hideRefs in file order.
+func (repo *Repo) hiddenRefs(config *GitConfig, section string) []string {
+	patterns := append([]string{}, ternary(repo.conf.HideRefs != nil, repo.conf.HideRefs, DEFAULT_HIDE_REFS)...)
+
+	for _, v := range config.vars() {
+		if v.is("transfer", "", "hiderefs") || v.is(section, "", "hiderefs") {
+			patterns = append(patterns, v.value)
+		}
+	}
+
+	return patterns
+}
+
+// refHidden reports whether a ref matches the patterns of hideRefs, the last matching pattern decides.
+// A pattern matches the ref of its name and the refs below it, a leading ! shows them again. In a
+// namespace, patterns starting with ^ match the full name of the ref.
+func (repo *Repo) refHidden(name string, patterns []string) bool {
+	for i := len(patterns) - 1; i >= 0; i-- {
+		pattern, show := strings.CutPrefix(patterns[i], "!")
+		subject := name
+
+		if full, ok := strings.CutPrefix(pattern, "^"); ok {
+			pattern, subject = full, repo.namespace()+name
+		}
+
+		pattern = strings.TrimSuffix(pattern, "/")
+
+		if rest, ok := strings.CutPrefix(subject, pattern); ok && (rest == "" || rest[0] == '/') {
+			return !show
+		}
+	}
+
+	return false
+}
+
+// Follows the rules of git check-ref-format for full ref names.
+func validRefName(name string) bool {
+	if !strings.HasPrefix(name, "refs/") || strings.HasSuffix(name, "/") || strings.HasSuffix(name, ".") {
+		return false
+	}
+
+	if strings.Contains(name, "..") || strings.Contains(name, "@{") || strings.Contains(name, "//") {
+		return false
+	}
+
+	if strings.ContainsAny(name, " ~^:?*[\\\x7f") {
+		return false
+	}
+
+	for _, c := range name {
+		if c < 32 {
+			return false
+		}
+	}
+
+	for _, part := range strings.Split(name, "/") {
+		if part == "" || strings.HasPrefix(part, ".") || strings.HasSuffix(part, ".lock") {
+			return false
+		}
+	}
+
+	return true
+}
+
+func (t *refTransaction) Update(name, oldHash, newHash string) error {
+	if name != "HEAD" && !validRefName(name) {
+		return fmt.Errorf("invalid ref name: %s", name)
+	}
+
+	if !isHash(newHash) || oldHash != "" && !isHash(oldHash) {
+		return fmt.Errorf("invalid update of %s: %s %s", name, oldHash, newHash)
+	}
+
+	t.updates = append(t.updates, &RefUpdate{Name: name, Old: oldHash, New: newHash})
+
+	return nil
+}
+
+func (t *refTransaction) SetSymref(name, target string) error {
+	if name != "HEAD" && !validRefName(name) || !validRefName(target) {
+		return fmt.Errorf("invalid symbolic ref: %s -> %s", name, target)
+	}
+
+	t.symrefs[name] = target
+
+	return nil
+}
+
+// Refs updated without an old hash get their current one, for the reflog. Like git, the reflog of
+// HEAD also records the updates of the branch it points to.
+func (t *refTransaction) Commit(who *Signature, msg string) error {
+	if who != nil {
+		if err := validSignature(who); err != nil {
+			return err
+		}
+	}
+
+	unlock := t.repo.lockRefs()
+	defer unlock()
+
+	head, err := t.store.Get("HEAD")
+
+	if err != nil {
+		return err
+	}
+
+	updates := make([]*RefUpdate, len(t.updates))
+	logs := []*RefUpdate{}
+
+	for i, update := range t.updates {
+		ref, err := t.store.Get(update.Name)
+
+		if err != nil {
+			return err
+		}
+
+		current := ZERO_HASH
+
+		if ref != nil && ref.Hash != "" {
+			current = ref.Hash
+		}
+
+		if update.Old != "" && update.Old != current {
+			return &RefConflictError{Ref: update.Name, Expected: update.Old, Actual: current}
+		}
+
+		updates[i] = &RefUpdate{Name: update.Name, Old: current, New: update.New}
+		logs = append(logs, updates[i])
+
+		if head != nil && head.Target == update.Name {
+			logs = append(logs, &RefUpdate{Name: "HEAD", Old: current, New: update.New})
+		}
+	}
+
+	return t.store.apply(updates, t.symrefs, logs, who, msg)
+}
+
+func (t *refTransaction) Abort() error {
+	t.updates = nil
+	t.symrefs = map[string]string{}
+
+	return nil
+}
+
+// A loose ref wins over the same ref in packed-refs.
+func (f *filesRefs) Get(name string) (*Ref, error) {
+	path := f.repo.absPath(name)
+
+	if f.repo.fs.Stat(path)[0] != 1 {
+		if name == "HEAD" {
+			return nil, nil
+		}
+
+		packed, _, err := f.readPackedRefs()
+
+		if err != nil || packed[name] == "" {
+			return nil, err
+		}
+
+		return &Ref{Name: name, Hash: packed[name]}, nil
+	}
+
+	data, err := f.repo.fs.ReadFile(path)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return parseLooseRef(name, string(data)), nil
+}
+
+func (f *filesRefs) Iterate(prefix string, fn func(ref *Ref) error) error {
+	refs, err := f.refs()
+
+	if err != nil {
+		return err
+	}
+
+	return iterateRefs(refs, prefix, fn)
+}
+
+func (f *filesRefs) Transaction() (RefTransaction, error) {
+	return &refTransaction{repo: f.repo, store: f, symrefs: map[string]string{}}, nil
+}
+
+// refs reads every ref under refs/, loose and packed.
+func (f *filesRefs) refs() (map[string]*Ref, error) {
+	packed, _, err := f.readPackedRefs()
+
+	if err != nil {
+		return nil, err
+	}
+
+	refs := map[string]*Ref{}
+
+	for name, hash := range packed {
+		refs[name] = &Ref{Name: name, Hash: hash}
+	}
+
+	refsPath := f.repo.absPath("refs")
+
+	if f.repo.fs.Stat(refsPath)[0] != 2 {
+		return refs, nil
+	}
+
+	files, err := f.repo.fs.Scan(refsPath, FS_TYPE_FILE, -1)
+
+	if err != nil {
+		return nil, err
+	}
+
+	for file := range files {
+		name := "refs" + file[len(refsPath):]
+
+		if !validRefName(name) {
+			continue
+		}
+
+		data, err := f.repo.fs.ReadFile(file)
+
+		if err != nil {
+			return nil, err
+		}
+
+		// A ref holding the zero hash was deleted, it hides the packed one.
+		if ref := parseLooseRef(name, string(data)); ref != nil {
+			refs[name] = ref
+		} else {
+			delete(refs, name)
+		}
+	}
+
+	return refs, nil
+}
+
+// Every file changes through a lock: the refs, packed-refs when a deleted ref is packed, then the
+// reflogs. If a step fails, the files already changed are restored, so either all refs move and
+// get their reflog line or none. Like git, deleted refs lose their reflog.
+func (f *filesRefs) apply(updates []*RefUpdate, symrefs map[string]string, logs []*RefUpdate, who *Signature, msg string) error {
+	tx := newLockTx(f.repo.fs)
+
+	if err := f.stage(tx, updates, symrefs, logs, who, msg); err != nil {
+		tx.abort()
+		return err
+	}
+
+	return tx.commit()
+}
+
+func (f *filesRefs) stage(tx *lockTx, updates []*RefUpdate, symrefs map[string]string, logs []*RefUpdate, who *Signature, msg string) error {
+	for name, target := range symrefs {
+		if err := tx.write(f.repo.absPath(name), []byte("ref: "+target+"\n")); err != nil {
+			return err
+		}
+	}
+
+	deleted := map[string]bool{}
+
+	for _, update := range updates {
+		if update.New != ZERO_HASH {
+			if err := tx.write(f.repo.absPath(update.Name), []byte(update.New+"\n")); err != nil {
+				return err
+			}
+
+			continue
+		}
+
+		deleted[update.Name] = true
+	}
+
+	if len(deleted) > 0 {
+		refs, peeled, err := f.readPackedRefs()
+
+		if err != nil {
+			return err
+		}
+
+		found := false
+
+		for name := range deleted {
+			found = found || refs[name] != ""
+			delete(refs, name)
+			delete(peeled, name)
+		}
+
+		if found {
+			if err := tx.write(f.repo.absPath("packed-refs"), formatPackedRefs(refs, peeled)); err != nil {
+				return err
+			}
+		}
+
+		for name := range deleted {
+			if tx.rename == nil {
+				if err := f.tombstone(tx, name); err != nil {
+					return err
+				}
+
+				continue
+			}
+
+			for _, file := range []string{f.repo.absPath(name), f.repo.absPath("logs/" + name)} {
+				if err := tx.remove(file); err != nil {
+					return err
+				}
+			}
+		}
+	}
+
+	for _, log := range logs {
+		if !deleted[log.Name] {
+			if err := f.appendReflog(tx, log, who, msg); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// tombstone deletes a ref on an FS that cannot remove files: the loose ref is kept holding ZERO_HASH,
+// which reads as deleted and hides a packed ref, and its reflog is emptied. git reports such a ref as
+// broken, these FS are not meant to be shared with it.
+func (f *filesRefs) tombstone(tx *lockTx, name string) error {
+	files := []struct{ path, data string }{
+		{f.repo.absPath(name), ZERO_HASH + "\n"},
+		{f.repo.absPath("logs/" + name), ""},
+	}
+
+	for _, file := range files {
+		_, exists, err := tx.read(file.path)
+
+		if err != nil {
+			return err
+		}
+
+		if exists {
+			if err := tx.write(file.path, []byte(file.data)); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+func (f *filesRefs) init() error {
+	return f.repo.fs.Mkdir(f.repo.absPath("refs"))
+}
+
+// parseLooseRef reads the content of a ref file, nil for an empty or deleted ref.
+func parseLooseRef(name, data string) *Ref {
+	data = strings.TrimSpace(data)
+
+	switch {
+	case data == "" || data == ZERO_HASH:
+		return nil
+	case strings.HasPrefix(data, "ref: "):
+		return &Ref{Name: name, Target: strings.TrimPrefix(data, "ref: ")}
+	default:
+		return &Ref{Name: name, Hash: data}
+	}
+}
+
+// iterateRefs calls fn for the refs starting with prefix, by name.
+func iterateRefs(refs map[string]*Ref, prefix string, fn func(ref *Ref) error) error {
+	names := make([]string, 0, len(refs))
+
+	for name := range refs {
+		if strings.HasPrefix(name, prefix) {
+			names = append(names, name)
+		}
+	}
+
+	sort.Strings(names)
+
+	for _, name := range names {
+		if err := fn(refs[name]); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,367 @@
+package gits
+
+import (
+	"errors"
+	"io/fs"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// failingFS fails to rename a file over the one whose path ends with failOn.
+type failingFS struct {
+	FS
+	failOn string
+}
+
+func (f *failingFS) Rename(oldPath, newPath string) error {
+	if f.failOn != "" && strings.HasSuffix(newPath, f.failOn) {
+		return errors.New("rename failed")
+	}
+
+	return f.FS.(RenameFS).Rename(oldPath, newPath)
+}
+
+func (f *failingFS) Remove(path string) error {
+	return f.FS.(RenameFS).Remove(path)
+}
+
+func TestRefTransactionAllOrNothing(t *testing.T) {
+	tests := []struct {
+		name   string
+		failOn string
+	}{
+		{"first ref", "refs/heads/main"},
+		{"second ref", "refs/heads/new"},
+		{"packed-refs", "packed-refs"},
+		{"reflog", "logs/HEAD"},
+		{"success", ""},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			fs := &failingFS{}
+			repo := newTestRepo(t, &Config{FS: func(root string) (FS, error) {
+				disk, err := NewDiskFS(root)
+				fs.FS = disk
+
+				return fs, err
+			}})
+
+			first, err := repo.CommitFiles(&CommitFilesSpec{
+				Branch:  "main",
+				Author:  testSignature(),
+				Message: "first",
+				Ops:     []FileOp{{Action: FILE_ADD, Path: "a", Content: []byte("a\n")}},
+			})
+
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if err := repo.updateRef("refs/tags/v1", "", first, nil, "tag"); err != nil {
+				t.Fatal(err)
+			}
+
+			if err := repo.PackRefs(); err != nil {
+				t.Fatal(err)
+			}
+
+			second, err := repo.WriteCommit(&CommitSpec{Tree: readTree(t, repo, first), Parents: []string{first}, Author: testSignature(), Message: "second\n"})
+
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			before := snapshotRepo(t, repo)
+			fs.failOn = test.failOn
+
+			tx, err := repo.refs.Transaction()
+
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			tx.Update("refs/heads/main", first, second)
+			tx.Update("refs/heads/new", ZERO_HASH, second)
+			tx.Update("refs/tags/v1", first, ZERO_HASH)
+			err = tx.Commit(testSignature(), "update")
+			after := snapshotRepo(t, repo)
+
+			if test.failOn == "" {
+				if err != nil {
+					t.Fatal(err)
+				}
+
+				if hash, _ := repo.resolveRef("refs/heads/new"); hash != second {
+					t.Fatalf("refs/heads/new = %s, want %s", hash, second)
+				}
+
+				runGit(t, repoPath(repo), "fsck", "--strict")
+
+				return
+			}
+
+			if err == nil {
+				t.Fatal("commit succeeded")
+			}
+
+			for path, data := range before {
+				if after[path] != data {
+					t.Errorf("%s changed from %q to %q", path, data, after[path])
+				}
+			}
+
+			for path := range after {
+				if _, ok := before[path]; !ok {
+					t.Errorf("%s was left behind", path)
+				}
+			}
+		})
+	}
+}
+
+func TestExpireReflogAllOrNothing(t *testing.T) {
+	fs := &failingFS{}
+	repo := newTestRepo(t, &Config{FS: func(root string) (FS, error) {
+		disk, err := NewDiskFS(root)
+		fs.FS = disk
+
+		return fs, err
+	}})
+
+	_, err := repo.CommitFiles(&CommitFilesSpec{
+		Branch:  "main",
+		Author:  testSignature(),
+		Message: "first",
+		Ops:     []FileOp{{Action: FILE_ADD, Path: "a", Content: []byte("a\n")}},
+	})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	before := snapshotRepo(t, repo)
+	opts := &ReflogExpireOptions{Refs: []string{"refs/heads/main"}, Expire: time.Now()}
+	fs.failOn = "logs/refs/heads/main"
+
+	if err := repo.ExpireReflog(opts); err == nil {
+		t.Fatal("expire succeeded")
+	}
+
+	after := snapshotRepo(t, repo)
+
+	for path, data := range after {
+		if before[path] != data {
+			t.Fatalf("%s changed from %q to %q", path, before[path], data)
+		}
+	}
+
+	fs.failOn = ""
+
+	if err := repo.ExpireReflog(opts); err != nil {
+		t.Fatal(err)
+	}
+
+	if log := snapshotRepo(t, repo)["/logs/refs/heads/main"]; log != "" {
+		t.Fatalf("reflog = %q, want it empty", log)
+	}
+}
+
+func TestForeignLocks(t *testing.T) {
+	repo := newTestRepo(t, nil)
+
+	first, err := repo.CommitFiles(&CommitFilesSpec{
+		Branch:  "main",
+		Author:  testSignature(),
+		Message: "first",
+		Ops:     []FileOp{{Action: FILE_ADD, Path: "a", Content: []byte("a\n")}},
+	})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := repo.updateRef("refs/heads/other", "", first, nil, "create"); err != nil {
+		t.Fatal(err)
+	}
+
+	config, err := repo.Config()
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		lock string
+		run  func() error
+	}{
+		{"refs/heads/new", func() error { return repo.updateRef("refs/heads/new", "", first, nil, "create") }},
+		{"refs/heads/other", func() error { return repo.updateRef("refs/heads/other", first, ZERO_HASH, nil, "delete") }},
+		{"logs/HEAD", func() error { return repo.updateRef("refs/heads/main", first, first, nil, "reset") }},
+		{"packed-refs", repo.PackRefs},
+		{"config", func() error { return repo.WriteConfig(config) }},
+	}
+
+	for _, test := range tests {
+		t.Run(test.lock, func(t *testing.T) {
+			lock := filepath.Join(repoPath(repo), test.lock+".lock")
+
+			if err := os.WriteFile(lock, []byte("taken"), 0644); err != nil {
+				t.Fatal(err)
+			}
+
+			before := snapshotRepo(t, repo)
+
+			if err := test.run(); !errors.Is(err, fs.ErrExist) {
+				t.Fatalf("err = %v, want fs.ErrExist", err)
+			}
+
+			after := snapshotRepo(t, repo)
+
+			for path, data := range before {
+				if after[path] != data {
+					t.Errorf("%s changed from %q to %q", path, data, after[path])
+				}
+			}
+
+			for path := range after {
+				if _, ok := before[path]; !ok {
+					t.Errorf("%s was left behind", path)
+				}
+			}
+
+			os.Remove(lock)
+
+			if err := test.run(); err != nil {
+				t.Fatal(err)
+			}
+		})
+	}
+
+	if _, err := exec.LookPath("git"); err != nil {
+		return
+	}
+
+	// git refuses a lock gits holds the same way.
+	if err := os.WriteFile(filepath.Join(repoPath(repo), "refs/heads/main.lock"), nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	cmd := exec.Command("git", "update-ref", "refs/heads/main", first)
+	cmd.Dir = repoPath(repo)
+
+	if out, err := cmd.CombinedOutput(); err == nil || !strings.Contains(string(out), "File exists") {
+		t.Fatalf("git update-ref: %v\n%s", err, out)
+	}
+}
+
+func TestFSWithoutRename(t *testing.T) {
+	repo := newTestRepo(t, &Config{FS: plainFS})
+
+	first, err := repo.CommitFiles(&CommitFilesSpec{
+		Branch:  "main",
+		Author:  testSignature(),
+		Message: "first",
+		Ops:     []FileOp{{Action: FILE_ADD, Path: "a", Content: []byte("a\n")}},
+	})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	config, err := repo.Config()
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	config.Set("core.test", "true")
+
+	tests := []struct {
+		name      string
+		run       func() error
+		supported bool
+	}{
+		{"create ref", func() error { return repo.updateRef("refs/heads/other", "", first, nil, "create") }, true},
+		{"write config", func() error { return repo.WriteConfig(config) }, true},
+		{"delete ref", func() error { return repo.updateRef("refs/heads/other", first, ZERO_HASH, nil, "delete") }, true},
+		{"recreate ref", func() error { return repo.updateRef("refs/heads/other", ZERO_HASH, first, nil, "create") }, true},
+		{"delete recreated ref", func() error { return repo.updateRef("refs/heads/other", first, ZERO_HASH, nil, "delete") }, true},
+		{"pack refs", repo.PackRefs, false},
+		{"gc", func() error { return repo.GC(nil) }, false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			err := test.run()
+
+			if test.supported && err != nil {
+				t.Fatal(err)
+			}
+
+			if !test.supported && !errors.Is(err, ErrNoRename) {
+				t.Fatalf("err = %v, want ErrNoRename", err)
+			}
+
+			for path := range snapshotRepo(t, repo) {
+				if strings.HasSuffix(path, ".lock") {
+					t.Errorf("%s was left behind", path)
+				}
+			}
+		})
+	}
+
+	if hash, _ := repo.resolveRef("refs/heads/other"); hash != "" {
+		t.Fatalf("refs/heads/other = %s, want it deleted", hash)
+	}
+
+	repo.refs.Iterate("refs/", func(ref *Ref) error {
+		if ref.Name == "refs/heads/other" {
+			t.Errorf("%s is listed", ref.Name)
+		}
+
+		return nil
+	})
+
+	if entries, _ := repo.Reflog("refs/heads/other"); len(entries) != 0 {
+		t.Fatalf("reflog of refs/heads/other has %d entries", len(entries))
+	}
+}
+
+// snapshotRepo returns the content of the refs, logs and packed-refs of a repo by path.
+func snapshotRepo(t *testing.T, repo *Repo) map[string]string {
+	files := map[string]string{}
+	root := repoPath(repo)
+
+	for _, dir := range []string{"refs", "logs", "packed-refs", "HEAD"} {
+		filepath.Walk(filepath.Join(root, dir), func(path string, info os.FileInfo, err error) error {
+			if err == nil && !info.IsDir() {
+				data, err := os.ReadFile(path)
+
+				if err != nil {
+					t.Fatal(err)
+				}
+
+				files[path[len(root):]] = string(data)
+			}
+
+			return nil
+		})
+	}
+
+	return files
+}
+
+func readTree(t *testing.T, repo *Repo, commit string) string {
+	object, err := repo.Object(commit)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return object.TreeHash
+}
@@ -0,0 +1,919 @@
+package gits
+
+import (
+	"bytes"
+	"compress/zlib"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"math/rand"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Layout of reftable version 1, see https://git-scm.com/docs/reftable.
+const (
+	reftableHeaderSize = 24
+	reftableFooterSize = 68
+	reftableBlockSize  = 4096
+	reftableRestarts   = 16 // Records between two restart points.
+)
+
+// Value types of ref records, log records use 0 (deletion) and 1.
+const (
+	reftableDeletion = 0
+	reftableValue    = 1
+	reftablePeeled   = 2
+	reftableSymref   = 3
+)
+
+// Parsed tables by path, a table never changes once it is in tables.list.
+var reftableCache sync.Map
+
+// reftableRefs keeps refs in a stack of tables listed in reftable/tables.list, oldest first.
+// Every change adds a table, tables are merged when the stack stops shrinking geometrically.
+type reftableRefs struct {
+	repo *Repo
+}
+
+type reftable struct {
+	minIndex uint64
+	maxIndex uint64
+	refs     []*reftableRef // By name.
+	logs     []*reftableLog // By ref, newest first.
+	size     int
+}
+
+type reftableRef struct {
+	name        string
+	updateIndex uint64
+	typ         uint8
+	hash        string
+	peeled      string
+	target      string
+}
+
+type reftableLog struct {
+	ref         string
+	updateIndex uint64
+	deleted     bool
+	old         string
+	new         string
+	who         *Signature
+	message     string
+}
+
+// reftableBlock collects the records of one block, sharing key prefixes between restart points.
+type reftableBlock struct {
+	typ      byte
+	offset   int // Of the block in the file.
+	header   int // File header bytes in front of the block, only for the first block.
+	records  bytes.Buffer
+	restarts []int
+	last     string
+	count    int
+}
+
+type reftableIndexEntry struct {
+	key    string
+	offset int
+}
+
+// reftableReader decodes the records of a block.
+type reftableReader struct {
+	data []byte
+	pos  int
+}
+
+func (t *reftableRefs) Get(name string) (*Ref, error) {
+	_, tables, err := t.load()
+
+	if err != nil {
+		return nil, err
+	}
+
+	for i := len(tables) - 1; i >= 0; i-- {
+		refs := tables[i].refs
+		at := sort.Search(len(refs), func(j int) bool { return refs[j].name >= name })
+
+		if at < len(refs) && refs[at].name == name {
+			return refs[at].ref(), nil
+		}
+	}
+
+	return nil, nil
+}
+
+func (t *reftableRefs) Iterate(prefix string, fn func(ref *Ref) error) error {
+	_, tables, err := t.load()
+
+	if err != nil {
+		return err
+	}
+
+	refs := map[string]*Ref{}
+
+	for _, table := range tables {
+		for _, record := range table.refs {
+			if ref := record.ref(); ref != nil && strings.HasPrefix(ref.Name, "refs/") {
+				refs[ref.Name] = ref
+			} else {
+				delete(refs, record.name)
+			}
+		}
+	}
+
+	return iterateRefs(refs, prefix, fn)
+}
+
+func (t *reftableRefs) Transaction() (RefTransaction, error) {
+	return &refTransaction{repo: t.repo, store: t, symrefs: map[string]string{}}, nil
+}
+
+// The changes and their log records go to one new table. Deleted refs keep their log.
+func (t *reftableRefs) apply(updates []*RefUpdate, symrefs map[string]string, logs []*RefUpdate, who *Signature, msg string) error {
+	refs := []*reftableRef{}
+	records := []*reftableLog{}
+
+	for _, log := range logs {
+		records = append(records, &reftableLog{ref: log.Name, old: log.Old, new: log.New, who: who, message: msg})
+	}
+
+	for name, target := range symrefs {
+		refs = append(refs, &reftableRef{name: name, typ: reftableSymref, target: target})
+	}
+
+	for _, update := range updates {
+		ref := &reftableRef{name: update.Name, typ: reftableValue, hash: update.New}
+
+		if update.New == ZERO_HASH {
+			ref = &reftableRef{name: update.Name, typ: reftableDeletion}
+		}
+
+		refs = append(refs, ref)
+	}
+
+	// A table holds a ref once, the last change wins.
+	last := map[string]*reftableRef{}
+
+	for _, ref := range refs {
+		last[ref.name] = ref
+	}
+
+	refs = refs[:0]
+
+	for _, ref := range last {
+		refs = append(refs, ref)
+	}
+
+	return t.add(refs, records)
+}
+
+func (t *reftableRefs) pack() error {
+	names, tables, err := t.load()
+
+	if err != nil || len(tables) < 2 {
+		return err
+	}
+
+	return t.compact(names, tables, 0, len(tables), nil)
+}
+
+// HEAD only tells git to look for refs elsewhere, the real one is in the tables.
+func (t *reftableRefs) init() error {
+	if err := t.repo.fs.WriteFile(t.repo.absPath("reftable/tables.list"), []byte{}); err != nil {
+		return err
+	}
+
+	return t.repo.fs.WriteFile(t.repo.absPath("HEAD"), []byte("ref: refs/heads/.invalid\n"))
+}
+
+// load returns the names and the parsed tables of tables.list, oldest first.
+func (t *reftableRefs) load() ([]string, []*reftable, error) {
+	data, err := t.repo.fs.ReadFile(t.repo.absPath("reftable/tables.list"))
+
+	if err != nil {
+		return nil, nil, err
+	}
+
+	names := strings.Fields(string(data))
+	tables := make([]*reftable, len(names))
+
+	for i, name := range names {
+		if tables[i], err = t.table(name); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	return names, tables, nil
+}
+
+func (t *reftableRefs) table(name string) (*reftable, error) {
+	path := t.repo.absPath("reftable/" + name)
+	key := t.repo.conf.Dir + "\x00" + path
+
+	if cached, ok := reftableCache.Load(key); ok {
+		return cached.(*reftable), nil
+	}
+
+	data, err := t.repo.fs.ReadFile(path)
+
+	if err != nil {
+		return nil, err
+	}
+
+	table, err := parseReftable(data)
+
+	if err != nil {
+		return nil, fmt.Errorf("reftable %s: %w", name, err)
+	}
+
+	reftableCache.Store(key, table)
+
+	return table, nil
+}
+
+// add writes the records as a new table on top of the stack.
+func (t *reftableRefs) add(refs []*reftableRef, logs []*reftableLog) error {
+	names, tables, err := t.load()
+
+	if err != nil {
+		return err
+	}
+
+	index := uint64(1)
+
+	if len(tables) > 0 {
+		index = tables[len(tables)-1].maxIndex + 1
+	}
+
+	for _, ref := range refs {
+		ref.updateIndex = index
+	}
+
+	for _, log := range logs {
+		log.updateIndex = index
+	}
+
+	name, err := t.writeTable(index, index, refs, logs)
+
+	if err != nil {
+		return err
+	}
+
+	if err := t.writeStack(append(names, name)); err != nil {
+		return err
+	}
+
+	return t.autoCompact()
+}
+
+// autoCompact merges the top tables while a table is not at least twice as big as the one above it.
+func (t *reftableRefs) autoCompact() error {
+	// The merged tables could not be removed.
+	if _, ok := t.repo.fs.(RenameFS); !ok {
+		return nil
+	}
+
+	for {
+		names, tables, err := t.load()
+
+		if err != nil {
+			return err
+		}
+
+		n := len(tables)
+
+		if n < 2 || tables[n-2].size > 2*tables[n-1].size {
+			return nil
+		}
+
+		if err := t.compact(names, tables, n-2, n, nil); err != nil {
+			return err
+		}
+	}
+}
+
+// compact replaces tables[from:to] with one table. Deletions are dropped once nothing older is left,
+// log records also when keep returns false for them.
+func (t *reftableRefs) compact(names []string, tables []*reftable, from, to int, keep func(log *reftableLog) bool) error {
+	if _, ok := t.repo.fs.(RenameFS); !ok {
+		return fmt.Errorf("compact reftable: %w", ErrNoRename)
+	}
+
+	merged := map[string]*reftableRef{}
+	mergedLogs := map[string]*reftableLog{}
+
+	for _, table := range tables[from:to] {
+		for _, ref := range table.refs {
+			merged[ref.name] = ref
+		}
+
+		for _, log := range table.logs {
+			mergedLogs[fmt.Sprintf("%s\x00%d", log.ref, log.updateIndex)] = log
+		}
+	}
+
+	refs := []*reftableRef{}
+	logs := []*reftableLog{}
+
+	for _, ref := range merged {
+		if from > 0 || ref.typ != reftableDeletion {
+			refs = append(refs, ref)
+		}
+	}
+
+	for _, log := range mergedLogs {
+		if keep != nil && !log.deleted && !keep(log) {
+			log = &reftableLog{ref: log.ref, updateIndex: log.updateIndex, deleted: true}
+		}
+
+		if from > 0 || !log.deleted {
+			logs = append(logs, log)
+		}
+	}
+
+	name, err := t.writeTable(tables[from].minIndex, tables[to-1].maxIndex, refs, logs)
+
+	if err != nil {
+		return err
+	}
+
+	stack := append(append(append([]string{}, names[:from]...), name), names[to:]...)
+
+	if err := t.writeStack(stack); err != nil {
+		return err
+	}
+
+	for _, old := range names[from:to] {
+		path := t.repo.absPath("reftable/" + old)
+		reftableCache.Delete(t.repo.conf.Dir + "\x00" + path)
+
+		if err := removeFile(t.repo.fs, path); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (t *reftableRefs) writeTable(minIndex, maxIndex uint64, refs []*reftableRef, logs []*reftableLog) (string, error) {
+	data, err := encodeReftable(minIndex, maxIndex, refs, logs)
+
+	if err != nil {
+		return "", err
+	}
+
+	name := fmt.Sprintf("0x%012x-0x%012x-%08x.ref", minIndex, maxIndex, rand.Uint32())
+
+	return name, t.repo.fs.WriteFile(t.repo.absPath("reftable/"+name), data)
+}
+
+// writeStack replaces tables.list through tables.list.lock, readers see the old or the new stack.
+func (t *reftableRefs) writeStack(names []string) error {
+	data := strings.Join(names, "\n")
+
+	if len(names) > 0 {
+		data += "\n"
+	}
+
+	return replaceFile(t.repo.fs, t.repo.absPath("reftable/tables.list"), []byte(data))
+}
+
+// encodeReftable writes refs and logs as a version 1 table: unaligned ref blocks, their index,
+// then zlib compressed log blocks and their index. There are no object blocks.
+func encodeReftable(minIndex, maxIndex uint64, refs []*reftableRef, logs []*reftableLog) ([]byte, error) {
+	sort.Slice(refs, func(i, j int) bool { return refs[i].name < refs[j].name })
+
+	sortReftableLogs(logs)
+
+	var out bytes.Buffer
+
+	header := reftableFileHeader(minIndex, maxIndex)
+	out.Write(header)
+
+	blocks := []reftableIndexEntry{}
+	block := &reftableBlock{typ: 'r', header: reftableHeaderSize}
+
+	for _, ref := range refs {
+		var payload bytes.Buffer
+
+		payload.Write(putVarint(ref.updateIndex - minIndex))
+
+		switch ref.typ {
+		case reftableValue, reftablePeeled:
+			if err := writeRawHash(&payload, ref.hash); err != nil {
+				return nil, err
+			}
+
+			if ref.typ == reftablePeeled {
+				if err := writeRawHash(&payload, ref.peeled); err != nil {
+					return nil, err
+				}
+			}
+
+		case reftableSymref:
+			payload.Write(putVarint(uint64(len(ref.target))))
+			payload.WriteString(ref.target)
+		}
+
+		block = block.add(&out, &blocks, ref.name, ref.typ, payload.Bytes())
+	}
+
+	block.flush(&out, &blocks)
+
+	refIndex := writeReftableIndex(&out, blocks)
+	logPosition := 0
+	logIndex := 0
+
+	if len(logs) > 0 {
+		logPosition = out.Len()
+		blocks = []reftableIndexEntry{}
+		block = &reftableBlock{typ: 'g', offset: out.Len()}
+
+		for _, log := range logs {
+			var key bytes.Buffer
+			var payload bytes.Buffer
+
+			key.WriteString(log.ref + "\x00")
+			binary.Write(&key, binary.BigEndian, ^log.updateIndex)
+
+			if !log.deleted {
+				if err := writeRawHash(&payload, log.old); err != nil {
+					return nil, err
+				}
+
+				if err := writeRawHash(&payload, log.new); err != nil {
+					return nil, err
+				}
+
+				_, offset := log.who.When.Zone()
+
+				payload.Write(putVarint(uint64(len(log.who.Name))))
+				payload.WriteString(log.who.Name)
+				payload.Write(putVarint(uint64(len(log.who.Email))))
+				payload.WriteString(log.who.Email)
+				payload.Write(putVarint(uint64(log.who.When.Unix())))
+				binary.Write(&payload, binary.BigEndian, int16(offset/60))
+				payload.Write(putVarint(uint64(len(log.message))))
+				payload.WriteString(log.message)
+			}
+
+			block = block.add(&out, &blocks, key.String(), ternary[uint8](log.deleted, 0, 1), payload.Bytes())
+		}
+
+		block.flush(&out, &blocks)
+		logIndex = writeReftableIndex(&out, blocks)
+	}
+
+	footer := bytes.NewBuffer(append([]byte{}, header...))
+
+	for _, v := range []uint64{uint64(refIndex), 0, 0, uint64(logPosition), uint64(logIndex)} {
+		binary.Write(footer, binary.BigEndian, v)
+	}
+
+	binary.Write(footer, binary.BigEndian, crc32.ChecksumIEEE(footer.Bytes()))
+	out.Write(footer.Bytes())
+
+	return out.Bytes(), nil
+}
+
+// sortReftableLogs orders log records like their keys: by ref, then newest first.
+func sortReftableLogs(logs []*reftableLog) {
+	sort.Slice(logs, func(i, j int) bool {
+		if logs[i].ref != logs[j].ref {
+			return logs[i].ref < logs[j].ref
+		}
+
+		return logs[i].updateIndex > logs[j].updateIndex
+	})
+}
+
+func reftableFileHeader(minIndex, maxIndex uint64) []byte {
+	header := []byte{'R', 'E', 'F', 'T', 1, reftableBlockSize >> 16, reftableBlockSize >> 8 & 0xff, reftableBlockSize & 0xff}
+	header = binary.BigEndian.AppendUint64(header, minIndex)
+
+	return binary.BigEndian.AppendUint64(header, maxIndex)
+}
+
+// writeReftableIndex writes index blocks over the given blocks, level by level, and returns the offset
+// of the top level. A single block needs no index, then the offset is 0.
+func writeReftableIndex(out *bytes.Buffer, blocks []reftableIndexEntry) int {
+	if len(blocks) < 2 {
+		return 0
+	}
+
+	for len(blocks) > 1 {
+		level := []reftableIndexEntry{}
+		block := &reftableBlock{typ: 'i', offset: out.Len()}
+
+		for _, entry := range blocks {
+			block = block.add(out, &level, entry.key, 0, putVarint(uint64(entry.offset)))
+		}
+
+		block.flush(out, &level)
+		blocks = level
+	}
+
+	return blocks[0].offset
+}
+
+// add appends a record, writing the block out first when the record does not fit anymore.
+// It returns the block the record went to.
+func (b *reftableBlock) add(out *bytes.Buffer, blocks *[]reftableIndexEntry, key string, typ uint8, payload []byte) *reftableBlock {
+	prefix := 0
+
+	if b.count%reftableRestarts != 0 {
+		for prefix < len(key) && prefix < len(b.last) && key[prefix] == b.last[prefix] {
+			prefix++
+		}
+	}
+
+	var record bytes.Buffer
+
+	record.Write(putVarint(uint64(prefix)))
+	record.Write(putVarint(uint64(len(key)-prefix)<<3 | uint64(typ)))
+	record.WriteString(key[prefix:])
+	record.Write(payload)
+
+	if b.count > 0 && b.size()+record.Len()+3 > reftableBlockSize {
+		b.flush(out, blocks)
+		next := &reftableBlock{typ: b.typ, offset: out.Len()}
+
+		return next.add(out, blocks, key, typ, payload)
+	}
+
+	if prefix == 0 {
+		b.restarts = append(b.restarts, b.header+4+b.records.Len())
+	}
+
+	b.records.Write(record.Bytes())
+	b.last = key
+	b.count++
+
+	return b
+}
+
+// size is the length of the block with its header and restart table.
+func (b *reftableBlock) size() int {
+	return b.header + 4 + b.records.Len() + 3*len(b.restarts) + 2
+}
+
+// flush writes the block and records its last key for the index. Log blocks are compressed after
+// their header, their length is the inflated one.
+func (b *reftableBlock) flush(out *bytes.Buffer, blocks *[]reftableIndexEntry) {
+	if b.count == 0 {
+		return
+	}
+
+	content := append([]byte{}, b.records.Bytes()...)
+
+	for _, restart := range b.restarts {
+		content = append(content, byte(restart>>16), byte(restart>>8), byte(restart))
+	}
+
+	content = binary.BigEndian.AppendUint16(content, uint16(len(b.restarts)))
+	length := b.size()
+
+	out.Write([]byte{b.typ, byte(length >> 16), byte(length >> 8), byte(length)})
+
+	if b.typ == 'g' {
+		zw := zlib.NewWriter(out)
+		zw.Write(content)
+		zw.Close()
+	} else {
+		out.Write(content)
+	}
+
+	*blocks = append(*blocks, reftableIndexEntry{key: b.last, offset: b.offset})
+}
+
+// ref is the record as a Ref, nil for a deletion.
+func (r *reftableRef) ref() *Ref {
+	switch r.typ {
+	case reftableDeletion:
+		return nil
+	case reftableSymref:
+		return &Ref{Name: r.name, Target: r.target}
+	default:
+		return &Ref{Name: r.name, Hash: r.hash}
+	}
+}
+
+func parseReftable(data []byte) (*reftable, error) {
+	if len(data) < reftableHeaderSize+reftableFooterSize || string(data[:4]) != "REFT" {
+		return nil, fmt.Errorf("not a reftable")
+	}
+
+	if data[4] != 1 {
+		return nil, fmt.Errorf("unsupported reftable version %d", data[4])
+	}
+
+	footerStart := len(data) - reftableFooterSize
+	footer := data[footerStart:]
+
+	if crc32.ChecksumIEEE(footer[:reftableFooterSize-4]) != binary.BigEndian.Uint32(footer[reftableFooterSize-4:]) {
+		return nil, fmt.Errorf("footer checksum mismatch")
+	}
+
+	table := &reftable{
+		minIndex: binary.BigEndian.Uint64(data[8:16]),
+		maxIndex: binary.BigEndian.Uint64(data[16:24]),
+		size:     len(data),
+	}
+
+	blockSize := int(data[5])<<16 | int(data[6])<<8 | int(data[7])
+	refIndex := int(binary.BigEndian.Uint64(footer[24:32]))
+	objPosition := int(binary.BigEndian.Uint64(footer[32:40]) >> 5)
+	objIndex := int(binary.BigEndian.Uint64(footer[40:48]))
+	logPosition := int(binary.BigEndian.Uint64(footer[48:56]))
+
+	// Ref blocks run up to the first section after them.
+	refEnd := footerStart
+
+	for _, position := range []int{refIndex, objPosition, objIndex, logPosition} {
+		if position > 0 && position < refEnd {
+			refEnd = position
+		}
+	}
+
+	for offset := 0; offset < refEnd; {
+		header := ternary(offset == 0, reftableHeaderSize, 0)
+
+		if offset+header+4 > refEnd || data[offset+header] != 'r' {
+			break
+		}
+
+		length := int(data[offset+header+1])<<16 | int(data[offset+header+2])<<8 | int(data[offset+header+3])
+
+		if length < header+6 || offset+length > refEnd {
+			return nil, fmt.Errorf("invalid ref block at %d", offset)
+		}
+
+		err := reftableRecords(data[offset:offset+length], header, func(r *reftableReader, key string, typ uint8) error {
+			return table.readRef(r, key, typ)
+		})
+
+		if err != nil {
+			return nil, err
+		}
+
+		// Padded blocks take the whole block size.
+		next := offset + length
+
+		if next < refEnd && data[next] == 0 && blockSize > 0 {
+			next = offset + blockSize
+		}
+
+		offset = next
+	}
+
+	for offset := logPosition; logPosition > 0 && offset+4 <= footerStart && data[offset] == 'g'; {
+		length := int(data[offset+1])<<16 | int(data[offset+2])<<8 | int(data[offset+3])
+
+		if length < 6 {
+			return nil, fmt.Errorf("invalid log block at %d", offset)
+		}
+
+		compressed := bytes.NewReader(data[offset+4 : footerStart])
+		zr, err := zlib.NewReader(compressed)
+
+		if err != nil {
+			return nil, err
+		}
+
+		block := make([]byte, length)
+		copy(block, data[offset:offset+4])
+
+		if _, err := io.ReadFull(zr, block[4:]); err != nil {
+			return nil, err
+		}
+
+		// Reads the checksum, so the next block starts where the reader stopped.
+		if _, err := io.Copy(io.Discard, zr); err != nil {
+			return nil, err
+		}
+
+		err = reftableRecords(block, 0, func(r *reftableReader, key string, typ uint8) error {
+			return table.readLog(r, key, typ)
+		})
+
+		if err != nil {
+			return nil, err
+		}
+
+		offset = footerStart - compressed.Len()
+	}
+
+	return table, nil
+}
+
+// reftableRecords calls fn for every record of a block, fn reads the value.
+func reftableRecords(block []byte, header int, fn func(r *reftableReader, key string, typ uint8) error) error {
+	count := int(binary.BigEndian.Uint16(block[len(block)-2:]))
+	end := len(block) - 2 - 3*count
+
+	if end < header+4 {
+		return fmt.Errorf("invalid restart table")
+	}
+
+	r := &reftableReader{data: block[:end], pos: header + 4}
+	last := ""
+
+	for r.pos < end {
+		prefix, err := r.varint()
+
+		if err != nil {
+			return err
+		}
+
+		suffix, err := r.varint()
+
+		if err != nil {
+			return err
+		}
+
+		data, err := r.bytes(int(suffix >> 3))
+
+		if err != nil {
+			return err
+		}
+
+		if int(prefix) > len(last) {
+			return fmt.Errorf("invalid key prefix")
+		}
+
+		key := last[:prefix] + string(data)
+
+		if err := fn(r, key, uint8(suffix&7)); err != nil {
+			return err
+		}
+
+		last = key
+	}
+
+	return nil
+}
+
+func (t *reftable) readRef(r *reftableReader, name string, typ uint8) error {
+	delta, err := r.varint()
+
+	if err != nil {
+		return err
+	}
+
+	ref := &reftableRef{name: name, updateIndex: t.minIndex + delta, typ: typ}
+
+	switch typ {
+	case reftableValue, reftablePeeled:
+		if ref.hash, err = r.hash(); err == nil && typ == reftablePeeled {
+			ref.peeled, err = r.hash()
+		}
+
+	case reftableSymref:
+		ref.target, err = r.string()
+
+	case reftableDeletion:
+
+	default:
+		err = fmt.Errorf("unknown ref value type %d", typ)
+	}
+
+	t.refs = append(t.refs, ref)
+
+	return err
+}
+
+func (t *reftable) readLog(r *reftableReader, key string, typ uint8) error {
+	if len(key) < 9 || key[len(key)-9] != 0 {
+		return fmt.Errorf("invalid log key")
+	}
+
+	log := &reftableLog{
+		ref:         key[:len(key)-9],
+		updateIndex: ^binary.BigEndian.Uint64([]byte(key[len(key)-8:])),
+		deleted:     typ == 0,
+		who:         &Signature{},
+	}
+
+	t.logs = append(t.logs, log)
+
+	if log.deleted {
+		return nil
+	}
+
+	var err error
+
+	if log.old, err = r.hash(); err != nil {
+		return err
+	}
+
+	if log.new, err = r.hash(); err != nil {
+		return err
+	}
+
+	if log.who.Name, err = r.string(); err != nil {
+		return err
+	}
+
+	if log.who.Email, err = r.string(); err != nil {
+		return err
+	}
+
+	when, err := r.varint()
+
+	if err != nil {
+		return err
+	}
+
+	tz, err := r.bytes(2)
+
+	if err != nil {
+		return err
+	}
+
+	offset := int(int16(binary.BigEndian.Uint16(tz))) * 60
+	log.who.When = time.Unix(int64(when), 0).In(time.FixedZone("", offset))
+	log.message, err = r.string()
+
+	return err
+}
+
+func (r *reftableReader) varint() (uint64, error) {
+	if r.pos >= len(r.data) {
+		return 0, fmt.Errorf("truncated reftable record")
+	}
+
+	value := uint64(r.data[r.pos] & 0x7f)
+
+	for r.data[r.pos]&0x80 != 0 {
+		r.pos++
+
+		if r.pos >= len(r.data) {
+			return 0, fmt.Errorf("truncated reftable record")
+		}
+
+		value = (value+1)<<7 | uint64(r.data[r.pos]&0x7f)
+	}
+
+	r.pos++
+
+	return value, nil
+}
+
+func (r *reftableReader) bytes(n int) ([]byte, error) {
+	if n < 0 || r.pos+n > len(r.data) {
+		return nil, fmt.Errorf("truncated reftable record")
+	}
+
+	r.pos += n
+
+	return r.data[r.pos-n : r.pos], nil
+}
+
+// string reads a length prefixed string.
+func (r *reftableReader) string() (string, error) {
+	length, err := r.varint()
+
+	if err != nil {
+		return "", err
+	}
+
+	data, err := r.bytes(int(length))
+
+	return string(data), err
+}
+
+func (r *reftableReader) hash() (string, error) {
+	data, err := r.bytes(20)
+
+	return hex.EncodeToString(data), err
+}
+
+// putVarint encodes like ofs-delta offsets: big-endian groups of 7 bits, each continuation minus one.
+func putVarint(value uint64) []byte {
+	buf := []byte{byte(value & 0x7f)}
+
+	for value >>= 7; value > 0; value >>= 7 {
+		value--
+		buf = append([]byte{0x80 | byte(value&0x7f)}, buf...)
+	}
+
+	return buf
+}
+
+func writeRawHash(buf *bytes.Buffer, hash string) error {
+	raw, err := hex.DecodeString(hash)
+
+	if err != nil || len(raw) != 20 {
+		return fmt.Errorf("invalid hash: %s", hash)
+	}
+
+	buf.Write(raw)
+
+	return nil
+}
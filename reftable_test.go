@@ -0,0 +1,226 @@
+package gits
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+)
+
+func TestReftableMatchesGit(t *testing.T) {
+	// Git reads reftable since 2.45, the git subtests are skipped before.
+	readable := exec.Command("git", "init", "-q", "--bare", "--ref-format=reftable", t.TempDir()).Run() == nil
+
+	update := func(t *testing.T, repo *Repo, refs map[string]string, names []string, hash string) {
+		tx, err := repo.refs.Transaction()
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		for _, name := range names {
+			if err := tx.Update(name, "", hash); err != nil {
+				t.Fatal(err)
+			}
+
+			if hash == ZERO_HASH {
+				delete(refs, name)
+			} else {
+				refs[name] = hash
+			}
+		}
+
+		if err := tx.Commit(testSignature(), "update"); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	names := func(format string, n int) []string {
+		result := []string{}
+
+		for i := 0; i < n; i++ {
+			result = append(result, fmt.Sprintf(format, i))
+		}
+
+		return result
+	}
+
+	tests := []struct {
+		name string
+		run  func(t *testing.T, repo *Repo, refs map[string]string, commits []string)
+	}{
+		{"one ref", func(t *testing.T, repo *Repo, refs map[string]string, commits []string) {}},
+		{"many refs in one table", func(t *testing.T, repo *Repo, refs map[string]string, commits []string) {
+			update(t, repo, refs, names("refs/pull/%05d/head", 1000), commits[1])
+		}},
+		{"a table per update", func(t *testing.T, repo *Repo, refs map[string]string, commits []string) {
+			for i, name := range names("refs/heads/topic-%d", 40) {
+				update(t, repo, refs, []string{name}, commits[i%len(commits)])
+			}
+		}},
+		{"deletions", func(t *testing.T, repo *Repo, refs map[string]string, commits []string) {
+			all := names("refs/changes/%02d/1", 50)
+			update(t, repo, refs, all, commits[1])
+
+			for _, name := range all[:20] {
+				update(t, repo, refs, []string{name}, ZERO_HASH)
+			}
+		}},
+		{"packed after deletions", func(t *testing.T, repo *Repo, refs map[string]string, commits []string) {
+			all := names("refs/changes/%02d/1", 50)
+			update(t, repo, refs, all, commits[1])
+			update(t, repo, refs, all[10:30], ZERO_HASH)
+
+			if err := repo.PackRefs(); err != nil {
+				t.Fatal(err)
+			}
+		}},
+		{"annotated tag", func(t *testing.T, repo *Repo, refs map[string]string, commits []string) {
+			tag, err := repo.WriteTag(&TagSpec{Object: commits[1], Name: "v1", Tagger: testSignature(), Message: "v1\n"})
+
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			update(t, repo, refs, []string{"refs/tags/v1"}, tag)
+		}},
+		{"head on another branch", func(t *testing.T, repo *Repo, refs map[string]string, commits []string) {
+			update(t, repo, refs, []string{"refs/heads/dev"}, commits[1])
+
+			if err := repo.SetHead("refs/heads/dev"); err != nil {
+				t.Fatal(err)
+			}
+		}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			repo := newTestRepo(t, &Config{RefStorage: REF_STORAGE_REFTABLE})
+			dir := repoPath(repo)
+			commits := []string{}
+
+			for i := 0; i < 3; i++ {
+				parent := ""
+
+				if i > 0 {
+					parent = commits[i-1]
+				}
+
+				hash, err := repo.CommitFiles(&CommitFilesSpec{
+					Branch:  "main",
+					Parent:  parent,
+					Author:  testSignature(),
+					Message: fmt.Sprint(i),
+					Ops:     []FileOp{{Action: ternary[uint8](i == 0, FILE_ADD, FILE_MODIFY), Path: "a", Content: []byte(fmt.Sprint(i))}},
+				})
+
+				if err != nil {
+					t.Fatal(err)
+				}
+
+				commits = append(commits, hash)
+			}
+
+			refs := map[string]string{"refs/heads/main": commits[2]}
+			test.run(t, repo, refs, commits)
+
+			// Tables are parsed again by a new repo.
+			reopened, err := OpenRepo(&Config{Dir: repo.conf.Dir, Name: repo.conf.Name})
+
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			want := formatRefs(refs)
+			got := map[string]string{}
+
+			err = reopened.refs.Iterate("", func(ref *Ref) error {
+				if ref.Target == "" {
+					got[ref.Name] = ref.Hash
+				}
+
+				return nil
+			})
+
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if formatRefs(got) != want {
+				t.Fatalf("refs:\n%s\nwant:\n%s", formatRefs(got), want)
+			}
+
+			// The stack shrinks geometrically, every table is over twice as big as the next one.
+			stack, err := os.ReadFile(filepath.Join(dir, "reftable", "tables.list"))
+
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			tables := strings.Fields(string(stack))
+
+			for i := 0; i+1 < len(tables); i++ {
+				a, errA := os.Stat(filepath.Join(dir, "reftable", tables[i]))
+				b, errB := os.Stat(filepath.Join(dir, "reftable", tables[i+1]))
+
+				if errA != nil || errB != nil || a.Size() <= 2*b.Size() {
+					t.Fatalf("table %d of %d is not over twice as big as the next one", i, len(tables))
+				}
+			}
+
+			head, err := reopened.refs.Get("HEAD")
+
+			if err != nil || head == nil {
+				t.Fatalf("HEAD = %v: %v", head, err)
+			}
+
+			t.Run("git", func(t *testing.T) {
+				if !readable {
+					t.Skip("git before 2.45 cannot read reftable")
+				}
+
+				if got := runGit(t, dir, "for-each-ref", "--format=%(refname) %(objectname)"); got != want {
+					t.Fatalf("git for-each-ref:\n%s\nwant:\n%s", got, want)
+				}
+
+				if got := strings.TrimSpace(runGit(t, dir, "symbolic-ref", "HEAD")); got != head.Target {
+					t.Fatalf("git symbolic-ref HEAD = %s, want %s", got, head.Target)
+				}
+
+				reflog, err := reopened.Reflog("refs/heads/main")
+
+				if err != nil {
+					t.Fatal(err)
+				}
+
+				if got := strings.Fields(runGit(t, dir, "reflog", "show", "--format=%H", "refs/heads/main")); len(got) != len(reflog) {
+					t.Fatalf("git reflog has %d entries, want %d", len(got), len(reflog))
+				}
+
+				runGit(t, dir, "fsck", "--strict", "--no-progress")
+			})
+		})
+	}
+}
+
+// formatRefs lists refs like git for-each-ref --format="%(refname) %(objectname)".
+func formatRefs(refs map[string]string) string {
+	names := make([]string, 0, len(refs))
+
+	for name := range refs {
+		names = append(names, name)
+	}
+
+	sort.Strings(names)
+
+	var buf strings.Builder
+
+	for _, name := range names {
+		fmt.Fprintf(&buf, "%s %s\n", name, refs[name])
+	}
+
+	return buf.String()
+}
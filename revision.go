@@ -0,0 +1,386 @@
+package gits
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+type AmbiguousHashError struct {
+	Prefix     string
+	Candidates []string
+}
+
+func (e *AmbiguousHashError) Error() string {
+	return fmt.Sprintf("short object id %s is ambiguous: %s", e.Prefix, strings.Join(e.Candidates, ", "))
+}
+
+type RevisionError struct {
+	Rev    string
+	Reason string
+}
+
+func (e *RevisionError) Error() string {
+	return fmt.Sprintf("%s: %s", e.Rev, e.Reason)
+}
+
+// Ref lookup order for short names, same as git rev-parse.
+var revRefRules = []string{
+	"%s",
+	"refs/%s",
+	"refs/tags/%s",
+	"refs/heads/%s",
+	"refs/remotes/%s",
+	"refs/remotes/%s/HEAD",
+}
+
+// ResolveRevision resolves a revision such as "main~3^2:src/app.go" to an object hash.
+//
+// Supported syntax: full and short hashes, HEAD, ref names, <ref>@{n}, ^, ^n, ~, ~n,
+// ^{}, ^{object}, ^{commit}, ^{tree}, ^{blob}, ^{tag} and <rev>:<path>.
+func (repo *Repo) ResolveRevision(rev string) (string, error) {
+	spec, filePath, hasPath := splitRevPath(rev)
+
+	if spec == "" {
+		return "", &RevisionError{Rev: rev, Reason: "index lookups are not supported in a bare repository"}
+	}
+
+	end := strings.IndexAny(spec, "^~")
+	end = ternary(end == -1, len(spec), end)
+	base, suffix := spec[:end], spec[end:]
+
+	hash, err := repo.resolveBase(rev, base)
+
+	if err != nil {
+		return "", err
+	}
+
+	for suffix != "" {
+		op := suffix[0]
+		suffix = suffix[1:]
+
+		// ^{type}
+		if op == '^' && strings.HasPrefix(suffix, "{") {
+			closeIdx := strings.IndexByte(suffix, '}')
+
+			if closeIdx == -1 {
+				return "", &RevisionError{Rev: rev, Reason: "unterminated ^{...}"}
+			}
+
+			target := suffix[1:closeIdx]
+			suffix = suffix[closeIdx+1:]
+
+			if hash, err = repo.peelRevision(rev, hash, target); err != nil {
+				return "", err
+			}
+
+			continue
+		}
+
+		digits := len(suffix) - len(strings.TrimLeft(suffix, "0123456789"))
+		n := 1
+
+		if digits > 0 {
+			if n, err = strconv.Atoi(suffix[:digits]); err != nil {
+				return "", &RevisionError{Rev: rev, Reason: "invalid number"}
+			}
+
+			suffix = suffix[digits:]
+		}
+
+		if hash, err = repo.peelRevision(rev, hash, "commit"); err != nil {
+			return "", err
+		}
+
+		// ~n follows the first parent n times, ^n selects the n-th parent.
+		if op == '~' {
+			for i := 0; i < n; i++ {
+				if hash, err = repo.revParent(rev, hash, 1); err != nil {
+					return "", err
+				}
+			}
+		} else if n > 0 {
+			if hash, err = repo.revParent(rev, hash, n); err != nil {
+				return "", err
+			}
+		}
+	}
+
+	if hasPath {
+		return repo.resolvePath(rev, hash, filePath)
+	}
+
+	return hash, nil
+}
+
+// resolveBase resolves the part of a revision before any ^ or ~ suffix.
+func (repo *Repo) resolveBase(rev, base string) (string, error) {
+	selector := ""
+
+	if idx := strings.Index(base, "@{"); idx != -1 {
+		if !strings.HasSuffix(base, "}") {
+			return "", &RevisionError{Rev: rev, Reason: "unterminated @{...}"}
+		}
+
+		base, selector = base[:idx], base[idx+2:len(base)-1]
+	}
+
+	if base == "" || base == "@" {
+		base = "HEAD"
+	}
+
+	if selector != "" {
+		return repo.resolveReflog(rev, base, selector)
+	}
+
+	if isHash(base) {
+		return base, nil
+	}
+
+	for _, rule := range revRefRules {
+		hash, err := repo.resolveRef(fmt.Sprintf(rule, base))
+
+		if err != nil {
+			return "", err
+		}
+
+		if hash != "" {
+			return hash, nil
+		}
+	}
+
+	if len(base) >= 4 && isHexString(base) {
+		return repo.expandHash(base)
+	}
+
+	return "", &RevisionError{Rev: rev, Reason: "unknown revision"}
+}
+
+// resolveRef reads a ref, following symbolic refs. It returns an empty string if the ref does not exist.
+func (repo *Repo) resolveRef(name string) (string, error) {
+	for depth := 0; depth < 5; depth++ {
+		if name != "HEAD" && !validRefName(name) {
+			return "", nil
+		}
+
+		hash, err := repo.readRef(name)
+
+		if err != nil || !strings.HasPrefix(hash, "ref: ") {
+			return hash, err
+		}
+
+		name = strings.TrimPrefix(hash, "ref: ")
+	}
+
+	return "", fmt.Errorf("too many levels of symbolic refs")
+}
+
+// expandHash finds the single object whose hash starts with prefix. Stores that cannot look up a
+// prefix are iterated.
+func (repo *Repo) expandHash(prefix string) (string, error) {
+	prefix = strings.ToLower(prefix)
+	candidates := []string{}
+	var err error
+
+	if store, ok := repo.objects.(PrefixObjectStore); ok {
+		candidates, err = store.FindPrefix(prefix)
+	} else {
+		err = repo.objects.Iterate(func(hash string) error {
+			if strings.HasPrefix(hash, prefix) {
+				candidates = append(candidates, hash)
+			}
+
+			return nil
+		})
+	}
+
+	if err != nil {
+		return "", err
+	}
+
+	if len(candidates) == 0 {
+		return "", &RevisionError{Rev: prefix, Reason: "unknown revision"}
+	}
+
+	if len(candidates) > 1 {
+		sort.Strings(candidates)
+		return "", &AmbiguousHashError{Prefix: prefix, Candidates: candidates}
+	}
+
+	return candidates[0], nil
+}
+
+// resolveReflog resolves <ref>@{n} to the value the ref had n updates ago.
+func (repo *Repo) resolveReflog(rev, ref, selector string) (string, error) {
+	n, err := strconv.Atoi(selector)
+
+	if err != nil || n < 0 {
+		return "", &RevisionError{Rev: rev, Reason: "unsupported reflog selector @{" + selector + "}"}
+	}
+
+	name := ref
+
+	for _, rule := range revRefRules {
+		if hash, _ := repo.resolveRef(fmt.Sprintf(rule, ref)); hash != "" {
+			name = fmt.Sprintf(rule, ref)
+			break
+		}
+	}
+
+	// @{n} without a ref refers to the branch HEAD points at.
+	if name == "HEAD" {
+		if head, err := repo.getHead(); err == nil && head.Ref != "" {
+			name = head.Ref
+		}
+	}
+
+	entries, err := repo.Reflog(name)
+
+	if err != nil {
+		return "", err
+	}
+
+	if n >= len(entries) {
+		return "", &RevisionError{Rev: rev, Reason: fmt.Sprintf("log for %s only has %d entries", name, len(entries))}
+	}
+
+	return entries[n].New, nil
+}
+
+// peelRevision dereferences tags and commits until an object of the target type is found.
+// An empty target peels tags only.
+func (repo *Repo) peelRevision(rev, hash, target string) (string, error) {
+	if target == "object" {
+		if _, err := repo.Object(hash); err != nil {
+			return "", &RevisionError{Rev: rev, Reason: "object " + hash + " not found"}
+		}
+
+		return hash, nil
+	}
+
+	if target != "" && OBJ_TYPES_NUM[target] == 0 {
+		return "", &RevisionError{Rev: rev, Reason: "unknown object type " + target}
+	}
+
+	for {
+		object, err := repo.Object(hash)
+
+		if err != nil {
+			return "", &RevisionError{Rev: rev, Reason: "object " + hash + " not found"}
+		}
+
+		if OBJ_TYPES_STR[object.Type] == target || (target == "" && object.Type != OBJ_TAG) {
+			return hash, nil
+		}
+
+		switch {
+		case object.Type == OBJ_TAG:
+			kv := parseLinesKV(object.Data)
+
+			if len(kv["object"]) == 0 {
+				return "", fmt.Errorf("invalid tag object: %s", hash)
+			}
+
+			hash = kv["object"][0]
+
+		case object.Type == OBJ_COMMIT && target == "tree":
+			hash = object.TreeHash
+
+		default:
+			return "", &RevisionError{Rev: rev, Reason: fmt.Sprintf("%s is a %s, not a %s", hash, OBJ_TYPES_STR[object.Type], target)}
+		}
+	}
+}
+
+func (repo *Repo) revParent(rev, hash string, n int) (string, error) {
+	object, err := repo.Object(hash)
+
+	if err != nil {
+		return "", err
+	}
+
+	if n > len(object.ParentHashes) {
+		return "", &RevisionError{Rev: rev, Reason: fmt.Sprintf("commit %s has no parent %d", hash, n)}
+	}
+
+	return object.ParentHashes[n-1], nil
+}
+
+// resolvePath finds the object at filePath in the tree of a tree-ish.
+func (repo *Repo) resolvePath(rev, hash, filePath string) (string, error) {
+	hash, err := repo.peelRevision(rev, hash, "tree")
+
+	if err != nil {
+		return "", err
+	}
+
+	filePath = strings.Trim(filePath, "/")
+
+	if filePath == "" {
+		return hash, nil
+	}
+
+	for _, name := range strings.Split(filePath, "/") {
+		object, err := repo.Object(hash)
+
+		if err != nil {
+			return "", err
+		}
+
+		if object.Type != OBJ_TREE {
+			return "", &RevisionError{Rev: rev, Reason: "path '" + filePath + "' does not exist"}
+		}
+
+		entries, err := object.Entries()
+
+		if err != nil {
+			return "", err
+		}
+
+		found := false
+
+		for _, entry := range entries {
+			if entry.Name == name {
+				hash, found = entry.Hash, true
+				break
+			}
+		}
+
+		if !found {
+			return "", &RevisionError{Rev: rev, Reason: "path '" + filePath + "' does not exist"}
+		}
+	}
+
+	return hash, nil
+}
+
+// splitRevPath splits "rev:path" at the first colon outside of braces.
+func splitRevPath(rev string) (string, string, bool) {
+	depth := 0
+
+	for i, c := range rev {
+		switch c {
+		case '{':
+			depth++
+		case '}':
+			depth--
+		case ':':
+			if depth == 0 {
+				return rev[:i], rev[i+1:], true
+			}
+		}
+	}
+
+	return rev, "", false
+}
+
+func isHexString(s string) bool {
+	for _, c := range s {
+		if !strings.ContainsRune("0123456789abcdefABCDEF", c) {
+			return false
+		}
+	}
+
+	return true
+}
@@ -0,0 +1,94 @@
+package gits
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+)
+
+func TestExpandHash(t *testing.T) {
+	repo := newTestRepo(t, nil)
+
+	// Packed and loose blobs, a fork borrows both.
+	packed, loose := []string{}, []string{}
+
+	for i := 0; i < 300; i++ {
+		hash, err := repo.WriteBlob([]byte(fmt.Sprintf("packed %d\n", i)))
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		packed = append(packed, hash)
+	}
+
+	keepBlobs(t, repo, "packed", packed)
+	runGit(t, repoPath(repo), "repack", "-adq")
+
+	for i := 0; i < 300; i++ {
+		hash, err := repo.WriteBlob([]byte(fmt.Sprintf("loose %d\n", i)))
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		loose = append(loose, hash)
+	}
+
+	fork, err := repo.Fork("fork.git")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Two objects that share the first 4 digits, to check ambiguity.
+	all := append(append([]string{}, packed...), loose...)
+	byPrefix := map[string]string{}
+	ambiguous := ""
+
+	for _, hash := range all {
+		if other, ok := byPrefix[hash[:4]]; ok && other != hash {
+			ambiguous = hash[:4]
+			break
+		}
+
+		byPrefix[hash[:4]] = hash
+	}
+
+	tests := []struct {
+		name string
+		repo *Repo
+		hash string
+	}{
+		{"packed", repo, packed[7]},
+		{"loose", repo, loose[7]},
+		{"borrowed packed", fork, packed[8]},
+		{"borrowed loose", fork, loose[8]},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			for _, length := range []int{7, 12, 40} {
+				got, err := test.repo.ResolveRevision(test.hash[:length])
+
+				if err != nil || got != test.hash {
+					t.Fatalf("ResolveRevision(%s) = %s, %v, want %s", test.hash[:length], got, err, test.hash)
+				}
+			}
+		})
+	}
+
+	if ambiguous == "" {
+		t.Skip("no two hashes share 4 digits")
+	}
+
+	var target *AmbiguousHashError
+
+	if _, err := fork.ResolveRevision(ambiguous); !errors.As(err, &target) || len(target.Candidates) < 2 {
+		t.Fatalf("ResolveRevision(%s) = %v, want an ambiguous hash", ambiguous, err)
+	}
+
+	if _, err := repo.ResolveRevision("ffff0000"); err == nil {
+		t.Fatal("unknown prefix resolved")
+	}
+}
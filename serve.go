@@ -0,0 +1,51 @@
+package gits
+
+import (
+	"bufio"
+	"io"
+)
+
+// Serve runs the whole conversation of service on one connection, as SSH and git:// do: the
+// advertisement, then the negotiation and the pack, the push or the archive. The session is switched
+// to TRANSPORT_STATEFUL. Version 2 is only used by git-upload-pack, other services ignore it.
+func (repo *Repo) Serve(r io.Reader, w io.Writer, service string, version int) error {
+	session := Session{}
+
+	if repo.session != nil {
+		session = *repo.session
+	}
+
+	session.Transport = TRANSPORT_STATEFUL
+	repo = repo.With(&session)
+
+	// Shared by every step, a reader of its own could buffer what belongs to the next one.
+	br := bufio.NewReader(r)
+
+	switch {
+	case service == "git-upload-archive":
+		return repo.UploadArchive(br, w, nil)
+
+	case service == "git-upload-pack" && version == 2:
+		if _, err := repo.AdvertiseV2(w, nil); err != nil {
+			return err
+		}
+
+		return repo.UploadPackV2(br, w, nil)
+	}
+
+	if _, err := repo.Advertise(br, w, service, nil); err != nil {
+		return err
+	}
+
+	if service == "git-receive-pack" {
+		return repo.ReceivePack(br, w, nil)
+	}
+
+	return repo.UploadPack(br, w, nil)
+}
+
+// stateful reports whether the client waits for answers on the same connection, instead of sending
+// a new request for every negotiation round.
+func (repo *Repo) stateful() bool {
+	return repo.session != nil && repo.session.Transport == TRANSPORT_STATEFUL
+}
@@ -0,0 +1,168 @@
+package gits
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/fs"
+	"path"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// Files a dumb HTTP client may fetch, relative to the repository.
+var dumbFiles = regexp.MustCompile(`^(HEAD|info/refs|objects/info/(packs|alternates|http-alternates)|objects/[0-9a-f]{2}/[0-9a-f]{38}|objects/pack/pack-[0-9a-f]{40}\.(pack|idx))$`)
+
+// UpdateServerInfo regenerates info/refs and objects/info/packs, the files dumb HTTP clients start from.
+// The files are shared by every namespace, info/refs lists the refs of the whole repo.
+func (repo *Repo) UpdateServerInfo() error {
+	info, err := repo.physical().infoRefs()
+
+	if err != nil {
+		return err
+	}
+
+	if err := repo.fs.WriteFile(repo.absPath("info/refs"), info); err != nil {
+		return err
+	}
+
+	var buf bytes.Buffer
+	packDir := repo.absPath("objects/pack")
+
+	if repo.fs.Stat(packDir)[0] == 2 {
+		files, err := repo.fs.Scan(packDir, FS_TYPE_FILE, 0)
+
+		if err != nil {
+			return err
+		}
+
+		packs := []string{}
+
+		for file := range files {
+			if name := path.Base(file); strings.HasPrefix(name, "pack-") && strings.HasSuffix(name, ".pack") {
+				packs = append(packs, name)
+			}
+		}
+
+		sort.Strings(packs)
+
+		for _, name := range packs {
+			fmt.Fprintf(&buf, "P %s\n", name)
+		}
+	}
+
+	buf.WriteString("\n")
+
+	return repo.fs.WriteFile(repo.absPath("objects/info/packs"), buf.Bytes())
+}
+
+// infoRefs returns the content of info/refs. Annotated tags are followed by a "^{}" line with the
+// object they peel to, like git update-server-info. Refs hidden from fetches are left out.
+func (repo *Repo) infoRefs() ([]byte, error) {
+	refs, err := repo.listRefs()
+
+	if err != nil {
+		return nil, err
+	}
+
+	config, err := repo.Config()
+
+	if err != nil {
+		return nil, err
+	}
+
+	hidden := repo.hiddenRefs(config, "uploadpack")
+	names := make([]string, 0, len(refs))
+
+	for name := range refs {
+		if !repo.refHidden(name, hidden) {
+			names = append(names, name)
+		}
+	}
+
+	sort.Strings(names)
+
+	var buf bytes.Buffer
+
+	for _, name := range names {
+		fmt.Fprintf(&buf, "%s\t%s\n", refs[name], name)
+
+		if !strings.HasPrefix(name, "refs/tags/") {
+			continue
+		}
+
+		peeled, err := repo.peelRevision(name, refs[name], "")
+
+		if err != nil {
+			return nil, err
+		}
+
+		if peeled != refs[name] {
+			fmt.Fprintf(&buf, "%s\t%s^{}\n", peeled, name)
+		}
+	}
+
+	return buf.Bytes(), nil
+}
+
+// DumbFile opens a file of the dumb HTTP protocol: HEAD, info/refs, objects/info/packs, the
+// alternates files, a loose object or a pack and its index. Other paths, object paths of a custom
+// ObjectStore and files that do not exist give an error wrapping fs.ErrNotExist. The caller closes the file.
+func (repo *Repo) DumbFile(name string) (io.ReadCloser, error) {
+	if err := repo.authorize(OP_READ, nil); err != nil {
+		return nil, err
+	}
+
+	// The info/refs file lists every namespace.
+	if name == "info/refs" && repo.namespace() != "" {
+		info, err := repo.infoRefs()
+
+		if err != nil {
+			return nil, err
+		}
+
+		return bytesFile{bytes.NewReader(info)}, nil
+	}
+
+	// The HEAD file of a reftable repo only points git to the tables, a namespace has its own HEAD.
+	if name == "HEAD" {
+		head, err := repo.readRef("HEAD")
+
+		if err != nil {
+			return nil, err
+		}
+
+		if head != "" {
+			return bytesFile{bytes.NewReader([]byte(head + "\n"))}, nil
+		}
+	}
+
+	// A custom store keeps its objects elsewhere, whatever is left under objects/ is stale.
+	custom := repo.conf.ObjectStore != nil && strings.HasPrefix(name, "objects/")
+
+	if custom || !dumbFiles.MatchString(name) || repo.fs.Stat(repo.absPath(name))[0] != 1 {
+		return nil, fmt.Errorf("%s: %w", name, fs.ErrNotExist)
+	}
+
+	if open, ok := repo.fs.(OpenFS); ok {
+		return open.Open(repo.absPath(name))
+	}
+
+	data, err := repo.fs.ReadFile(repo.absPath(name))
+
+	if err != nil {
+		return nil, err
+	}
+
+	return bytesFile{bytes.NewReader(data)}, nil
+}
+
+// bytesFile is a file read whole, it seeks so that ranges can be served from it.
+type bytesFile struct {
+	*bytes.Reader
+}
+
+func (bytesFile) Close() error {
+	return nil
+}
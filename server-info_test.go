@@ -0,0 +1,93 @@
+package gits
+
+import (
+	"errors"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestDumbFile(t *testing.T) {
+	builtin := func(repo *Repo) (ObjectStore, error) {
+		return &filesObjects{repo: repo, dir: repo.absPath("objects")}, nil
+	}
+
+	tests := []struct {
+		name   string
+		conf   *Config
+		custom bool
+	}{
+		{"disk", &Config{}, false},
+		{"fs without open", &Config{FS: plainFS}, false},
+		{"custom object store", &Config{ObjectStore: builtin}, true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			repo := newTestRepo(t, test.conf)
+
+			commit, err := repo.CommitFiles(&CommitFilesSpec{
+				Branch:  "main",
+				Author:  testSignature(),
+				Message: "first",
+				Ops:     []FileOp{{Action: FILE_ADD, Path: "a", Content: []byte("a\n")}},
+			})
+
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if err := repo.UpdateServerInfo(); err != nil {
+				t.Fatal(err)
+			}
+
+			files := map[string]bool{
+				"HEAD":               true,
+				"info/refs":          true,
+				"objects/info/packs": !test.custom,
+				"objects/" + commit[:2] + "/" + commit[2:]: !test.custom,
+				"config":                   false,
+				"objects/00/" + commit[2:]: false,
+			}
+
+			for name, found := range files {
+				file, err := repo.DumbFile(name)
+
+				if !found {
+					if !errors.Is(err, fs.ErrNotExist) {
+						t.Errorf("%s: err = %v, want not found", name, err)
+					}
+
+					continue
+				}
+
+				if err != nil {
+					t.Fatalf("%s: %v", name, err)
+				}
+
+				data, err := io.ReadAll(file)
+				file.Close()
+
+				if err != nil {
+					t.Fatal(err)
+				}
+
+				if _, ok := file.(io.Seeker); !ok {
+					t.Errorf("%s cannot seek", name)
+				}
+
+				want, err := os.ReadFile(filepath.Join(repoPath(repo), name))
+
+				if err != nil {
+					t.Fatal(err)
+				}
+
+				if string(data) != string(want) {
+					t.Errorf("%s = %q, want %q", name, data, want)
+				}
+			}
+		})
+	}
+}
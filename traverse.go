@@ -1,111 +1,296 @@
 package gits
 
-import "fmt"
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
 
+// objectFilter is a parsed filter-spec, see the --filter option of git rev-list.
+type objectFilter struct {
+	blobLimit int64 // Blobs of this size and bigger are left out, -1 for any size.
+	treeDepth int   // Trees and blobs this deep and deeper are left out, a root tree is 0. -1 for any depth.
+}
+
+// Traverse returns the objects reachable from the wants but not from the common haves. Objects
+// left out by neg.Filter are not walked, wants are always sent.
 func (r *Repo) Traverse(neg *Negotiation) (map[string]bool, error) {
 	if neg == nil {
 		neg = &Negotiation{}
 	}
 
+	filter, err := parseObjectFilter(neg.Filter)
+
+	if err != nil {
+		return nil, err
+	}
+
 	result := map[string]bool{}
-	visited := map[string]bool{}
+	uninteresting := map[string]bool{} // Trees and blobs the client has.
+	depths := map[string]int{}         // Trees by the smallest depth they were walked at.
+	g := r.newCommitGraph()
 
-	var walk func(hash string) error
+	// peel follows tags to the object they point to, the tags themselves are sent when wanted.
+	peel := func(hash string, want bool) (*Object, error) {
+		for {
+			object, err := r.Object(hash)
 
-	walk = func(hash string) error {
-		if !neg.Haves[hash] {
-			result[hash] = true
+			if err != nil || object.Type != OBJ_TAG {
+				return object, err
+			}
+
+			if want && !uninteresting[hash] {
+				result[hash] = true
+			}
+
+			kv := parseLinesKV(object.Data)
+
+			if len(kv["object"]) == 0 {
+				return nil, fmt.Errorf("invalid tag object: %s", hash)
+			}
+
+			hash = kv["object"][0]
 		}
+	}
+
+	// mark marks a tree and everything in it as uninteresting.
+	var mark func(hash string) error
 
+	mark = func(hash string) error {
+		if uninteresting[hash] {
+			return nil
+		}
+
+		uninteresting[hash] = true
 		object, err := r.Object(hash)
 
 		if err != nil {
 			return err
 		}
 
-		if object.Type == OBJ_COMMIT {
-			// Check if visited.
-			if visited[hash] {
-				return nil
-			}
+		entries, err := object.Entries()
 
-			// Traverse tree
-			if object.TreeHash != "" {
-				err := walk(object.TreeHash)
+		if err != nil {
+			return err
+		}
 
-				if err != nil {
+		for _, entry := range entries {
+			switch entry.Mode {
+			case MODE_GITLINK: // Submodule commits are in another repo.
+			case MODE_TREE:
+				if err := mark(entry.Hash); err != nil {
 					return err
 				}
+			default:
+				uninteresting[entry.Hash] = true
 			}
+		}
 
-			// Traverse parents
-			for _, parentHash := range object.ParentHashes {
-				if parentHash != "" {
-					err := walk(parentHash)
+		return nil
+	}
 
-					if err != nil {
-						return err
-					}
-				}
-			}
+	var walk func(hash string, depth int) error
 
-			// Add to visited
-			visited[hash] = true
+	walk = func(hash string, depth int) error {
+		// Check if visited. With a depth filter a tree reached higher up may keep more of it.
+		if walked, ok := depths[hash]; ok && (walked <= depth || filter == nil || filter.treeDepth < 0) {
+			return nil
 		}
 
-		if object.Type == OBJ_TREE {
-			// Check if visited.
-			if visited[hash] {
-				return nil
+		object, err := r.Object(hash)
+
+		if err != nil {
+			return err
+		}
+
+		entries, err := object.Entries()
+
+		if err != nil {
+			return err
+		}
+
+		for _, entry := range entries {
+			hash, typ := entry.Hash, ternary[uint8](entry.Mode == MODE_TREE, OBJ_TREE, OBJ_BLOB)
+
+			// Submodule commits are in another repo.
+			if entry.Mode == MODE_GITLINK || uninteresting[hash] {
+				continue
 			}
 
-			// Traverse tree
-			treeHashes, err := object.Tree()
+			keep, err := filter.keep(r, hash, typ, depth+1)
 
 			if err != nil {
 				return err
 			}
 
-			for hash, typ := range treeHashes {
-				if !neg.Haves[hash] {
-					result[hash] = true
-				}
+			if !keep {
+				continue
+			}
 
-				if typ == OBJ_TREE || typ == OBJ_COMMIT {
-					err := walk(hash)
+			result[hash] = true
 
-					if err != nil {
-						return err
-					}
+			if typ == OBJ_TREE {
+				if err := walk(hash, depth+1); err != nil {
+					return err
 				}
 			}
+		}
+
+		// Add to visited
+		depths[hash] = depth
+
+		return nil
+	}
+
+	// The common haves, only commits limit the walk.
+	haves := []string{}
 
-			// Add to visited
-			visited[hash] = true
+	for have := range neg.Haves {
+		if !r.hasObject(have) {
+			continue
 		}
 
-		if object.Type == OBJ_BLOB {
-			// Nothing to do.
+		uninteresting[have] = true
+		object, err := peel(have, false)
+
+		if err != nil {
+			return nil, err
 		}
 
-		if object.Type == OBJ_TAG {
-			return fmt.Errorf("tag object is not supported")
+		switch object.Type {
+		case OBJ_COMMIT:
+			haves = append(haves, object.Hash)
+		case OBJ_TREE:
+			err = mark(object.Hash)
+		default:
+			uninteresting[object.Hash] = true
 		}
 
-		return nil
+		if err != nil {
+			return nil, err
+		}
 	}
 
+	wants := []string{}
+	objects := []*Object{} // Trees and blobs wanted by hash, or pointed to by a wanted tag.
+
 	for want, include := range neg.Wants {
 		if !include {
 			continue
 		}
 
-		err := walk(want)
+		object, err := peel(want, true)
 
 		if err != nil {
 			return nil, err
 		}
+
+		if object.Type == OBJ_COMMIT {
+			wants = append(wants, object.Hash)
+		} else {
+			objects = append(objects, object)
+		}
+	}
+
+	commits, common, err := g.limit(wants, haves)
+
+	if err != nil {
+		return nil, err
+	}
+
+	// Everything in the trees of the uninteresting commits the walk reached is on the client.
+	for hash := range common {
+		if err := mark(g.commits[hash].Tree); err != nil {
+			return nil, err
+		}
+	}
+
+	for _, commit := range commits {
+		result[commit.Hash] = true
+
+		if uninteresting[commit.Tree] {
+			continue
+		}
+
+		keep, err := filter.keep(r, commit.Tree, OBJ_TREE, 0)
+
+		if err != nil {
+			return nil, err
+		}
+
+		if keep {
+			result[commit.Tree] = true
+
+			if err := walk(commit.Tree, 0); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	for _, object := range objects {
+		if uninteresting[object.Hash] {
+			continue
+		}
+
+		result[object.Hash] = true
+
+		if object.Type == OBJ_TREE {
+			if err := walk(object.Hash, 0); err != nil {
+				return nil, err
+			}
+		}
 	}
 
 	return result, nil
 }
+
+// parseObjectFilter parses blob:none, blob:limit=<n> with an optional k, m or g suffix, and
+// tree:<depth>. An empty spec is no filter.
+func parseObjectFilter(spec string) (*objectFilter, error) {
+	switch {
+	case spec == "":
+		return nil, nil
+
+	case spec == "blob:none":
+		return &objectFilter{blobLimit: 0, treeDepth: -1}, nil
+
+	case strings.HasPrefix(spec, "blob:limit="):
+		limit, err := parseConfigInt(strings.TrimPrefix(spec, "blob:limit="))
+
+		if err == nil && limit >= 0 {
+			return &objectFilter{blobLimit: limit, treeDepth: -1}, nil
+		}
+
+	case strings.HasPrefix(spec, "tree:"):
+		depth, err := strconv.Atoi(strings.TrimPrefix(spec, "tree:"))
+
+		if err == nil && depth >= 0 {
+			return &objectFilter{blobLimit: -1, treeDepth: depth}, nil
+		}
+	}
+
+	return nil, fmt.Errorf("invalid filter-spec '%s'", spec)
+}
+
+// keep reports whether an object found at depth passes the filter, every object passes a nil one.
+func (f *objectFilter) keep(r *Repo, hash string, typ uint8, depth int) (bool, error) {
+	if f == nil || typ != OBJ_TREE && typ != OBJ_BLOB {
+		return true, nil
+	}
+
+	if f.treeDepth >= 0 && depth >= f.treeDepth {
+		return false, nil
+	}
+
+	if typ != OBJ_BLOB || f.blobLimit < 0 {
+		return true, nil
+	}
+
+	if f.blobLimit == 0 {
+		return false, nil
+	}
+
+	_, size, err := r.objects.Stat(hash)
+
+	return size < f.blobLimit, err
+}
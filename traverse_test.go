@@ -0,0 +1,140 @@
+package gits
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestTraverseSkipsCommonObjects(t *testing.T) {
+	repo := newTestRepo(t, nil)
+
+	branches := 0
+
+	// commit writes the files on top of parent on a new branch, when offsets the date.
+	commit := func(parent string, when int64, files map[string]string) string {
+		ops := []FileOp{}
+
+		for path, content := range files {
+			_, err := repo.ResolveRevision(parent + ":" + path)
+			ops = append(ops, FileOp{Action: ternary[uint8](err == nil, FILE_MODIFY, FILE_ADD), Path: path, Content: []byte(content)})
+		}
+
+		branches++
+		branch := fmt.Sprintf("b%d", branches)
+
+		if parent != "" {
+			if err := repo.updateRef("refs/heads/"+branch, "", parent, nil, "test"); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		who := testSignature()
+		who.When = who.When.Add(time.Duration(when) * time.Second)
+
+		hash, err := repo.CommitFiles(&CommitFilesSpec{Branch: branch, Parent: parent, Author: who, Message: "c", Ops: ops})
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		return hash
+	}
+
+	base := commit("", 0, map[string]string{"a": "a\n", "dir/b": "b\n"})
+	edit := commit(base, 1, map[string]string{"dir/b": "b2\n"})
+	same := commit(base, 2, map[string]string{"dir/b": "b2\n", "c": "c\n"})
+	x := commit(base, 0, map[string]string{"x": "x\n"})
+	y := commit(x, 0, map[string]string{"y": "y\n"})
+	z := commit(y, 0, map[string]string{"z": "z\n"})
+	w := commit(base, 0, map[string]string{"w": "w\n"})
+	skewed := commit(edit, -100, map[string]string{"d": "d\n"})
+
+	tag, err := repo.WriteTag(&TagSpec{Object: edit, Name: "v1", Tagger: testSignature(), Message: "v1\n"})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name  string
+		wants []string
+		haves []string
+	}{
+		{"clone", []string{edit}, nil},
+		{"linear", []string{edit}, []string{base}},
+		{"up to date", []string{edit}, []string{edit}},
+		{"blob on a sibling", []string{same}, []string{edit}},
+		{"equal dates", []string{x}, []string{y}},
+		{"equal dates on both sides", []string{w}, []string{z}},
+		{"skewed date", []string{skewed}, []string{edit}},
+		{"tag", []string{tag}, []string{base}},
+		{"unknown have", []string{edit}, []string{strings.Repeat("1", 40)}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			neg := &Negotiation{Wants: map[string]bool{}, Haves: map[string]bool{}}
+
+			for _, want := range test.wants {
+				neg.Wants[want] = true
+			}
+
+			for _, have := range test.haves {
+				neg.Haves[have] = true
+			}
+
+			objects, err := repo.Traverse(neg)
+
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			got := []string{}
+
+			for hash := range objects {
+				got = append(got, hash)
+			}
+
+			// Everything reachable from the wants that is not reachable from the known haves.
+			excluded := map[string]bool{}
+
+			for _, have := range test.haves {
+				if repo.hasObject(have) {
+					for _, hash := range revListObjects(t, repo, have) {
+						excluded[hash] = true
+					}
+				}
+			}
+
+			want := []string{}
+
+			for _, hash := range revListObjects(t, repo, test.wants...) {
+				if !excluded[hash] {
+					want = append(want, hash)
+				}
+			}
+
+			sort.Strings(got)
+			sort.Strings(want)
+
+			if strings.Join(got, " ") != strings.Join(want, " ") {
+				t.Fatalf("objects = %v, want %v", got, want)
+			}
+		})
+	}
+}
+
+func revListObjects(t *testing.T, repo *Repo, revs ...string) []string {
+	hashes := []string{}
+
+	for _, line := range strings.Split(runGit(t, repoPath(repo), append([]string{"rev-list", "--objects"}, revs...)...), "\n") {
+		if line != "" {
+			hashes = append(hashes, strings.Fields(line)[0])
+		}
+	}
+
+	return hashes
+}
@@ -3,7 +3,6 @@ package gits
 import (
 	"bufio"
 	"bytes"
-	"crypto/sha1"
 	"encoding/binary"
 	"encoding/hex"
 	"fmt"
@@ -71,21 +70,14 @@ func (repo *Repo) Unpack(br *bufio.Reader) error {
 			return fmt.Errorf("unknown object type: %d", typ)
 		}
 
-		header := fmt.Sprintf("%s %d\x00", OBJ_TYPES_STR[typ], len(content))
-		objdata := append([]byte(header), content...)
-		hashBytes := sha1.Sum(objdata)
-		hashHex := hex.EncodeToString(hashBytes[:])
-		compressed, err := Zlib.Compress(objdata)
-
-		if err != nil {
+		if _, err := repo.WriteObject(typ, content); err != nil {
 			return err
 		}
+	}
 
-		objpath := repo.absPath(fmt.Sprintf("objects/%s/%s", hashHex[:2], hashHex[2:]))
-
-		if err := repo.fs.WriteFile(objpath, compressed); err != nil {
-			return err
-		}
+	// Consume the SHA-1 trailer, over a stateful connection the client is still writing it.
+	if _, err := io.ReadFull(br, make([]byte, 20)); err != nil {
+		return err
 	}
 
 	return nil
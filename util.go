@@ -90,6 +90,26 @@ func readPktLine(br *bufio.Reader) (data string, flush bool, err error) {
 	return strings.TrimSpace(string(dataBytes)), false, nil
 }
 
+// readPktLineV2 is readPktLine for protocol v2, where "0001" (delim) and "0002" (response end)
+// may show up next to "0000" (flush). Those are returned in special, with empty data.
+func readPktLineV2(br *bufio.Reader) (data string, special string, err error) {
+	prefix, err := br.Peek(4)
+
+	if err != nil {
+		return "", "", err
+	}
+
+	switch string(prefix) {
+	case "0000", "0001", "0002":
+		_, err = br.Discard(4)
+		return "", string(prefix), err
+	}
+
+	data, _, err = readPktLine(br)
+
+	return data, "", err
+}
+
 // pktLine encodes a non-empty pkt-line; use "0000" for flush.
 func pktLine(s string) []byte {
 	return []byte(fmt.Sprintf("%04x%s", len(s)+4, s))
@@ -261,15 +281,21 @@ func parseDeltaOps(r *bytes.Reader) ([]*DeltaOp, error) {
 //			[]string{"refs/heads/main", "aaa", "bbb"},
 //			[]string{"refs/heads/master", "ccc", "ddd"},
 //	}
-func prepSuccessRes(refs [][]string) []byte {
+//
+// Refs with a reason in rejected are reported as "ng <ref> <reason>".
+func prepReportRes(refs [][]string, rejected map[string]string) []byte {
 	var buf bytes.Buffer
 
 	// Write "unpack ok\n" to indicate successful packfile unpacking
 	buf.Write(pktLine("unpack ok\n"))
 
-	// Write "ok <ref>\n" for each reference
+	// Write "ok <ref>\n" or "ng <ref> <reason>\n" for each reference
 	for _, ref := range refs {
-		buf.Write(pktLine("ok " + ref[0] + "\n"))
+		if reason := rejected[ref[0]]; reason != "" {
+			buf.Write(pktLine("ng " + ref[0] + " " + reason + "\n"))
+		} else {
+			buf.Write(pktLine("ok " + ref[0] + "\n"))
+		}
 	}
 
 	// Write flush packet
@@ -285,3 +311,27 @@ func ternary[T any](cond bool, a, b T) T {
 
 	return b
 }
+
+// sidebandWriter wraps writes into side-band-64k pkt-lines on one band.
+type sidebandWriter struct {
+	w    io.Writer
+	band byte
+}
+
+func (s *sidebandWriter) Write(p []byte) (int, error) {
+	written := 0
+
+	for len(p) > 0 {
+		n := min(len(p), SIDEBAND_MAX_DATA)
+		line := append([]byte{s.band}, p[:n]...)
+
+		if _, err := s.w.Write(pktLine(string(line))); err != nil {
+			return written, err
+		}
+
+		written += n
+		p = p[n:]
+	}
+
+	return written, nil
+}
@@ -0,0 +1,351 @@
+package gits
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// WriteObject stores raw object data of the given type and returns its hash.
+// Objects that already exist are not rewritten.
+func (repo *Repo) WriteObject(typ uint8, data []byte) (string, error) {
+	if typ < OBJ_COMMIT || typ > OBJ_TAG {
+		return "", fmt.Errorf("invalid object type: %d", typ)
+	}
+
+	return repo.objects.Put(typ, data)
+}
+
+// objectHash returns the hash git gives to data of the type.
+func objectHash(typ uint8, data []byte) string {
+	h := sha1.New()
+
+	fmt.Fprintf(h, "%s %d\x00", OBJ_TYPES_STR[typ], len(data))
+	h.Write(data)
+
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+func (repo *Repo) WriteBlob(data []byte) (string, error) {
+	return repo.WriteObject(OBJ_BLOB, data)
+}
+
+// WriteTree sorts the entries in git order and stores the tree.
+func (repo *Repo) WriteTree(entries []TreeEntry) (string, error) {
+	sorted := make([]TreeEntry, len(entries))
+	copy(sorted, entries)
+
+	seen := map[string]bool{}
+
+	for _, entry := range sorted {
+		if err := validTreeEntry(entry); err != nil {
+			return "", err
+		}
+
+		if seen[entry.Name] {
+			return "", fmt.Errorf("duplicate tree entry: %s", entry.Name)
+		}
+
+		seen[entry.Name] = true
+	}
+
+	sort.Slice(sorted, func(i, j int) bool {
+		return treeSortKey(sorted[i]) < treeSortKey(sorted[j])
+	})
+
+	var buf bytes.Buffer
+
+	for _, entry := range sorted {
+		raw, _ := hex.DecodeString(entry.Hash)
+
+		buf.WriteString(strconv.FormatUint(uint64(entry.Mode), 8))
+		buf.WriteByte(' ')
+		buf.WriteString(entry.Name)
+		buf.WriteByte(0)
+		buf.Write(raw)
+	}
+
+	return repo.WriteObject(OBJ_TREE, buf.Bytes())
+}
+
+func (repo *Repo) WriteCommit(spec *CommitSpec) (string, error) {
+	if spec.Author == nil {
+		return "", fmt.Errorf("commit author is required")
+	}
+
+	committer := ternary(spec.Committer == nil, spec.Author, spec.Committer)
+
+	if err := validSignature(spec.Author); err != nil {
+		return "", err
+	}
+
+	if err := validSignature(committer); err != nil {
+		return "", err
+	}
+
+	if err := repo.expectType(spec.Tree, OBJ_TREE); err != nil {
+		return "", err
+	}
+
+	var buf bytes.Buffer
+
+	fmt.Fprintf(&buf, "tree %s\n", spec.Tree)
+
+	for _, parent := range spec.Parents {
+		if err := repo.expectType(parent, OBJ_COMMIT); err != nil {
+			return "", err
+		}
+
+		fmt.Fprintf(&buf, "parent %s\n", parent)
+	}
+
+	fmt.Fprintf(&buf, "author %s\n", spec.Author)
+	fmt.Fprintf(&buf, "committer %s\n", committer)
+	buf.WriteByte('\n')
+	buf.WriteString(message(spec.Message))
+
+	return repo.WriteObject(OBJ_COMMIT, buf.Bytes())
+}
+
+func (repo *Repo) WriteTag(spec *TagSpec) (string, error) {
+	if spec.Name == "" || strings.ContainsAny(spec.Name, "\n\x00") {
+		return "", fmt.Errorf("invalid tag name: %q", spec.Name)
+	}
+
+	if spec.Tagger == nil {
+		return "", fmt.Errorf("tagger is required")
+	}
+
+	if err := validSignature(spec.Tagger); err != nil {
+		return "", err
+	}
+
+	typ := spec.Type
+
+	if typ == 0 {
+		object, err := repo.Object(spec.Object)
+
+		if err != nil {
+			return "", err
+		}
+
+		typ = object.Type
+	} else if err := repo.expectType(spec.Object, typ); err != nil {
+		return "", err
+	}
+
+	var buf bytes.Buffer
+
+	fmt.Fprintf(&buf, "object %s\n", spec.Object)
+	fmt.Fprintf(&buf, "type %s\n", OBJ_TYPES_STR[typ])
+	fmt.Fprintf(&buf, "tag %s\n", spec.Name)
+	fmt.Fprintf(&buf, "tagger %s\n", spec.Tagger)
+	buf.WriteByte('\n')
+	buf.WriteString(message(spec.Message))
+
+	return repo.WriteObject(OBJ_TAG, buf.Bytes())
+}
+
+// String formats the signature as it appears in commit and tag headers.
+func (s *Signature) String() string {
+	_, offset := s.When.Zone()
+	sign := '+'
+
+	if offset < 0 {
+		sign = '-'
+		offset = -offset
+	}
+
+	return fmt.Sprintf("%s <%s> %d %c%02d%02d", s.Name, s.Email, s.When.Unix(), sign, offset/3600, offset%3600/60)
+}
+
+// Helpers.
+
+// Characters that end a name or an email in a header line.
+const identityDelimiters = "<>\n\x00"
+
+// validSignature rejects names and emails that would break the header line, like git's fmt_ident.
+func validSignature(s *Signature) error {
+	if strings.ContainsAny(s.Name, identityDelimiters) || strings.ContainsAny(s.Email, identityDelimiters) {
+		return fmt.Errorf("invalid identity: %q", s.Name+" <"+s.Email+">")
+	}
+
+	return nil
+}
+
+func (repo *Repo) expectType(hash string, typ uint8) error {
+	if !isHash(hash) {
+		return fmt.Errorf("invalid object hash: %q", hash)
+	}
+
+	object, err := repo.Object(hash)
+
+	if err != nil {
+		return err
+	}
+
+	if object.Type != typ {
+		return fmt.Errorf("object %s is a %s, not a %s", hash, OBJ_TYPES_STR[object.Type], OBJ_TYPES_STR[typ])
+	}
+
+	return nil
+}
+
+func validTreeEntry(entry TreeEntry) error {
+	switch entry.Mode {
+	case MODE_TREE, MODE_FILE, MODE_EXEC, MODE_SYMLINK, MODE_GITLINK:
+	default:
+		return fmt.Errorf("invalid mode %o for %s", entry.Mode, entry.Name)
+	}
+
+	if !validPathComponent(entry.Name, entry.Mode) {
+		return fmt.Errorf("invalid tree entry name: %q", entry.Name)
+	}
+
+	if !isHash(entry.Hash) {
+		return fmt.Errorf("invalid hash for %s: %q", entry.Name, entry.Hash)
+	}
+
+	return nil
+}
+
+// validPathComponent checks a tree entry name like git's verify_path: . and .. are refused, as are
+// the names NTFS or HFS+ open as .git. A symlink cannot stand for .gitmodules either.
+func validPathComponent(name string, mode uint32) bool {
+	if name == "" || name == "." || name == ".." || strings.ContainsAny(name, "/\x00") {
+		return false
+	}
+
+	if isHFSDot(name, "git") || isNTFSDotgit(name) {
+		return false
+	}
+
+	return mode != MODE_SYMLINK || !(isHFSDot(name, "gitmodules") || isNTFSDot(name, "gitmodules", "gi7eba"))
+}
+
+// isHFSDot reports whether HFS+ opens name as .<dotName>. It ignores case and some zero-width code points.
+func isHFSDot(name, dotName string) bool {
+	folded := strings.Map(func(r rune) rune {
+		switch {
+		case r >= 0x200c && r <= 0x200f, r >= 0x202a && r <= 0x202e, r >= 0x206a && r <= 0x206f, r == 0xfeff:
+			return -1
+		case r >= 'A' && r <= 'Z':
+			return r + 'a' - 'A'
+		}
+
+		return r
+	}, name)
+
+	return folded == "."+dotName
+}
+
+// isNTFSDotgit reports whether NTFS opens name as .git, like git's is_ntfs_dotgit: case is ignored
+// and so are trailing dots and spaces, a :stream suffix and the short name git~1.
+func isNTFSDotgit(name string) bool {
+	lower := asciiLower(name)
+
+	switch {
+	case strings.HasPrefix(lower, ".git"):
+		return ntfsIgnoredSuffix(lower[4:])
+	case strings.HasPrefix(lower, "git~1"):
+		return ntfsIgnoredSuffix(lower[5:])
+	}
+
+	return false
+}
+
+// isNTFSDot reports whether NTFS opens name as .<dotName>, like git's is_ntfs_dot_generic. Besides
+// .<dotName>, the 8.3 short names are the first 6 characters of dotName with ~1 to ~4, or shortPrefix
+// shortened to fit a ~<number> in 8 characters.
+func isNTFSDot(name, dotName, shortPrefix string) bool {
+	lower := asciiLower(name)
+
+	if strings.HasPrefix(lower, "."+dotName) {
+		return ntfsIgnoredSuffix(lower[len(dotName)+1:])
+	}
+
+	if len(lower) >= 8 && lower[:6] == dotName[:6] && lower[6] == '~' && lower[7] >= '1' && lower[7] <= '4' {
+		return ntfsIgnoredSuffix(lower[8:])
+	}
+
+	if len(lower) < 8 {
+		return false
+	}
+
+	sawTilde := false
+
+	for i := 0; i < 8; i++ {
+		switch c := lower[i]; {
+		case sawTilde:
+			if c < '0' || c > '9' {
+				return false
+			}
+		case c == '~':
+			if i++; i == 8 || lower[i] < '1' || lower[i] > '9' {
+				return false
+			}
+
+			sawTilde = true
+		case i >= 6 || c != shortPrefix[i]:
+			return false
+		}
+	}
+
+	return ntfsIgnoredSuffix(lower[8:])
+}
+
+// ntfsIgnoredSuffix reports whether NTFS drops rest from the end of a name: dots and spaces, up to an
+// alternate data stream or a backslash.
+func ntfsIgnoredSuffix(rest string) bool {
+	for i := 0; i < len(rest); i++ {
+		switch rest[i] {
+		case ':', '\\':
+			return true
+		case '.', ' ':
+		default:
+			return false
+		}
+	}
+
+	return true
+}
+
+// asciiLower lowercases ASCII letters only, byte offsets are kept.
+func asciiLower(s string) string {
+	b := []byte(s)
+
+	for i, c := range b {
+		if c >= 'A' && c <= 'Z' {
+			b[i] = c + 'a' - 'A'
+		}
+	}
+
+	return string(b)
+}
+
+// Git sorts tree entries as if directory names ended with a slash.
+func treeSortKey(entry TreeEntry) string {
+	return entry.Name + ternary(entry.Mode == MODE_TREE, "/", "")
+}
+
+func isHash(s string) bool {
+	if len(s) != 40 || strings.ToLower(s) != s {
+		return false
+	}
+
+	_, err := hex.DecodeString(s)
+
+	return err == nil
+}
+
+func message(msg string) string {
+	if msg != "" && !strings.HasSuffix(msg, "\n") {
+		msg += "\n"
+	}
+
+	return msg
+}
@@ -0,0 +1,150 @@
+package gits
+
+import (
+	"encoding/hex"
+	"fmt"
+	"os/exec"
+	"testing"
+)
+
+func TestWriteRejectsBrokenIdentity(t *testing.T) {
+	repo := newTestRepo(t, nil)
+
+	tree, err := repo.WriteTree(nil)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	commit, err := repo.WriteCommit(&CommitSpec{Tree: tree, Author: testSignature(), Message: "root\n"})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name string
+		who  Signature
+	}{
+		{"newline in name", Signature{Name: "t\nparent " + commit, Email: "t@t"}},
+		{"angle bracket in name", Signature{Name: "t <x@x>", Email: "t@t"}},
+		{"closing bracket in email", Signature{Name: "t", Email: "t@t> 0 +0000"}},
+		{"nul in email", Signature{Name: "t", Email: "t\x00@t"}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			who := test.who
+			who.When = testSignature().When
+
+			if _, err := repo.WriteCommit(&CommitSpec{Tree: tree, Author: &who, Message: "x\n"}); err == nil {
+				t.Error("WriteCommit accepted the author")
+			}
+
+			if _, err := repo.WriteCommit(&CommitSpec{Tree: tree, Author: testSignature(), Committer: &who, Message: "x\n"}); err == nil {
+				t.Error("WriteCommit accepted the committer")
+			}
+
+			if _, err := repo.WriteTag(&TagSpec{Object: commit, Name: "v1", Tagger: &who, Message: "x\n"}); err == nil {
+				t.Error("WriteTag accepted the tagger")
+			}
+
+			_, err := repo.CommitFiles(&CommitFilesSpec{
+				Branch:  "main",
+				Author:  &who,
+				Message: "x",
+				Ops:     []FileOp{{Action: FILE_ADD, Path: "a", Content: []byte("a\n")}},
+			})
+
+			if err == nil {
+				t.Error("CommitFiles accepted the author")
+			}
+
+			if err := repo.updateRef("refs/heads/x", "", commit, &who, "x"); err == nil {
+				t.Error("updateRef accepted the reflog identity")
+			}
+		})
+	}
+}
+
+func TestWriteTreeRejectsDotgit(t *testing.T) {
+	tests := []struct {
+		name    string
+		mode    uint32
+		refused bool
+	}{
+		{".git", MODE_TREE, true},
+		{".GIT", MODE_TREE, true},
+		{".Git", MODE_FILE, true},
+		{"git~1", MODE_TREE, true},
+		{"GIT~1", MODE_FILE, true},
+		{".git.", MODE_TREE, true},
+		{".git ", MODE_TREE, true},
+		{".git::$INDEX_ALLOCATION", MODE_TREE, true},
+		{".git\\hooks", MODE_FILE, true},
+		{".g\u200cit", MODE_TREE, true},
+		{"\ufeff.GIT", MODE_TREE, true},
+		{".gitmodules", MODE_SYMLINK, true},
+		{".GitModules", MODE_SYMLINK, true},
+		{".gitmodules .", MODE_SYMLINK, true},
+		{"gitmod~1", MODE_SYMLINK, true},
+		{"GI7EBA~1", MODE_SYMLINK, true},
+		{"gi7eb~12", MODE_SYMLINK, true},
+		{".gitmodul\u200fes", MODE_SYMLINK, true},
+		{".gitmodules", MODE_FILE, false},
+		{"gitmod~1", MODE_FILE, false},
+		{"gitmod~5", MODE_SYMLINK, false},
+		{".github", MODE_TREE, false},
+		{".gitignore", MODE_FILE, false},
+		{"a.git", MODE_TREE, false},
+		{"git~2", MODE_TREE, false},
+		{".gitx", MODE_FILE, false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			repo := newTestRepo(t, nil)
+			hash, err := repo.WriteBlob([]byte("x\n"))
+
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if test.mode == MODE_TREE {
+				if hash, err = repo.WriteTree([]TreeEntry{{Mode: MODE_FILE, Name: "x", Hash: hash}}); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			tree, err := repo.WriteTree([]TreeEntry{{Mode: test.mode, Name: test.name, Hash: hash}})
+
+			if refused := err != nil; refused != test.refused {
+				t.Fatalf("refused = %v, want %v: %v", refused, test.refused, err)
+			}
+
+			// git fsck agrees: a refused entry written by hand fails the check.
+			if test.refused {
+				raw, _ := hex.DecodeString(hash)
+
+				if tree, err = repo.WriteObject(OBJ_TREE, fmt.Appendf(nil, "%o %s\x00%s", test.mode, test.name, raw)); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			if err := repo.updateRef("refs/keep/tree", "", tree, nil, "test"); err != nil {
+				t.Fatal(err)
+			}
+
+			if _, err := exec.LookPath("git"); err != nil {
+				return
+			}
+
+			cmd := exec.Command("git", "fsck", "--strict")
+			cmd.Dir = repoPath(repo)
+
+			if out, err := cmd.CombinedOutput(); (err != nil) != test.refused {
+				t.Fatalf("git fsck: %v\n%s", err, out)
+			}
+		})
+	}
+}